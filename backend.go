@@ -0,0 +1,145 @@
+package lightauth
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"google.golang.org/grpc"
+)
+
+// ErrNotSupported is returned by backends that can't do what lightauth asks of them
+var ErrNotSupported = errors.New("Lightauth error: not supported by this backend")
+
+// LightningBackend is what lightauth needs from a Lightning node. It speaks in lnd's messages, so
+// backends for other node implementations translate to and from them.
+type LightningBackend interface {
+	GetInfo(ctx context.Context) (*lnrpc.GetInfoResponse, error)
+	AddInvoice(ctx context.Context, invoice *lnrpc.Invoice) (*lnrpc.AddInvoiceResponse, error)
+	SubscribeInvoices(ctx context.Context) (InvoiceStream, error)
+	DecodePayReq(ctx context.Context, payReq string) (*lnrpc.PayReq, error)
+	// SendPayment pays an invoice and blocks until the payment has either succeeded or failed
+	SendPayment(ctx context.Context, request *routerrpc.SendPaymentRequest) (*lnrpc.Payment, error)
+	ChannelBalance(ctx context.Context) (int64, error)
+	QueryRoutes(ctx context.Context, request *lnrpc.QueryRoutesRequest) (*lnrpc.QueryRoutesResponse, error)
+	// SignMessage signs a message with the node's key
+	SignMessage(ctx context.Context, message []byte) (string, error)
+	// VerifyMessage returns the public key that signed a message
+	VerifyMessage(ctx context.Context, message []byte, signature string) (string, error)
+}
+
+// RPCTimeout bounds lightauth's calls to the node, except payments which have their own timeout
+const RPCTimeout = 30 * time.Second
+
+// RPCContext derives the context of a call to the node from the context of the request that needs it,
+// so calls are abandoned when the request is.
+func RPCContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, RPCTimeout)
+}
+
+// PaymentLister can be implemented by a LightningBackend to list the payments of the node, including
+// those still in flight. With it, the payments sent before stopping without learning how they ended
+// are recovered.
+type PaymentLister interface {
+	ListPayments(ctx context.Context) ([]*lnrpc.Payment, error)
+}
+
+// InvoiceStream delivers the updates of the invoices of a node
+type InvoiceStream interface {
+	Recv() (*lnrpc.Invoice, error)
+}
+
+type lndBackend struct {
+	lightningClient lnrpc.LightningClient
+	routerClient    routerrpc.RouterClient
+}
+
+// NewLndBackend returns a LightningBackend that talks to lnd over a gRPC connection
+func NewLndBackend(conn *grpc.ClientConn) LightningBackend {
+	return &lndBackend{
+		lightningClient: lnrpc.NewLightningClient(conn),
+		routerClient:    routerrpc.NewRouterClient(conn),
+	}
+}
+
+func (b *lndBackend) GetInfo(ctx context.Context) (*lnrpc.GetInfoResponse, error) {
+	return b.lightningClient.GetInfo(ctx, &lnrpc.GetInfoRequest{})
+}
+
+func (b *lndBackend) AddInvoice(ctx context.Context, invoice *lnrpc.Invoice) (*lnrpc.AddInvoiceResponse, error) {
+	return b.lightningClient.AddInvoice(ctx, invoice)
+}
+
+func (b *lndBackend) SubscribeInvoices(ctx context.Context) (InvoiceStream, error) {
+	return b.lightningClient.SubscribeInvoices(ctx, &lnrpc.InvoiceSubscription{})
+}
+
+func (b *lndBackend) DecodePayReq(ctx context.Context, payReq string) (*lnrpc.PayReq, error) {
+	return b.lightningClient.DecodePayReq(ctx, &lnrpc.PayReqString{PayReq: payReq})
+}
+
+func (b *lndBackend) SendPayment(ctx context.Context, request *routerrpc.SendPaymentRequest) (*lnrpc.Payment, error) {
+	stream, err := b.routerClient.SendPaymentV2(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		payment, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+
+		if payment.Status == lnrpc.Payment_SUCCEEDED || payment.Status == lnrpc.Payment_FAILED {
+			return payment, nil
+		}
+	}
+}
+
+func (b *lndBackend) ChannelBalance(ctx context.Context) (int64, error) {
+	balance, err := b.lightningClient.ChannelBalance(ctx, &lnrpc.ChannelBalanceRequest{})
+	if err != nil {
+		return 0, err
+	}
+
+	return balance.Balance, nil
+}
+
+func (b *lndBackend) QueryRoutes(ctx context.Context, request *lnrpc.QueryRoutesRequest) (*lnrpc.QueryRoutesResponse, error) {
+	return b.lightningClient.QueryRoutes(ctx, request)
+}
+
+func (b *lndBackend) SignMessage(ctx context.Context, message []byte) (string, error) {
+	signResponse, err := b.lightningClient.SignMessage(ctx, &lnrpc.SignMessageRequest{Msg: message})
+	if err != nil {
+		return "", err
+	}
+
+	return signResponse.Signature, nil
+}
+
+func (b *lndBackend) LookupInvoice(ctx context.Context, rHash []byte) (*lnrpc.Invoice, error) {
+	return b.lightningClient.LookupInvoice(ctx, &lnrpc.PaymentHash{RHash: rHash})
+}
+
+// VerifyMessage returns the key recovered from the signature, which doesn't need to belong to a node
+// in our graph.
+func (b *lndBackend) VerifyMessage(ctx context.Context, message []byte, signature string) (string, error) {
+	verifyResponse, err := b.lightningClient.VerifyMessage(ctx, &lnrpc.VerifyMessageRequest{Msg: message, Signature: signature})
+	if err != nil {
+		return "", err
+	}
+
+	return verifyResponse.Pubkey, nil
+}
+
+func (b *lndBackend) ListPayments(ctx context.Context) ([]*lnrpc.Payment, error) {
+	response, err := b.lightningClient.ListPayments(ctx, &lnrpc.ListPaymentsRequest{IncludeIncomplete: true})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Payments, nil
+}
@@ -0,0 +1,104 @@
+package lightauth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// bREAKERTHRESHOLD consecutive failed calls to the node open the breaker, which then probes the node
+// every BreakerCooldown until it answers again.
+const (
+	bREAKERTHRESHOLD = 5
+	BreakerCooldown  = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned instead of calling the node while it is considered down
+var ErrCircuitOpen = errors.New("Lightauth error: lightning node unavailable, circuit breaker is open")
+
+// Breaker stops calling a node that keeps failing, so requests don't pile up waiting for it
+type Breaker struct {
+	mux      sync.Mutex
+	failures int
+	probe    func(ctx context.Context) error
+	onClose  func()
+}
+
+// NewBreaker returns the breaker of a node. probe tells whether the node answers again once the
+// breaker is open, onClose, which may be nil, is called when it does.
+func NewBreaker(probe func(ctx context.Context) error, onClose func()) *Breaker {
+	return &Breaker{probe: probe, onClose: onClose}
+}
+
+// Allow tells whether the node can be called
+func (b *Breaker) Allow() bool {
+	return !b.IsOpen()
+}
+
+// IsOpen tells whether the node is considered down
+func (b *Breaker) IsOpen() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	return b.failures >= bREAKERTHRESHOLD
+}
+
+// Call calls the node with f unless the breaker is open, and records the outcome. The call is bounded
+// by RPCTimeout on top of ctx, the context of the caller.
+func (b *Breaker) Call(ctx context.Context, f func(ctx context.Context) error) error {
+	if !b.Allow() {
+		return ErrCircuitOpen
+	}
+
+	rpcCtx, cancel := RPCContext(ctx)
+	defer cancel()
+
+	err := f(rpcCtx)
+	b.Record(ctx, err)
+	return err
+}
+
+// Record counts the outcome of a call made for ctx, and starts watching the node when the breaker
+// opens. Calls that failed because ctx is done, the caller having gone away or run out of time, say
+// nothing of the node and aren't counted.
+func (b *Breaker) Record(ctx context.Context, err error) {
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if err == nil {
+		wasOpen := b.failures >= bREAKERTHRESHOLD
+		b.failures = 0
+		if wasOpen && b.onClose != nil {
+			go b.onClose()
+		}
+		return
+	}
+
+	b.failures++
+	if b.failures == bREAKERTHRESHOLD {
+		ReportError(ErrCircuitOpen)
+		go b.watch()
+	}
+}
+
+// watch closes the breaker once the node is healthy again
+func (b *Breaker) watch() {
+	defer RecoverBackground("circuit breaker")
+
+	for b.IsOpen() {
+		time.Sleep(BreakerCooldown)
+
+		ctx, cancel := RPCContext(context.Background())
+		err := b.probe(ctx)
+		cancel()
+
+		if err == nil {
+			b.Record(context.Background(), nil)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// lATENCYWEIGHT is the weight of the latest observation in the moving averages of payment latencies and
+// request intervals
+const lATENCYWEIGHT = 0.2
+
+// pathLatency keeps the moving averages of how long the payments of a path take to settle and of the
+// time between its requests.
+type pathLatency struct {
+	settle      time.Duration
+	interval    time.Duration
+	lastRequest time.Time
+}
+
+var latencies = struct {
+	mux   sync.Mutex
+	paths map[string]*pathLatency
+}{paths: make(map[string]*pathLatency)}
+
+func average(previous time.Duration, observed time.Duration) time.Duration {
+	if previous == 0 {
+		return observed
+	}
+
+	return time.Duration(lATENCYWEIGHT*float64(observed) + (1-lATENCYWEIGHT)*float64(previous))
+}
+
+func (p *Path) latency() *pathLatency {
+	l, exists := latencies.paths[p.key()]
+	if !exists {
+		l = &pathLatency{}
+		latencies.paths[p.key()] = l
+	}
+
+	return l
+}
+
+// observePayment records how long a payment for the path took to settle
+func (p *Path) observePayment(d time.Duration) {
+	latencies.mux.Lock()
+	defer latencies.mux.Unlock()
+
+	l := p.latency()
+	l.settle = average(l.settle, d)
+}
+
+// observeRequest records that a request to the path is being made
+func (p *Path) observeRequest() {
+	latencies.mux.Lock()
+	defer latencies.mux.Unlock()
+
+	l := p.latency()
+	t := time.Now()
+	if !l.lastRequest.IsZero() {
+		l.interval = average(l.interval, t.Sub(l.lastRequest))
+	}
+	l.lastRequest = t
+}
+
+// prepayLead is how long before the period paid for on a time path runs out the next one is paid for.
+// With Payments.Adaptive, it is twice the time payments to the path take to settle, so requests never
+// wait for one. Otherwise the period is paid for once it has run out.
+func (p *Path) prepayLead() time.Duration {
+	if !paymentConfig.Adaptive {
+		return 0
+	}
+
+	latencies.mux.Lock()
+	defer latencies.mux.Unlock()
+
+	return 2 * p.latency().settle
+}
+
+// poolTarget is the number of paid invoices kept ready for a discrete path. With Payments.Adaptive, it
+// is the number of invoices the requests to the path use up while a payment settles, with room for the
+// requests of one more payment, up to a batch and at least Payments.PoolSize.
+func (p *Path) poolTarget() int {
+	target := paymentConfig.PoolSize
+	if !paymentConfig.Adaptive {
+		return target
+	}
+
+	latencies.mux.Lock()
+	l := *p.latency()
+	latencies.mux.Unlock()
+
+	adaptive := p.invoicesPerRequest()
+	if l.interval > 0 {
+		requests := int(l.settle/l.interval) + 1
+		adaptive = (requests + 1) * p.invoicesPerRequest()
+	}
+
+	if adaptive > p.batchSize() {
+		adaptive = p.batchSize()
+	}
+
+	if adaptive > target {
+		target = adaptive
+	}
+
+	return target
+}
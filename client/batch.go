@@ -0,0 +1,54 @@
+package client
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+// batchSize is the number of invoices the client pays for at once on a path: the MaxInvoices of the
+// route, or Payments.BatchSize when it is smaller, but never fewer than a request claims.
+func (p *Path) batchSize() int {
+	batch := p.MaxInvoices
+	if paymentConfig.BatchSize > 0 && (batch == 0 || paymentConfig.BatchSize < batch) {
+		batch = paymentConfig.BatchSize
+	}
+
+	if batch < p.invoicesPerRequest() {
+		batch = p.invoicesPerRequest()
+	}
+
+	return batch
+}
+
+// setBatchHeader asks the server for no more than Payments.BatchSize invoices at once
+func setBatchHeader(request *http.Request) {
+	if paymentConfig.BatchSize > 0 {
+		request.Header.Set(core.HeaderBatchSize, strconv.Itoa(paymentConfig.BatchSize))
+	}
+}
+
+// keepInvoices adds the invoices sent by the server to a path, up to MaxInvoices unpaid ones, which is
+// as many as the server ever issues at once.
+func (p *Path) keepInvoices(invoices map[string]*Invoice) {
+	unpaid := 0
+	for _, v := range p.invoices() {
+		if !v.isSettled() && !v.Deferred {
+			unpaid++
+		}
+	}
+
+	for _, v := range invoices {
+		if p.MaxInvoices > 0 && unpaid >= p.MaxInvoices {
+			return
+		}
+
+		if !p.addInvoice(v) {
+			continue
+		}
+
+		v.save()
+		unpaid++
+	}
+}
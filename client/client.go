@@ -0,0 +1,960 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+)
+
+var lOOPTHRESHOLD = 500
+
+// Path is a hash that stores all of the routes it is authenticating to
+type Path struct {
+	LocalExpirationTime time.Time
+	SyncExpirationTime  time.Time
+	Token               string
+	Invoices            map[string]*Invoice
+	mux                 sync.Mutex
+	Fee                 int
+	TimePeriod          core.Period
+	Mode                core.Mode
+	MaxInvoices         int
+	InvoicesPerRequest  int
+	BindRequest         bool
+	URL                 string
+	Origin              string
+	Host                string
+	Varies              []string
+	Variant             string
+	turn                chan struct{}
+	LNURL               string
+	InvoicesURL         string
+	Credit              int
+	Sunset              time.Time
+	InvoiceCutoff       time.Time
+	ID                  string
+	synced              bool
+}
+
+func (p *Path) getLocalExpirationTime() time.Time {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	return p.LocalExpirationTime
+}
+
+func (p *Path) setLocalExpirationTime(t time.Time) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	// if t != p.LocalExpirationTime {
+	p.LocalExpirationTime = t
+	return p.save()
+	// }
+
+	// return nil
+}
+
+func (p *Path) setSyncExpirationTime(t time.Time) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	// if t != p.SyncExpirationTime {
+	p.SyncExpirationTime = t
+	return p.save()
+	// }
+
+	// return nil
+}
+
+// setCredit records the credit balance the server has for us on a discrete path
+func (p *Path) setCredit(credit int) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.Credit == credit {
+		return nil
+	}
+
+	p.Credit = credit
+	return p.save()
+}
+
+// setFee records the fee the server charges us on a path
+func (p *Path) setFee(fee int) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.Fee == fee {
+		return nil
+	}
+
+	p.Fee = fee
+	return p.save()
+}
+
+// useCredit takes the cost of a request from the credit balance of a discrete path, if it covers it
+func (p *Path) useCredit() bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	cost := p.Fee * p.invoicesPerRequest()
+	if p.Mode != core.ModeDiscrete || p.BindRequest || cost == 0 || p.Credit < cost {
+		return false
+	}
+
+	p.Credit -= cost
+	return true
+}
+
+func (p *Path) setToken(token string) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.Token = token
+	return p.save()
+}
+
+// invoices returns the invoices of the path, copied so they can be gone through without its lock
+func (p *Path) invoices() []*Invoice {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	invoices := make([]*Invoice, 0, len(p.Invoices))
+	for _, i := range p.Invoices {
+		invoices = append(invoices, i)
+	}
+
+	return invoices
+}
+
+// addInvoice makes an invoice part of the path, unless the path already has it
+func (p *Path) addInvoice(i *Invoice) bool {
+	paymentHash := hex.EncodeToString(i.PaymentHash)
+
+	p.mux.Lock()
+	if _, exists := p.Invoices[paymentHash]; exists {
+		p.mux.Unlock()
+		return false
+	}
+	p.Invoices[paymentHash] = i
+	i.Path = p
+	p.mux.Unlock()
+
+	clientInvoices.Add(i.PaymentHash, i)
+	return true
+}
+
+func (p *Path) removeInvoice(i *Invoice) {
+	p.mux.Lock()
+	delete(p.Invoices, hex.EncodeToString(i.PaymentHash))
+	p.mux.Unlock()
+
+	clientInvoices.Remove(i.PaymentHash)
+}
+
+// getUnclaimedInvoices returns the paid invoices that can be claimed by the request with the given
+// fingerprint. Invoices of paths that don't bind them to requests have none.
+func (p *Path) getUnclaimedInvoices(fingerprint string) []*Invoice {
+	invoices := []*Invoice{}
+	for _, v := range p.invoices() {
+		if v.isSettled() && !v.isClaimed() && !v.Deferred && v.Fingerprint == fingerprint {
+			invoices = append(invoices, v)
+		}
+	}
+
+	return invoices
+}
+
+// discardExpiringInvoices forgets unpaid invoices that would expire before a payment could complete
+func (p *Path) discardExpiringInvoices() {
+	margin := time.Duration(paymentConfig.Timeout) * time.Second
+	for _, v := range p.invoices() {
+		if !v.isSettled() && v.expiresWithin(margin) && !v.Deferred {
+			p.removeInvoice(v)
+		}
+	}
+}
+
+func (p *Path) hasPayableInvoices(fingerprint string) bool {
+	for _, v := range p.invoices() {
+		if !v.isSettled() && !v.isExpired() && !v.Deferred && v.Fingerprint == fingerprint {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Path) save() error {
+	if p.ID == "" {
+		var err error
+		p.ID, err = clientDatabase.Create(p)
+		return err
+	}
+
+	return lightauth.Edit(clientDatabase, p, false)
+}
+
+func (p *Path) canRequest(fingerprint string) bool {
+	if p.Mode == core.ModeTime {
+		return p.getLocalExpirationTime().After(time.Now())
+	}
+
+	return len(p.getUnclaimedInvoices(fingerprint)) >= p.invoicesPerRequest()
+}
+
+func (p *Path) invoicesPerRequest() int {
+	if p.InvoicesPerRequest < 1 {
+		return 1
+	}
+
+	return p.InvoicesPerRequest
+}
+
+func (p *Path) updateBalance() error {
+	if p.Mode == core.ModeTime {
+		timePeriod := time.Millisecond
+		switch p.TimePeriod {
+		case core.PeriodMillisecond:
+			timePeriod = time.Millisecond
+		case core.PeriodSecond:
+			timePeriod = time.Second
+		case core.PeriodMinute:
+			timePeriod = time.Minute
+		default:
+			if strictMode {
+				return &lightauth.StrictError{Field: "time period", Value: string(p.TimePeriod)}
+			}
+			timePeriod = time.Millisecond
+		}
+
+		t := time.Now()
+		localExpirationTime := p.getLocalExpirationTime()
+
+		if localExpirationTime.After(t) {
+			diff := localExpirationTime.Sub(t)
+			return p.setLocalExpirationTime(t.Add(timePeriod).Add(diff))
+		}
+
+		return p.setLocalExpirationTime(t.Add(timePeriod))
+	}
+
+	return nil
+}
+
+func confirmInvoiceSettled(preImage []byte) {
+	hasher := sha256.New()
+	hasher.Write(preImage)
+	paymentHash := hex.EncodeToString(hasher.Sum(nil))
+
+	if i, invoiceExists := clientInvoices.Get(paymentHash); invoiceExists {
+		err := i.settle(preImage)
+		if err != nil {
+		}
+
+		err = i.Path.updateBalance()
+		if err != nil {
+			// TODO: Consider how to handle this scenario EXCEPTIONAL
+		}
+
+		settlements.Notify(lightauth.NewSettlementEvent(i.Info(), i.Path.key(), 0))
+	}
+}
+
+// ReadResponse will use the information from the response to synchronise info about the protocol status
+func ReadResponse(r *http.Response, u string) (*http.Response, error) {
+	if err := clientStarted(); err != nil {
+		return r, err
+	}
+
+	// TODO: Status code paymentrequired : This is where it would be that the local and sync expiration times mismatch gets caught
+	_url, err := url.Parse(u)
+	if err != nil {
+		log.Printf("Lightauth error: The URL is corrupted: %v\n", err)
+		return r, err
+	}
+
+	restoreHeaders(r)
+	params, isLightauth := core.ParseHeader(r.Header)
+	if !isLightauth {
+		return r, core.ErrNotLightauth
+	}
+
+	if err := checkResponseHeaders(r.Header); err != nil {
+		return r, err
+	}
+
+	host := ""
+	var requestHeader http.Header
+	if r.Request != nil {
+		host = r.Request.Host
+		requestHeader = r.Request.Header
+	}
+
+	store, exists := lookupPath(_url, host, requestHeader)
+	if !exists {
+		return r, errors.New("Lightauth error: attempting to read a response that is not configured")
+	}
+
+	lightStatusCode := r.StatusCode
+	if core.Result(params["result"]) == core.ResultOK {
+		// The handler's own status code doesn't concern the protocol
+		lightStatusCode = http.StatusOK
+	}
+
+	if readDeprecation(r.Header, store) {
+		if err := store.save(); err != nil {
+			log.Printf("Lightauth error: Could not save path deprecation: %v\n", err)
+		}
+	}
+
+	if token := core.ReadHeader(r.Header, core.HeaderToken); token != "" && token != store.Token {
+		// The server has rotated our token
+		err := store.setToken(token)
+		if err != nil {
+			log.Printf("Lightauth error: Could not save path token: %v\n", err)
+			return r, err
+		}
+	}
+
+	if core.ReadHeader(r.Header, core.HeaderToken) != "" {
+		// The credit header comes with the token, and only when there is credit left
+		credit, _ := strconv.Atoi(core.ReadHeader(r.Header, core.HeaderCredit))
+		if err := store.setCredit(credit); err != nil {
+			log.Printf("Lightauth error: Could not save path credit: %v\n", err)
+		}
+
+		// The fee changes when a promo code gives us a discount
+		if fee, err := strconv.Atoi(core.ReadHeader(r.Header, core.HeaderFee)); err == nil {
+			if err := store.setFee(fee); err != nil {
+				log.Printf("Lightauth error: Could not save path fee: %v\n", err)
+			}
+		}
+
+		readExpiryWarning(r.Header, store)
+	}
+
+	ctx := context.Background()
+	if r.Request != nil {
+		ctx = r.Request.Context()
+	}
+
+	invoices, err := getInvoicesFromResponse(ctx, r.Header)
+	if err != nil {
+		return r, err
+	}
+
+	store.keepInvoices(invoices)
+
+	// Deferred invoices can come with the results of a request or with its rejection
+	store.storeDeferredInvoices(ctx, r.Header)
+
+	if lightStatusCode == http.StatusOK {
+
+		if store.Mode == core.ModeTime {
+			var err error
+			syncExpirationTime, err := readExpirationTime(r.Header)
+			if err != nil {
+				log.Printf("Lightauth error: Could not read header: %v\n", err)
+				return r, err
+			}
+
+			err = store.setSyncExpirationTime(syncExpirationTime)
+			if err != nil {
+				log.Printf("Lightauth error: Could not save path time: %v\n", err)
+				return r, err
+			}
+		} else if core.ReadHeader(r.Header, core.HeaderInvoice) != "" {
+			invoiceIDs := strings.Split(core.ReadHeader(r.Header, core.HeaderInvoice), ",")
+
+			claimedInvoices := []*Invoice{}
+			for _, invoiceID := range invoiceIDs {
+				for _, v := range store.invoices() {
+					if v.PaymentRequest == invoiceID {
+						claimedInvoices = append(claimedInvoices, v)
+					}
+				}
+			}
+
+			if len(claimedInvoices) != len(invoiceIDs) {
+				// TODO: The invoice sent back by the server does not exist.
+				log.Printf("Lightauth error: Invoice declared as claimed by server does not exist: %v\n", err)
+				return r, err
+			}
+
+			if remaining, _ := strconv.Atoi(core.ReadHeader(r.Header, core.HeaderInvoiceRemaining)); remaining > 0 && len(claimedInvoices) == 1 {
+				// The server credited an overpayment, the invoice pays for more requests
+				claimedInvoices[0].give()
+				return r, nil
+			}
+
+			for _, v := range claimedInvoices {
+				err := v.claim()
+				if err != nil {
+					log.Printf("Lightauth error: Could not save invoice: %v\n", err)
+					return r, err
+				}
+				v.give()
+			}
+		}
+
+		return r, nil
+	} else if lightStatusCode == http.StatusBadRequest {
+		return r, readErrorResponse(r, "")
+	} else if lightStatusCode == http.StatusConflict {
+		return r, readErrorResponse(r, "Lightauth error: conflict")
+	} else if lightStatusCode == http.StatusInternalServerError {
+		return r, readErrorResponse(r, "Lightauth error: internal server error")
+	} else if lightStatusCode == http.StatusPaymentRequired {
+		if store.Mode == core.ModeTime {
+			// Our time ran out earlier than we thought, the next request pays for more
+			if syncExpirationTime, err := readExpirationTime(r.Header); err == nil {
+				if err := store.setSyncExpirationTime(syncExpirationTime); err != nil {
+					log.Printf("Lightauth error: Could not save path time: %v\n", err)
+				}
+			}
+		}
+
+		return r, readErrorResponse(r, "Lightauth error: payment required")
+	} else if lightStatusCode == http.StatusForbidden {
+		return r, readErrorResponse(r, "Lightauth error: forbidden")
+	} else if lightStatusCode == http.StatusTooManyRequests {
+		return r, readErrorResponse(r, "Lightauth error: too many requests")
+	}
+
+	return r, errors.New("Lightauth error: The response status code is not recognised")
+}
+
+// ResponseError is returned by ReadResponse when the server rejected a request. Its fields are filled
+// from the server's JSON error payload when there is one. The response body is left readable.
+type ResponseError struct {
+	StatusCode int                  `json:"-"`
+	Code       core.Code            `json:"code"`
+	Message    string               `json:"message"`
+	RetryAfter int                  `json:"retry_after"`
+	Invoices   []JSONInvoice        `json:"invoices"`
+	Payment    *PaymentInstructions `json:"payment"`
+}
+
+func (e *ResponseError) Error() string {
+	return e.Message
+}
+
+// readErrorResponse builds the error for a rejected response, using the body as message if the server
+// didn't send a JSON payload and there is no default one.
+func readErrorResponse(r *http.Response, message string) error {
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return errors.New("Lightauth error: could not read errored response body")
+	}
+
+	responseError := &ResponseError{StatusCode: r.StatusCode, Message: message}
+	if err := json.Unmarshal(body, responseError); err != nil && message == "" {
+		responseError.Message = string(body)
+	}
+
+	return responseError
+}
+
+func getInvoicesFromResponse(ctx context.Context, h http.Header) (map[string]*Invoice, error) {
+	invoices := make(map[string]*Invoice)
+	fee, err := strconv.Atoi(core.ReadHeader(h, core.HeaderFee))
+	if err != nil {
+		log.Printf("Lightauth error: Failed to read header: %v\n", err)
+		return invoices, err
+	}
+
+	maxInvoices, _ := strconv.Atoi(core.ReadHeader(h, core.HeaderMaxInvoices))
+	header := core.ReadHeader(h, core.HeaderInvoices)
+	if err := checkInvoicesHeader(header, maxInvoices); err != nil {
+		return invoices, err
+	}
+
+	jsonData, err := core.ReadInvoices(h)
+	if err != nil {
+		log.Printf("Lightauth error: Could not decode header data: %v\n", err)
+		return invoices, err
+	}
+
+	if maxInvoices > 0 && len(jsonData) > maxInvoices {
+		return invoices, errors.New(iNVOICESTOOLARGE)
+	}
+
+	destination := ""
+	for _, v := range jsonData {
+		payReq, err := decodePaymentRequest(ctx, v.PaymentRequest)
+		if err != nil {
+			// TODO Server is sending invalid invoice. EXCEPTIONAL
+			continue
+		}
+
+		if err := validateInvoice(payReq, v.PaymentRequest, fee); err != nil {
+			log.Printf("Lightauth error: Rejected invoice sent by the server: %v\n", err)
+			continue
+		}
+
+		if destination == "" {
+			destination = payReq.Destination
+		} else if destination != payReq.Destination {
+			return make(map[string]*Invoice), errors.New("Lightauth error: server has sent invoices for different destinations")
+		}
+
+		paymentHash := payReq.PaymentHash
+		paymentHashByte, err := hex.DecodeString(paymentHash)
+		if err != nil {
+			continue
+		}
+
+		invoices[paymentHash] = &Invoice{
+			PaymentRequest: v.PaymentRequest,
+			Fee:            fee,
+			PaymentHash:    paymentHashByte,
+			Description:    payReq.Description,
+			ExpirationTime: time.Unix(payReq.Timestamp+payReq.Expiry, 0),
+			Fingerprint:    core.ReadHeader(h, core.HeaderFingerprint),
+		}
+	}
+
+	return invoices, nil
+}
+
+// refreshInvoices asks the server for a fresh batch of invoices for a path, bound to the request with
+// the given fingerprint if it isn't empty.
+func refreshInvoices(ctx context.Context, p *Path, scheme string, fingerprint string) error {
+	request, err := http.NewRequest(http.MethodGet, scheme+"://"+p.URL, nil)
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	request.Host = p.Host
+	applyVariant(request, p.Variant)
+	request.Header.Set(core.HeaderToken, p.Token)
+	if fingerprint != "" {
+		request.Header.Set(core.HeaderFingerprint, fingerprint)
+	}
+	setBatchHeader(request)
+	setAcceptInvoicesHeader(request.Header)
+	core.AnnounceVersion(request.Header)
+
+	if signRequests {
+		if err := signRequest(request); err != nil {
+			return err
+		}
+	}
+
+	response, err := exchange(StepRefresh, request)
+	if err != nil {
+		return err
+	}
+	defer discardBody(response)
+	restoreHeaders(response)
+
+	invoices, err := getInvoicesFromResponse(ctx, response.Header)
+	if err != nil {
+		return err
+	}
+
+	p.keepInvoices(invoices)
+	return nil
+}
+
+// fetchPath makes the initial request to the route of a request the client doesn't know yet, and
+// stores what the server tells about it. The invoices sent back are bound to the request with the given
+// fingerprint if the route binds them.
+func fetchPath(request *http.Request, fingerprint string) (*Path, error) {
+	p, err := negotiatePath(request, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	storePath(p)
+	return p, nil
+}
+
+// negotiatePath makes the initial request to the route of a request and returns the path the server
+// tells about, without storing it
+func negotiatePath(request *http.Request, fingerprint string) (*Path, error) {
+	ctx := request.Context()
+	url := request.URL.Host + request.URL.Path
+	initialRequest, err := http.NewRequest(http.MethodGet, request.URL.Scheme+"://"+url, nil)
+	if err != nil {
+		return nil, err
+	}
+	initialRequest = initialRequest.WithContext(ctx)
+	initialRequest.Host = request.Host
+	// The route can depend on the query parameters and headers of the request
+	initialRequest.URL.RawQuery = request.URL.RawQuery
+	for k, v := range request.Header {
+		if !strings.HasPrefix(k, core.Header) {
+			initialRequest.Header[k] = v
+		}
+	}
+	initialRequest.Header.Set(core.HeaderFingerprint, fingerprint)
+	setBatchHeader(initialRequest)
+	setAcceptInvoicesHeader(initialRequest.Header)
+	core.AnnounceVersion(initialRequest.Header)
+
+	if signRequests {
+		if err := signRequest(initialRequest); err != nil {
+			return nil, err
+		}
+	}
+
+	response, err := exchange(StepNegotiate, initialRequest)
+	if err != nil {
+		log.Printf("Lightauth error: Couldn't make initial request to route %v\n", err)
+		return nil, err
+	}
+
+	defer discardBody(response)
+	restoreHeaders(response)
+
+	if _, isLightauth := core.ParseHeader(response.Header); !isLightauth {
+		return nil, core.ErrNotLightauth
+	}
+
+	if err := checkResponseHeaders(response.Header); err != nil {
+		return nil, err
+	}
+
+	invoices, err := getInvoicesFromResponse(ctx, response.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	fee, err := strconv.Atoi(core.ReadHeader(response.Header, core.HeaderFee))
+	if err != nil {
+		log.Printf("Lightauth error: Failed to read header: %v\n", err)
+		return nil, err
+	}
+
+	maxInvoices, err := strconv.Atoi(core.ReadHeader(response.Header, core.HeaderMaxInvoices))
+	if err != nil {
+		log.Printf("Lightauth error: Failed to read header: %v\n", err)
+		return nil, err
+	}
+
+	// Routes charging one invoice per request don't send the header
+	invoicesPerRequest, _ := strconv.Atoi(core.ReadHeader(response.Header, core.HeaderInvoicesPerRequest))
+
+	varies := []string{}
+	for _, v := range strings.Split(core.ReadHeader(response.Header, core.HeaderVaries), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			varies = append(varies, v)
+		}
+	}
+
+	p := &Path{
+		Invoices:           invoices,
+		Token:              core.ReadHeader(response.Header, core.HeaderToken),
+		Fee:                fee,
+		MaxInvoices:        maxInvoices,
+		InvoicesPerRequest: invoicesPerRequest,
+		BindRequest:        core.ReadHeader(response.Header, core.HeaderBindRequest) == "true",
+		Mode:               core.Mode(core.ReadHeader(response.Header, core.HeaderMode)),
+		URL:                url,
+		Origin:             originOf(request.URL, request.Host),
+		Host:               request.Host,
+		Varies:             varies,
+		Variant:            variantKey(varies, request.URL.Query(), request.Header),
+		LNURL:              core.ReadHeader(response.Header, core.HeaderLNURL),
+		InvoicesURL:        core.ReadHeader(response.Header, core.HeaderInvoicesURL),
+		// The server just told us what it has for the path
+		synced: true,
+	}
+	p.Credit, _ = strconv.Atoi(core.ReadHeader(response.Header, core.HeaderCredit))
+
+	for _, v := range p.Invoices {
+		v.Path = p
+		clientInvoices.Add(v.PaymentHash, v)
+		v.save()
+	}
+
+	if p.Mode == core.ModeTime {
+		// RFC3339
+		expirationTime, err := readExpirationTime(response.Header)
+		if err != nil {
+			log.Printf("Lightauth error: Failed to read header: %v\n", err)
+			return nil, err
+		}
+
+		p.SyncExpirationTime = expirationTime
+		p.LocalExpirationTime = expirationTime
+		p.TimePeriod = core.Period(core.ReadHeader(response.Header, core.HeaderTimePeriod))
+	}
+
+	readDeprecation(response.Header, p)
+	p.save()
+	return p, nil
+}
+
+// storePath makes a negotiated path known to the client
+func storePath(p *Path) {
+	clientStoreMux.Lock()
+	defer clientStoreMux.Unlock()
+
+	clientStore[p.key()] = p
+	if len(p.Varies) > 0 {
+		pathVaries[p.base()] = p.Varies
+	}
+}
+
+// ClearRequest is a function used to prepare a request to an API. The calls it makes to the node and
+// the server on the way are bound to the request's context.
+func ClearRequest(request *http.Request) (*http.Request, error) {
+	if err := clientStarted(); err != nil {
+		return request, err
+	}
+
+	ctx := request.Context()
+	checkClock()
+
+	routeStore, routeExists := lookupPath(request.URL, request.Host, request.Header)
+
+	fingerprint := ""
+	if !routeExists || routeStore.BindRequest {
+		// The route may want its invoices bound to the request
+		var err error
+		fingerprint, err = core.RequestFingerprint(request)
+		if err != nil {
+			return request, err
+		}
+	}
+
+	if !routeExists {
+		var err error
+		routeStore, err = fetchPath(request, fingerprint)
+		if err != nil {
+			return request, err
+		}
+	}
+
+	if !routeStore.isSynced() {
+		if err := syncPath(ctx, request, routeStore); err != nil {
+			log.Printf("Lightauth error: Could not check the path with the server: %v\n", err)
+		}
+	}
+
+	request.Header.Set(core.HeaderToken, routeStore.Token)
+	setBatchHeader(request)
+	setAcceptInvoicesHeader(request.Header)
+	core.AnnounceVersion(request.Header)
+	if routeStore.BindRequest {
+		request.Header.Set(core.HeaderFingerprint, fingerprint)
+	} else {
+		fingerprint = ""
+	}
+
+	if err := routeStore.payDeferredInvoices(ctx); err != nil {
+		return request, err
+	}
+
+	if signRequests {
+		if err := signRequest(request); err != nil {
+			return request, err
+		}
+	}
+
+	if routeStore.useCredit() {
+		// The server takes the request out of the credit it gave us
+		return request, nil
+	}
+
+	var flag bool
+	if routeStore.Mode == core.ModeTime {
+		flag = routeStore.SyncExpirationTime.Before(time.Now().Add(routeStore.prepayLead()))
+	} else {
+		flag = len(routeStore.getUnclaimedInvoices(fingerprint)) < routeStore.invoicesPerRequest()
+	}
+
+	if flag && Offline() {
+		// The request goes on with what was paid for before, the payment waits for the node
+		offlinePayments.queue(routeStore)
+	} else if flag {
+		routeStore.discardExpiringInvoices()
+		if !routeStore.hasPayableInvoices(fingerprint) && routeStore.LNURL == "" {
+			var err error
+			if routeStore.InvoicesURL != "" {
+				// The first page holds the next invoices to pay
+				err = fetchInvoicesPage(ctx, routeStore, 0, fingerprint)
+			} else {
+				err = refreshInvoices(ctx, routeStore, request.URL.Scheme, fingerprint)
+			}
+			if err != nil {
+				log.Printf("Lightauth error: Could not refresh invoices: %v\n", err)
+			}
+		}
+
+		if err := payBatch(ctx, routeStore, fingerprint); err != nil {
+			return request, err
+		}
+	}
+
+	if Offline() && !routeStore.canRequest(fingerprint) {
+		return request, ErrOffline
+	}
+
+	startTime := time.Now()
+	for {
+		if routeStore.canRequest(fingerprint) {
+			break
+		}
+
+		if time.Since(startTime) > time.Millisecond*time.Duration(lOOPTHRESHOLD) {
+			// return request, errors.New("Lightauth error: something went wrong (the time loop lasted longer than threshold)")
+			break
+		}
+	}
+
+	routeStore.observeRequest()
+	if routeStore.Mode == core.ModeDiscrete {
+		nonce, err := lightauth.NewNonce()
+		if err != nil {
+			return request, err
+		}
+
+		bundle := routeStore.takeBundle(fingerprint)
+		if bundle == nil {
+			return request, errors.New("Lightauth error: something went wrong")
+		}
+
+		preImages := make([]string, len(bundle))
+		for k, v := range bundle {
+			preImages[k] = hex.EncodeToString(v.PreImage)
+		}
+
+		request.Header.Set(core.HeaderPreImage, strings.Join(preImages, ","))
+		request.Header.Set(core.HeaderInvoice, paymentRequests(bundle))
+		request.Header.Set(core.HeaderNonce, nonce)
+		recordClaims(ctx, bundle)
+		// Top up the invoices ready for the next requests
+		clientPool.queue(routeStore)
+	}
+
+	return request, nil
+}
+
+// payBatch pays the invoices of a path for a batch of requests at most, the other invoices are kept
+// for later. Paths with an LNURL are paid through it when they have no invoice to pay.
+func payBatch(ctx context.Context, p *Path, fingerprint string) error {
+	madePayment := false
+	toPay := p.batchSize() - len(p.getUnclaimedInvoices(fingerprint))
+	for _, v := range p.invoices() {
+		if toPay <= 0 {
+			break
+		}
+
+		if !v.isSettled() && !v.isExpired() && !v.Deferred && v.Fingerprint == fingerprint {
+			err := payInvoice(ctx, v)
+			if errors.Is(err, lightauth.ErrInsufficientFunds) || errors.Is(err, lightauth.ErrNoRoute) {
+				return err
+			}
+			if errors.Is(err, ErrInvoiceLeased) {
+				continue
+			}
+			madePayment = true
+			toPay--
+		}
+	}
+	if !madePayment && p.LNURL != "" {
+		i, err := fetchLNURLInvoice(ctx, p)
+		if err == nil {
+			err = payInvoice(ctx, i)
+		}
+		if err != nil {
+			log.Printf("Lightauth error: Could not pay through LNURL: %v\n", err)
+		}
+	}
+
+	return nil
+}
+
+// decodePaymentRequest decodes a payment request locally, or with the node when it can't be decoded
+// locally (signet invoices for instance). Decoded requests are cached.
+func decodePaymentRequest(ctx context.Context, i string) (*lnrpc.PayReq, error) {
+	if payReq, cached := payReqCache.get(i); cached {
+		return payReq, nil
+	}
+
+	if payReq, err := core.DecodeBOLT11(i); err == nil {
+		payReqCache.add(i, payReq)
+		return payReq, nil
+	}
+
+	if clientBackend == nil {
+		return nil, errors.New("Lightauth error: payment request can't be decoded without a node")
+	}
+
+	ctx, cancel := lightauth.RPCContext(ctx)
+	defer cancel()
+
+	PayReqResponse, err := clientBackend.DecodePayReq(ctx, i)
+	if err != nil {
+		log.Printf("Lightauth error: Could not decode payment request: %v\n", err)
+		return nil, err
+	}
+
+	if PayReqResponse == nil {
+		return nil, errors.New("Lightauth error: node returned no decoded payment request")
+	}
+
+	payReqCache.add(i, PayReqResponse)
+	return PayReqResponse, nil
+}
+
+// makePayment pays an invoice through lnd's router, splitting it across several paths if needed, and
+// waits until the payment either succeeds or fails. The payment isn't bound to ctx, the context of the
+// request that needed it: once sent it can't be called back, so its outcome is waited for and recorded
+// even if the request is cancelled. ctx only gives the tags the payment is recorded under.
+func makePayment(ctx context.Context, i *Invoice, feeLimit int) error {
+	request := &routerrpc.SendPaymentRequest{
+		PaymentRequest: i.PaymentRequest,
+		FeeLimitSat:    int64(feeLimit),
+		TimeoutSeconds: int32(paymentConfig.Timeout),
+		MaxParts:       uint32(paymentConfig.MaxParts),
+	}
+
+	// lnd gives up on the payment after its timeout, we wait a bit longer to learn the outcome
+	paymentCtx, cancel := context.WithTimeout(context.Background(), time.Duration(paymentConfig.Timeout)*time.Second+lightauth.RPCTimeout)
+	defer cancel()
+
+	payment, err := clientBackend.SendPayment(paymentCtx, request)
+	clientBreaker.Record(context.Background(), err)
+	if err != nil {
+		log.Printf("Lightauth error: Failed to send a payment request: %v\n", err)
+		return err
+	}
+
+	if payment.Status == lnrpc.Payment_FAILED {
+		log.Printf("Lightauth error: Lightning payment failed: %v\n", payment.FailureReason)
+		return &lightauth.PaymentError{PaymentRequest: i.PaymentRequest, Reason: payment.FailureReason}
+	}
+
+	preImage, err := hex.DecodeString(payment.PaymentPreimage)
+	if err != nil {
+		return err
+	}
+
+	recordPayment(ctx, i, payment.ValueMsat, payment.FeeMsat)
+	confirmInvoiceSettled(preImage)
+	return nil
+}
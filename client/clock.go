@@ -0,0 +1,67 @@
+package client
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+// cLOCKJUMPTOLERANCE is how far the wall clock can drift from the monotonic clock between two requests
+// before the client takes it as a jump, like an NTP correction or a resume from suspend
+const cLOCKJUMPTOLERANCE = 2 * time.Second
+
+// The expiration times of time paths are kept on the monotonic clock while the client runs, anchored
+// at the times the server sends, so they aren't thrown off when the wall clock is set. clockAnchor is
+// the last reading of both clocks, to notice when they part.
+var clockAnchor = struct {
+	mux  sync.Mutex
+	wall time.Time
+	mono time.Time
+}{wall: time.Now().Round(0), mono: time.Now()}
+
+// checkClock resynchronizes the expiration times of the time paths when the wall clock has jumped since
+// it was last called. The monotonic clock stops while the machine sleeps, so after a jump the times are
+// read on the wall clock again, until the server anchors them anew.
+func checkClock() {
+	now := time.Now()
+
+	clockAnchor.mux.Lock()
+	drift := now.Round(0).Sub(clockAnchor.wall) - now.Sub(clockAnchor.mono)
+	clockAnchor.wall, clockAnchor.mono = now.Round(0), now
+	clockAnchor.mux.Unlock()
+
+	if drift < cLOCKJUMPTOLERANCE && drift > -cLOCKJUMPTOLERANCE {
+		return
+	}
+
+	for _, p := range knownPaths() {
+		if p.Mode == core.ModeTime {
+			p.dropMonotonic()
+		}
+	}
+}
+
+// dropMonotonic makes the expiration times of the path read on the wall clock
+func (p *Path) dropMonotonic() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.LocalExpirationTime = p.LocalExpirationTime.Round(0)
+	p.SyncExpirationTime = p.SyncExpirationTime.Round(0)
+}
+
+// readExpirationTime reads the expiration time of a time path sent by the server. It is anchored on the
+// monotonic clock with the seconds left in Light-Auth-Expires-In when the server sends them, as the
+// wall clocks of the server and the client can disagree.
+func readExpirationTime(h http.Header) (time.Time, error) {
+	// Larger values would overflow a time.Duration
+	if expiresIn, err := strconv.ParseInt(core.ReadHeader(h, core.HeaderExpiresIn), 10, 64); err == nil && expiresIn >= 0 && expiresIn <= math.MaxInt64/int64(time.Second) {
+		return time.Now().Add(time.Duration(expiresIn) * time.Second), nil
+	}
+
+	return time.Parse("2006-01-02T15:04:05Z07:00", core.ReadHeader(h, core.HeaderExpirationTime))
+}
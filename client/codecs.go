@@ -0,0 +1,15 @@
+package client
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+// setAcceptInvoicesHeader tells the server the encodings of Payments.InvoiceEncodings
+func setAcceptInvoicesHeader(h http.Header) {
+	if len(paymentConfig.InvoiceEncodings) > 0 {
+		h.Set(core.HeaderAcceptInvoices, strings.Join(paymentConfig.InvoiceEncodings, ", "))
+	}
+}
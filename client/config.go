@@ -0,0 +1,100 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+)
+
+var (
+	routeModes      = map[core.Mode]bool{core.ModeTime: true, core.ModeDiscrete: true}
+	routePeriods    = map[core.Period]bool{core.PeriodMillisecond: true, core.PeriodSecond: true, core.PeriodMinute: true}
+	failureClasses  = map[string]bool{"no_route": true, "insufficient_balance": true, "timeout": true, "incorrect_details": true, "error": true}
+	fallbackActions = map[string]bool{fALLBACKFAIL: true, fALLBACKRETRY: true, fALLBACKRAISEFEE: true}
+)
+
+// ValidateConfig reads lightauth.toml and reports all the problems of the client's configuration at
+// once, so they can be caught before starting it.
+func ValidateConfig() error {
+	var conf clientConfig
+	if err := lightauth.DecodeConfig(&conf); err != nil {
+		return err
+	}
+
+	problems := conf.Validate()
+	problems = append(problems, conf.validatePayments()...)
+	if conf.Client != nil {
+		problems = append(problems, validateNode("Client", *conf.Client)...)
+	}
+	if conf.ServerAddr != "" || conf.LNDConnect != "" || conf.NWC != "" || conf.LNDHub != "" {
+		problems = append(problems, validateNode("", conf.Node(nil))...)
+	}
+
+	return lightauth.NewConfigError(problems)
+}
+
+// validateRole validates the node of the client, which is the Client section when there is one
+func (conf clientConfig) validateRole() []string {
+	if conf.Client == nil {
+		return validateNode("", conf.Node(nil))
+	}
+
+	return validateNode("Client", *conf.Client)
+}
+
+// validateNode validates the node of the client, which unlike the server's can be a wallet
+func validateNode(section string, node lightauth.NodeConfig) []string {
+	prefix := ""
+	if section != "" {
+		prefix = section + "."
+	}
+
+	if node.NWC != "" {
+		if _, err := parseNWC(node.NWC); err != nil {
+			return []string{fmt.Sprintf("%vNWC: %v", prefix, err)}
+		}
+
+		return nil
+	}
+
+	if node.LNDHub != "" {
+		if _, err := parseLNDHub(node.LNDHub); err != nil {
+			return []string{fmt.Sprintf("%vLNDHub: %v", prefix, err)}
+		}
+
+		return nil
+	}
+
+	return lightauth.ValidateNode(section, node)
+}
+
+func (conf clientConfig) validatePayments() []string {
+	var problems []string
+	p := conf.Payments
+	if p.FeeLimit < 0 || p.Timeout < 0 || p.MaxParts < 0 || (p.MaxRetries != nil && *p.MaxRetries < 0) || p.MaxDeferred < 0 {
+		problems = append(problems, "Payments: FeeLimit, Timeout, MaxParts, MaxRetries and MaxDeferred can't be negative")
+	}
+
+	if p.MaxAttempts < 0 || p.PoolSize < 0 || p.PoolWorkers < 0 || p.BatchSize < 0 {
+		problems = append(problems, "Payments: MaxAttempts, PoolSize, PoolWorkers and BatchSize can't be negative")
+	}
+
+	for _, name := range p.InvoiceEncodings {
+		if _, known := core.LookupInvoiceCodec(name); !known {
+			problems = append(problems, fmt.Sprintf("Payments.InvoiceEncodings: unknown encoding %q", name))
+		}
+	}
+
+	for class, action := range p.Fallbacks {
+		if !failureClasses[class] {
+			problems = append(problems, fmt.Sprintf("Payments.Fallbacks: unknown failure %q", class))
+		}
+
+		if !fallbackActions[action] {
+			problems = append(problems, fmt.Sprintf("Payments.Fallbacks.%v: %q must be fail, retry or raise_fee", class, action))
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// dECODECACHESIZE is the number of decoded payment requests kept in memory
+const dECODECACHESIZE = 4096
+
+// decodeCache keeps the payment requests decoded by the node, as the same invoices are sent by the
+// server in every response until they are paid. Entries are dropped once their invoice expires.
+type decodeCache struct {
+	mux     sync.Mutex
+	entries map[string]*lnrpc.PayReq
+}
+
+var payReqCache = &decodeCache{entries: make(map[string]*lnrpc.PayReq)}
+
+func payReqExpired(payReq *lnrpc.PayReq, now time.Time) bool {
+	return time.Unix(payReq.Timestamp+payReq.Expiry, 0).Before(now)
+}
+
+func (d *decodeCache) get(paymentRequest string) (*lnrpc.PayReq, bool) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	payReq, exists := d.entries[paymentRequest]
+	return payReq, exists
+}
+
+func (d *decodeCache) add(paymentRequest string, payReq *lnrpc.PayReq) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if len(d.entries) >= dECODECACHESIZE {
+		now := time.Now()
+		for k, v := range d.entries {
+			if payReqExpired(v, now) {
+				delete(d.entries, k)
+			}
+		}
+	}
+
+	if len(d.entries) >= dECODECACHESIZE {
+		// Every entry is still valid, make room by dropping any of them
+		for k := range d.entries {
+			delete(d.entries, k)
+			break
+		}
+	}
+
+	d.entries[paymentRequest] = payReq
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DeprecationEvent tells the application that a path it pays for is deprecated by its server. The path
+// is paid for until InvoiceCutoff and served until Sunset.
+type DeprecationEvent struct {
+	Path          string    `json:"path"`
+	InvoiceCutoff time.Time `json:"invoice_cutoff"`
+	Sunset        time.Time `json:"sunset"`
+}
+
+// dEPRECATIONSBUFFER is the number of deprecations kept for the application before new ones are dropped
+const dEPRECATIONSBUFFER = 64
+
+var deprecations = make(chan DeprecationEvent, dEPRECATIONSBUFFER)
+
+// Deprecations returns the channel where the client reports the paths their server has deprecated,
+// when it learns about it or the dates change. Events are dropped when nobody reads them and the
+// channel is full.
+func Deprecations() <-chan DeprecationEvent {
+	return deprecations
+}
+
+// readDeprecation keeps the deprecation dates the server sends for a path, telling the application and
+// returning true when they change, for the path to be saved
+func readDeprecation(h http.Header, p *Path) bool {
+	sunset, err := http.ParseTime(h.Get("Sunset"))
+	if err != nil {
+		return false
+	}
+
+	cutoff := sunset
+	if deprecation := strings.TrimPrefix(h.Get("Deprecation"), "@"); deprecation != "" {
+		if seconds, err := strconv.ParseInt(deprecation, 10, 64); err == nil {
+			cutoff = time.Unix(seconds, 0)
+		}
+	}
+
+	p.mux.Lock()
+	if p.Sunset.Equal(sunset) && p.InvoiceCutoff.Equal(cutoff) {
+		p.mux.Unlock()
+		return false
+	}
+	p.Sunset, p.InvoiceCutoff = sunset, cutoff
+	p.mux.Unlock()
+
+	select {
+	case deprecations <- DeprecationEvent{Path: p.key(), InvoiceCutoff: cutoff, Sunset: sunset}:
+	default:
+	}
+
+	return true
+}
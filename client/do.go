@@ -0,0 +1,107 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+// retryableCodes are the codes of the 400 responses a request can be paid for again and retried after
+var retryableCodes = map[core.Code]bool{
+	core.CodeInvoiceClaimed: true,
+	core.CodeMissingInvoice: true,
+	core.CodeUnknownInvoice: true,
+}
+
+// Do sends a request to a paid API and returns its response, going through the whole protocol on the
+// way: the request is prepared with ClearRequest, sent with the configured HTTP client and its response
+// read with ReadResponse. When the server asks for a payment (402), for a moment to see one (409), for
+// another invoice or to slow down (429), the request is paid for again and retried, up to
+// Payments.MaxAttempts times and for as long as its context allows. The response of the last attempt
+// is returned along with its error.
+func Do(request *http.Request) (*http.Response, error) {
+	if err := clientStarted(); err != nil {
+		return nil, err
+	}
+
+	if request.Body != nil && request.Body != http.NoBody && request.GetBody == nil {
+		// Each attempt sends the body again
+		body, err := ioutil.ReadAll(request.Body)
+		request.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		request.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	ctx := request.Context()
+	var response *http.Response
+	var err error
+	for attempt := 1; ; attempt++ {
+		response, err = doOnce(request)
+		wait, retry := retryAfter(err)
+		if !retry || attempt >= paymentConfig.MaxAttempts {
+			return response, err
+		}
+		discardBody(response)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// doOnce makes one attempt at a request, on a copy of it so that the next attempt starts afresh
+func doOnce(request *http.Request) (*http.Response, error) {
+	attempt := request.Clone(request.Context())
+	if request.GetBody != nil {
+		body, err := request.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		attempt.Body = body
+	}
+
+	attempt, err := ClearRequest(attempt)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := httpClient.Do(attempt)
+	if err != nil {
+		return nil, err
+	}
+
+	return ReadResponse(response, attempt.URL.String())
+}
+
+// retryAfter tells whether a request rejected with err can be paid for and sent again, and how long to
+// wait before doing so.
+func retryAfter(err error) (time.Duration, bool) {
+	var responseError *ResponseError
+	if !errors.As(err, &responseError) {
+		return 0, false
+	}
+
+	switch responseError.StatusCode {
+	case http.StatusPaymentRequired:
+		return 0, true
+	case http.StatusConflict, http.StatusTooManyRequests:
+		return time.Duration(responseError.RetryAfter) * time.Second, true
+	case http.StatusBadRequest:
+		return 0, retryableCodes[responseError.Code]
+	}
+
+	return 0, false
+}
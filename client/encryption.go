@@ -0,0 +1,93 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/faurehu/lightauth"
+)
+
+// sealingProvider seals the sensitive fields of the records on their way to the DataProvider and opens
+// them on their way back. The provider gets copies of the records, whose references to other records
+// (Invoice.Path) point to the records in memory and must be stored by ID.
+type sealingProvider struct {
+	*lightauth.SealingStore
+	db DataProvider
+}
+
+// seal returns a copy of the record with its sensitive fields sealed
+func seal(s *lightauth.Sealer, r lightauth.Record) (lightauth.Record, error) {
+	var err error
+	switch v := lightauth.CopyRecord(r).(type) {
+	case *Invoice:
+		v.PreImage, err = s.SealPreImage(v.PreImage)
+		return v, err
+	case *Path:
+		v.Token, err = s.SealToken(v.Token)
+		return v, err
+	default:
+		return r, nil
+	}
+}
+
+func (p *sealingProvider) GetClientData() (map[string]*Path, error) {
+	paths, err := p.db.GetClientData()
+	if err != nil {
+		return paths, err
+	}
+
+	for _, path := range paths {
+		if path.Token, err = p.OpenToken(path.Token); err != nil {
+			return paths, err
+		}
+
+		for _, i := range path.Invoices {
+			if i.PreImage, err = p.OpenPreImage(i.PreImage); err != nil {
+				return paths, err
+			}
+		}
+	}
+
+	return paths, nil
+}
+
+// The optional interfaces of the provider are forwarded, doing what the client does without them when
+// the provider doesn't implement them.
+
+func (p *sealingProvider) CompareAndEdit(r lightauth.Record, version int64) (bool, error) {
+	sealed, err := p.Seal(r)
+	if err != nil {
+		return false, err
+	}
+
+	if cas, ok := p.db.(CompareAndEditor); ok {
+		return cas.CompareAndEdit(sealed, version)
+	}
+
+	p.db.Edit(sealed)
+	return true, nil
+}
+
+func (p *sealingProvider) GetInvoice(id string) (*Invoice, error) {
+	cas, ok := p.db.(CompareAndEditor)
+	if !ok {
+		return nil, errors.New("Lightauth error: the store can't read invoices back")
+	}
+
+	i, err := cas.GetInvoice(id)
+	if err != nil || i == nil {
+		return i, err
+	}
+
+	i.PreImage, err = p.OpenPreImage(i.PreImage)
+	return i, err
+}
+
+// sealRecords wraps the DataProvider when encryption at rest is enabled
+func sealRecords(db DataProvider, keyFile string) (DataProvider, error) {
+	s, err := lightauth.NewSealingStore(db, keyFile, seal)
+	if err != nil || s == nil {
+		return db, err
+	}
+
+	return &sealingProvider{SealingStore: s, db: db}, nil
+}
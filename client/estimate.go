@@ -0,0 +1,43 @@
+package client
+
+import (
+	"net/http"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+// EstimateCost returns what a request would cost in satoshis and the mode of its route, without paying
+// for anything: the fee of the invoices it claims in discrete mode, or the fee of one period in time
+// mode, plus what is still owed for the results of past requests. The route is asked for its prices
+// first if the client doesn't know it yet.
+func EstimateCost(request *http.Request) (int64, core.Mode, error) {
+	if err := clientStarted(); err != nil {
+		return 0, "", err
+	}
+
+	p, routeExists := lookupPath(request.URL, request.Host, request.Header)
+	if !routeExists {
+		fingerprint, err := core.RequestFingerprint(request)
+		if err != nil {
+			return 0, "", err
+		}
+
+		p, err = fetchPath(request, fingerprint)
+		if err != nil {
+			return 0, "", err
+		}
+	}
+
+	sats := int64(p.Fee)
+	if p.Mode == core.ModeDiscrete {
+		sats *= int64(p.invoicesPerRequest())
+	}
+
+	for _, v := range p.invoices() {
+		if v.Deferred && !v.isSettled() && !v.isExpired() {
+			sats += int64(v.Fee)
+		}
+	}
+
+	return sats, p.Mode, nil
+}
@@ -0,0 +1,11 @@
+package client
+
+import "github.com/faurehu/lightauth"
+
+var settlements = lightauth.NewSettlementFeed()
+
+// Settlements returns the channel where the client reports the invoices it has paid. Settlements are
+// dropped when nobody reads them and the channel is full.
+func Settlements() <-chan lightauth.SettlementEvent {
+	return settlements
+}
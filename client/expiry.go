@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+)
+
+// Warnings sent in Light-Auth-Expiry-Warning. Soft means the client has little left, hard that it has
+// nothing left.
+const (
+	eXPIRYSOFT = core.WarningSoft
+	eXPIRYHARD = core.WarningHard
+)
+
+// topUps holds the paths being topped up after a warning, so each is topped up once at a time
+var topUps = struct {
+	mux   sync.Mutex
+	paths map[*Path]bool
+}{paths: make(map[*Path]bool)}
+
+// readExpiryWarning tops up a path in the background when the server warns that what was paid for it
+// is running out. Like the pool, which tops up discrete paths, it only pays ahead when
+// Payments.PoolSize or Payments.Adaptive is set.
+func readExpiryWarning(h http.Header, p *Path) {
+	if core.ReadHeader(h, core.HeaderExpiryWarning) == "" || clientPool == nil || p.BindRequest || Offline() {
+		return
+	}
+
+	if p.Mode == core.ModeDiscrete {
+		clientPool.queue(p)
+		return
+	}
+
+	topUps.mux.Lock()
+	defer topUps.mux.Unlock()
+
+	if topUps.paths[p] {
+		return
+	}
+	topUps.paths[p] = true
+
+	go func() {
+		defer lightauth.RecoverBackground("top-up")
+		defer func() {
+			topUps.mux.Lock()
+			delete(topUps.paths, p)
+			topUps.mux.Unlock()
+		}()
+
+		if err := topUp(context.Background(), p); err != nil {
+			lightauth.ReportError(err)
+		}
+	}()
+}
+
+// topUp pays for the next requests to a path outside of a request to it, asking the server for
+// invoices first if there are none to pay
+func topUp(ctx context.Context, p *Path) error {
+	p.discardExpiringInvoices()
+	if !p.hasPayableInvoices("") && p.LNURL == "" {
+		if err := refreshPath(ctx, p); err != nil {
+			return err
+		}
+	}
+
+	return payBatch(ctx, p, "")
+}
@@ -0,0 +1,7 @@
+package client
+
+// StartPool starts the pools with the given size, as Payments.PoolSize would at setup
+func StartPool(size int) {
+	paymentConfig.PoolSize = size
+	startPool()
+}
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"net/textproto"
+	"testing"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+func FuzzGetInvoicesFromResponse(f *testing.F) {
+	f.Add(`[{"payment_request":"lnsb1n1qqqq","expiration_time":"2030-01-01T00:00:00Z"}]`)
+	f.Add(`[null,{},{"payment_request":""}]`)
+	f.Add(`lnbc1`)
+	f.Fuzz(func(t *testing.T, header string) {
+		h := http.Header{}
+		h.Set(core.HeaderFee, "1")
+		h.Set(core.HeaderInvoices, header)
+
+		getInvoicesFromResponse(context.Background(), h)
+	})
+}
+
+func FuzzResponseHeaders(f *testing.F) {
+	f.Add([]byte("Light-Auth: version=1, result=ok\r\nLight-Auth-Mode: time\r\nLight-Auth-Expires-In: 60"))
+	f.Add([]byte("Light-Auth: version=1\r\nLight-Auth-Expiration-Time: 2030-01-01T00:00:00Z"))
+	f.Add([]byte("Light-Auth: ,=,\r\nLight-Auth-Expires-In: 99999999999999999999"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		mimeHeader, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(append(data, '\r', '\n', '\r', '\n')))).ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		h := http.Header(mimeHeader)
+
+		core.ParseHeader(h)
+		readExpirationTime(h)
+
+		strict := strictMode
+		defer func() { strictMode = strict }()
+		strictMode = true
+		checkResponseHeaders(h)
+	})
+}
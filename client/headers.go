@@ -0,0 +1,25 @@
+package client
+
+import (
+	"errors"
+	"strings"
+)
+
+// mAXINVOICESHEADERBYTES caps the size of the invoice lists a client accepts from a server
+const mAXINVOICESHEADERBYTES = 64 * 1024
+
+const iNVOICESTOOLARGE = "Lightauth error: the server sent too many invoices"
+
+// checkInvoicesHeader rejects the invoice lists of a server that are too large to be honest, before
+// they are decoded. maxInvoices is the number of invoices the route announced, or 0 if unknown.
+func checkInvoicesHeader(header string, maxInvoices int) error {
+	if len(header) > mAXINVOICESHEADERBYTES {
+		return errors.New(iNVOICESTOOLARGE)
+	}
+
+	if maxInvoices > 0 && strings.Count(header, "payment_request") > maxInvoices {
+		return errors.New(iNVOICESTOOLARGE)
+	}
+
+	return nil
+}
@@ -0,0 +1,9 @@
+package client
+
+import "github.com/faurehu/lightauth"
+
+// Health reports whether the client can pay for requests: its node is reachable and synced and the
+// store is reachable.
+func Health() lightauth.Health {
+	return lightauth.CheckHealth(clientBackend, clientDatabase)
+}
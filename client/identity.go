@@ -0,0 +1,37 @@
+package client
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+)
+
+// signRequest signs the request with the client's node key
+func signRequest(request *http.Request) error {
+	timestamp := time.Now().Unix()
+	nonce, err := lightauth.NewNonce()
+	if err != nil {
+		return err
+	}
+
+	message := core.IdentityMessage(request.Method, request.URL.Host+request.URL.Path, timestamp, nonce)
+
+	ctx, cancel := lightauth.RPCContext(request.Context())
+	defer cancel()
+
+	signature, err := clientBackend.SignMessage(ctx, []byte(message))
+	if err != nil {
+		log.Printf("Lightauth error: Could not sign request: %v\n", err)
+		return err
+	}
+
+	request.Header.Set(core.HeaderIdentitySignature, signature)
+	request.Header.Set(core.HeaderIdentityTimestamp, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(core.HeaderIdentityNonce, nonce)
+
+	return nil
+}
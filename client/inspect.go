@@ -0,0 +1,42 @@
+package client
+
+import (
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"github.com/faurehu/lightauth"
+)
+
+// Info returns a copy of the state of the invoice
+func (i *Invoice) Info() lightauth.InvoiceInfo {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	return lightauth.InvoiceInfo{
+		PaymentRequest: i.PaymentRequest,
+		PaymentHash:    hex.EncodeToString(i.PaymentHash),
+		Fee:            i.Fee,
+		Settled:        i.Settled,
+		Claimed:        i.Claimed,
+		Expired:        time.Now().After(i.ExpirationTime),
+		Deferred:       i.Deferred,
+		ExpirationTime: i.ExpirationTime,
+	}
+}
+
+// ListInvoices returns the invoices of a path of the client that match the filter, sorted by
+// expiration time
+func (p *Path) ListInvoices(filter lightauth.InvoiceFilter) []lightauth.InvoiceInfo {
+	return lightauth.ListInvoices(p.invoices(), filter)
+}
+
+// Paths returns the paths the client knows, sorted by origin and path
+func Paths() []*Path {
+	paths := knownPaths()
+	sort.Slice(paths, func(a, b int) bool {
+		return paths[a].key() < paths[b].key()
+	})
+
+	return paths
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+// PaymentInstructions is the payment object of the JSON body of rejected requests
+type PaymentInstructions = core.PaymentInstructions
+
+// restoreHeaders puts back the Light-Auth headers of a rejected response from the payment object of its
+// body, when an intermediary between the client and the server dropped them. Headers that made it
+// through are left as they are, and so is the body, which can still be read.
+func restoreHeaders(r *http.Response) {
+	if r.StatusCode < http.StatusBadRequest || r.Body == nil {
+		return
+	}
+
+	if _, isLightauth := core.ParseHeader(r.Header); isLightauth {
+		return
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	response := core.ErrorResponse{}
+	if err := json.Unmarshal(body, &response); err != nil || response.Payment == nil {
+		return
+	}
+
+	p := response.Payment
+	headers := map[string]string{
+		core.Header:               "version=" + core.ProtocolVersion + ", result=" + string(core.ResultError),
+		core.HeaderToken:          p.Token,
+		core.HeaderName:           p.Name,
+		core.HeaderMode:           string(p.Mode),
+		core.HeaderFee:            strconv.Itoa(p.Fee),
+		core.HeaderMaxInvoices:    strconv.Itoa(p.MaxInvoices),
+		core.HeaderTimePeriod:     string(p.Period),
+		core.HeaderExpirationTime: p.ExpirationTime,
+		core.HeaderLNURL:          p.LNURL,
+		core.HeaderFingerprint:    p.Fingerprint,
+		core.HeaderVaries:         p.Varies,
+		core.HeaderInvoicesURL:    p.InvoicesURL,
+	}
+
+	if p.InvoicesTotal > 0 {
+		headers[core.HeaderInvoicesTotal] = strconv.Itoa(p.InvoicesTotal)
+	}
+
+	if p.InvoicesPerRequest > 1 {
+		headers[core.HeaderInvoicesPerRequest] = strconv.Itoa(p.InvoicesPerRequest)
+	}
+
+	if p.BindRequest {
+		headers[core.HeaderBindRequest] = "true"
+	}
+
+	if invoices, err := json.Marshal(response.Invoices); err == nil && len(response.Invoices) > 0 {
+		headers[core.HeaderInvoices] = string(invoices)
+	}
+
+	if deferred, err := json.Marshal(response.DeferredInvoices); err == nil && len(response.DeferredInvoices) > 0 {
+		headers[core.HeaderDeferredInvoices] = string(deferred)
+	}
+
+	if headers[core.HeaderInvoices] != "" && core.ReadHeader(r.Header, core.HeaderInvoices) == "" {
+		// The invoices of the body are always in JSON
+		r.Header.Del(core.HeaderInvoicesEncoding)
+	}
+
+	for k, v := range headers {
+		if v != "" && core.ReadHeader(r.Header, k) == "" {
+			r.Header.Set(k, v)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// PaymentLister can be implemented by a LightningBackend to list the payments of the node, including
+// those still in flight. With it, the client recovers the payments it sent before stopping without
+// learning how they ended.
+type PaymentLister = lightauth.PaymentLister
+
+// setIntent records that the invoice is about to be paid, before the payment is sent, so a payment the
+// client doesn't see the end of can be looked up on the next start.
+func (i *Invoice) setIntent() error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	i.PaymentIntent = time.Now()
+	return i.persist(true)
+}
+
+// clearIntent forgets the intent of an invoice whose payment is known to have failed
+func (i *Invoice) clearIntent() error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	if i.PaymentIntent.IsZero() {
+		return nil
+	}
+
+	i.PaymentIntent = time.Time{}
+	return i.persist(true)
+}
+
+// endIntent forgets the intent of an invoice when the error paying it tells the payment failed. Other
+// errors leave the outcome unknown, so the intent is kept.
+func endIntent(i *Invoice, err error) error {
+	if _, failed := err.(*lightauth.PaymentError); failed {
+		if err := i.clearIntent(); err != nil {
+			lightauth.ReportError(err)
+		}
+	}
+
+	return err
+}
+
+// pendingIntents returns the invoices that were being paid when the client last stopped
+func pendingIntents() []*Invoice {
+	invoices := []*Invoice{}
+	for _, p := range knownPaths() {
+		for _, i := range p.invoices() {
+			if !i.PaymentIntent.IsZero() && !i.isSettled() {
+				invoices = append(invoices, i)
+			}
+		}
+	}
+
+	return invoices
+}
+
+// reconcileIntents settles the invoices the node paid while the client wasn't watching, and forgets the
+// intents of those it didn't pay. Intents of payments still in flight are kept for the next start.
+func reconcileIntents(ctx context.Context) {
+	intents := pendingIntents()
+	if len(intents) == 0 {
+		return
+	}
+
+	lister, ok := clientBackend.(PaymentLister)
+	if !ok {
+		log.Printf("Lightauth error: %d payments may have been sent without being recorded, the node can't list its payments\n", len(intents))
+		return
+	}
+
+	ctx, cancel := lightauth.RPCContext(ctx)
+	defer cancel()
+
+	payments, err := lister.ListPayments(ctx)
+	if err != nil {
+		lightauth.ReportError(err)
+		return
+	}
+
+	byHash := make(map[string]*lnrpc.Payment)
+	for _, payment := range payments {
+		byHash[payment.PaymentHash] = payment
+	}
+
+	for _, i := range intents {
+		payment, sent := byHash[hex.EncodeToString(i.PaymentHash)]
+		switch {
+		case sent && payment.Status == lnrpc.Payment_SUCCEEDED:
+			preImage, err := hex.DecodeString(payment.PaymentPreimage)
+			if err != nil {
+				lightauth.ReportError(err)
+				continue
+			}
+
+			confirmInvoiceSettled(preImage)
+		case sent && payment.Status == lnrpc.Payment_IN_FLIGHT:
+			continue
+		default:
+			if err := i.clearIntent(); err != nil {
+				lightauth.ReportError(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+// The steps of the client an ExchangeInterceptor runs around
+const (
+	StepNegotiate    = "negotiate"     // The first request to a path, to learn its route
+	StepRefresh      = "refresh"       // Asking the server for more invoices
+	StepSync         = "sync"          // Checking the path with the server
+	StepInvoicesPage = "invoices_page" // Fetching a page of invoices from the InvoicesURL of the route
+	StepLNURL        = "lnurl"         // Asking the LNURL of the route for an invoice
+)
+
+// Exchange sends a request to a server and returns its response
+type Exchange func(request *http.Request) (*http.Response, error)
+
+// ExchangeInterceptor runs around each request the client sends to a server on its own while
+// negotiating a path, step being what the request is for. It may change the request before passing it
+// to next, look at or replace the response, or refuse the exchange by returning an error without
+// calling next.
+type ExchangeInterceptor func(step string, request *http.Request, next Exchange) (*http.Response, error)
+
+// Payment is an invoice the client is about to pay. Amount is in satoshis.
+type Payment struct {
+	URL            string
+	PaymentRequest string
+	Description    string
+	Amount         int64
+}
+
+// PaymentInterceptor runs around each payment of the client, before the consent hook. It may pass a
+// different context to next, or refuse the payment by returning an error without calling next.
+type PaymentInterceptor func(ctx context.Context, payment Payment, next func(ctx context.Context) error) error
+
+var (
+	exchangeInterceptors []ExchangeInterceptor
+	paymentInterceptors  []PaymentInterceptor
+)
+
+// SetExchangeInterceptors registers the interceptors run around the requests of the client to servers,
+// replacing those registered before. The first one is the outermost.
+func SetExchangeInterceptors(interceptors ...ExchangeInterceptor) {
+	exchangeInterceptors = interceptors
+}
+
+// SetPaymentInterceptors registers the interceptors run around the payments of the client, replacing
+// those registered before. The first one is the outermost.
+func SetPaymentInterceptors(interceptors ...PaymentInterceptor) {
+	paymentInterceptors = interceptors
+}
+
+// exchange sends a request of the client to a server through the exchange interceptors
+func exchange(step string, request *http.Request) (*http.Response, error) {
+	next := Exchange(httpClient.Do)
+	for k := len(exchangeInterceptors) - 1; k >= 0; k-- {
+		interceptor, inner := exchangeInterceptors[k], next
+		next = func(request *http.Request) (*http.Response, error) {
+			return interceptor(step, request, inner)
+		}
+	}
+
+	return next(request)
+}
+
+// interceptPayment pays an invoice with pay through the payment interceptors
+func interceptPayment(ctx context.Context, i *Invoice, pay func(ctx context.Context) error) error {
+	if len(paymentInterceptors) == 0 {
+		return pay(ctx)
+	}
+
+	payment := Payment{PaymentRequest: i.PaymentRequest, Description: i.Description, Amount: int64(i.Fee)}
+	if i.Path != nil {
+		payment.URL = i.Path.URL
+	}
+
+	next := pay
+	for k := len(paymentInterceptors) - 1; k >= 0; k-- {
+		interceptor, inner := paymentInterceptors[k], next
+		next = func(ctx context.Context) error {
+			return interceptor(ctx, payment, inner)
+		}
+	}
+
+	return next(ctx)
+}
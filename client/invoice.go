@@ -0,0 +1,108 @@
+package client
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+)
+
+// Invoice is a hash that stores all the information of an invoice a server issued to the client
+type Invoice struct {
+	PaymentRequest  string
+	PaymentHash     []byte
+	Fee             int
+	Settled         bool
+	PreImage        []byte
+	Claimed         bool
+	Version         int64
+	LeaseOwner      string
+	LeaseExpiration time.Time
+	Path            *Path
+	mux             sync.Mutex
+	ID              string
+	ExpirationTime  time.Time
+	Description     string
+	Deferred        bool
+	Fingerprint     string
+	PaymentIntent   time.Time
+	reservedUntil   time.Time
+	lease           string
+	routingFeeMsat  int64
+}
+
+// JSONInvoice is an invoice as sent in the Light-Auth headers
+type JSONInvoice = core.JSONInvoice
+
+// paymentRequests lists the payment requests of invoices as sent in the Light-Auth-Invoice header
+func paymentRequests(invoices []*Invoice) string {
+	requests := make([]string, len(invoices))
+	for k, i := range invoices {
+		requests[k] = i.PaymentRequest
+	}
+
+	return strings.Join(requests, ",")
+}
+
+func (i *Invoice) settle(preImage []byte) error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	i.Settled = true
+	i.PreImage = preImage
+
+	return i.persist(true)
+}
+
+func (i *Invoice) isSettled() bool {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	return i.Settled
+}
+
+func (i *Invoice) isClaimed() bool {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	return i.Claimed
+}
+
+func (i *Invoice) isExpired() bool {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	return i.ExpirationTime.Before(time.Now())
+}
+
+func (i *Invoice) expiresWithin(d time.Duration) bool {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	return i.ExpirationTime.Before(time.Now().Add(d))
+}
+
+func (i *Invoice) claim() error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	i.Claimed = true
+	return i.persist(true)
+}
+
+func (i *Invoice) save() error {
+	return i.persist(false)
+}
+
+// persist writes the invoice to the store, straight away if durable even in write-behind mode
+func (i *Invoice) persist(durable bool) error {
+	if i.ID == "" {
+		var err error
+		i.ID, err = clientDatabase.Create(i)
+		return err
+	}
+
+	return lightauth.Edit(clientDatabase, i, durable)
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/faurehu/lightauth"
+)
+
+// cLAIMLEASE is how long a paid invoice is kept for the request it has been attached to
+const cLAIMLEASE = 2 * time.Minute
+
+// ErrInvoiceLeased is returned when an invoice is being paid or claimed by another process sharing the
+// client's store
+var ErrInvoiceLeased = errors.New("Lightauth error: invoice is in use by another process")
+
+// processID tells apart the client processes that share a store
+var processID = func() string {
+	id, err := lightauth.NewNonce()
+	if err != nil {
+		// Processes sharing an ID would pay the invoices leased to each other
+		panic(err)
+	}
+
+	return id
+}()
+
+// leaseCount numbers the leases taken by this process, so its goroutines don't share them either
+var leaseCount uint64
+
+// CompareAndEditor can be implemented by a DataProvider shared by several client processes. It edits a
+// record only if the Version the store has for it is the given one, and returns false otherwise. With
+// it, invoices are leased to one process at a time, so processes don't pay the same invoice or present
+// the same preimage twice. GetInvoice reads an invoice as the store has it, so a process whose edit was
+// rejected learns what it lost to.
+type CompareAndEditor interface {
+	CompareAndEdit(r lightauth.Record, version int64) (bool, error)
+	GetInvoice(id string) (*Invoice, error)
+}
+
+// setLease writes the lease of an invoice with an optimistic lock on its version. It must be called with
+// the invoice's lock held.
+func (i *Invoice) setLease(owner string, expiration time.Time) bool {
+	previousOwner, previousExpiration := i.LeaseOwner, i.LeaseExpiration
+	i.LeaseOwner, i.LeaseExpiration = owner, expiration
+	i.Version++
+
+	cas, ok := clientDatabase.(CompareAndEditor)
+	if !ok || i.ID == "" {
+		return i.persist(true) == nil
+	}
+
+	edited, err := cas.CompareAndEdit(i, i.Version-1)
+	if err != nil || !edited {
+		i.LeaseOwner, i.LeaseExpiration = previousOwner, previousExpiration
+		i.Version--
+		if err == nil {
+			// Someone else changed the invoice since we read it
+			i.reload(cas)
+		}
+		return false
+	}
+
+	return true
+}
+
+// reload catches up with the invoice as the store has it after an edit was rejected, so the next lease
+// is attempted on the version the store has and an invoice paid or claimed elsewhere isn't used again.
+// It must be called with the invoice's lock held.
+func (i *Invoice) reload(cas CompareAndEditor) {
+	stored, err := cas.GetInvoice(i.ID)
+	if err != nil || stored == nil {
+		log.Printf("Lightauth error: could not read invoice %v back from the store: %v\n", i.ID, err)
+		return
+	}
+
+	i.Version = stored.Version
+	i.LeaseOwner, i.LeaseExpiration = stored.LeaseOwner, stored.LeaseExpiration
+	if stored.Settled && !i.Settled {
+		i.Settled, i.PreImage = true, stored.PreImage
+	}
+	i.Claimed = i.Claimed || stored.Claimed
+}
+
+// acquireLease reserves an invoice for the given time, returning the lease to release it with, or false
+// if another goroutine or process holds it.
+func (i *Invoice) acquireLease(d time.Duration) (string, bool) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	t := time.Now()
+	if i.LeaseOwner != "" && i.LeaseExpiration.After(t) {
+		return "", false
+	}
+
+	owner := fmt.Sprintf("%v/%v", processID, atomic.AddUint64(&leaseCount, 1))
+	if !i.setLease(owner, t.Add(d)) {
+		return "", false
+	}
+
+	return owner, true
+}
+
+// releaseLease ends a lease returned by acquireLease, unless it has expired and been taken since
+func (i *Invoice) releaseLease(lease string) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	if lease != "" && i.LeaseOwner == lease {
+		i.setLease("", time.Time{})
+	}
+}
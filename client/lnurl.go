@@ -0,0 +1,104 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+func getLNURL(ctx context.Context, u string, v interface{}) error {
+	request, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+
+	response, err := exchange(StepLNURL, request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	return core.DecodeLNURL(body, v)
+}
+
+// fetchLNURLInvoice resolves the LNURL-pay endpoint advertised by a path into an invoice for its fee
+func fetchLNURLInvoice(ctx context.Context, p *Path) (*Invoice, error) {
+	lnurl, err := core.LNURLWithToken(p.LNURL, p.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	params := core.LNURLPayParams{}
+	if err := getLNURL(ctx, lnurl, &params); err != nil {
+		log.Printf("Lightauth error: Could not resolve LNURL: %v\n", err)
+		return nil, err
+	}
+
+	msat := int64(p.Fee) * 1000
+	if params.Tag != "payRequest" || msat < params.MinSendable || msat > params.MaxSendable {
+		return nil, errors.New("Lightauth error: LNURL endpoint can't issue invoices for the route fee")
+	}
+
+	callback, err := url.Parse(params.Callback)
+	if err != nil {
+		return nil, err
+	}
+
+	query := callback.Query()
+	query.Set("amount", strconv.FormatInt(msat, 10))
+	callback.RawQuery = query.Encode()
+
+	payInvoice := core.LNURLPayInvoice{}
+	if err := getLNURL(ctx, callback.String(), &payInvoice); err != nil {
+		log.Printf("Lightauth error: Could not fetch LNURL invoice: %v\n", err)
+		return nil, err
+	}
+
+	payReq, err := decodePaymentRequest(ctx, payInvoice.PR)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateInvoice(payReq, payInvoice.PR, p.Fee); err != nil {
+		return nil, err
+	}
+
+	descriptionHash := sha256.Sum256([]byte(params.Metadata))
+	if payReq.DescriptionHash != hex.EncodeToString(descriptionHash[:]) {
+		return nil, errors.New("Lightauth error: LNURL invoice does not match the requested payment")
+	}
+
+	paymentHash, err := hex.DecodeString(payReq.PaymentHash)
+	if err != nil {
+		return nil, err
+	}
+
+	i := &Invoice{
+		PaymentRequest: payInvoice.PR,
+		Fee:            p.Fee,
+		PaymentHash:    paymentHash,
+		ExpirationTime: time.Unix(payReq.Timestamp+payReq.Expiry, 0),
+		Description:    payReq.Description,
+		Path:           p,
+	}
+
+	p.addInvoice(i)
+	err = i.save()
+
+	return i, err
+}
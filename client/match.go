@@ -0,0 +1,58 @@
+package client
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+// variantKey tells apart the requests to a path whose price depends on the query parameters and headers
+// in varies, by the values they have for them.
+func variantKey(varies []string, query url.Values, h http.Header) string {
+	if len(varies) == 0 {
+		return ""
+	}
+
+	values := url.Values{}
+	for _, v := range varies {
+		rc, err := core.ParseCondition(v)
+		if err != nil {
+			continue
+		}
+
+		requestValues := append([]string{}, rc.Values(query, h)...)
+		sort.Strings(requestValues)
+		values[v] = requestValues
+	}
+
+	return "?" + values.Encode()
+}
+
+// applyVariant gives a request the query parameters and headers of the variant of a path, so it goes
+// to the same route as the requests the path was negotiated for.
+func applyVariant(request *http.Request, variant string) {
+	values, err := url.ParseQuery(strings.TrimPrefix(variant, "?"))
+	if err != nil {
+		return
+	}
+
+	query := request.URL.Query()
+	for k, vs := range values {
+		rc, err := core.ParseCondition(k)
+		if err != nil {
+			continue
+		}
+
+		for _, v := range vs {
+			if rc.Source == "query" {
+				query.Add(rc.Name, v)
+			} else {
+				request.Header.Add(rc.Name, v)
+			}
+		}
+	}
+	request.URL.RawQuery = query.Encode()
+}
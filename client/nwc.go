@@ -0,0 +1,313 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"golang.org/x/net/websocket"
+)
+
+// Event kinds of Nostr Wallet Connect (NIP-47)
+const (
+	nWCREQUEST  = 23194
+	nWCRESPONSE = 23195
+)
+
+// nWCTIMEOUT bounds the wait for the answer of the wallet when the context of the payment has no deadline
+const nWCTIMEOUT = time.Minute
+
+// nwcConnection is the wallet, relay and client key decoded from a nostr+walletconnect:// URI
+type nwcConnection struct {
+	wallet    *btcec.PublicKey
+	walletHex string
+	relay     string
+	secret    *btcec.PrivateKey
+}
+
+// parseNWC decodes a nostr+walletconnect://<wallet pubkey>?relay=wss://...&secret=<hex> URI, as shown by
+// Alby and other NWC wallets.
+func parseNWC(uri string) (*nwcConnection, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "nostr+walletconnect" && u.Scheme != "nostrwalletconnect" {
+		return nil, errors.New("Lightauth error: NWC must be a nostr+walletconnect:// URI")
+	}
+
+	walletHex := u.Host
+	if walletHex == "" {
+		walletHex = u.Opaque
+	}
+
+	walletKey, err := hex.DecodeString(walletHex)
+	if err != nil {
+		return nil, errors.New("Lightauth error: NWC URI has no valid wallet public key")
+	}
+
+	wallet, err := schnorr.ParsePubKey(walletKey)
+	if err != nil {
+		return nil, errors.New("Lightauth error: NWC URI has no valid wallet public key")
+	}
+
+	query := u.Query()
+	secret, err := hex.DecodeString(query.Get("secret"))
+	if err != nil || len(secret) != 32 {
+		return nil, errors.New("Lightauth error: NWC URI has no valid secret")
+	}
+
+	relay := query.Get("relay")
+	if !strings.HasPrefix(relay, "wss://") && !strings.HasPrefix(relay, "ws://") {
+		return nil, errors.New("Lightauth error: NWC URI has no valid relay")
+	}
+
+	privateKey, _ := btcec.PrivKeyFromBytes(secret)
+	return &nwcConnection{wallet: wallet, walletHex: walletHex, relay: relay, secret: privateKey}, nil
+}
+
+// nostrEvent is a signed Nostr event (NIP-01)
+type nostrEvent struct {
+	ID        string     `json:"id"`
+	PubKey    string     `json:"pubkey"`
+	CreatedAt int64      `json:"created_at"`
+	Kind      int        `json:"kind"`
+	Tags      [][]string `json:"tags"`
+	Content   string     `json:"content"`
+	Sig       string     `json:"sig"`
+}
+
+// sign sets the ID, public key and signature of the event
+func (e *nostrEvent) sign(key *btcec.PrivateKey) error {
+	e.PubKey = hex.EncodeToString(schnorr.SerializePubKey(key.PubKey()))
+
+	// The ID commits to the event serialized without any escaping beyond JSON's
+	var serialized bytes.Buffer
+	encoder := json.NewEncoder(&serialized)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode([]interface{}{0, e.PubKey, e.CreatedAt, e.Kind, e.Tags, e.Content}); err != nil {
+		return err
+	}
+
+	id := sha256.Sum256(bytes.TrimSuffix(serialized.Bytes(), []byte("\n")))
+	signature, err := schnorr.Sign(key, id[:])
+	if err != nil {
+		return err
+	}
+
+	e.ID = hex.EncodeToString(id[:])
+	e.Sig = hex.EncodeToString(signature.Serialize())
+	return nil
+}
+
+// sharedSecret is the X coordinate of the ECDH point of the client key and the wallet key, on the 32
+// bytes NIP-04 keys with
+func (c *nwcConnection) sharedSecret() []byte {
+	return btcec.GenerateSharedSecret(c.secret, c.wallet)
+}
+
+// encrypt encrypts a message for the wallet as NIP-04 does: AES-256-CBC with the ECDH shared secret
+func (c *nwcConnection) encrypt(message []byte) (string, error) {
+	block, err := aes.NewCipher(c.sharedSecret())
+	if err != nil {
+		return "", err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+
+	padding := aes.BlockSize - len(message)%aes.BlockSize
+	plaintext := append(message, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+
+	return base64.StdEncoding.EncodeToString(ciphertext) + "?iv=" + base64.StdEncoding.EncodeToString(iv), nil
+}
+
+func (c *nwcConnection) decrypt(content string) ([]byte, error) {
+	parts := strings.Split(content, "?iv=")
+	if len(parts) != 2 {
+		return nil, errors.New("Lightauth error: NWC response is not NIP-04 encrypted")
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	iv, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(iv) != aes.BlockSize || len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, errors.New("Lightauth error: NWC response has an invalid ciphertext")
+	}
+
+	block, err := aes.NewCipher(c.sharedSecret())
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	// PKCS#7 pads with as many bytes as it adds, each holding their number
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(plaintext[len(plaintext)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, errors.New("Lightauth error: NWC response has an invalid padding")
+	}
+
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+// nwcResponse is the decrypted content of a response event
+type nwcResponse struct {
+	ResultType string `json:"result_type"`
+	Error      *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	Result struct {
+		Preimage string `json:"preimage"`
+	} `json:"result"`
+}
+
+// NewNWCPayer returns a PayerFunc paying invoices with the wallet of a Nostr Wallet Connect URI. Each
+// payment opens its own connection to the relay, subscribes to the answer of the wallet and then
+// publishes the pay_invoice request.
+func NewNWCPayer(uri string) (PayerFunc, error) {
+	conn, err := parseNWC(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.payInvoice, nil
+}
+
+func (c *nwcConnection) payInvoice(ctx context.Context, paymentRequest string) ([]byte, error) {
+	content, err := json.Marshal(map[string]interface{}{
+		"method": "pay_invoice",
+		"params": map[string]string{"invoice": paymentRequest},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := c.encrypt(content)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &nostrEvent{
+		CreatedAt: time.Now().Unix(),
+		Kind:      nWCREQUEST,
+		Tags:      [][]string{{"p", c.walletHex}},
+		Content:   encrypted,
+	}
+	if err := request.sign(c.secret); err != nil {
+		return nil, err
+	}
+
+	config, err := websocket.NewConfig(c.relay, "http://localhost/")
+	if err != nil {
+		return nil, err
+	}
+
+	ws, err := config.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer ws.Close()
+
+	// Relays may never answer, so the connection doesn't outlive the payment
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(nWCTIMEOUT)
+	}
+	ws.SetDeadline(deadline)
+
+	subscription := request.ID[:16]
+	filter := map[string]interface{}{
+		"kinds":   []int{nWCRESPONSE},
+		"authors": []string{c.walletHex},
+		"#e":      []string{request.ID},
+	}
+	if err := websocket.JSON.Send(ws, []interface{}{"REQ", subscription, filter}); err != nil {
+		return nil, err
+	}
+
+	if err := websocket.JSON.Send(ws, []interface{}{"EVENT", request}); err != nil {
+		return nil, err
+	}
+
+	for {
+		var message []json.RawMessage
+		if err := websocket.JSON.Receive(ws, &message); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+
+		var messageType string
+		if len(message) < 2 || json.Unmarshal(message[0], &messageType) != nil {
+			continue
+		}
+
+		switch messageType {
+		case "OK":
+			var accepted bool
+			if len(message) >= 3 && json.Unmarshal(message[2], &accepted) == nil && !accepted {
+				return nil, fmt.Errorf("Lightauth error: NWC relay rejected the request: %s", message[len(message)-1])
+			}
+		case "EVENT":
+			var response nostrEvent
+			if len(message) < 3 || json.Unmarshal(message[2], &response) != nil {
+				continue
+			}
+
+			if response.Kind != nWCRESPONSE || response.PubKey != c.walletHex {
+				continue
+			}
+
+			return c.readResponse(response)
+		}
+	}
+}
+
+// readResponse returns the preimage sent by the wallet. It doesn't need to trust the wallet with it:
+// the payer backend checks the preimage against the invoice.
+func (c *nwcConnection) readResponse(event nostrEvent) ([]byte, error) {
+	content, err := c.decrypt(event.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	var response nwcResponse
+	if err := json.Unmarshal(content, &response); err != nil {
+		return nil, err
+	}
+
+	if response.Error != nil {
+		return nil, fmt.Errorf("Lightauth error: NWC wallet failed to pay: %v: %v", response.Error.Code, response.Error.Message)
+	}
+
+	return hex.DecodeString(response.Result.Preimage)
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"testing"
+)
+
+const nwcTestURI = "nostr+walletconnect://b889ff5b1513b641e2a139f661a661364979c5beee91842f8f0ef42ab558e9d4?relay=wss://relay.example.com&secret=71a8c14c1407c113601079c4302dab36460f0ccd0ad506f1f2dc73b5100e4f3c"
+
+// encryptPadded encrypts plaintext as it is, padded or not, so decrypt can be given any padding
+func encryptPadded(t *testing.T, c *nwcConnection, plaintext []byte) string {
+	t.Helper()
+
+	block, err := aes.NewCipher(c.sharedSecret())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+
+	return base64.StdEncoding.EncodeToString(ciphertext) + "?iv=" + base64.StdEncoding.EncodeToString(iv)
+}
+
+func TestNWCDecrypt(t *testing.T) {
+	c, err := parseNWC(nwcTestURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := []byte(`{"result_type":"pay_invoice"}`)
+	encrypted, err := c.encrypt(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := c.decrypt(encrypted)
+	if err != nil || !bytes.Equal(decrypted, message) {
+		t.Fatalf("decrypt(encrypt(%s)) = %s, %v", message, decrypted, err)
+	}
+
+	// Blocks whose last byte doesn't tell how many bytes of padding there are
+	blocks := map[string][]byte{
+		"no padding":         append(bytes.Repeat([]byte{'a'}, 15), 0),
+		"padding too long":   append(bytes.Repeat([]byte{'a'}, 15), aes.BlockSize+1),
+		"inconsistent bytes": append(bytes.Repeat([]byte{'a'}, 12), 1, 4, 4, 4),
+	}
+	for name, block := range blocks {
+		if _, err := c.decrypt(encryptPadded(t, c, block)); err == nil {
+			t.Errorf("%v: invalid padding accepted", name)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/faurehu/lightauth"
+)
+
+// ErrOffline is returned by the client when its node is unreachable and the path has nothing paid for
+// left to make the request with
+var ErrOffline = errors.New("Lightauth error: lightning node unreachable, nothing paid for is left")
+
+var clientBreaker *lightauth.Breaker
+
+// The payments that waited for the node are made as soon as it is back. The breaker is made here,
+// payOffline depending on it.
+func init() {
+	clientBreaker = lightauth.NewBreaker(func(ctx context.Context) error {
+		_, err := clientBackend.GetInfo(ctx)
+		return err
+	}, payOffline)
+}
+
+// Offline tells whether the client has lost its node. Meanwhile requests are made with the time and the
+// invoices already paid for, and the payments they need wait until the node is back.
+func Offline() bool {
+	return clientBreaker.IsOpen()
+}
+
+// offlinePaths holds the paths whose payments wait for the node to be back
+type offlinePaths struct {
+	mux   sync.Mutex
+	paths map[*Path]bool
+}
+
+var offlinePayments = &offlinePaths{paths: make(map[*Path]bool)}
+
+func (q *offlinePaths) queue(p *Path) {
+	if p.BindRequest {
+		// Their invoices are issued for one request, there is nothing to pay ahead
+		return
+	}
+
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	q.paths[p] = true
+}
+
+func (q *offlinePaths) take() []*Path {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	paths := []*Path{}
+	for p := range q.paths {
+		paths = append(paths, p)
+	}
+	q.paths = make(map[*Path]bool)
+
+	return paths
+}
+
+// payOffline makes the payments queued while the node was unreachable
+func payOffline() {
+	defer lightauth.RecoverBackground("offline payments")
+
+	for _, p := range offlinePayments.take() {
+		if err := topUp(context.Background(), p); err != nil {
+			lightauth.ReportError(err)
+		}
+	}
+}
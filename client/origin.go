@@ -0,0 +1,115 @@
+package client
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// originOf returns the origin a request is for: its scheme, host and port, in lower case, without the
+// trailing dot of a fully qualified host and with the default port of the scheme filled in. host is
+// the Host header of the request when it overrides the host of the URL, as that is what tells
+// virtual hosts apart on the server.
+func originOf(u *url.URL, host string) string {
+	if host == "" {
+		host = u.Host
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname, port = host, ""
+	}
+	if port == "" {
+		port = defaultPorts[scheme]
+	}
+	hostname = strings.TrimSuffix(strings.ToLower(strings.Trim(hostname, "[]")), ".")
+
+	if port == "" {
+		return scheme + "://" + hostname
+	}
+
+	return scheme + "://" + net.JoinHostPort(hostname, port)
+}
+
+// cleanPath resolves the dot segments and repeated slashes of a URL path and drops its trailing slash,
+// so the spellings of a path share its key. Paths are case sensitive and kept as they are otherwise.
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// pathKey is the canonical form of the URL of a request, which paths are stored under in clientStore
+func pathKey(u *url.URL, host string) string {
+	return originOf(u, host) + cleanPath(u.Path)
+}
+
+// pathVaries lists, by path key, the query parameters and headers the server prices the requests to a
+// path by. It is guarded by clientStoreMux along with clientStore.
+var pathVaries = make(map[string][]string)
+
+// base is the key of the path without its variant
+func (p *Path) base() string {
+	return p.Origin + cleanPath(p.URL[strings.Index(p.URL+"/", "/"):])
+}
+
+// key is what the path is stored under in clientStore: its base key, followed by the values of its
+// variant when the server prices requests to it by query parameters or headers. Paths stored before
+// they were told apart by origin are stored under their URL.
+func (p *Path) key() string {
+	if p.Origin == "" {
+		return p.URL
+	}
+
+	return p.base() + p.Variant
+}
+
+// knownPaths returns the paths the client knows, in no particular order
+func knownPaths() []*Path {
+	clientStoreMux.RLock()
+	defer clientStoreMux.RUnlock()
+
+	paths := make([]*Path, 0, len(clientStore))
+	for _, p := range clientStore {
+		paths = append(paths, p)
+	}
+
+	return paths
+}
+
+// lookupPath returns the path a request is for. Paths are kept per origin, so a client talking to
+// several deployments of the same API (staging and production, or two ports of a host) keeps their
+// tokens and invoices apart, and per variant, when the price depends on the query parameters and
+// headers h of the request. A path stored before origins were told apart is adopted by the first origin
+// asking for it.
+func lookupPath(u *url.URL, host string, h http.Header) (*Path, bool) {
+	base := pathKey(u, host)
+	clientStoreMux.RLock()
+	p, exists := clientStore[base+variantKey(pathVaries[base], u.Query(), h)]
+	clientStoreMux.RUnlock()
+	if exists {
+		return p, true
+	}
+
+	clientStoreMux.Lock()
+	p, exists = clientStore[u.Host+u.Path]
+	if !exists || p.Origin != "" {
+		clientStoreMux.Unlock()
+		return nil, false
+	}
+
+	delete(clientStore, u.Host+u.Path)
+	p.Origin = originOf(u, host)
+	p.Host = host
+	clientStore[p.key()] = p
+	clientStoreMux.Unlock()
+	p.save()
+
+	return p, true
+}
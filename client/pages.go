@@ -0,0 +1,65 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+// fetchInvoicesPage gets a page of invoices for a path from the InvoicesURL of its route, and keeps
+// those it doesn't have yet.
+func fetchInvoicesPage(ctx context.Context, p *Path, page int, fingerprint string) error {
+	request, err := http.NewRequest(http.MethodGet, p.InvoicesURL+"?page="+strconv.Itoa(page), nil)
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set(core.HeaderToken, p.Token)
+	if fingerprint != "" {
+		request.Header.Set(core.HeaderFingerprint, fingerprint)
+	}
+	setBatchHeader(request)
+	setAcceptInvoicesHeader(request.Header)
+	core.AnnounceVersion(request.Header)
+
+	response, err := exchange(StepInvoicesPage, request)
+	if err != nil {
+		return err
+	}
+	defer discardBody(response)
+
+	if response.StatusCode != http.StatusOK {
+		return readErrorResponse(response, "Lightauth error: could not fetch invoices")
+	}
+
+	data := core.InvoicesPage{}
+	if err := json.NewDecoder(response.Body).Decode(&data); err != nil {
+		return err
+	}
+
+	if len(data.Invoices) > core.InvoicesPageSize {
+		return errors.New(iNVOICESTOOLARGE)
+	}
+
+	invoicesJSON, err := json.Marshal(data.Invoices)
+	if err != nil {
+		return err
+	}
+
+	// The page is read like the invoices sent in the headers of the route
+	h := http.Header{}
+	h.Set(core.HeaderFee, strconv.Itoa(p.Fee))
+	h.Set(core.HeaderInvoices, string(invoicesJSON))
+	h.Set(core.HeaderFingerprint, fingerprint)
+	invoices, err := getInvoicesFromResponse(ctx, h)
+	if err != nil {
+		return err
+	}
+
+	p.keepInvoices(invoices)
+	return nil
+}
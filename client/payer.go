@@ -0,0 +1,122 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+)
+
+// PayerFunc pays a payment request and returns its preimage. It can be backed by anything able to pay:
+// WebLN in a browser, a wallet through Nostr Wallet Connect, a mobile wallet SDK.
+type PayerFunc func(ctx context.Context, paymentRequest string) ([]byte, error)
+
+// walletPayer returns the payer of the wallet a node section configures instead of a node, or nil
+func walletPayer(node lightauth.NodeConfig) (PayerFunc, error) {
+	switch {
+	case node.NWC != "":
+		return NewNWCPayer(node.NWC)
+	case node.LNDHub != "":
+		return NewLNDHubPayer(node.LNDHub)
+	}
+
+	return nil, nil
+}
+
+// payerBackend is a client backend without a node: invoices are decoded locally and paid by an
+// external payer.
+type payerBackend struct {
+	pay     PayerFunc
+	network string
+}
+
+// NewPayerBackend returns a LightningBackend for clients that delegates payments to pay, so the client
+// can run where there is no lnd, e.g.
+//
+//	client.StartWithBackend(db, client.NewPayerBackend("mainnet", payWithWebLN))
+//
+// Payment requests must be of a network lightauth can decode locally. Preflight checks and signed
+// requests are not available, and the backend can't be used by a server.
+func NewPayerBackend(network string, pay PayerFunc) lightauth.LightningBackend {
+	return &payerBackend{pay: pay, network: network}
+}
+
+func (b *payerBackend) GetInfo(ctx context.Context) (*lnrpc.GetInfoResponse, error) {
+	info := &lnrpc.GetInfoResponse{SyncedToChain: true}
+	if b.network != "" {
+		info.Chains = []*lnrpc.Chain{{Chain: "bitcoin", Network: b.network}}
+	}
+
+	return info, nil
+}
+
+func (b *payerBackend) AddInvoice(ctx context.Context, invoice *lnrpc.Invoice) (*lnrpc.AddInvoiceResponse, error) {
+	return nil, lightauth.ErrNotSupported
+}
+
+func (b *payerBackend) SubscribeInvoices(ctx context.Context) (lightauth.InvoiceStream, error) {
+	return nil, lightauth.ErrNotSupported
+}
+
+func (b *payerBackend) DecodePayReq(ctx context.Context, payReq string) (*lnrpc.PayReq, error) {
+	return core.DecodeBOLT11(payReq)
+}
+
+// SendPayment reports the payment as failed when the payer errors, and only as succeeded when the
+// preimage it returned matches the invoice.
+func (b *payerBackend) SendPayment(ctx context.Context, request *routerrpc.SendPaymentRequest) (*lnrpc.Payment, error) {
+	payReq, err := core.DecodeBOLT11(request.PaymentRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	payment := &lnrpc.Payment{
+		PaymentHash:    payReq.PaymentHash,
+		PaymentRequest: request.PaymentRequest,
+		ValueSat:       payReq.NumSatoshis,
+		Status:         lnrpc.Payment_FAILED,
+		FailureReason:  lnrpc.PaymentFailureReason_FAILURE_REASON_ERROR,
+	}
+
+	preImage, err := b.pay(ctx, request.PaymentRequest)
+	if err == context.DeadlineExceeded {
+		payment.FailureReason = lnrpc.PaymentFailureReason_FAILURE_REASON_TIMEOUT
+		return payment, nil
+	}
+	if err != nil {
+		log.Printf("Lightauth error: payer failed to pay the invoice: %v\n", err)
+		return payment, nil
+	}
+
+	hash := sha256.Sum256(preImage)
+	if hex.EncodeToString(hash[:]) != payReq.PaymentHash {
+		return nil, errors.New("Lightauth error: the payer returned a preimage that doesn't match the invoice")
+	}
+
+	payment.Status = lnrpc.Payment_SUCCEEDED
+	payment.FailureReason = lnrpc.PaymentFailureReason_FAILURE_REASON_NONE
+	payment.PaymentPreimage = hex.EncodeToString(preImage)
+	return payment, nil
+}
+
+func (b *payerBackend) ChannelBalance(ctx context.Context) (int64, error) {
+	return 0, lightauth.ErrNotSupported
+}
+
+func (b *payerBackend) QueryRoutes(ctx context.Context, request *lnrpc.QueryRoutesRequest) (*lnrpc.QueryRoutesResponse, error) {
+	return nil, lightauth.ErrNotSupported
+}
+
+func (b *payerBackend) SignMessage(ctx context.Context, message []byte) (string, error) {
+	return "", lightauth.ErrNotSupported
+}
+
+func (b *payerBackend) VerifyMessage(ctx context.Context, message []byte, signature string) (string, error) {
+	return "", lightauth.ErrNotSupported
+}
@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+)
+
+// ErrPaymentDeclined is returned when the consent hook declines a payment
+var ErrPaymentDeclined = errors.New("Lightauth error: payment declined by the consent hook")
+
+// Fallback strategies that can be configured for each class of payment failure
+const (
+	fALLBACKFAIL     = "fail"
+	fALLBACKRETRY    = "retry"
+	fALLBACKRAISEFEE = "raise_fee"
+)
+
+var consentHook func(url string, description string, amount int64) bool
+
+// SetConsentHook registers a function that is asked before paying each invoice. It receives the URL of
+// the path, the description the server put in the invoice and the amount in satoshis, and the payment
+// only goes ahead if it returns true.
+func SetConsentHook(hook func(url string, description string, amount int64) bool) {
+	consentHook = hook
+}
+
+// maxRetries is the number of times a failed payment is retried
+func (p PaymentConfig) maxRetries() int {
+	if p.MaxRetries == nil {
+		return dEFAULTMAXRETRIES
+	}
+
+	return *p.MaxRetries
+}
+
+var defaultFallbacks = map[string]string{
+	"no_route": fALLBACKRAISEFEE,
+	"timeout":  fALLBACKRETRY,
+}
+
+// failureClass is the name used for a payment failure in the Fallbacks configuration
+func failureClass(e *lightauth.PaymentError) string {
+	switch e.Unwrap() {
+	case lightauth.ErrNoRoute:
+		return "no_route"
+	case lightauth.ErrInsufficientFunds:
+		return "insufficient_balance"
+	case lightauth.ErrPaymentTimeout:
+		return "timeout"
+	case lightauth.ErrIncorrectPaymentDetails:
+		return "incorrect_details"
+	default:
+		return "error"
+	}
+}
+
+// payInvoice pays an invoice through the payment interceptors, optionally checking first that the
+// payment is feasible, and applying the configured fallback strategy when the payment fails: failing
+// straight away, retrying as is, or retrying with twice the fee limit.
+func payInvoice(ctx context.Context, i *Invoice) error {
+	return interceptPayment(ctx, i, func(ctx context.Context) error {
+		return sendPayment(ctx, i)
+	})
+}
+
+// sendPayment is payInvoice under the payment interceptors
+func sendPayment(ctx context.Context, i *Invoice) error {
+	if clientNetwork != "" && core.InvoiceNetwork(i.PaymentRequest) != clientNetwork {
+		return lightauth.ErrWrongNetwork
+	}
+
+	if consentHook != nil && !consentHook(i.Path.URL, i.Description, int64(i.Fee)) {
+		return ErrPaymentDeclined
+	}
+
+	// Another goroutine or process sharing the store may be paying it already
+	lease, leased := i.acquireLease(time.Duration(paymentConfig.Timeout)*time.Second + lightauth.RPCTimeout)
+	if !leased {
+		return ErrInvoiceLeased
+	}
+	defer i.releaseLease(lease)
+
+	if paymentConfig.Preflight {
+		if err := preflightPayment(ctx, i); err != nil {
+			return err
+		}
+	}
+
+	if Offline() {
+		return ErrOffline
+	}
+
+	if err := i.setIntent(); err != nil {
+		return err
+	}
+
+	feeLimit := paymentConfig.FeeLimit
+	start := time.Now()
+
+	for attempt := 0; ; attempt++ {
+		err := makePayment(ctx, i, feeLimit)
+		if err == nil && i.Path != nil {
+			i.Path.observePayment(time.Since(start))
+		}
+
+		paymentErr, ok := err.(*lightauth.PaymentError)
+		if !ok || attempt >= paymentConfig.maxRetries() {
+			return endIntent(i, err)
+		}
+
+		switch paymentConfig.Fallbacks[failureClass(paymentErr)] {
+		case fALLBACKRETRY:
+		case fALLBACKRAISEFEE:
+			feeLimit *= 2
+		default:
+			return endIntent(i, err)
+		}
+	}
+}
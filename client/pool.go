@@ -0,0 +1,203 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+)
+
+// dEFAULTPOOLWORKERS is the number of payments the pool makes at once when Payments.PoolWorkers is 0
+const dEFAULTPOOLWORKERS = 2
+
+// invoicePool keeps paid invoices ready for the requests to discrete paths, so that requests don't wait
+// for payments to settle. Paths are queued for a refill when a request takes invoices from them, and
+// the workers pay for invoices until each path holds Payments.PoolSize paid invoices again, or as many
+// as its payment latency calls for with Payments.Adaptive.
+type invoicePool struct {
+	mux      sync.Mutex
+	refill   chan *Path
+	queued   map[*Path]bool
+	refills  map[string]int
+	failures map[string]int
+	errors   map[string]string
+}
+
+var clientPool *invoicePool
+
+// PoolStatus describes the pool of paid invoices of a path. Depth is the number of paid invoices it
+// holds, Target the number it is refilled to, Refills the number of invoices paid for it in the
+// background and Failures the number of payments that failed, the last one with LastError.
+type PoolStatus struct {
+	Path      string `json:"path"`
+	Depth     int    `json:"depth"`
+	Target    int    `json:"target"`
+	Refills   int    `json:"refills"`
+	Failures  int    `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// startPool starts the workers refilling the pools of the discrete paths, and queues the paths known
+// so far.
+func startPool() {
+	if paymentConfig.PoolSize <= 0 && !paymentConfig.Adaptive {
+		return
+	}
+
+	workers := paymentConfig.PoolWorkers
+	if workers <= 0 {
+		workers = dEFAULTPOOLWORKERS
+	}
+
+	clientPool = &invoicePool{
+		refill:   make(chan *Path, len(knownPaths())+workers),
+		queued:   make(map[*Path]bool),
+		refills:  make(map[string]int),
+		failures: make(map[string]int),
+		errors:   make(map[string]string),
+	}
+
+	for i := 0; i < workers; i++ {
+		go clientPool.work()
+	}
+
+	for _, p := range knownPaths() {
+		clientPool.queue(p)
+	}
+}
+
+// queue asks for the pool of a path to be refilled, unless it is already waiting for it. Paths binding
+// their invoices to requests have no pool, their invoices are only good for one request.
+func (pool *invoicePool) queue(p *Path) {
+	if pool == nil || p.Mode != core.ModeDiscrete || p.BindRequest {
+		return
+	}
+
+	pool.mux.Lock()
+	if pool.queued[p] {
+		pool.mux.Unlock()
+		return
+	}
+	pool.queued[p] = true
+	pool.mux.Unlock()
+
+	go func() {
+		pool.refill <- p
+	}()
+}
+
+func (pool *invoicePool) work() {
+	for p := range pool.refill {
+		pool.mux.Lock()
+		delete(pool.queued, p)
+		pool.mux.Unlock()
+
+		pool.fill(context.Background(), p)
+	}
+}
+
+// fill pays for invoices of a path until its pool is full, asking the server for more invoices when it
+// runs out of them.
+func (pool *invoicePool) fill(ctx context.Context, p *Path) {
+	refreshed := false
+	for len(p.getUnclaimedInvoices("")) < p.poolTarget() {
+		p.discardExpiringInvoices()
+
+		var next *Invoice
+		for _, v := range p.invoices() {
+			if !v.isSettled() && !v.isExpired() && !v.Deferred && v.Fingerprint == "" {
+				next = v
+				break
+			}
+		}
+
+		if next == nil {
+			if refreshed {
+				// The server has no more invoices for us at the moment
+				return
+			}
+
+			refreshed = true
+			if err := refreshPath(ctx, p); err != nil {
+				pool.fail(p, err)
+				return
+			}
+			continue
+		}
+
+		err := payInvoice(ctx, next)
+		if errors.Is(err, ErrInvoiceLeased) {
+			// A request is paying for it
+			return
+		}
+
+		if err != nil {
+			pool.fail(p, err)
+			return
+		}
+
+		pool.mux.Lock()
+		pool.refills[p.key()]++
+		pool.mux.Unlock()
+	}
+}
+
+// refreshPath asks the server for more invoices for a path, outside of a request to it
+func refreshPath(ctx context.Context, p *Path) error {
+	if p.InvoicesURL != "" {
+		return fetchInvoicesPage(ctx, p, 0, "")
+	}
+
+	if p.Origin == "" {
+		return errors.New("Lightauth error: the origin of the path is unknown")
+	}
+
+	return refreshInvoices(ctx, p, strings.SplitN(p.Origin, "://", 2)[0], "")
+}
+
+func (pool *invoicePool) fail(p *Path, err error) {
+	pool.mux.Lock()
+	defer pool.mux.Unlock()
+
+	pool.failures[p.key()]++
+	pool.errors[p.key()] = err.Error()
+	lightauth.ReportError(err)
+}
+
+// Pools returns the state of the pools of paid invoices of the discrete paths, sorted by path. It is
+// empty unless Payments.PoolSize or Payments.Adaptive is set.
+func Pools() []PoolStatus {
+	pools := []PoolStatus{}
+	if clientPool == nil {
+		return pools
+	}
+
+	clientPool.mux.Lock()
+	defer clientPool.mux.Unlock()
+
+	for _, p := range knownPaths() {
+		if p.Mode != core.ModeDiscrete || p.BindRequest {
+			continue
+		}
+
+		key := p.key()
+		pools = append(pools, PoolStatus{
+			Path:      key,
+			Depth:     len(p.getUnclaimedInvoices("")),
+			Target:    p.poolTarget(),
+			Refills:   clientPool.refills[key],
+			Failures:  clientPool.failures[key],
+			LastError: clientPool.errors[key],
+		})
+	}
+
+	sort.Slice(pools, func(a, b int) bool {
+		return pools[a].Path < pools[b].Path
+	})
+
+	return pools
+}
@@ -0,0 +1,84 @@
+package client_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/faurehu/lightauth/client"
+	"github.com/faurehu/lightauth/lightauthtest"
+	"github.com/faurehu/lightauth/server"
+	"github.com/faurehu/lightauth/simnet"
+)
+
+var startPool sync.Once
+
+// TestPoolUnderLoad refills the pool of a discrete path while requests claim its invoices. It is
+// meant to be run with -race.
+func TestPoolUnderLoad(t *testing.T) {
+	if _, err := lightauthtest.WriteConformanceConfig(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	network := simnet.New(1 << 40)
+	if err := server.StartWithBackend(simnet.NewMemoryProvider(), network); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.StartWithBackend(simnet.NewMemoryProvider(), network); err != nil {
+		t.Fatal(err)
+	}
+	// The workers of a previous run are still going, like the client and the server are
+	startPool.Do(func() { client.StartPool(2) })
+
+	handler := func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") }
+	live := httptest.NewServer(http.HandlerFunc(server.Middleware(handler)))
+	defer live.Close()
+	url := live.URL + strings.TrimPrefix(lightauthtest.ConformanceDiscreteRoute, http.MethodGet)
+
+	// The first request makes the path known, so the pool has something to refill
+	if err := get(url); err != nil {
+		t.Fatal(err)
+	}
+
+	// The route holds two invoices at a time, so some of the requests find nothing left to claim
+	var wg sync.WaitGroup
+	var served int64
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 4; j++ {
+				if err := get(url); err == nil {
+					atomic.AddInt64(&served, 1)
+				}
+				client.Pools()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if served == 0 {
+		t.Error("no request was served while the pool was refilled")
+	}
+}
+
+func get(url string) error {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	_, err = io.Copy(ioutil.Discard, response.Body)
+	return err
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/faurehu/lightauth/core"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// storeDeferredInvoices keeps the invoices a server issued for the results of past requests, to be
+// paid before the next request to the path.
+func (p *Path) storeDeferredInvoices(ctx context.Context, h http.Header) {
+	jsonData := []JSONInvoice{}
+	header := core.ReadHeader(h, core.HeaderDeferredInvoices)
+	if header == "" {
+		return
+	}
+
+	if err := checkInvoicesHeader(header, 0); err != nil {
+		log.Printf("Lightauth error: Rejected deferred invoices sent by the server: %v\n", err)
+		return
+	}
+
+	if err := json.Unmarshal([]byte(header), &jsonData); err != nil {
+		log.Printf("Lightauth error: Could not decode header data: %v\n", err)
+		return
+	}
+
+	for _, v := range jsonData {
+		payReq, err := decodePaymentRequest(ctx, v.PaymentRequest)
+		if err != nil {
+			continue
+		}
+
+		if err := validateDeferredInvoice(payReq, v.PaymentRequest); err != nil {
+			log.Printf("Lightauth error: Rejected deferred invoice sent by the server: %v\n", err)
+			continue
+		}
+
+		paymentHash, err := hex.DecodeString(payReq.PaymentHash)
+		if err != nil {
+			continue
+		}
+
+		i := &Invoice{
+			PaymentRequest: v.PaymentRequest,
+			Fee:            int(payReq.NumSatoshis),
+			PaymentHash:    paymentHash,
+			Description:    payReq.Description,
+			ExpirationTime: time.Unix(payReq.Timestamp+payReq.Expiry, 0),
+			Deferred:       true,
+			Path:           p,
+		}
+		if p.addInvoice(i) {
+			i.save()
+		}
+	}
+}
+
+// validateDeferredInvoice checks that a deferred invoice is one we are willing to pay. Its amount is
+// whatever the results cost, up to Payments.MaxDeferred when it is set.
+func validateDeferredInvoice(payReq *lnrpc.PayReq, paymentRequest string) error {
+	if payReq.NumSatoshis <= 0 {
+		return errors.New("Lightauth error: deferred invoice has no amount")
+	}
+
+	if paymentConfig.MaxDeferred != 0 && payReq.NumSatoshis > int64(paymentConfig.MaxDeferred) {
+		return errors.New("Lightauth error: deferred invoice amount is above Payments.MaxDeferred")
+	}
+
+	return validateInvoice(payReq, paymentRequest, int(payReq.NumSatoshis))
+}
+
+// payDeferredInvoices pays the invoices for past results of a path, as the server won't take another
+// request until they are. Those that expired are dropped, the server sends new ones.
+func (p *Path) payDeferredInvoices(ctx context.Context) error {
+	for _, v := range p.invoices() {
+		if !v.Deferred || v.isSettled() {
+			continue
+		}
+
+		if v.isExpired() {
+			p.removeInvoice(v)
+			continue
+		}
+
+		err := payInvoice(ctx, v)
+		if err != nil && !errors.Is(err, ErrInvoiceLeased) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/faurehu/lightauth"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+var rebalanceHook func(amount int64) error
+
+// SetRebalanceHook registers a function that is called when the preflight check finds the local balance
+// too low to pay for a route. It receives the missing amount in satoshis and should return once the
+// node's channels have been topped up.
+func SetRebalanceHook(hook func(amount int64) error) {
+	rebalanceHook = hook
+}
+
+func localBalance(ctx context.Context) (int64, error) {
+	balance, err := clientBackend.ChannelBalance(ctx)
+	if err != nil {
+		log.Printf("Lightauth error: Could not fetch channel balance: %v\n", err)
+		return 0, err
+	}
+
+	return balance, nil
+}
+
+// preflightPayment checks that the node has the balance and a route to pay an invoice before trying to pay it
+func preflightPayment(ctx context.Context, i *Invoice) error {
+	payReq, err := decodePaymentRequest(ctx, i.PaymentRequest)
+	if err != nil {
+		return err
+	}
+
+	ctxb, cancel := lightauth.RPCContext(ctx)
+	defer cancel()
+
+	amount := payReq.NumSatoshis + int64(paymentConfig.FeeLimit)
+	balance, err := localBalance(ctxb)
+	if err != nil {
+		return err
+	}
+
+	if balance < amount && rebalanceHook != nil {
+		if err := rebalanceHook(amount - balance); err != nil {
+			log.Printf("Lightauth error: Rebalance hook failed: %v\n", err)
+		} else if balance, err = localBalance(ctxb); err != nil {
+			return err
+		}
+	}
+
+	if balance < amount {
+		return fmt.Errorf("%w: %d sats available in channels, %d sats needed", lightauth.ErrInsufficientFunds, balance, amount)
+	}
+
+	routes, err := clientBackend.QueryRoutes(ctxb, &lnrpc.QueryRoutesRequest{
+		PubKey:     payReq.Destination,
+		Amt:        payReq.NumSatoshis,
+		RouteHints: payReq.RouteHints,
+	})
+	if err != nil || len(routes.Routes) == 0 {
+		return fmt.Errorf("%w: %s can't be reached for %d sats", lightauth.ErrNoRoute, payReq.Destination, payReq.NumSatoshis)
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Preload negotiates the paths of the given URLs at once, so the first requests to them don't wait for
+// the initial request that fetches their token, fee and mode. Paths the client already knows are left
+// alone. The errors of the URLs that could not be negotiated are joined in the result, the others are
+// stored all the same.
+func Preload(urls []string) error {
+	if err := clientStarted(); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	paths := make([]*Path, len(urls))
+	errs := make([]error, len(urls))
+	for k, u := range urls {
+		request, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			errs[k] = err
+			continue
+		}
+
+		if _, exists := lookupPath(request.URL, request.Host, request.Header); exists {
+			continue
+		}
+
+		wg.Add(1)
+		go func(k int, request *http.Request) {
+			defer wg.Done()
+			paths[k], errs[k] = negotiatePath(request, "")
+		}(k, request)
+	}
+	wg.Wait()
+
+	var failures []string
+	for k, p := range paths {
+		if errs[k] != nil {
+			failures = append(failures, fmt.Sprintf("%v: %v", urls[k], errs[k]))
+			continue
+		}
+
+		if p != nil {
+			storePath(p)
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("Lightauth error: could not preload paths: %v", strings.Join(failures, "; "))
+	}
+
+	return nil
+}
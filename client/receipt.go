@@ -0,0 +1,66 @@
+package client
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+)
+
+// FetchReceipt asks the ReceiptHandler at receiptURL for the receipt of an invoice paid by the client
+func FetchReceipt(ctx context.Context, receiptURL string, paymentHash []byte) (*core.SignedReceipt, error) {
+	i, invoiceExists := clientInvoices.Get(hex.EncodeToString(paymentHash))
+	if !invoiceExists || !i.isSettled() {
+		return nil, errors.New("Lightauth error: no settled invoice with this payment hash")
+	}
+
+	form := url.Values{}
+	form.Set("payment_hash", hex.EncodeToString(paymentHash))
+	form.Set("preimage", hex.EncodeToString(i.PreImage))
+
+	request, err := http.NewRequest("GET", receiptURL+"?"+form.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := httpClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, readErrorResponse(response, "")
+	}
+
+	receipt := &core.SignedReceipt{}
+	if err := json.NewDecoder(response.Body).Decode(receipt); err != nil {
+		return nil, err
+	}
+
+	return receipt, nil
+}
+
+// VerifyReceipt returns the public key of the node that signed the receipt. Callers must check that it
+// is the key of the server they paid.
+func VerifyReceipt(ctx context.Context, receipt *core.SignedReceipt) (string, error) {
+	message, err := core.ReceiptMessage(receipt.Receipt)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := lightauth.RPCContext(ctx)
+	defer cancel()
+
+	signer, err := clientBackend.VerifyMessage(ctx, message, receipt.Signature)
+	if err != nil || signer == "" {
+		return "", errors.New("Lightauth error: invalid receipt signature")
+	}
+
+	return signer, nil
+}
@@ -0,0 +1,294 @@
+package client
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+)
+
+// rESERVEPOLL is how often a goroutine waiting for a credential checks whether one has been paid for
+const rESERVEPOLL = 10 * time.Millisecond
+
+// ErrCredentialUsed is returned when applying a credential that has been consumed or released
+var ErrCredentialUsed = errors.New("Lightauth error: the credential has already been used")
+
+// Credential is what pays for one request to a path, reserved for the goroutine that asked for it: the
+// paid invoices of a request in discrete mode, or the period paid for in time mode. It has to be
+// consumed once the request has been served, or released if it is not sent, so no other goroutine gets
+// the same invoices in the meantime.
+type Credential struct {
+	mux      sync.Mutex
+	path     *Path
+	invoices []*Invoice
+	used     bool
+}
+
+// PathFor returns the path a request goes to, asking the server for its prices first if the client
+// doesn't know it yet.
+func PathFor(request *http.Request) (*Path, error) {
+	if err := clientStarted(); err != nil {
+		return nil, err
+	}
+
+	if p, exists := lookupPath(request.URL, request.Host, request.Header); exists {
+		return p, nil
+	}
+
+	fingerprint, err := core.RequestFingerprint(request)
+	if err != nil {
+		return nil, err
+	}
+
+	return fetchPath(request, fingerprint)
+}
+
+// take reserves a paid invoice for this goroutine for the given time, returning false if it has been
+// claimed or is reserved by another goroutine or process.
+func (i *Invoice) take(d time.Duration) bool {
+	i.mux.Lock()
+	t := time.Now()
+	if i.Claimed || i.reservedUntil.After(t) {
+		i.mux.Unlock()
+		return false
+	}
+	i.reservedUntil = t.Add(d)
+	i.mux.Unlock()
+
+	lease, leased := i.acquireLease(d)
+	if !leased {
+		i.give()
+		return false
+	}
+
+	i.mux.Lock()
+	i.lease = lease
+	i.mux.Unlock()
+
+	return true
+}
+
+// give hands back an invoice taken by this goroutine
+func (i *Invoice) give() {
+	i.mux.Lock()
+	lease := i.lease
+	i.lease = ""
+	i.reservedUntil = time.Time{}
+	i.mux.Unlock()
+
+	i.releaseLease(lease)
+}
+
+// takeBundle takes as many paid invoices as a request to the path claims, or none if there aren't enough
+func (p *Path) takeBundle(fingerprint string) []*Invoice {
+	bundle := []*Invoice{}
+	for _, v := range p.invoices() {
+		if len(bundle) == p.invoicesPerRequest() {
+			break
+		}
+
+		if v.isSettled() && !v.Deferred && v.Fingerprint == fingerprint && v.take(cLAIMLEASE) {
+			bundle = append(bundle, v)
+		}
+	}
+
+	if len(bundle) != p.invoicesPerRequest() {
+		// Not enough paid invoices for a request, leave them for the next one
+		for _, v := range bundle {
+			v.give()
+		}
+
+		return nil
+	}
+
+	return bundle
+}
+
+// ReserveCredential waits for the credential of one request to the path and reserves it for the
+// caller. Goroutines get credentials in the order they asked for them, and each one pays for the
+// invoices it needs when there are no paid invoices left. It gives up when ctx is done. Paths binding
+// their invoices to requests can't have credentials reserved ahead of the requests.
+func (p *Path) ReserveCredential(ctx context.Context) (*Credential, error) {
+	if err := clientStarted(); err != nil {
+		return nil, err
+	}
+
+	if p.BindRequest {
+		return nil, errors.New("Lightauth error: the invoices of the path are bound to requests")
+	}
+
+	// Waiting goroutines are served one at a time, in order
+	p.mux.Lock()
+	if p.turn == nil {
+		p.turn = make(chan struct{}, 1)
+		p.turn <- struct{}{}
+	}
+	turn := p.turn
+	p.mux.Unlock()
+
+	select {
+	case <-turn:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() {
+		turn <- struct{}{}
+	}()
+
+	if err := p.payDeferredInvoices(ctx); err != nil {
+		return nil, err
+	}
+
+	paid := false
+	for {
+		if p.Mode == core.ModeTime && p.canRequest("") {
+			return &Credential{path: p}, nil
+		}
+
+		if p.Mode == core.ModeDiscrete {
+			if bundle := p.takeBundle(""); bundle != nil {
+				clientPool.queue(p)
+				return &Credential{path: p, invoices: bundle}, nil
+			}
+		}
+
+		if !paid {
+			if err := p.payNext(ctx); err != nil {
+				return nil, err
+			}
+			paid = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(rESERVEPOLL):
+			// The payment settles in the background
+			paid = paid && p.payableSoon()
+		}
+	}
+}
+
+// payNext pays for one of the invoices of the path, asking the server for more if it has none left
+func (p *Path) payNext(ctx context.Context) error {
+	p.discardExpiringInvoices()
+	if !p.hasPayableInvoices("") {
+		if p.LNURL != "" {
+			i, err := fetchLNURLInvoice(ctx, p)
+			if err != nil {
+				return err
+			}
+
+			return payInvoice(ctx, i)
+		}
+
+		if err := refreshPath(ctx, p); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range p.invoices() {
+		if !v.isSettled() && !v.isExpired() && !v.Deferred && v.Fingerprint == "" {
+			err := payInvoice(ctx, v)
+			if errors.Is(err, ErrInvoiceLeased) {
+				continue
+			}
+
+			return err
+		}
+	}
+
+	return errors.New("Lightauth error: the server has no invoices to pay")
+}
+
+// payableSoon tells whether a payment is still on its way for the path: another goroutine or process
+// holds one of its unpaid invoices.
+func (p *Path) payableSoon() bool {
+	for _, v := range p.invoices() {
+		v.mux.Lock()
+		leased := !v.Settled && v.LeaseOwner != "" && v.LeaseExpiration.After(time.Now())
+		v.mux.Unlock()
+
+		if leased {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Apply sets the headers that make a request pay with the credential
+func (c *Credential) Apply(request *http.Request) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.used {
+		return ErrCredentialUsed
+	}
+
+	request.Header.Set(core.HeaderToken, c.path.Token)
+	if len(c.invoices) > 0 {
+		nonce, err := lightauth.NewNonce()
+		if err != nil {
+			return err
+		}
+
+		preImages := make([]string, len(c.invoices))
+		for k, v := range c.invoices {
+			preImages[k] = hex.EncodeToString(v.PreImage)
+		}
+
+		request.Header.Set(core.HeaderPreImage, strings.Join(preImages, ","))
+		request.Header.Set(core.HeaderInvoice, paymentRequests(c.invoices))
+		request.Header.Set(core.HeaderNonce, nonce)
+	}
+
+	if signRequests {
+		return signRequest(request)
+	}
+
+	return nil
+}
+
+// Consume records that the request the credential was applied to has been served, so its invoices are
+// never used again. ReadResponse does it too when given the response of the request.
+func (c *Credential) Consume() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.used = true
+	for _, v := range c.invoices {
+		if v.isClaimed() {
+			continue
+		}
+
+		if err := v.claim(); err != nil {
+			return err
+		}
+		v.give()
+	}
+
+	return nil
+}
+
+// Release hands back the invoices of a credential whose request wasn't served, for another request to
+// use them.
+func (c *Credential) Release() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.used {
+		return
+	}
+
+	c.used = true
+	for _, v := range c.invoices {
+		v.give()
+	}
+}
@@ -0,0 +1,240 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/faurehu/lightauth"
+	"google.golang.org/grpc"
+)
+
+var (
+	clientStore    map[string]*Path
+	clientStoreMux sync.RWMutex
+	clientInvoices = lightauth.NewInvoiceIndex[*Invoice]()
+	clientBackend  lightauth.LightningBackend
+	clientDatabase DataProvider
+	signRequests   bool
+	paymentConfig  PaymentConfig
+	clientNetwork  string
+	httpClient     = http.DefaultClient
+)
+
+const (
+	dEFAULTFEELIMIT       = 10
+	dEFAULTPAYMENTTIMEOUT = 60
+	dEFAULTMAXPARTS       = 16
+	dEFAULTMAXRETRIES     = 2
+	dEFAULTMAXATTEMPTS    = 3
+)
+
+// DataProvider is an interface that specifies the methods required to store the data of the client
+type DataProvider interface {
+	lightauth.Store
+	GetClientData() (map[string]*Path, error)
+}
+
+// PaymentConfig details how the client pays invoices. FeeLimit is in satoshis and Timeout in seconds.
+// MaxRetries is the number of times a failed payment is retried, 2 when it isn't set and none when it
+// is 0. Fallbacks maps a class of payment failure (no_route, insufficient_balance, timeout,
+// incorrect_details or error) to the strategy used when it happens: fail, retry or raise_fee, on top
+// of the defaults of raising the fee when there is no route and retrying on timeouts. Preflight checks the node's
+// liquidity and routes before paying. MaxDeferred is the largest invoice in satoshis the client pays for
+// the results of a request to a PerResult route, with no limit when it is 0. MaxAttempts is the number of
+// times Do sends a request before giving up on it. PoolSize is the number of paid invoices kept ready for
+// each discrete path, paid for in the background by PoolWorkers workers, with no pool when it is 0.
+// BatchSize is the number of invoices the client asks servers for and pays at once, fewer than the
+// MaxInvoices of their routes, with the MaxInvoices of the routes when it is 0. Adaptive pays ahead
+// according to how long the payments of each path take to settle. InvoiceEncodings lists the encodings
+// of the invoices sent by servers the client reads, json, cbor, protobuf or those registered with
+// core.RegisterInvoiceCodec, by order of preference. Servers send JSON when it is empty.
+type PaymentConfig struct {
+	FeeLimit    int
+	Timeout     int
+	MaxParts    int
+	MaxRetries  *int
+	Fallbacks   map[string]string
+	Preflight   bool
+	MaxDeferred int
+	MaxAttempts int
+	PoolSize    int
+	PoolWorkers int
+	BatchSize   int
+	Adaptive    bool
+
+	InvoiceEncodings []string
+}
+
+// clientConfig holds the settings of the client on top of the shared ones
+type clientConfig struct {
+	lightauth.Config
+	SignRequests bool
+	Payments     PaymentConfig
+}
+
+// SetHTTPClient changes the client used for all the protocol traffic of the client side (negotiation,
+// invoice refreshes, paid requests and LNURL). Connections are reused across requests as long as the
+// client's transport allows it. http.DefaultClient is used by default, or a client going through the
+// configured Proxy if there is one.
+func SetHTTPClient(client *http.Client) {
+	httpClient = client
+}
+
+func readConfig() (clientConfig, error) {
+	var conf clientConfig
+	if err := lightauth.DecodeConfig(&conf); err != nil {
+		return conf, err
+	}
+
+	if err := lightauth.NewConfigError(conf.Validate()); err != nil {
+		return conf, err
+	}
+
+	return conf, nil
+}
+
+// StartConnection is used to initiate the connection with the LDN node on a client's behalf.
+// The node is the one of the Client section of lightauth.toml if there is one, so a process can be
+// client and server with different nodes. When the node is not lnd there is no connection to return
+// and the result is nil. Only the first successful call starts the client, later ones return the same
+// connection. When lightauth.toml can't be used, the error lists all of its problems as a ConfigError.
+func StartConnection(db DataProvider) (*grpc.ClientConn, error) {
+	return clientState.Start(func() (*grpc.ClientConn, error) {
+		conf, err := readConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := lightauth.NewConfigError(conf.validateRole()); err != nil {
+			return nil, err
+		}
+
+		backend, conn, err := startBackend(conf.Node(conf.Client), conf)
+		if err != nil {
+			return nil, fmt.Errorf("Lightauth error: Failed to start client: %v", err)
+		}
+
+		clientBackend = backend
+		if err := startClient(db, conf); err != nil {
+			return nil, err
+		}
+
+		return conn, nil
+	})
+}
+
+// startBackend connects to the node of the client, which can also be a wallet. The gRPC connection is
+// only returned for lnd.
+func startBackend(node lightauth.NodeConfig, conf clientConfig) (lightauth.LightningBackend, *grpc.ClientConn, error) {
+	payer, err := walletPayer(node)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if payer != nil {
+		return NewPayerBackend(conf.Network, payer), nil, nil
+	}
+
+	return lightauth.StartBackend(node, conf.Config)
+}
+
+// StartWithBackend starts the client on top of the given Lightning backend instead of connecting to
+// lnd. The rest of the configuration is still read from lightauth.toml. Only the first start of the
+// client does anything.
+func StartWithBackend(db DataProvider, backend lightauth.LightningBackend) error {
+	_, err := clientState.Start(func() (*grpc.ClientConn, error) {
+		conf, err := readConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		clientBackend = backend
+		return nil, startClient(db, conf)
+	})
+
+	return err
+}
+
+func startClient(db DataProvider, conf clientConfig) error {
+	if err := lightauth.NewConfigError(conf.validatePayments()); err != nil {
+		return err
+	}
+
+	db, err := sealRecords(db, conf.EncryptionKeyFile)
+	if err != nil {
+		return fmt.Errorf("Lightauth error: Failed to start client: %v", err)
+	}
+
+	clientDatabase = db
+	lightauth.StartPersistence(conf.Persistence)
+
+	signRequests = conf.SignRequests
+	strictMode = conf.Strict
+
+	if conf.Proxy != "" && httpClient == http.DefaultClient {
+		proxyClient, err := lightauth.ProxyHTTPClient(conf.Proxy)
+		if err != nil {
+			return fmt.Errorf("Lightauth error: Failed to start client: %v", err)
+		}
+
+		httpClient = proxyClient
+	}
+
+	clientNetwork, err = lightauth.CheckNetwork(clientBackend, conf.Network)
+	if err != nil {
+		return fmt.Errorf("Lightauth error: Failed to start client: %v", err)
+	}
+
+	stored, err := db.GetClientData()
+	if err != nil {
+		return fmt.Errorf("Lightauth error: could not fetch data from store: %v", err)
+	}
+	// Whatever the store keys them by, paths are looked up by origin and path
+	paths := make(map[string]*Path)
+	clientStoreMux.Lock()
+	for _, p := range stored {
+		paths[p.key()] = p
+		if len(p.Varies) > 0 {
+			pathVaries[p.base()] = p.Varies
+		}
+	}
+	clientStore = paths
+	clientStoreMux.Unlock()
+
+	for _, p := range paths {
+		for _, i := range p.Invoices {
+			i.Path = p
+			clientInvoices.Add(i.PaymentHash, i)
+		}
+	}
+
+	paymentConfig = conf.Payments
+	if paymentConfig.FeeLimit == 0 {
+		paymentConfig.FeeLimit = dEFAULTFEELIMIT
+	}
+	if paymentConfig.Timeout == 0 {
+		paymentConfig.Timeout = dEFAULTPAYMENTTIMEOUT
+	}
+	if paymentConfig.MaxParts == 0 {
+		paymentConfig.MaxParts = dEFAULTMAXPARTS
+	}
+	if paymentConfig.MaxAttempts == 0 {
+		paymentConfig.MaxAttempts = dEFAULTMAXATTEMPTS
+	}
+	fallbacks := make(map[string]string)
+	for class, action := range defaultFallbacks {
+		fallbacks[class] = action
+	}
+	for class, action := range conf.Payments.Fallbacks {
+		fallbacks[class] = action
+	}
+	paymentConfig.Fallbacks = fallbacks
+
+	// Payments sent before the client last stopped may have bought credit we don't know about
+	reconcileIntents(context.Background())
+	startPool()
+
+	return nil
+}
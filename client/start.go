@@ -0,0 +1,41 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/faurehu/lightauth"
+)
+
+var (
+	clientState  = &lightauth.StartState{}
+	autoStartMux sync.Mutex
+	autoStartDB  DataProvider
+)
+
+// SetAutoStart makes the client start itself with StartConnection and the given store the first
+// time it is used without having been started, instead of failing with ErrNotStarted. When the client
+// can't be started, the call that needed it fails with the error StartConnection returned.
+func SetAutoStart(db DataProvider) {
+	autoStartMux.Lock()
+	defer autoStartMux.Unlock()
+
+	autoStartDB = db
+}
+
+// clientStarted makes sure the client has been started, starting it if auto start is set
+func clientStarted() error {
+	if clientState.IsStarted() {
+		return nil
+	}
+
+	autoStartMux.Lock()
+	db := autoStartDB
+	autoStartMux.Unlock()
+
+	if db == nil {
+		return &lightauth.NotStartedError{Side: "client"}
+	}
+
+	_, err := StartConnection(db)
+	return err
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+)
+
+// strictMode turns the values lightauth would otherwise ignore or replace with a default into errors,
+// set with Strict in lightauth.toml
+var strictMode bool
+
+// checkResponseHeaders checks the Light-Auth headers of a response in strict mode
+func checkResponseHeaders(h http.Header) error {
+	if !strictMode {
+		return nil
+	}
+
+	params, _ := core.ParseHeader(h)
+	if params["version"] != core.ProtocolVersion {
+		return &lightauth.StrictError{Field: core.Header + " version", Value: params["version"]}
+	}
+
+	if result := core.Result(params["result"]); result != "" && result != core.ResultOK && result != core.ResultError {
+		return &lightauth.StrictError{Field: core.Header + " result", Value: string(result)}
+	}
+
+	// Responses to requests for no route, or rejected before their route was known, have no mode
+	mode := core.Mode(core.ReadHeader(h, core.HeaderMode))
+	if mode != "" && !routeModes[mode] {
+		return &lightauth.StrictError{Field: core.HeaderMode, Value: string(mode)}
+	}
+
+	if period := core.Period(core.ReadHeader(h, core.HeaderTimePeriod)); mode == core.ModeTime && !routePeriods[period] {
+		return &lightauth.StrictError{Field: core.HeaderTimePeriod, Value: string(period)}
+	}
+
+	counts := map[string]int{
+		core.HeaderFee:                1,
+		core.HeaderMaxInvoices:        1,
+		core.HeaderInvoicesPerRequest: 1,
+		core.HeaderCredit:             0,
+		core.HeaderExpiresIn:          0,
+		core.HeaderInvoiceRemaining:   0,
+		core.HeaderInvoicesTotal:      0,
+	}
+	for header, min := range counts {
+		if !core.IsCount(h, header, min) {
+			return &lightauth.StrictError{Field: header, Value: core.ReadHeader(h, header)}
+		}
+	}
+
+	if expirationTime := core.ReadHeader(h, core.HeaderExpirationTime); expirationTime != "" {
+		if _, err := time.Parse("2006-01-02T15:04:05Z07:00", expirationTime); err != nil {
+			return &lightauth.StrictError{Field: core.HeaderExpirationTime, Value: expirationTime}
+		}
+	}
+
+	if warning := core.Warning(core.ReadHeader(h, core.HeaderExpiryWarning)); warning != "" && warning != eXPIRYSOFT && warning != eXPIRYHARD {
+		return &lightauth.StrictError{Field: core.HeaderExpiryWarning, Value: string(warning)}
+	}
+
+	if encoding := core.ReadHeader(h, core.HeaderInvoicesEncoding); encoding != "" {
+		if _, known := core.LookupInvoiceCodec(encoding); !known {
+			return &lightauth.StrictError{Field: core.HeaderInvoicesEncoding, Value: encoding}
+		}
+	}
+
+	return nil
+}
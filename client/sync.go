@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+func (p *Path) isSynced() bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	return p.synced
+}
+
+func (p *Path) setSynced() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.synced = true
+}
+
+// syncPath checks what was stored for a path against the server before the first request made to it
+// since the client started, as the time or invoices paid for may have been used up meanwhile, by
+// another process or before a crash. The server's expiration time replaces ours, and the invoices it
+// has already taken are marked as claimed. Servers that don't answer the check are trusted to have
+// what we stored.
+func syncPath(ctx context.Context, request *http.Request, p *Path) error {
+	syncRequest, err := http.NewRequest(http.MethodHead, request.URL.Scheme+"://"+p.URL, nil)
+	if err != nil {
+		return err
+	}
+	syncRequest = syncRequest.WithContext(ctx)
+	syncRequest.Host = request.Host
+	syncRequest.Header.Set(core.HeaderToken, p.Token)
+	syncRequest.Header.Set(core.HeaderSync, "1")
+	setAcceptInvoicesHeader(syncRequest.Header)
+	core.AnnounceVersion(syncRequest.Header)
+
+	unclaimed := p.getUnclaimedInvoices("")
+	if len(unclaimed) > 0 {
+		syncRequest.Header.Set(core.HeaderInvoice, paymentRequests(unclaimed))
+	}
+
+	if signRequests {
+		if err := signRequest(syncRequest); err != nil {
+			return err
+		}
+	}
+
+	response, err := exchange(StepSync, syncRequest)
+	if err != nil {
+		return err
+	}
+	defer discardBody(response)
+
+	if core.ReadResult(response.Header) != core.ResultOK {
+		p.setSynced()
+		return nil
+	}
+
+	if err := checkResponseHeaders(response.Header); err != nil {
+		return err
+	}
+
+	if token := core.ReadHeader(response.Header, core.HeaderToken); token != "" && token != p.Token {
+		if err := p.setToken(token); err != nil {
+			return err
+		}
+	}
+
+	invoices, err := getInvoicesFromResponse(ctx, response.Header)
+	if err != nil {
+		return err
+	}
+	p.keepInvoices(invoices)
+
+	if p.Mode == core.ModeTime {
+		expirationTime, err := readExpirationTime(response.Header)
+		if err != nil {
+			return err
+		}
+
+		if err := p.setSyncExpirationTime(expirationTime); err != nil {
+			return err
+		}
+
+		if err := p.setLocalExpirationTime(expirationTime); err != nil {
+			return err
+		}
+	}
+
+	claimed := make(map[string]bool)
+	for _, paymentRequest := range strings.Split(core.ReadHeader(response.Header, core.HeaderClaimed), ",") {
+		claimed[paymentRequest] = true
+	}
+
+	for _, i := range unclaimed {
+		if claimed[i.PaymentRequest] {
+			if err := i.claim(); err != nil {
+				return err
+			}
+		}
+	}
+
+	p.setSynced()
+	return nil
+}
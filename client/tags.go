@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+type tagsKey struct{}
+
+// WithTag returns a context whose requests have their cost attributed to tag, like team=search, on top
+// of the tags ctx already has. ClearRequest and Do read the tags of the context of the request.
+func WithTag(ctx context.Context, tag string) context.Context {
+	tags := append(append([]string{}, Tags(ctx)...), tag)
+	return context.WithValue(ctx, tagsKey{}, tags)
+}
+
+// Tags returns the tags of a context
+func Tags(ctx context.Context) []string {
+	tags, _ := ctx.Value(tagsKey{}).([]string)
+	return tags
+}
+
+// TagSpend is what the requests with a tag have cost since the client started, in millisatoshis paid
+// to the servers and in routing fees, over Payments invoices. Requests without tags are counted under
+// the empty tag.
+type TagSpend struct {
+	Tag        string `json:"tag"`
+	AmountMsat int64  `json:"amount_msat"`
+	FeesMsat   int64  `json:"fees_msat"`
+	Payments   int    `json:"payments"`
+}
+
+// spendLedger adds up the spend of each tag
+var spendLedger = struct {
+	mux   sync.Mutex
+	spend map[string]*TagSpend
+}{spend: make(map[string]*TagSpend)}
+
+// recordSpend attributes an invoice paid for a request to each of the tags of its context
+func recordSpend(ctx context.Context, amountMsat int64, feesMsat int64) {
+	tags := Tags(ctx)
+	if len(tags) == 0 {
+		tags = []string{""}
+	}
+
+	spendLedger.mux.Lock()
+	defer spendLedger.mux.Unlock()
+
+	for _, tag := range tags {
+		s, exists := spendLedger.spend[tag]
+		if !exists {
+			s = &TagSpend{Tag: tag}
+			spendLedger.spend[tag] = s
+		}
+
+		s.AmountMsat += amountMsat
+		s.FeesMsat += feesMsat
+		s.Payments++
+	}
+}
+
+// recordPayment attributes a payment to the request it was made for. Invoices of discrete paths are
+// paid ahead, by the pool for instance, so they are attributed to the request that claims them instead.
+func recordPayment(ctx context.Context, i *Invoice, amountMsat int64, feesMsat int64) {
+	i.mux.Lock()
+	i.routingFeeMsat = feesMsat
+	deferred := i.Deferred
+	if amountMsat == 0 {
+		// Not every backend reports the amount it paid
+		amountMsat = int64(i.Fee) * 1000
+	}
+	i.mux.Unlock()
+
+	if deferred || i.Path.Mode == core.ModeTime {
+		recordSpend(ctx, amountMsat, feesMsat)
+	}
+}
+
+// recordClaims attributes the invoices of a bundle to the request claiming them
+func recordClaims(ctx context.Context, bundle []*Invoice) {
+	for _, i := range bundle {
+		i.mux.Lock()
+		amountMsat, feesMsat := int64(i.Fee)*1000, i.routingFeeMsat
+		i.mux.Unlock()
+
+		recordSpend(ctx, amountMsat, feesMsat)
+	}
+}
+
+// SpendByTag returns what the requests of each tag have cost since the client started, sorted by tag. A
+// request with several tags counts fully towards each of them.
+func SpendByTag() []TagSpend {
+	spendLedger.mux.Lock()
+	defer spendLedger.mux.Unlock()
+
+	spend := []TagSpend{}
+	for _, s := range spendLedger.spend {
+		spend = append(spend, *s)
+	}
+
+	sort.Slice(spend, func(a, b int) bool {
+		return spend[a].Tag < spend[b].Tag
+	})
+
+	return spend
+}
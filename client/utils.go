@@ -0,0 +1,13 @@
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// discardBody drains and closes a response body so its connection can be reused
+func discardBody(r *http.Response) {
+	io.Copy(ioutil.Discard, r.Body)
+	r.Body.Close()
+}
@@ -0,0 +1,27 @@
+package client
+
+import (
+	"errors"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// validateInvoice checks that an invoice sent by a server is one we are willing to store and pay
+func validateInvoice(payReq *lnrpc.PayReq, paymentRequest string, fee int) error {
+	if payReq.NumSatoshis != int64(fee) {
+		return errors.New("Lightauth error: invoice amount does not match the route fee")
+	}
+
+	if !time.Unix(payReq.Timestamp+payReq.Expiry, 0).After(time.Now()) {
+		return errors.New("Lightauth error: invoice has already expired")
+	}
+
+	if clientNetwork != "" && core.InvoiceNetwork(paymentRequest) != clientNetwork {
+		return lightauth.ErrWrongNetwork
+	}
+
+	return nil
+}
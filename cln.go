@@ -0,0 +1,463 @@
+package lightauth
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+)
+
+// Error codes of Core Lightning's pay command
+const (
+	cLNROUTENOTFOUND     = 205
+	cLNROUTETOOEXPENSIVE = 206
+	cLNINVOICEEXPIRED    = 207
+	cLNPAYMENTTIMEOUT    = 210
+)
+
+// clnBackend talks to Core Lightning through the JSON-RPC socket of lightningd. Every call gets its
+// own connection, so a blocking waitanyinvoice doesn't hold the others back.
+type clnBackend struct {
+	socket       string
+	mux          sync.Mutex
+	indexed      bool
+	lastPayIndex uint64
+	requestID    uint64
+}
+
+// NewCLNBackend returns a LightningBackend for the Core Lightning node listening on the given
+// lightning-rpc socket, usually ~/.lightning/bitcoin/lightning-rpc.
+func NewCLNBackend(socket string) LightningBackend {
+	return &clnBackend{socket: socket}
+}
+
+// clnError is the error of a JSON-RPC call
+type clnError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *clnError) Error() string {
+	return fmt.Sprintf("Lightauth error: lightningd error %v: %v", e.Code, e.Message)
+}
+
+func (b *clnBackend) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", b.socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Unblock the call when the context is cancelled without a deadline
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	request := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      atomic.AddUint64(&b.requestID, 1),
+		"method":  method,
+		"params":  params,
+	}
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return err
+	}
+
+	response := struct {
+		Result json.RawMessage `json:"result"`
+		Error  *clnError       `json:"error"`
+	}{}
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	if response.Error != nil {
+		return response.Error
+	}
+
+	return json.Unmarshal(response.Result, result)
+}
+
+// clnMsat is an amount in millisatoshis, which older versions of lightningd send as "1000msat"
+type clnMsat int64
+
+func (m *clnMsat) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		v, err := strconv.ParseInt(strings.TrimSuffix(s, "msat"), 10, 64)
+		*m = clnMsat(v)
+		return err
+	}
+
+	var v int64
+	err := json.Unmarshal(b, &v)
+	*m = clnMsat(v)
+	return err
+}
+
+// clnNetworks translates the network names of lightningd to the ones of lnd
+var clnNetworks = map[string]string{
+	"bitcoin": "mainnet",
+	"testnet": "testnet",
+	"regtest": "regtest",
+	"signet":  "signet",
+}
+
+func (b *clnBackend) GetInfo(ctx context.Context) (*lnrpc.GetInfoResponse, error) {
+	info := struct {
+		ID                    string `json:"id"`
+		Alias                 string `json:"alias"`
+		Network               string `json:"network"`
+		BlockHeight           uint32 `json:"blockheight"`
+		WarningBitcoindSync   string `json:"warning_bitcoind_sync"`
+		WarningLightningdSync string `json:"warning_lightningd_sync"`
+	}{}
+	if err := b.call(ctx, "getinfo", map[string]interface{}{}, &info); err != nil {
+		return nil, err
+	}
+
+	network, known := clnNetworks[info.Network]
+	if !known {
+		network = info.Network
+	}
+
+	return &lnrpc.GetInfoResponse{
+		IdentityPubkey: info.ID,
+		Alias:          info.Alias,
+		BlockHeight:    info.BlockHeight,
+		SyncedToChain:  info.WarningBitcoindSync == "" && info.WarningLightningdSync == "",
+		Chains:         []*lnrpc.Chain{{Chain: "bitcoin", Network: network}},
+	}, nil
+}
+
+// AddInvoice labels invoices with a random nonce, as lightningd requires unique labels. Route hints
+// can't be given to lightningd, which adds its own for private channels when Private is set.
+func (b *clnBackend) AddInvoice(ctx context.Context, invoice *lnrpc.Invoice) (*lnrpc.AddInvoiceResponse, error) {
+	label, err := NewNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	params := map[string]interface{}{
+		"amount_msat":           invoice.Value * 1000,
+		"label":                 "lightauth-" + label,
+		"description":           invoice.Memo,
+		"exposeprivatechannels": invoice.Private,
+	}
+	if invoice.Expiry != 0 {
+		params["expiry"] = invoice.Expiry
+	}
+
+	created := struct {
+		PaymentHash string `json:"payment_hash"`
+		Bolt11      string `json:"bolt11"`
+	}{}
+	if err := b.call(ctx, "invoice", params, &created); err != nil {
+		return nil, err
+	}
+
+	rHash, err := hex.DecodeString(created.PaymentHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lnrpc.AddInvoiceResponse{RHash: rHash, PaymentRequest: created.Bolt11}, nil
+}
+
+// clnInvoiceStream waits for the payments of invoices one at a time with waitanyinvoice
+type clnInvoiceStream struct {
+	ctx     context.Context
+	backend *clnBackend
+}
+
+// SubscribeInvoices starts from the last payment the node had when the backend first subscribed, and
+// later subscriptions resume where the previous one stopped so no payment is missed.
+func (b *clnBackend) SubscribeInvoices(ctx context.Context) (InvoiceStream, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if !b.indexed {
+		invoices := struct {
+			Invoices []struct {
+				PayIndex uint64 `json:"pay_index"`
+			} `json:"invoices"`
+		}{}
+		if err := b.call(ctx, "listinvoices", map[string]interface{}{}, &invoices); err != nil {
+			return nil, err
+		}
+
+		for _, i := range invoices.Invoices {
+			if i.PayIndex > b.lastPayIndex {
+				b.lastPayIndex = i.PayIndex
+			}
+		}
+		b.indexed = true
+	}
+
+	return &clnInvoiceStream{ctx: ctx, backend: b}, nil
+}
+
+// payIndex is the index of the last payment the streams of the backend have seen
+func (b *clnBackend) payIndex() uint64 {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	return b.lastPayIndex
+}
+
+// seePayment moves the index of the backend past a payment received on one of its streams
+func (b *clnBackend) seePayment(payIndex uint64) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if payIndex > b.lastPayIndex {
+		b.lastPayIndex = payIndex
+	}
+}
+
+func (s *clnInvoiceStream) Recv() (*lnrpc.Invoice, error) {
+	paid := struct {
+		PaymentHash string  `json:"payment_hash"`
+		Bolt11      string  `json:"bolt11"`
+		Status      string  `json:"status"`
+		PayIndex    uint64  `json:"pay_index"`
+		Preimage    string  `json:"payment_preimage"`
+		Received    clnMsat `json:"amount_received_msat"`
+	}{}
+	params := map[string]interface{}{"lastpay_index": s.backend.payIndex()}
+	if err := s.backend.call(s.ctx, "waitanyinvoice", params, &paid); err != nil {
+		return nil, err
+	}
+
+	s.backend.seePayment(paid.PayIndex)
+
+	rHash, err := hex.DecodeString(paid.PaymentHash)
+	if err != nil {
+		return nil, err
+	}
+
+	rPreimage, err := hex.DecodeString(paid.Preimage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lnrpc.Invoice{
+		RHash:          rHash,
+		RPreimage:      rPreimage,
+		PaymentRequest: paid.Bolt11,
+		Settled:        paid.Status == "paid",
+		State:          lnrpc.Invoice_SETTLED,
+		AmtPaidMsat:    int64(paid.Received),
+	}, nil
+}
+
+func (b *clnBackend) LookupInvoice(ctx context.Context, rHash []byte) (*lnrpc.Invoice, error) {
+	found := struct {
+		Invoices []struct {
+			Bolt11 string `json:"bolt11"`
+			Status string `json:"status"`
+		} `json:"invoices"`
+	}{}
+	params := map[string]interface{}{"payment_hash": hex.EncodeToString(rHash)}
+	if err := b.call(ctx, "listinvoices", params, &found); err != nil {
+		return nil, err
+	}
+
+	if len(found.Invoices) == 0 {
+		return nil, errors.New("Lightauth error: invoice not found")
+	}
+
+	invoice := &lnrpc.Invoice{RHash: rHash, PaymentRequest: found.Invoices[0].Bolt11}
+	if found.Invoices[0].Status == "paid" {
+		invoice.Settled = true
+		invoice.State = lnrpc.Invoice_SETTLED
+	}
+
+	return invoice, nil
+}
+
+func (b *clnBackend) DecodePayReq(ctx context.Context, payReq string) (*lnrpc.PayReq, error) {
+	decoded := struct {
+		Payee       string  `json:"payee"`
+		PaymentHash string  `json:"payment_hash"`
+		Amount      clnMsat `json:"amount_msat"`
+		CreatedAt   int64   `json:"created_at"`
+		Expiry      int64   `json:"expiry"`
+		Description string  `json:"description"`
+		CltvExpiry  int64   `json:"min_final_cltv_expiry"`
+	}{}
+	if err := b.call(ctx, "decodepay", map[string]interface{}{"bolt11": payReq}, &decoded); err != nil {
+		return nil, err
+	}
+
+	return &lnrpc.PayReq{
+		Destination: decoded.Payee,
+		PaymentHash: decoded.PaymentHash,
+		NumSatoshis: int64(decoded.Amount) / 1000,
+		NumMsat:     int64(decoded.Amount),
+		Timestamp:   decoded.CreatedAt,
+		Expiry:      decoded.Expiry,
+		Description: decoded.Description,
+		CltvExpiry:  decoded.CltvExpiry,
+	}, nil
+}
+
+// SendPayment translates the errors of pay into the failure reasons of lnd
+func (b *clnBackend) SendPayment(ctx context.Context, request *routerrpc.SendPaymentRequest) (*lnrpc.Payment, error) {
+	params := map[string]interface{}{
+		"bolt11": request.PaymentRequest,
+		"maxfee": request.FeeLimitSat * 1000,
+	}
+	if request.TimeoutSeconds != 0 {
+		params["retry_for"] = request.TimeoutSeconds
+	}
+
+	paid := struct {
+		PaymentHash string  `json:"payment_hash"`
+		Preimage    string  `json:"payment_preimage"`
+		Status      string  `json:"status"`
+		Amount      clnMsat `json:"amount_msat"`
+		AmountSent  clnMsat `json:"amount_sent_msat"`
+	}{}
+	err := b.call(ctx, "pay", params, &paid)
+
+	payment := &lnrpc.Payment{PaymentRequest: request.PaymentRequest, Status: lnrpc.Payment_FAILED}
+	if rpcErr, ok := err.(*clnError); ok {
+		switch rpcErr.Code {
+		case cLNROUTENOTFOUND, cLNROUTETOOEXPENSIVE:
+			payment.FailureReason = lnrpc.PaymentFailureReason_FAILURE_REASON_NO_ROUTE
+		case cLNINVOICEEXPIRED:
+			payment.FailureReason = lnrpc.PaymentFailureReason_FAILURE_REASON_INCORRECT_PAYMENT_DETAILS
+		case cLNPAYMENTTIMEOUT:
+			payment.FailureReason = lnrpc.PaymentFailureReason_FAILURE_REASON_TIMEOUT
+		default:
+			payment.FailureReason = lnrpc.PaymentFailureReason_FAILURE_REASON_ERROR
+		}
+
+		return payment, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if paid.Status != "complete" {
+		payment.FailureReason = lnrpc.PaymentFailureReason_FAILURE_REASON_ERROR
+		return payment, nil
+	}
+
+	payment.Status = lnrpc.Payment_SUCCEEDED
+	payment.PaymentHash = paid.PaymentHash
+	payment.PaymentPreimage = paid.Preimage
+	payment.ValueSat = int64(paid.Amount) / 1000
+	payment.FeeSat = int64(paid.AmountSent-paid.Amount) / 1000
+	return payment, nil
+}
+
+// ChannelBalance is what we can spend in channels that are open and working
+func (b *clnBackend) ChannelBalance(ctx context.Context) (int64, error) {
+	funds := struct {
+		Channels []struct {
+			State     string  `json:"state"`
+			OurAmount clnMsat `json:"our_amount_msat"`
+		} `json:"channels"`
+	}{}
+	if err := b.call(ctx, "listfunds", map[string]interface{}{}, &funds); err != nil {
+		return 0, err
+	}
+
+	var balance int64
+	for _, c := range funds.Channels {
+		if c.State == "CHANNELD_NORMAL" {
+			balance += int64(c.OurAmount) / 1000
+		}
+	}
+
+	return balance, nil
+}
+
+// QueryRoutes only looks for one route, without the request's route hints which getroute doesn't take
+func (b *clnBackend) QueryRoutes(ctx context.Context, request *lnrpc.QueryRoutesRequest) (*lnrpc.QueryRoutesResponse, error) {
+	found := struct {
+		Route []struct {
+			ID     string  `json:"id"`
+			Amount clnMsat `json:"amount_msat"`
+			Delay  uint32  `json:"delay"`
+		} `json:"route"`
+	}{}
+	params := map[string]interface{}{
+		"id":          request.PubKey,
+		"amount_msat": request.Amt * 1000,
+		"riskfactor":  1,
+	}
+	if err := b.call(ctx, "getroute", params, &found); err != nil {
+		return nil, err
+	}
+
+	if len(found.Route) == 0 {
+		return &lnrpc.QueryRoutesResponse{}, nil
+	}
+
+	route := &lnrpc.Route{
+		TotalTimeLock: found.Route[0].Delay,
+		TotalAmtMsat:  int64(found.Route[0].Amount),
+		TotalFeesMsat: int64(found.Route[0].Amount) - request.Amt*1000,
+	}
+	for _, hop := range found.Route {
+		route.Hops = append(route.Hops, &lnrpc.Hop{PubKey: hop.ID, AmtToForwardMsat: int64(hop.Amount), Expiry: hop.Delay})
+	}
+
+	return &lnrpc.QueryRoutesResponse{Routes: []*lnrpc.Route{route}}, nil
+}
+
+func (b *clnBackend) SignMessage(ctx context.Context, message []byte) (string, error) {
+	signed := struct {
+		Zbase string `json:"zbase"`
+	}{}
+	if err := b.call(ctx, "signmessage", map[string]interface{}{"message": string(message)}, &signed); err != nil {
+		return "", err
+	}
+
+	return signed.Zbase, nil
+}
+
+// VerifyMessage returns the key recovered from the signature, like lnd's
+func (b *clnBackend) VerifyMessage(ctx context.Context, message []byte, signature string) (string, error) {
+	checked := struct {
+		Pubkey   string `json:"pubkey"`
+		Verified bool   `json:"verified"`
+	}{}
+	params := map[string]interface{}{"message": string(message), "zbase": signature}
+	if err := b.call(ctx, "checkmessage", params, &checked); err != nil {
+		return "", err
+	}
+
+	if !checked.Verified {
+		return "", errors.New("Lightauth error: invalid signature")
+	}
+
+	return checked.Pubkey, nil
+}
@@ -0,0 +1,131 @@
+// Command lightauth-mockserver serves priced routes on a simnet network, where invoices settle instantly,
+// so client developers can integrate against the 402 flows of lightauth without any Lightning setup.
+//
+// The routes are read from a lightauth.toml like a real server's, or two default routes are served
+// when there is none: GET/time, paid by the minute, and GET/discrete, paid per request, both for 1 sat.
+// Every other path is served for free. The invoices the routes issue are paid by posting them to
+// /_mock/pay, which answers with their preimage:
+//
+//	curl -d invoice=lnsb1n1... localhost:8402/_mock/pay
+//
+// Usage:
+//
+//	lightauth-mockserver [-addr :8402] [-config lightauth.toml] [-settlement-delay 0s]
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/server"
+	"github.com/faurehu/lightauth/simnet"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+)
+
+const defaultConfig = `Network = "simnet"
+
+[Routes."GET/time"]
+Name = "GET/time"
+Fee = 1
+MaxInvoices = 1
+Mode = "time"
+Period = "minute"
+
+[Routes."GET/discrete"]
+Name = "GET/discrete"
+Fee = 1
+MaxInvoices = 3
+Mode = "discrete"
+`
+
+// writeDefaultConfig writes the default routes to a temporary lightauth.toml and returns its path
+func writeDefaultConfig() (string, error) {
+	dir, err := ioutil.TempDir("", "lightauth-mockserver")
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, "lightauth.toml")
+	return path, ioutil.WriteFile(path, []byte(defaultConfig), 0600)
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
+
+// echo answers the requests that made it through the middleware with what was requested
+func echo(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"method": r.Method, "path": r.URL.Path})
+}
+
+// pay pays the invoice posted in the invoice form value on the network
+func pay(network *simnet.Network) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "invoices are paid with POST"})
+			return
+		}
+
+		invoice := r.FormValue("invoice")
+		if invoice == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing invoice"})
+			return
+		}
+
+		payment, err := network.SendPayment(r.Context(), &routerrpc.SendPaymentRequest{PaymentRequest: invoice})
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+			return
+		}
+
+		if payment.Status != lnrpc.Payment_SUCCEEDED {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": payment.FailureReason.String()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]string{
+			"payment_hash": payment.PaymentHash,
+			"preimage":     payment.PaymentPreimage,
+		})
+	}
+}
+
+func main() {
+	addr := flag.String("addr", ":8402", "address to listen on")
+	config := flag.String("config", "lightauth.toml", "lightauth configuration with the routes to serve")
+	settlementDelay := flag.Duration("settlement-delay", 0, "time before the server learns of a payment")
+	flag.Parse()
+
+	path := *config
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if path, err = writeDefaultConfig(); err != nil {
+			log.Fatalf("lightauth-mockserver: could not write the default configuration: %v\n", err)
+		}
+		log.Printf("lightauth-mockserver: %v not found, serving GET/time and GET/discrete\n", *config)
+	}
+	lightauth.SetConfigPath(path)
+
+	network := simnet.New(1 << 40)
+	network.SetFaults(simnet.Faults{SettlementDelay: *settlementDelay})
+	if err := server.StartWithBackend(simnet.NewMemoryProvider(), network); err != nil {
+		log.Fatalf("lightauth-mockserver: %v\n", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_mock/pay", pay(network))
+	mux.HandleFunc("/", server.Middleware(echo))
+
+	httpServer := &http.Server{Addr: *addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	log.Printf("lightauth-mockserver: listening on %v\n", *addr)
+	log.Fatal(httpServer.ListenAndServe())
+}
@@ -0,0 +1,126 @@
+package lightauth
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ConfigError lists every problem found in lightauth.toml
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "Lightauth error: invalid configuration in " + configPath + ":\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// NewConfigError returns the ConfigError listing problems, or nil when there are none
+func NewConfigError(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+
+	return &ConfigError{Problems: problems}
+}
+
+// Validate returns the problems of the settings the client and the server have in common
+func (conf Config) Validate() []string {
+	var problems []string
+	if conf.Network != "" && !networks[conf.Network] {
+		problems = append(problems, fmt.Sprintf("Network %q is not one of mainnet, testnet, regtest, signet or simnet", conf.Network))
+	}
+
+	if conf.Persistence.Mode != "" && conf.Persistence.Mode != "sync" && conf.Persistence.Mode != "write-behind" {
+		problems = append(problems, fmt.Sprintf("Persistence.Mode %q must be sync or write-behind", conf.Persistence.Mode))
+	}
+
+	if d, err := ParseDuration(conf.Persistence.FlushInterval); err != nil || d < 0 {
+		problems = append(problems, fmt.Sprintf("Persistence.FlushInterval %q is not a valid duration", conf.Persistence.FlushInterval))
+	}
+
+	if conf.Proxy != "" {
+		if _, err := parseProxy(conf.Proxy); err != nil {
+			problems = append(problems, fmt.Sprintf("Proxy %q is not a socks5:// URL", conf.Proxy))
+		}
+	}
+
+	if conf.EncryptionKeyFile != "" {
+		if key, err := readKeyFile(conf.EncryptionKeyFile); err != nil {
+			problems = append(problems, fmt.Sprintf("EncryptionKeyFile can't be read: %v", err))
+		} else if len(key) < 32 {
+			problems = append(problems, "EncryptionKeyFile must hold a hex encoded key of at least 32 bytes")
+		}
+	}
+
+	return problems
+}
+
+// ValidateRole validates the node used by a role, which is its own section when it has one
+func (conf Config) ValidateRole(section string, role *NodeConfig) []string {
+	if role == nil {
+		return ValidateNode("", conf.Node(nil))
+	}
+
+	return ValidateNode(section, *role)
+}
+
+// ValidateNode returns the problems of the connection details of a node, found in the given section of
+// lightauth.toml. Wallets are left to the client, which is the only side that can use them.
+func ValidateNode(section string, node NodeConfig) []string {
+	prefix := ""
+	if section != "" {
+		prefix = section + "."
+	}
+
+	if node.NWC != "" || node.LNDHub != "" {
+		return []string{strings.TrimPrefix(section+": NWC and LNDHub wallets can only be used by clients", ": ")}
+	}
+
+	if node.LNbits != "" {
+		if _, _, err := parseLNbits(node.LNbits); err != nil {
+			return []string{fmt.Sprintf("%vLNbits: %v", prefix, err)}
+		}
+
+		return nil
+	}
+
+	if node.Phoenixd != "" {
+		if _, _, err := parsePhoenixd(node.Phoenixd); err != nil {
+			return []string{fmt.Sprintf("%vPhoenixd: %v", prefix, err)}
+		}
+
+		return nil
+	}
+
+	if node.CLNSocket != "" {
+		if _, err := os.Stat(node.CLNSocket); err != nil {
+			return []string{fmt.Sprintf("%vCLNSocket can't be read: %v", prefix, err)}
+		}
+
+		return nil
+	}
+
+	if node.LNDConnect != "" {
+		if _, err := parseLNDConnect(node.LNDConnect); err != nil {
+			return []string{fmt.Sprintf("%vLNDConnect: %v", prefix, err)}
+		}
+
+		return nil
+	}
+
+	var problems []string
+	if node.ServerAddr == "" {
+		problems = append(problems, prefix+"ServerAddr is missing")
+	}
+
+	if _, err := os.Stat(node.CAFile); err != nil {
+		problems = append(problems, fmt.Sprintf("%vCAFile can't be read: %v", prefix, err))
+	}
+
+	if _, err := os.Stat(node.MacaroonPath); err != nil {
+		problems = append(problems, fmt.Sprintf("%vMacaroonPath can't be read: %v", prefix, err))
+	}
+
+	return problems
+}
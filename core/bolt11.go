@@ -0,0 +1,162 @@
+package core
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/zpay32"
+)
+
+var chainParams = map[string]*chaincfg.Params{
+	"mainnet": &chaincfg.MainNetParams,
+	"testnet": &chaincfg.TestNet3Params,
+	"regtest": &chaincfg.RegressionNetParams,
+	"signet":  signetParams(),
+	"simnet":  &chaincfg.SimNetParams,
+}
+
+// signetParams are the parameters of signet invoices. The btcd lnd is pinned to predates signet, whose
+// invoices only differ from testnet ones by their prefix.
+func signetParams() *chaincfg.Params {
+	params := chaincfg.TestNet3Params
+	params.Name = "signet"
+	params.Bech32HRPSegwit = "tbs"
+	return &params
+}
+
+// The data part of a payment request ends with a timestamp, tagged fields, a signature and a checksum,
+// measured in groups of 5 bits
+const (
+	bOLT11TIMESTAMPLEN = 7
+	bOLT11SIGNATURELEN = 104
+	bOLT11CHECKSUMLEN  = 6
+)
+
+// bOLT11FALLBACKFIELD is the type of the tagged field of a fallback on-chain address, f in bech32
+const bOLT11FALLBACKFIELD = 9
+
+const bECH32CHARSET = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// checkBOLT11 checks that the data of a payment request holds the parts it is sliced into, and that
+// each tagged field fits in it. zpay32 slices payment requests without checking their lengths first,
+// so malformed ones coming from the other side would make it panic.
+func checkBOLT11(paymentRequest string) error {
+	separator := strings.LastIndexByte(paymentRequest, '1')
+	if separator < 1 {
+		return errors.New("Lightauth error: malformed payment request: no separator")
+	}
+
+	data := make([]byte, 0, len(paymentRequest)-separator-1)
+	for _, c := range paymentRequest[separator+1:] {
+		group := strings.IndexRune(bECH32CHARSET, c)
+		if group < 0 {
+			return fmt.Errorf("Lightauth error: malformed payment request: invalid character %q", c)
+		}
+		data = append(data, byte(group))
+	}
+
+	if len(data) < bOLT11TIMESTAMPLEN+bOLT11SIGNATURELEN+bOLT11CHECKSUMLEN {
+		return errors.New("Lightauth error: malformed payment request: too short")
+	}
+
+	fields := data[bOLT11TIMESTAMPLEN : len(data)-bOLT11SIGNATURELEN-bOLT11CHECKSUMLEN]
+	for index := 0; len(fields)-index >= 3; {
+		fieldType := fields[index]
+		length := int(fields[index+1])<<5 | int(fields[index+2])
+		if index+3+length > len(fields) {
+			return errors.New("Lightauth error: malformed payment request: tagged field overflows")
+		}
+
+		if fieldType == bOLT11FALLBACKFIELD && length < 2 {
+			return errors.New("Lightauth error: malformed payment request: fallback address without an address")
+		}
+
+		index += 3 + length
+	}
+
+	return nil
+}
+
+// DecodeBOLT11 decodes a payment request without asking a node, into the message lnd would have
+// answered with. Payment requests come from the other side, so they are checked to be well formed
+// before being decoded.
+func DecodeBOLT11(paymentRequest string) (*lnrpc.PayReq, error) {
+	params, known := chainParams[InvoiceNetwork(paymentRequest)]
+	if !known {
+		return nil, errors.New("Lightauth error: can't decode payment requests of this network locally")
+	}
+
+	pr := strings.TrimPrefix(strings.ToLower(paymentRequest), "lightning:")
+	if err := checkBOLT11(pr); err != nil {
+		return nil, err
+	}
+
+	invoice, err := zpay32.Decode(pr, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if invoice.PaymentHash == nil || invoice.Destination == nil {
+		return nil, errors.New("Lightauth error: payment request has no payment hash or destination")
+	}
+
+	payReq := &lnrpc.PayReq{
+		Destination: hex.EncodeToString(invoice.Destination.SerializeCompressed()),
+		PaymentHash: hex.EncodeToString(invoice.PaymentHash[:]),
+		Timestamp:   invoice.Timestamp.Unix(),
+		Expiry:      int64(invoice.Expiry().Seconds()),
+		CltvExpiry:  int64(invoice.MinFinalCLTVExpiry()),
+	}
+
+	if invoice.MilliSat != nil {
+		payReq.NumMsat = int64(*invoice.MilliSat)
+		payReq.NumSatoshis = int64(invoice.MilliSat.ToSatoshis())
+	}
+
+	if invoice.Description != nil {
+		payReq.Description = *invoice.Description
+	}
+
+	if invoice.DescriptionHash != nil {
+		payReq.DescriptionHash = hex.EncodeToString(invoice.DescriptionHash[:])
+	}
+
+	for _, hints := range invoice.RouteHints {
+		routeHint := &lnrpc.RouteHint{}
+		for _, hint := range hints {
+			routeHint.HopHints = append(routeHint.HopHints, &lnrpc.HopHint{
+				NodeId:                    hex.EncodeToString(hint.NodeID.SerializeCompressed()),
+				ChanId:                    hint.ChannelID,
+				FeeBaseMsat:               hint.FeeBaseMSat,
+				FeeProportionalMillionths: hint.FeeProportionalMillionths,
+				CltvExpiryDelta:           uint32(hint.CLTVExpiryDelta),
+			})
+		}
+		payReq.RouteHints = append(payReq.RouteHints, routeHint)
+	}
+
+	return payReq, nil
+}
+
+// InvoiceNetwork returns the network a BOLT11 payment request is meant for, read from its prefix
+func InvoiceNetwork(paymentRequest string) string {
+	pr := strings.TrimPrefix(strings.ToLower(paymentRequest), "lightning:")
+	switch {
+	case strings.HasPrefix(pr, "lnbcrt"):
+		return "regtest"
+	case strings.HasPrefix(pr, "lnbc"):
+		return "mainnet"
+	case strings.HasPrefix(pr, "lntbs"):
+		return "signet"
+	case strings.HasPrefix(pr, "lntb"):
+		return "testnet"
+	case strings.HasPrefix(pr, "lnsb"):
+		return "simnet"
+	default:
+		return ""
+	}
+}
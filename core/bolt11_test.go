@@ -0,0 +1,54 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+// The first example payment request of BOLT11
+const bolt11Example = "lnbc1pvjluezpp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdpl2pkx2ctnv5sxxmmwwd5kgetjypeh2ursdae8g6twvus8g6rfwvs8qun0dfjkxaq8rkx3yf5tcsyz3d73gafnh3cax9rn449d9p5uxz9ezhhypd0elx87sjle52x86fux2ypatgddc6k63n7erqz25le42c4u4ecky03ylcqca784w"
+
+func TestCheckBOLT11(t *testing.T) {
+	timestamp := strings.Repeat("q", bOLT11TIMESTAMPLEN)
+	signature := strings.Repeat("q", bOLT11SIGNATURELEN+bOLT11CHECKSUMLEN)
+
+	tests := []struct {
+		name           string
+		paymentRequest string
+		valid          bool
+	}{
+		{"no separator", "lnbc", false},
+		{"invalid character", "lnbc1b" + timestamp + signature, false},
+		{"too short", "lnbc1" + timestamp + signature[1:], false},
+		{"no fields", "lnbc1" + timestamp + signature, true},
+		// A payment hash field, p, of 52 groups, 1 and 20 in bech32
+		{"field fits", "lnbc1" + timestamp + "pp5" + strings.Repeat("q", 52) + signature, true},
+		{"field overflows", "lnbc1" + timestamp + "pp5" + strings.Repeat("q", 51) + signature, false},
+		{"empty fallback", "lnbc1" + timestamp + "fqq" + signature, false},
+		{"example", bolt11Example, true},
+	}
+
+	for _, test := range tests {
+		err := checkBOLT11(test.paymentRequest)
+		if test.valid && err != nil {
+			t.Errorf("%v: unexpected error: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%v: malformed payment request accepted", test.name)
+		}
+	}
+}
+
+func FuzzDecodeBOLT11(f *testing.F) {
+	f.Add(bolt11Example)
+	f.Add("lightning:" + strings.ToUpper(bolt11Example))
+	f.Add(bolt11Example[:len(bolt11Example)-bOLT11SIGNATURELEN])
+	f.Add("lnbc1")
+	f.Add("lnsb1n1pp5")
+	f.Fuzz(func(t *testing.T, paymentRequest string) {
+		payReq, err := DecodeBOLT11(paymentRequest)
+		if err == nil && len(payReq.PaymentHash) != 64 {
+			t.Errorf("decoded payment request with payment hash %q", payReq.PaymentHash)
+		}
+	})
+}
@@ -0,0 +1,461 @@
+package core
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The encodings of the Light-Auth-Invoices header known to every client and server. JSON is the one
+// used when none was negotiated.
+const (
+	EncodingJSON     = "json"
+	EncodingCBOR     = "cbor"
+	EncodingProtobuf = "protobuf"
+)
+
+// ErrMalformedInvoices is returned when an invoice list can't be decoded
+var ErrMalformedInvoices = errors.New("Lightauth error: malformed invoice list")
+
+// InvoiceCodec encodes the invoice lists of the Light-Auth-Invoices header. Encodings must give values
+// that can be sent in a header, so binary encodings are base64 encoded. Clients list the encodings they
+// read in Light-Auth-Accept-Invoices, and servers name the one they picked in
+// Light-Auth-Invoices-Encoding.
+type InvoiceCodec interface {
+	Name() string
+	Encode(invoices []JSONInvoice) (string, error)
+	Decode(value string) ([]JSONInvoice, error)
+}
+
+var codecs = struct {
+	mux    sync.RWMutex
+	byName map[string]InvoiceCodec
+}{byName: map[string]InvoiceCodec{
+	EncodingJSON:     jsonCodec{},
+	EncodingCBOR:     cborCodec{},
+	EncodingProtobuf: protobufCodec{},
+}}
+
+// RegisterInvoiceCodec makes an encoding of invoice lists known to the client and the server, replacing
+// the codec of the same name. It is to be called before they are set up.
+func RegisterInvoiceCodec(c InvoiceCodec) {
+	codecs.mux.Lock()
+	defer codecs.mux.Unlock()
+
+	codecs.byName[c.Name()] = c
+}
+
+// LookupInvoiceCodec returns the codec of an encoding, if it is known
+func LookupInvoiceCodec(name string) (InvoiceCodec, bool) {
+	codecs.mux.RLock()
+	defer codecs.mux.RUnlock()
+
+	c, known := codecs.byName[name]
+	return c, known
+}
+
+// AcceptedInvoiceCodec returns the first codec known of those a request lists in
+// Light-Auth-Accept-Invoices, or JSON
+func AcceptedInvoiceCodec(h http.Header) InvoiceCodec {
+	for _, name := range strings.Split(ReadHeader(h, HeaderAcceptInvoices), ",") {
+		if c, known := LookupInvoiceCodec(strings.TrimSpace(name)); known {
+			return c
+		}
+	}
+
+	return jsonCodec{}
+}
+
+// SetInvoices encodes invoices with a codec into the Light-Auth-Invoices header, naming the encoding
+// in Light-Auth-Invoices-Encoding unless it is JSON
+func SetInvoices(h http.Header, c InvoiceCodec, invoices []JSONInvoice) error {
+	value, err := c.Encode(invoices)
+	if err != nil {
+		return err
+	}
+
+	h.Set(HeaderInvoices, value)
+	if c.Name() == EncodingJSON {
+		h.Del(HeaderInvoicesEncoding)
+	} else {
+		h.Set(HeaderInvoicesEncoding, c.Name())
+	}
+
+	return nil
+}
+
+// ReadInvoices decodes the Light-Auth-Invoices header with the encoding named in
+// Light-Auth-Invoices-Encoding
+func ReadInvoices(h http.Header) ([]JSONInvoice, error) {
+	name := ReadHeader(h, HeaderInvoicesEncoding)
+	if name == "" {
+		name = EncodingJSON
+	}
+
+	c, known := LookupInvoiceCodec(name)
+	if !known {
+		return nil, errors.New("Lightauth error: unknown invoice encoding " + name)
+	}
+
+	return c.Decode(ReadHeader(h, HeaderInvoices))
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return EncodingJSON
+}
+
+func (jsonCodec) Encode(invoices []JSONInvoice) (string, error) {
+	if invoices == nil {
+		invoices = []JSONInvoice{}
+	}
+
+	b, err := json.Marshal(invoices)
+	return string(b), err
+}
+
+func (jsonCodec) Decode(value string) ([]JSONInvoice, error) {
+	invoices := []JSONInvoice{}
+	err := json.Unmarshal([]byte(value), &invoices)
+	return invoices, err
+}
+
+// cborCodec encodes invoice lists in CBOR (RFC 8949), as an array of maps with the keys of the JSON
+// encoding, the expiration times being tagged epoch times in seconds
+type cborCodec struct{}
+
+// The major types of CBOR used by invoice lists
+const (
+	cborUint   = 0
+	cborNegint = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+// cborMaxDepth bounds the nesting of the values skipped while decoding
+const cborMaxDepth = 16
+
+func (cborCodec) Name() string {
+	return EncodingCBOR
+}
+
+func cborHead(b []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(b, major<<5|byte(n))
+	case n <= 0xff:
+		return append(b, major<<5|24, byte(n))
+	case n <= 0xffff:
+		return append(b, major<<5|25, byte(n>>8), byte(n))
+	case n <= 0xffffffff:
+		b = append(b, major<<5|26)
+		return append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	default:
+		b = append(b, major<<5|27)
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], n)
+		return append(b, buf[:]...)
+	}
+}
+
+func cborString(b []byte, s string) []byte {
+	return append(cborHead(b, cborText, uint64(len(s))), s...)
+}
+
+func (cborCodec) Encode(invoices []JSONInvoice) (string, error) {
+	b := cborHead(nil, cborArray, uint64(len(invoices)))
+	for _, i := range invoices {
+		b = cborHead(b, cborMap, 2)
+		b = cborString(b, "payment_request")
+		b = cborString(b, i.PaymentRequest)
+		b = cborString(b, "expiration_time")
+		b = cborHead(b, cborTag, 1)
+		if seconds := i.ExpirationTime.Unix(); seconds >= 0 {
+			b = cborHead(b, cborUint, uint64(seconds))
+		} else {
+			b = cborHead(b, cborNegint, uint64(-1-seconds))
+		}
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+type cborReader struct {
+	b []byte
+}
+
+// head reads the major type and argument of the next item
+func (r *cborReader) head() (byte, uint64, error) {
+	if len(r.b) == 0 {
+		return 0, 0, ErrMalformedInvoices
+	}
+
+	major, info := r.b[0]>>5, r.b[0]&0x1f
+	r.b = r.b[1:]
+	if info < 24 {
+		return major, uint64(info), nil
+	}
+
+	size := map[byte]int{24: 1, 25: 2, 26: 4, 27: 8}[info]
+	if size == 0 || len(r.b) < size {
+		// Indefinite lengths aren't used by invoice lists
+		return 0, 0, ErrMalformedInvoices
+	}
+
+	n := uint64(0)
+	for _, v := range r.b[:size] {
+		n = n<<8 | uint64(v)
+	}
+	r.b = r.b[size:]
+
+	return major, n, nil
+}
+
+func (r *cborReader) text() (string, error) {
+	major, n, err := r.head()
+	if err != nil || major != cborText || n > uint64(len(r.b)) {
+		return "", ErrMalformedInvoices
+	}
+
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s, nil
+}
+
+func (r *cborReader) time() (time.Time, error) {
+	major, n, err := r.head()
+	if err == nil && major == cborTag && n == 1 {
+		major, n, err = r.head()
+	}
+
+	switch {
+	case err != nil:
+		return time.Time{}, err
+	case major == cborUint && n <= 1<<62:
+		return time.Unix(int64(n), 0), nil
+	case major == cborNegint && n < 1<<62:
+		return time.Unix(-1-int64(n), 0), nil
+	default:
+		return time.Time{}, ErrMalformedInvoices
+	}
+}
+
+// skip reads past the next item
+func (r *cborReader) skip(depth int) error {
+	if depth > cborMaxDepth {
+		return ErrMalformedInvoices
+	}
+
+	major, n, err := r.head()
+	if err != nil {
+		return err
+	}
+
+	switch major {
+	case cborBytes, cborText:
+		if n > uint64(len(r.b)) {
+			return ErrMalformedInvoices
+		}
+		r.b = r.b[n:]
+	case cborArray, cborMap:
+		if major == cborMap {
+			n *= 2
+		}
+		if n > uint64(len(r.b)) {
+			return ErrMalformedInvoices
+		}
+		for k := uint64(0); k < n; k++ {
+			if err := r.skip(depth + 1); err != nil {
+				return err
+			}
+		}
+	case cborTag:
+		return r.skip(depth + 1)
+	}
+
+	return nil
+}
+
+func (cborCodec) Decode(value string) ([]JSONInvoice, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &cborReader{b: b}
+	major, n, err := r.head()
+	if err != nil || major != cborArray || n > uint64(len(r.b)) {
+		return nil, ErrMalformedInvoices
+	}
+
+	invoices := make([]JSONInvoice, 0, n)
+	for k := uint64(0); k < n; k++ {
+		major, fields, err := r.head()
+		if err != nil || major != cborMap || fields > uint64(len(r.b)) {
+			return nil, ErrMalformedInvoices
+		}
+
+		i := JSONInvoice{}
+		for f := uint64(0); f < fields; f++ {
+			key, err := r.text()
+			if err != nil {
+				return nil, err
+			}
+
+			switch key {
+			case "payment_request":
+				i.PaymentRequest, err = r.text()
+			case "expiration_time":
+				i.ExpirationTime, err = r.time()
+			default:
+				err = r.skip(0)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		invoices = append(invoices, i)
+	}
+
+	return invoices, nil
+}
+
+// protobufCodec encodes invoice lists in the protocol buffers wire format, as the message
+//
+//	message Invoices {
+//		message Invoice {
+//			string payment_request = 1;
+//			int64 expiration_time = 2; // Unix time in seconds
+//		}
+//		repeated Invoice invoices = 1;
+//	}
+type protobufCodec struct{}
+
+// The wire types of protocol buffers
+const (
+	protobufVarint  = 0
+	protobufFixed64 = 1
+	protobufBytes   = 2
+	protobufFixed32 = 5
+)
+
+func (protobufCodec) Name() string {
+	return EncodingProtobuf
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func protobufKey(b []byte, field uint64, wireType uint64) []byte {
+	return appendUvarint(b, field<<3|wireType)
+}
+
+func (protobufCodec) Encode(invoices []JSONInvoice) (string, error) {
+	b := []byte{}
+	for _, i := range invoices {
+		invoice := protobufKey(nil, 1, protobufBytes)
+		invoice = appendUvarint(invoice, uint64(len(i.PaymentRequest)))
+		invoice = append(invoice, i.PaymentRequest...)
+		invoice = protobufKey(invoice, 2, protobufVarint)
+		invoice = appendUvarint(invoice, uint64(i.ExpirationTime.Unix()))
+
+		b = protobufKey(b, 1, protobufBytes)
+		b = appendUvarint(b, uint64(len(invoice)))
+		b = append(b, invoice...)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// protobufFields calls field with the number, wire type and value of each field of a message. Varints
+// are given as their value, length delimited fields as their bytes, and fixed size fields are skipped.
+func protobufFields(b []byte, field func(number uint64, wireType uint64, varint uint64, bytes []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return ErrMalformedInvoices
+		}
+		b = b[n:]
+
+		number, wireType := key>>3, key&7
+		switch wireType {
+		case protobufVarint:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return ErrMalformedInvoices
+			}
+			b = b[n:]
+			if err := field(number, wireType, v, nil); err != nil {
+				return err
+			}
+		case protobufBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || length > uint64(len(b)-n) {
+				return ErrMalformedInvoices
+			}
+			value := b[n : n+int(length)]
+			b = b[n+int(length):]
+			if err := field(number, wireType, 0, value); err != nil {
+				return err
+			}
+		case protobufFixed64, protobufFixed32:
+			size := 8
+			if wireType == protobufFixed32 {
+				size = 4
+			}
+			if len(b) < size {
+				return ErrMalformedInvoices
+			}
+			b = b[size:]
+		default:
+			return ErrMalformedInvoices
+		}
+	}
+
+	return nil
+}
+
+func (protobufCodec) Decode(value string) ([]JSONInvoice, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	invoices := []JSONInvoice{}
+	err = protobufFields(b, func(number uint64, wireType uint64, _ uint64, message []byte) error {
+		if number != 1 || wireType != protobufBytes {
+			return nil
+		}
+
+		i := JSONInvoice{}
+		err := protobufFields(message, func(number uint64, wireType uint64, varint uint64, bytes []byte) error {
+			switch {
+			case number == 1 && wireType == protobufBytes:
+				i.PaymentRequest = string(bytes)
+			case number == 2 && wireType == protobufVarint:
+				i.ExpirationTime = time.Unix(int64(varint), 0)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		invoices = append(invoices, i)
+		return nil
+	})
+
+	return invoices, err
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Condition is one of the Match conditions of a route: a query parameter or a header the request must
+// have, with the given value unless only its presence is required. They are written source:name=value,
+// like query:resolution=4k or header:X-Tier=pro, or source:name. Source is either query or header.
+type Condition struct {
+	Source   string
+	Name     string
+	Value    string
+	AnyValue bool
+}
+
+// ParseCondition parses a Match condition of lightauth.toml or a Light-Auth-Varies entry
+func ParseCondition(s string) (Condition, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || (parts[0] != "query" && parts[0] != "header") {
+		return Condition{}, errors.New("Lightauth error: route conditions start with query: or header:")
+	}
+
+	rc := Condition{Source: parts[0], AnyValue: true}
+	nameValue := strings.SplitN(parts[1], "=", 2)
+	rc.Name = nameValue[0]
+	if rc.Source == "header" {
+		rc.Name = http.CanonicalHeaderKey(rc.Name)
+	}
+
+	if len(nameValue) == 2 {
+		rc.Value = nameValue[1]
+		rc.AnyValue = false
+	}
+
+	if rc.Name == "" {
+		return Condition{}, errors.New("Lightauth error: route conditions need a name")
+	}
+
+	return rc, nil
+}
+
+// Values returns the values the request has for the query parameter or header of the condition
+func (rc Condition) Values(query url.Values, h http.Header) []string {
+	if rc.Source == "query" {
+		return query[rc.Name]
+	}
+
+	return h[rc.Name]
+}
+
+// Matches tells whether the request meets the condition
+func (rc Condition) Matches(query url.Values, h http.Header) bool {
+	values := rc.Values(query, h)
+	if rc.AnyValue {
+		return len(values) > 0
+	}
+
+	for _, v := range values {
+		if v == rc.Value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Varies names the query parameter or header the condition depends on, as sent in Light-Auth-Varies
+func (rc Condition) Varies() string {
+	return rc.Source + ":" + rc.Name
+}
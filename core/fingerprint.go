@@ -0,0 +1,34 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// RequestFingerprint identifies a request on routes that bind invoices to requests: it is the hex
+// SHA-256 of the method, the path and the hex SHA-256 of the body, each followed by a newline. The body
+// is put back for whoever reads it next.
+func RequestFingerprint(r *http.Request) (string, error) {
+	body := []byte{}
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return "", err
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	bodyHash := sha256.Sum256(body)
+	fingerprint := sha256.Sum256([]byte(r.Method + "\n" + r.URL.Path + "\n" + hex.EncodeToString(bodyHash[:]) + "\n"))
+	return hex.EncodeToString(fingerprint[:]), nil
+}
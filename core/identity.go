@@ -0,0 +1,10 @@
+package core
+
+import "fmt"
+
+// IdentityMessage is the canonical message signed by a client, in the spirit of NIP-98: it commits to
+// the method, the URL and the time of the request so a signature can't be replayed elsewhere, and to a
+// nonce so it can't be replayed within the window either.
+func IdentityMessage(method string, u string, timestamp int64, nonce string) string {
+	return fmt.Sprintf("lightauth %s %s %d %s", method, u, timestamp, nonce)
+}
@@ -0,0 +1,56 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+)
+
+// LNURLPayParams is the first response of an LNURL-pay exchange (LUD-06)
+type LNURLPayParams struct {
+	Tag         string `json:"tag"`
+	Callback    string `json:"callback"`
+	MinSendable int64  `json:"minSendable"`
+	MaxSendable int64  `json:"maxSendable"`
+	Metadata    string `json:"metadata"`
+}
+
+// LNURLPayInvoice is the response of the LNURL-pay callback
+type LNURLPayInvoice struct {
+	PR     string   `json:"pr"`
+	Routes []string `json:"routes"`
+}
+
+// LNURLStatus is the status LNURL services answer with when a call fails
+type LNURLStatus struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// DecodeLNURL decodes the response of an LNURL service into v, unless it is an error status
+func DecodeLNURL(body []byte, v interface{}) error {
+	status := LNURLStatus{}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return err
+	}
+
+	if status.Status == "ERROR" {
+		return errors.New(status.Reason)
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// LNURLWithToken adds the token of a client to an LNURL-pay URL. LNURL-pay wallets only follow URLs,
+// so the token travels in the token query parameter rather than in the Light-Auth-Token header.
+func LNURLWithToken(u string, token string) (string, error) {
+	withToken, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+
+	query := withToken.Query()
+	query.Set("token", token)
+	withToken.RawQuery = query.Encode()
+	return withToken.String(), nil
+}
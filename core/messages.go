@@ -0,0 +1,46 @@
+package core
+
+import "time"
+
+// JSONInvoice is an invoice as listed in the Light-Auth-Invoices and Light-Auth-Deferred-Invoices
+// headers
+type JSONInvoice struct {
+	PaymentRequest string    `json:"payment_request"`
+	ExpirationTime time.Time `json:"expiration_time"`
+}
+
+// ErrorResponse is the JSON object a server writes when it rejects a request. Code is one of the
+// values of errorCodes, or the generic code of the status when the message has no specific one.
+// RetryAfter is set in seconds when the request can be retried as is, and Invoices lists the unpaid
+// invoices of the client on 400, 402 and 409 responses. DeferredInvoices lists the invoices for past
+// results the client has to pay before its request is served. Payment repeats what the Light-Auth
+// headers of those responses say, for clients behind intermediaries that drop custom headers.
+type ErrorResponse struct {
+	Code             Code                 `json:"code"`
+	Message          string               `json:"message"`
+	RetryAfter       int                  `json:"retry_after,omitempty"`
+	Invoices         []JSONInvoice        `json:"invoices,omitempty"`
+	DeferredInvoices []JSONInvoice        `json:"deferred_invoices,omitempty"`
+	Payment          *PaymentInstructions `json:"payment,omitempty"`
+}
+
+// PaymentInstructions tell a client how to pay for a route: the token to send, the pricing of the
+// route and, in time mode, until when it has paid for. RetryWith is the retry hint, the headers the
+// request has to be sent again with once an invoice is paid.
+type PaymentInstructions struct {
+	Token              string   `json:"token"`
+	Name               string   `json:"name"`
+	Mode               Mode     `json:"mode"`
+	Fee                int      `json:"fee"`
+	MaxInvoices        int      `json:"max_invoices"`
+	InvoicesPerRequest int      `json:"invoices_per_request,omitempty"`
+	Period             Period   `json:"period,omitempty"`
+	ExpirationTime     string   `json:"expiration_time,omitempty"`
+	LNURL              string   `json:"lnurl,omitempty"`
+	BindRequest        bool     `json:"bind_request,omitempty"`
+	Fingerprint        string   `json:"fingerprint,omitempty"`
+	Varies             string   `json:"varies,omitempty"`
+	InvoicesTotal      int      `json:"invoices_total,omitempty"`
+	InvoicesURL        string   `json:"invoices_url,omitempty"`
+	RetryWith          []string `json:"retry_with"`
+}
@@ -0,0 +1,115 @@
+package core
+
+// The headers of the protocol. Header is the one marking lightauth responses, with the version of the
+// protocol and the result of the request as parameters.
+const (
+	Header                   = "Light-Auth"
+	HeaderToken              = "Light-Auth-Token"
+	HeaderName               = "Light-Auth-Name"
+	HeaderMode               = "Light-Auth-Mode"
+	HeaderFee                = "Light-Auth-Fee"
+	HeaderMaxInvoices        = "Light-Auth-Max-Invoices"
+	HeaderInvoicesPerRequest = "Light-Auth-Invoices-Per-Request"
+	HeaderTimePeriod         = "Light-Auth-Time-Period"
+	HeaderExpirationTime     = "Light-Auth-Expiration-Time"
+	HeaderExpiresIn          = "Light-Auth-Expires-In"
+	HeaderExpiryWarning      = "Light-Auth-Expiry-Warning"
+	HeaderInvoices           = "Light-Auth-Invoices"
+	HeaderInvoicesURL        = "Light-Auth-Invoices-URL"
+	HeaderInvoicesTotal      = "Light-Auth-Invoices-Total"
+	HeaderDeferredInvoices   = "Light-Auth-Deferred-Invoices"
+	HeaderInvoice            = "Light-Auth-Invoice"
+	HeaderInvoiceRemaining   = "Light-Auth-Invoice-Remaining"
+	HeaderPreImage           = "Light-Auth-Pre-Image"
+	HeaderNonce              = "Light-Auth-Nonce"
+	HeaderFingerprint        = "Light-Auth-Fingerprint"
+	HeaderBindRequest        = "Light-Auth-Bind-Request"
+	HeaderVaries             = "Light-Auth-Varies"
+	HeaderLNURL              = "Light-Auth-LNURL"
+	HeaderCredit             = "Light-Auth-Credit"
+	HeaderBatchSize          = "Light-Auth-Batch-Size"
+	HeaderIdentitySignature  = "Light-Auth-Identity-Signature"
+	HeaderIdentityTimestamp  = "Light-Auth-Identity-Timestamp"
+	HeaderIdentityNonce      = "Light-Auth-Identity-Nonce"
+	HeaderPromo              = "Light-Auth-Promo"
+	HeaderSync               = "Light-Auth-Sync"
+	HeaderClaimed            = "Light-Auth-Claimed"
+	HeaderQuotaLimit         = "Light-Auth-Quota-Limit"
+	HeaderQuotaRemaining     = "Light-Auth-Quota-Remaining"
+	HeaderQuotaRate          = "Light-Auth-Quota-Rate"
+	HeaderAcceptInvoices     = "Light-Auth-Accept-Invoices"
+	HeaderInvoicesEncoding   = "Light-Auth-Invoices-Encoding"
+	// HeaderStatus carries the status code of responses to legacy clients, which are all 200
+	HeaderStatus = "Light-Auth-Status"
+)
+
+// Mode is the mode of a route, sent in Light-Auth-Mode. Time routes sell periods of access, discrete
+// routes single requests.
+type Mode string
+
+const (
+	ModeTime     Mode = "time"
+	ModeDiscrete Mode = "discrete"
+)
+
+// Period is what an invoice of a time route pays for, sent in Light-Auth-Time-Period
+type Period string
+
+const (
+	PeriodMillisecond Period = "millisecond"
+	PeriodSecond      Period = "second"
+	PeriodMinute      Period = "minute"
+)
+
+// Result is the result of the Light-Auth header: ok when the request was authorized and passed to the
+// handler, error when lightauth rejected it
+type Result string
+
+const (
+	ResultOK    Result = "ok"
+	ResultError Result = "error"
+)
+
+// Warning is the warning of Light-Auth-Expiry-Warning: soft when little of what was paid for is left,
+// hard when nothing is
+type Warning string
+
+const (
+	WarningSoft Warning = "soft"
+	WarningHard Warning = "hard"
+)
+
+// Code is the code of an ErrorResponse. Each comes with a status, which alone tells whether the client
+// has to pay (402), wait for its payment to be seen (409), slow down (429) or fix its request (400).
+type Code string
+
+const (
+	CodeInvalidToken       Code = "invalid_token"       // 400
+	CodeTimeExpired        Code = "time_expired"        // 402
+	CodeInvalidCredentials Code = "invalid_credentials" // 400
+	CodeMissingInvoice     Code = "missing_invoice"     // 400
+	CodeMissingPreImage    Code = "missing_preimage"    // 400
+	CodePaymentPending     Code = "payment_pending"     // 409
+	CodeInvoiceClaimed     Code = "invoice_claimed"     // 400
+	CodeInternalError      Code = "internal_error"      // 500
+	CodeInvalidSignature   Code = "invalid_signature"   // 400
+	CodeIdentityRevoked    Code = "identity_revoked"    // 403
+	CodeMissingCertificate Code = "missing_certificate" // 403
+	CodeInvalidBinding     Code = "invalid_binding"     // 403
+	CodeReplayedNonce      Code = "replayed_nonce"      // 400
+	CodeUnknownInvoice     Code = "unknown_invoice"     // 404
+	CodeNodeUnavailable    Code = "node_unavailable"    // 503
+	CodeWrongBundle        Code = "wrong_bundle"        // 400
+	CodePaymentOutstanding Code = "payment_outstanding" // 402
+	CodeWrongRequest       Code = "wrong_request"       // 400
+	CodeHeadersTooLarge    Code = "headers_too_large"   // 431
+	CodeRequestInProgress  Code = "request_in_progress" // 409
+	CodeRateLimited        Code = "rate_limited"        // 429
+	CodeRepeatedHeader     Code = "repeated_header"     // 400
+	CodeInvalidPromo       Code = "invalid_promo"       // 400
+	CodeMalformedHeader    Code = "malformed_header"    // 400
+	CodeRiskDenied         Code = "risk_denied"         // 403
+	CodeRouteSunset        Code = "route_sunset"        // 410
+	CodeLegacyClient       Code = "legacy_client"       // 400
+	CodeInvalidAPIKey      Code = "invalid_api_key"     // 401
+)
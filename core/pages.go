@@ -0,0 +1,12 @@
+package core
+
+// InvoicesPageSize is the number of invoices sent at once on routes with an InvoicesURL
+const InvoicesPageSize = 50
+
+// InvoicesPage is a page of the unpaid invoices of a client, as served by InvoicesHandler. Total is the
+// number of unpaid invoices over all pages.
+type InvoicesPage struct {
+	Page     int           `json:"page"`
+	Total    int           `json:"total"`
+	Invoices []JSONInvoice `json:"invoices"`
+}
@@ -0,0 +1,85 @@
+// Package core holds the parts of the lightauth protocol that clients and servers share: the
+// Light-Auth headers, the JSON objects sent in them, payment request decoding and request
+// fingerprints. It doesn't depend on a node, a store or the configuration of either side.
+package core
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ProtocolVersion is the version of the protocol announced in the Light-Auth header
+const ProtocolVersion = "1"
+
+// ErrNotLightauth is returned when reading a response that doesn't come from a lightauth server
+var ErrNotLightauth = errors.New("Lightauth error: the response does not come from a lightauth server")
+
+// SetHeader marks a response as coming from lightauth. The result is "ok" when the request has been
+// authorized and passed to the handler, or "error" when lightauth rejected it, in which case the HTTP
+// status code tells why.
+func SetHeader(w http.ResponseWriter, result Result) {
+	value := "version=" + ProtocolVersion
+	if result != "" {
+		value += ", result=" + string(result)
+	}
+
+	w.Header().Set(Header, value)
+}
+
+// AnnounceVersion tells the server which version of the protocol a client's request speaks, in the
+// Light-Auth header of the request. Servers take requests without it for those of clients older than
+// the announcement.
+func AnnounceVersion(h http.Header) {
+	h.Set(Header, "version="+ProtocolVersion)
+}
+
+// ParseHeader returns the parameters of the Light-Auth header, or false if there is none
+func ParseHeader(h http.Header) (map[string]string, bool) {
+	value := ReadHeader(h, Header)
+	if value == "" {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	for _, v := range strings.Split(value, ",") {
+		param := strings.SplitN(strings.TrimSpace(v), "=", 2)
+		if len(param) == 2 {
+			params[param[0]] = param[1]
+		}
+	}
+
+	return params, true
+}
+
+// ReadResult returns the result of the Light-Auth header, empty if it has none
+func ReadResult(h http.Header) Result {
+	params, _ := ParseHeader(h)
+	return Result(params["result"])
+}
+
+// ReadHeader returns the first value of a header, or an empty string if it isn't set. The name must be
+// in canonical form.
+func ReadHeader(h http.Header, header string) string {
+	_value, headerExists := h[header]
+	var value string
+	if !headerExists {
+		value = ""
+	} else {
+		value = _value[0]
+	}
+
+	return value
+}
+
+// IsCount tells whether a header holds a whole number of at least min, or is absent
+func IsCount(h http.Header, header string, min int) bool {
+	value := ReadHeader(h, header)
+	if value == "" {
+		return true
+	}
+
+	n, err := strconv.Atoi(value)
+	return err == nil && n >= min
+}
@@ -0,0 +1,40 @@
+package core
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Receipt is the server's statement of what a paid invoice was credited for: Requests on discrete
+// routes, with Claimed telling whether they have all been used, and the period between CreditedFrom
+// and CreditedUntil on time routes.
+type Receipt struct {
+	PaymentHash    string    `json:"payment_hash"`
+	PaymentRequest string    `json:"payment_request"`
+	Route          string    `json:"route"`
+	Mode           Mode      `json:"mode"`
+	Fee            int       `json:"fee"`
+	AmountPaidMsat int64     `json:"amount_paid_msat,omitempty"`
+	Requests       int       `json:"requests,omitempty"`
+	Claimed        bool      `json:"claimed,omitempty"`
+	CreditedFrom   time.Time `json:"credited_from,omitempty"`
+	CreditedUntil  time.Time `json:"credited_until,omitempty"`
+	IssuedAt       time.Time `json:"issued_at"`
+}
+
+// SignedReceipt is a Receipt signed with the key of the node the route is paid to
+type SignedReceipt struct {
+	Receipt   Receipt `json:"receipt"`
+	Signature string  `json:"signature"`
+}
+
+// ReceiptMessage is the message signed by the server, so the signature can't be mistaken for the one
+// of a request identity.
+func ReceiptMessage(receipt Receipt) ([]byte, error) {
+	b, err := json.Marshal(receipt)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte("lightauth receipt "), b...), nil
+}
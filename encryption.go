@@ -0,0 +1,247 @@
+package lightauth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"strings"
+)
+
+// sEALEDPREFIX marks the tokens that have been sealed
+const sEALEDPREFIX = "sealed:"
+
+// Cipher seals the sensitive fields of records (preimages and tokens) before they reach the
+// DataProvider. Sealing must be deterministic, so sealed tokens can still be looked up in the store.
+// It can be backed by a KMS or a keyring, see SetCipher.
+type Cipher interface {
+	Seal(plaintext []byte) ([]byte, error)
+	Open(sealed []byte) ([]byte, error)
+}
+
+var recordCipher Cipher
+
+// SetCipher enables the encryption at rest of preimages and tokens. It must be called before starting
+// the client or the server. EncryptionKeyFile in lightauth.toml does the same with NewAESCipher.
+func SetCipher(c Cipher) {
+	recordCipher = c
+}
+
+type aesCipher struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+// NewAESCipher returns a Cipher using AES-256-GCM with keys derived from the given one. The nonce of
+// each value is derived from the value itself, which makes sealing deterministic.
+func NewAESCipher(key []byte) (Cipher, error) {
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+
+	block, err := aes.NewCipher(derive("lightauth encryption"))
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &aesCipher{aead: aead, nonceKey: derive("lightauth nonce")}, nil
+}
+
+func (c *aesCipher) Seal(plaintext []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, c.nonceKey)
+	mac.Write(plaintext)
+	nonce := mac.Sum(nil)[:c.aead.NonceSize()]
+
+	return c.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (c *aesCipher) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, errors.New("Lightauth error: sealed value is too short")
+	}
+
+	nonce := sealed[:c.aead.NonceSize()]
+	return c.aead.Open(nil, nonce, sealed[c.aead.NonceSize():], nil)
+}
+
+// readKeyFile reads a hex encoded key
+func readKeyFile(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return hex.DecodeString(strings.TrimSpace(string(b)))
+}
+
+// Sealer seals the sensitive fields of records with the cipher of encryption at rest. The client and
+// the server use it to seal their records on their way to the DataProvider and open them on their way
+// back.
+type Sealer struct {
+	cipher Cipher
+}
+
+// NewSealer returns the sealer of the records of a side, or nil when encryption at rest is disabled.
+// keyFile is the EncryptionKeyFile of lightauth.toml, used unless SetCipher was called.
+func NewSealer(keyFile string) (*Sealer, error) {
+	if keyFile != "" && recordCipher == nil {
+		key, err := readKeyFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if recordCipher, err = NewAESCipher(key); err != nil {
+			return nil, err
+		}
+	}
+
+	if recordCipher == nil {
+		return nil, nil
+	}
+
+	return &Sealer{cipher: recordCipher}, nil
+}
+
+// SealToken seals a token, which can still be looked up once sealed
+func (s *Sealer) SealToken(token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+
+	sealed, err := s.cipher.Seal([]byte(token))
+	if err != nil {
+		return "", err
+	}
+
+	return sEALEDPREFIX + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// OpenToken opens a token sealed with SealToken
+func (s *Sealer) OpenToken(token string) (string, error) {
+	if !strings.HasPrefix(token, sEALEDPREFIX) {
+		// Stored before encryption was enabled
+		return token, nil
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, sEALEDPREFIX))
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := s.cipher.Open(sealed)
+	return string(plaintext), err
+}
+
+// SealPreImage seals the preimage of an invoice
+func (s *Sealer) SealPreImage(preImage []byte) ([]byte, error) {
+	if len(preImage) == 0 {
+		return preImage, nil
+	}
+
+	return s.cipher.Seal(preImage)
+}
+
+// OpenPreImage opens a preimage sealed with SealPreImage
+func (s *Sealer) OpenPreImage(preImage []byte) ([]byte, error) {
+	if len(preImage) <= sha256.Size {
+		// Stored before encryption was enabled
+		return preImage, nil
+	}
+
+	return s.cipher.Open(preImage)
+}
+
+// CopyRecord returns a copy of the exported fields of the struct a record points to, which are the
+// ones stores keep, and none of its runtime state such as its lock. Records are sealed on a copy.
+func CopyRecord(r Record) Record {
+	v := reflect.ValueOf(r)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return r
+	}
+
+	original := v.Elem()
+	c := reflect.New(original.Type()).Elem()
+	for i := 0; i < original.NumField(); i++ {
+		if original.Type().Field(i).PkgPath == "" {
+			c.Field(i).Set(original.Field(i))
+		}
+	}
+
+	return c.Addr().Interface()
+}
+
+// SealingStore seals the sensitive fields of the records of the client or the server on their way to
+// their Store. The side opens them on their way back with the Sealer.
+type SealingStore struct {
+	Store
+	*Sealer
+	seal func(*Sealer, Record) (Record, error)
+}
+
+// NewSealingStore wraps the store of a side when encryption at rest is enabled, or returns nil when it
+// isn't. seal returns a copy of a record of the side with its sensitive fields sealed.
+func NewSealingStore(db Store, keyFile string, seal func(*Sealer, Record) (Record, error)) (*SealingStore, error) {
+	sealer, err := NewSealer(keyFile)
+	if err != nil || sealer == nil {
+		return nil, err
+	}
+
+	return &SealingStore{Store: db, Sealer: sealer, seal: seal}, nil
+}
+
+// Seal returns a copy of the record with its sensitive fields sealed. Records that can't be sealed
+// never reach the store.
+func (s *SealingStore) Seal(r Record) (Record, error) {
+	return s.seal(s.Sealer, r)
+}
+
+func (s *SealingStore) Create(r Record) (string, error) {
+	sealed, err := s.Seal(r)
+	if err != nil {
+		return "", err
+	}
+
+	return s.Store.Create(sealed)
+}
+
+func (s *SealingStore) Edit(r Record) {
+	sealed, err := s.Seal(r)
+	if err != nil {
+		log.Printf("Lightauth error: could not seal record: %v\n", err)
+		return
+	}
+
+	s.Store.Edit(sealed)
+}
+
+func (s *SealingStore) EditChecked(r Record) error {
+	sealed, err := s.Seal(r)
+	if err != nil {
+		return err
+	}
+
+	return EditChecked(s.Store, sealed)
+}
+
+// Ping forwards the health checks of the store, which is taken as reachable when it can't tell
+func (s *SealingStore) Ping(ctx context.Context) error {
+	if pinger, ok := s.Store.(Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package lightauth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// eRRORSBUFFER is the number of errors kept for the application before new ones are dropped
+const eRRORSBUFFER = 64
+
+var errorsChannel = make(chan error, eRRORSBUFFER)
+
+// Errors returns the channel where lightauth reports the errors of its background work, like losing
+// the invoice subscription or failing to save a settled invoice. Applications decide how to react to
+// them; lightauth keeps running and recovers on its own when it can. Errors are dropped when nobody
+// reads them and the channel is full.
+func Errors() <-chan error {
+	return errorsChannel
+}
+
+// ReportError logs an error of the background work of lightauth and sends it to Errors
+func ReportError(err error) {
+	log.Printf("%v\n", err)
+	select {
+	case errorsChannel <- err:
+	default:
+	}
+}
+
+// RecoverBackground turns a panic in a background goroutine into a reported error
+func RecoverBackground(name string) {
+	if r := recover(); r != nil {
+		ReportError(fmt.Errorf("Lightauth error: %v panicked: %v", name, r))
+	}
+}
+
+// StrictError is returned in strict mode when a Light-Auth header or a stored value isn't one lightauth
+// knows, where it would otherwise carry on with a default.
+type StrictError struct {
+	Field string
+	Value string
+}
+
+func (e *StrictError) Error() string {
+	return fmt.Sprintf("Lightauth error: strict mode: unexpected %v %q", e.Field, e.Value)
+}
+
+// Errors a payment can fail with, see PaymentError.
+var (
+	ErrNoRoute                 = errors.New("Lightauth error: no route found to pay the invoice")
+	ErrInsufficientFunds       = errors.New("Lightauth error: insufficient local balance to pay the invoice")
+	ErrPaymentTimeout          = errors.New("Lightauth error: payment timed out")
+	ErrIncorrectPaymentDetails = errors.New("Lightauth error: the destination rejected the payment details")
+	ErrPaymentFailed           = errors.New("Lightauth error: payment failed")
+)
+
+// PaymentError is returned when the lightning node could not pay an invoice. It wraps one of the
+// payment errors above, so callers can use errors.Is to decide how to react.
+type PaymentError struct {
+	PaymentRequest string
+	Reason         lnrpc.PaymentFailureReason
+}
+
+func (e *PaymentError) Error() string {
+	return e.Unwrap().Error() + " (" + e.Reason.String() + ")"
+}
+
+// Unwrap returns the class of the failure
+func (e *PaymentError) Unwrap() error {
+	switch e.Reason {
+	case lnrpc.PaymentFailureReason_FAILURE_REASON_NO_ROUTE:
+		return ErrNoRoute
+	case lnrpc.PaymentFailureReason_FAILURE_REASON_INSUFFICIENT_BALANCE:
+		return ErrInsufficientFunds
+	case lnrpc.PaymentFailureReason_FAILURE_REASON_TIMEOUT:
+		return ErrPaymentTimeout
+	case lnrpc.PaymentFailureReason_FAILURE_REASON_INCORRECT_PAYMENT_DETAILS:
+		return ErrIncorrectPaymentDetails
+	default:
+		return ErrPaymentFailed
+	}
+}
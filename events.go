@@ -0,0 +1,51 @@
+package lightauth
+
+import "time"
+
+// SettlementEvent is an invoice that has been paid. AmountMsat is what was paid, Route the key of the
+// route on the server side or the path on the client side, and Deferred tells that it paid for the
+// results of a past request. Cohort is the pricing cohort of the client on the server side, if any.
+type SettlementEvent struct {
+	PaymentHash    string    `json:"payment_hash"`
+	AmountMsat     int64     `json:"amount_msat"`
+	Route          string    `json:"route"`
+	Deferred       bool      `json:"deferred,omitempty"`
+	Cohort         string    `json:"cohort,omitempty"`
+	SettledAt      time.Time `json:"settled_at"`
+	ExpirationTime time.Time `json:"expiration_time"`
+}
+
+// sETTLEMENTSBUFFER is the number of settlements kept for the application before new ones are dropped
+const sETTLEMENTSBUFFER = 256
+
+// SettlementFeed is where the client or the server reports the invoices settled to the application.
+// Settlements are dropped when nobody reads them and the feed is full.
+type SettlementFeed chan SettlementEvent
+
+func NewSettlementFeed() SettlementFeed {
+	return make(SettlementFeed, sETTLEMENTSBUFFER)
+}
+
+func (f SettlementFeed) Notify(event SettlementEvent) {
+	select {
+	case f <- event:
+	default:
+	}
+}
+
+// NewSettlementEvent describes a settled invoice. amountMsat is 0 when the amount paid isn't known, in
+// which case the invoice is taken as paid in full.
+func NewSettlementEvent(info InvoiceInfo, route string, amountMsat int64) SettlementEvent {
+	if amountMsat == 0 {
+		amountMsat = int64(info.Fee) * 1000
+	}
+
+	return SettlementEvent{
+		PaymentHash:    info.PaymentHash,
+		AmountMsat:     amountMsat,
+		Route:          route,
+		Deferred:       info.Deferred,
+		SettledAt:      time.Now(),
+		ExpirationTime: info.ExpirationTime,
+	}
+}
@@ -0,0 +1,84 @@
+package lightauth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// hEALTHTIMEOUT bounds the time a health check waits on the node and the store
+const hEALTHTIMEOUT = 5 * time.Second
+
+// Pinger can be implemented by a DataProvider so health checks can tell whether it is reachable
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Health is the state of one side of lightauth. Subscribed only concerns servers, which learn about
+// payments through their invoice subscription. Errors lists why the other fields are false.
+type Health struct {
+	Ready         bool     `json:"ready"`
+	NodeReachable bool     `json:"node_reachable"`
+	SyncedToChain bool     `json:"synced_to_chain"`
+	Subscribed    bool     `json:"subscribed"`
+	StoreOK       bool     `json:"store_ok"`
+	Errors        []string `json:"errors,omitempty"`
+}
+
+// CheckHealth checks the node and the store of one side of lightauth, which is ready when both are
+// usable. Subscribed is left to the server, which needs its invoice subscription on top.
+func CheckHealth(backend LightningBackend, db Store) Health {
+	h := Health{StoreOK: true}
+	if backend == nil || db == nil {
+		h.Errors = append(h.Errors, "Lightauth error: not started")
+		return h
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hEALTHTIMEOUT)
+	defer cancel()
+
+	info, err := backend.GetInfo(ctx)
+	if err != nil {
+		h.Errors = append(h.Errors, "Lightauth error: node unreachable: "+err.Error())
+	} else {
+		h.NodeReachable = true
+		h.SyncedToChain = info.SyncedToChain
+		if !info.SyncedToChain {
+			h.Errors = append(h.Errors, "Lightauth error: node is not synced to chain")
+		}
+	}
+
+	if p, ok := db.(Pinger); ok {
+		if err := p.Ping(ctx); err != nil {
+			h.StoreOK = false
+			h.Errors = append(h.Errors, "Lightauth error: store unreachable: "+err.Error())
+		}
+	}
+
+	h.Ready = h.NodeReachable && h.SyncedToChain && h.StoreOK
+	return h
+}
+
+// HealthHandler serves the health of the given sides of lightauth, for use as /healthz, like
+// lightauth.HealthHandler(map[string]func() lightauth.Health{"server": server.Health}). It answers 200
+// when all of them are ready and 503 otherwise.
+func HealthHandler(sides map[string]func() Health) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := make(map[string]Health)
+		ready := true
+		for name, health := range sides {
+			response[name] = health()
+			ready = ready && response[name].Ready
+		}
+
+		statusCode := http.StatusOK
+		if !ready || len(response) == 0 {
+			statusCode = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		json.NewEncoder(w).Encode(response)
+	}
+}
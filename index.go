@@ -0,0 +1,40 @@
+package lightauth
+
+import (
+	"encoding/hex"
+	"sync"
+)
+
+// InvoiceIndex finds the invoices of the client or the server by payment hash, so settlements are
+// handled without going through every route, client or path.
+type InvoiceIndex[I any] struct {
+	mux      sync.RWMutex
+	invoices map[string]I
+}
+
+func NewInvoiceIndex[I any]() *InvoiceIndex[I] {
+	return &InvoiceIndex[I]{invoices: make(map[string]I)}
+}
+
+func (x *InvoiceIndex[I]) Add(paymentHash []byte, i I) {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	x.invoices[hex.EncodeToString(paymentHash)] = i
+}
+
+// Get returns the invoice of a hex encoded payment hash
+func (x *InvoiceIndex[I]) Get(paymentHash string) (I, bool) {
+	x.mux.RLock()
+	defer x.mux.RUnlock()
+
+	i, exists := x.invoices[paymentHash]
+	return i, exists
+}
+
+func (x *InvoiceIndex[I]) Remove(paymentHash []byte) {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	delete(x.invoices, hex.EncodeToString(paymentHash))
+}
@@ -0,0 +1,79 @@
+package lightauth
+
+import (
+	"sort"
+	"time"
+)
+
+// InvoiceFilter selects invoices by state. The states left nil match any invoice, and ExpiresAfter and
+// ExpiresBefore bound the expiration time of the invoices when they are set.
+type InvoiceFilter struct {
+	Settled       *bool
+	Claimed       *bool
+	Expired       *bool
+	Deferred      *bool
+	ExpiresAfter  time.Time
+	ExpiresBefore time.Time
+}
+
+// InvoiceInfo is a copy of the state of an invoice, for applications to inspect. Fee is in satoshis and
+// AmountPaidMsat in millisatoshis. Claims is the number of requests the invoice pays for and ClaimCount
+// those already made with it. The last three are only known on the server side.
+type InvoiceInfo struct {
+	PaymentRequest string    `json:"payment_request"`
+	PaymentHash    string    `json:"payment_hash"`
+	Fee            int       `json:"fee"`
+	Settled        bool      `json:"settled"`
+	Claimed        bool      `json:"claimed"`
+	Expired        bool      `json:"expired"`
+	Deferred       bool      `json:"deferred,omitempty"`
+	ExpirationTime time.Time `json:"expiration_time"`
+	AmountPaidMsat int64     `json:"amount_paid_msat,omitempty"`
+	Claims         int       `json:"claims"`
+	ClaimCount     int       `json:"claim_count"`
+}
+
+func matchesState(state *bool, value bool) bool {
+	return state == nil || *state == value
+}
+
+func (f InvoiceFilter) matches(info InvoiceInfo) bool {
+	if !matchesState(f.Settled, info.Settled) || !matchesState(f.Claimed, info.Claimed) {
+		return false
+	}
+
+	if !matchesState(f.Expired, info.Expired) || !matchesState(f.Deferred, info.Deferred) {
+		return false
+	}
+
+	if !f.ExpiresAfter.IsZero() && !info.ExpirationTime.After(f.ExpiresAfter) {
+		return false
+	}
+
+	return f.ExpiresBefore.IsZero() || info.ExpirationTime.Before(f.ExpiresBefore)
+}
+
+// Inspectable is an invoice of the client or the server
+type Inspectable interface {
+	Info() InvoiceInfo
+}
+
+// ListInvoices returns the state of the invoices matching the filter, sorted by expiration time
+func ListInvoices[I Inspectable](invoices []I, filter InvoiceFilter) []InvoiceInfo {
+	list := []InvoiceInfo{}
+	for _, i := range invoices {
+		if info := i.Info(); filter.matches(info) {
+			list = append(list, info)
+		}
+	}
+
+	sort.Slice(list, func(a, b int) bool {
+		if !list[a].ExpirationTime.Equal(list[b].ExpirationTime) {
+			return list[a].ExpirationTime.Before(list[b].ExpirationTime)
+		}
+
+		return list[a].PaymentRequest < list[b].PaymentRequest
+	})
+
+	return list
+}
@@ -0,0 +1,362 @@
+package lightauthtest
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/faurehu/lightauth/core"
+	"github.com/faurehu/lightauth/server"
+	"github.com/faurehu/lightauth/simnet"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+)
+
+// The conformance suites check that a server or a client speaks the lightauth protocol, so alternative
+// implementations and custom DataProviders can be verified against it. They are meant to be called
+// from the tests of a _test.go file, for instance:
+//
+//	func TestConformance(t *testing.T) {
+//		lightauthtest.WriteConformanceConfig(t.TempDir())
+//		network := simnet.New(1 << 40)
+//		if err := server.StartWithBackend(myProvider, network); err != nil {
+//			t.Fatal(err)
+//		}
+//		handler := http.HandlerFunc(server.Middleware(func(w http.ResponseWriter, r *http.Request) {}))
+//		lightauthtest.RunServerConformance(t, handler, lightauthtest.SimnetPayer(network))
+//	}
+
+// The routes a server under test must serve, as returned by ConformanceRoutes
+const (
+	ConformanceTimeRoute     = "GET/conformance/time"
+	ConformanceDiscreteRoute = "GET/conformance/discrete"
+)
+
+// cONFORMANCETIMEOUT bounds the wait for a payment to be seen by the server
+const cONFORMANCETIMEOUT = 10 * time.Second
+
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok")
+}
+
+// ConformanceRoutes returns the routes the conformance suites expect: a time route paid by the second
+// and a discrete route, both for 1 sat
+func ConformanceRoutes() []server.RouteInfo {
+	return []server.RouteInfo{
+		{Name: ConformanceTimeRoute, Fee: 1, MaxInvoices: 1, Mode: core.ModeTime, Period: core.PeriodSecond},
+		{Name: ConformanceDiscreteRoute, Fee: 1, MaxInvoices: 2, Mode: core.ModeDiscrete},
+	}
+}
+
+// WriteConformanceConfig writes a simnet lightauth configuration with the conformance routes in dir,
+// points lightauth at it and returns its path.
+func WriteConformanceConfig(dir string) (string, error) {
+	return WriteSimnetConfig(dir, ConformanceRoutes()...)
+}
+
+// WriteSimnetConfig writes a simnet lightauth configuration with the given routes in dir, points
+// lightauth at it and returns its path.
+func WriteSimnetConfig(dir string, routes ...server.RouteInfo) (string, error) {
+	conf := config{Network: "simnet", Routes: map[string]server.RouteInfo{}}
+	for _, v := range routes {
+		conf.Routes[v.Name] = v
+	}
+
+	return writeConfig(dir, conf)
+}
+
+// PayFunc pays an invoice of the server under test and returns its preimage
+type PayFunc func(ctx context.Context, paymentRequest string) ([]byte, error)
+
+// SimnetPayer pays invoices on a simnet network
+func SimnetPayer(network *simnet.Network) PayFunc {
+	return func(ctx context.Context, paymentRequest string) ([]byte, error) {
+		payment, err := network.SendPayment(ctx, &routerrpc.SendPaymentRequest{PaymentRequest: paymentRequest})
+		if err != nil {
+			return nil, err
+		}
+
+		if payment.Status != lnrpc.Payment_SUCCEEDED {
+			return nil, fmt.Errorf("lightauthtest: payment failed: %v", payment.FailureReason)
+		}
+
+		return hex.DecodeString(payment.PaymentPreimage)
+	}
+}
+
+// exchange is a response of the server under test, with its body read
+type exchange struct {
+	*http.Response
+	body string
+}
+
+func send(t *testing.T, url string, headers map[string]string) exchange {
+	t.Helper()
+
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	core.AnnounceVersion(request.Header)
+	for header, value := range headers {
+		request.Header.Set(header, value)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return exchange{Response: response, body: string(body)}
+}
+
+// expect checks the status and, when the server answers with JSON errors, the error code of a response
+func (e exchange) expect(t *testing.T, statusCode int, result core.Result, code core.Code) {
+	t.Helper()
+
+	params, isLightauth := core.ParseHeader(e.Header)
+	if !isLightauth {
+		t.Fatalf("lightauthtest: no Light-Auth header in the response")
+	}
+
+	if params["version"] != core.ProtocolVersion {
+		t.Errorf("lightauthtest: Light-Auth version is %q, want %q", params["version"], core.ProtocolVersion)
+	}
+
+	if e.StatusCode != statusCode || core.Result(params["result"]) != result {
+		t.Fatalf("lightauthtest: got %v with result %q, want %v with result %q: %v", e.StatusCode, params["result"], statusCode, result, e.body)
+	}
+
+	if code == "" || !strings.HasPrefix(e.Header.Get("Content-Type"), "application/json") {
+		return
+	}
+
+	var errorResponse core.ErrorResponse
+	if err := json.Unmarshal([]byte(e.body), &errorResponse); err != nil {
+		t.Fatalf("lightauthtest: error response isn't JSON: %v", err)
+	}
+
+	if errorResponse.Code != code {
+		t.Fatalf("lightauthtest: error code is %q, want %q", errorResponse.Code, code)
+	}
+}
+
+func (e exchange) token(t *testing.T) string {
+	t.Helper()
+
+	token := core.ReadHeader(e.Header, core.HeaderToken)
+	if token == "" {
+		t.Fatalf("lightauthtest: no Light-Auth-Token in the response")
+	}
+
+	return token
+}
+
+func (e exchange) invoices(t *testing.T) []core.JSONInvoice {
+	t.Helper()
+
+	invoices := []core.JSONInvoice{}
+	if err := json.Unmarshal([]byte(core.ReadHeader(e.Header, core.HeaderInvoices)), &invoices); err != nil || len(invoices) == 0 {
+		t.Fatalf("lightauthtest: no invoices in Light-Auth-Invoices: %v", err)
+	}
+
+	return invoices
+}
+
+// sendPaid sends a request until the server has seen its payment, as settlements reach the server
+// asynchronously
+func sendPaid(t *testing.T, url string, headers map[string]string, pending func(exchange) bool) exchange {
+	t.Helper()
+
+	deadline := time.Now().Add(cONFORMANCETIMEOUT)
+	for {
+		e := send(t, url, headers)
+		if !pending(e) || time.Now().After(deadline) {
+			return e
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// RunServerConformance checks that handler serves the conformance routes following the protocol: the
+// negotiation of a token and invoices, payments in both modes, the expiration of paid time, the replay
+// of claimed invoices and the errors for missing or wrong credentials. pay pays the invoices the
+// handler issues.
+func RunServerConformance(t *testing.T, handler http.Handler, pay PayFunc) {
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	timeURL := server.URL + strings.TrimPrefix(ConformanceTimeRoute, http.MethodGet)
+	discreteURL := server.URL + strings.TrimPrefix(ConformanceDiscreteRoute, http.MethodGet)
+
+	t.Run("negotiation", func(t *testing.T) {
+		e := send(t, discreteURL, nil)
+		e.expect(t, http.StatusBadRequest, core.ResultError, core.CodeMissingInvoice)
+		e.token(t)
+		e.invoices(t)
+
+		for header, want := range map[string]string{core.HeaderMode: string(core.ModeDiscrete), core.HeaderFee: "1", core.HeaderName: ConformanceDiscreteRoute} {
+			if got := core.ReadHeader(e.Header, header); got != want {
+				t.Errorf("lightauthtest: %v is %q, want %q", header, got, want)
+			}
+		}
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		send(t, discreteURL, map[string]string{core.HeaderToken: "conformance"}).expect(t, http.StatusBadRequest, core.ResultError, core.CodeInvalidToken)
+	})
+
+	t.Run("missing preimage", func(t *testing.T) {
+		e := send(t, discreteURL, nil)
+		headers := map[string]string{core.HeaderToken: e.token(t), core.HeaderInvoice: e.invoices(t)[0].PaymentRequest}
+		send(t, discreteURL, headers).expect(t, http.StatusBadRequest, core.ResultError, core.CodeMissingPreImage)
+	})
+
+	t.Run("wrong preimage", func(t *testing.T) {
+		e := send(t, discreteURL, nil)
+		headers := map[string]string{
+			core.HeaderToken:    e.token(t),
+			core.HeaderInvoice:  e.invoices(t)[0].PaymentRequest,
+			core.HeaderPreImage: strings.Repeat("00", 32),
+		}
+		send(t, discreteURL, headers).expect(t, http.StatusBadRequest, core.ResultError, core.CodeInvalidCredentials)
+	})
+
+	t.Run("discrete payment and replay", func(t *testing.T) {
+		e := send(t, discreteURL, nil)
+		invoice := e.invoices(t)[0].PaymentRequest
+		preImage, err := pay(context.Background(), invoice)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		headers := map[string]string{
+			core.HeaderToken:    e.token(t),
+			core.HeaderInvoice:  invoice,
+			core.HeaderPreImage: hex.EncodeToString(preImage),
+		}
+		paid := sendPaid(t, discreteURL, headers, func(e exchange) bool { return e.StatusCode == http.StatusConflict })
+		paid.expect(t, http.StatusOK, core.ResultOK, "")
+		if got := core.ReadHeader(paid.Header, core.HeaderInvoice); got != invoice {
+			t.Errorf("lightauthtest: Light-Auth-Invoice is %q, want the invoice claimed", got)
+		}
+
+		headers[core.HeaderToken] = paid.token(t)
+		send(t, discreteURL, headers).expect(t, http.StatusBadRequest, core.ResultError, core.CodeInvoiceClaimed)
+	})
+
+	t.Run("time payment and expiration", func(t *testing.T) {
+		e := send(t, timeURL, nil)
+		e.expect(t, http.StatusPaymentRequired, core.ResultError, core.CodeTimeExpired)
+		if got := core.ReadHeader(e.Header, core.HeaderTimePeriod); got != string(core.PeriodSecond) {
+			t.Errorf("lightauthtest: Light-Auth-Time-Period is %q, want \"second\"", got)
+		}
+
+		if _, err := pay(context.Background(), e.invoices(t)[0].PaymentRequest); err != nil {
+			t.Fatal(err)
+		}
+
+		headers := map[string]string{core.HeaderToken: e.token(t)}
+		paid := sendPaid(t, timeURL, headers, func(e exchange) bool { return e.StatusCode == http.StatusPaymentRequired })
+		paid.expect(t, http.StatusOK, core.ResultOK, "")
+
+		expirationTime, err := time.Parse(time.RFC3339, core.ReadHeader(paid.Header, core.HeaderExpirationTime))
+		if err != nil {
+			t.Fatalf("lightauthtest: Light-Auth-Expiration-Time is not an RFC 3339 date: %v", err)
+		}
+
+		time.Sleep(time.Until(expirationTime) + time.Second)
+		headers[core.HeaderToken] = paid.token(t)
+		send(t, timeURL, headers).expect(t, http.StatusPaymentRequired, core.ResultError, core.CodeTimeExpired)
+	})
+}
+
+// Doer sends a request through a client under test, going through the whole protocol like client.Do
+type Doer func(request *http.Request) (*http.Response, error)
+
+// RunClientConformance checks that a client pays for and makes requests to a reference lightauth
+// server: requests in both modes, again after the time paid for has run out, and to paths that aren't
+// paid for. start starts the client under test on the simnet network the server takes payments on,
+// for instance:
+//
+//	lightauthtest.RunClientConformance(t, func(t *testing.T, network *simnet.Network) lightauthtest.Doer {
+//		if err := client.StartWithBackend(simnet.NewMemoryProvider(), network); err != nil {
+//			t.Fatal(err)
+//		}
+//		return client.Do
+//	})
+//
+// The reference server is the lightauth server of the process, started on the conformance routes.
+func RunClientConformance(t *testing.T, start func(t *testing.T, network *simnet.Network) Doer) {
+	if _, err := WriteConformanceConfig(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	network := simnet.New(1 << 40)
+	if err := server.StartWithBackend(simnet.NewMemoryProvider(), network); err != nil {
+		t.Fatal(err)
+	}
+	reference := httptest.NewServer(http.HandlerFunc(server.Middleware(okHandler)))
+	defer reference.Close()
+
+	do := start(t, network)
+	request := func(t *testing.T, path string, lightauthResult core.Result) {
+		t.Helper()
+
+		ctx, cancel := context.WithTimeout(context.Background(), cONFORMANCETIMEOUT)
+		defer cancel()
+
+		r, err := http.NewRequest(http.MethodGet, reference.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := do(r.WithContext(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+
+		result := core.ReadResult(response.Header)
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1<<10))
+		if response.StatusCode != http.StatusOK || result != lightauthResult || string(body) != "ok" {
+			t.Fatalf("lightauthtest: got %v with result %q for %v: %s", response.StatusCode, result, path, body)
+		}
+	}
+
+	t.Run("discrete", func(t *testing.T) {
+		balance := network.Balance()
+		for k := 0; k < 3; k++ {
+			request(t, strings.TrimPrefix(ConformanceDiscreteRoute, http.MethodGet), core.ResultOK)
+		}
+
+		if spent := balance - network.Balance(); spent < 3 {
+			t.Errorf("lightauthtest: %v sats were paid for 3 requests of 1 sat", spent)
+		}
+	})
+
+	t.Run("time and expiration", func(t *testing.T) {
+		request(t, strings.TrimPrefix(ConformanceTimeRoute, http.MethodGet), core.ResultOK)
+		time.Sleep(2 * time.Second)
+		request(t, strings.TrimPrefix(ConformanceTimeRoute, http.MethodGet), core.ResultOK)
+	})
+
+	t.Run("unpaid path", func(t *testing.T) {
+		request(t, "/conformance/free", "")
+	})
+}
@@ -0,0 +1,110 @@
+// Package lightauthtest provides helpers to run integration tests of lightauth clients and servers
+// against lnd nodes of a local regtest network, such as the ones started by Polar, without any
+// docker-compose setup of its own.
+package lightauthtest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/server"
+)
+
+// Node holds the connection details of an lnd node of the regtest network
+type Node struct {
+	RPCAddr      string
+	TLSCertPath  string
+	MacaroonPath string
+}
+
+type config struct {
+	ServerAddr   string
+	CAFile       string
+	MacaroonPath string
+	Network      string
+	Routes       map[string]server.RouteInfo
+}
+
+// PolarNode returns the node with the given name of a Polar network. Polar chooses the gRPC port of each
+// node, so it has to be given.
+func PolarNode(networkID int, name string, port int) Node {
+	home, _ := os.UserHomeDir()
+	dir := filepath.Join(home, ".polar", "networks", strconv.Itoa(networkID), "volumes", "lnd", name)
+
+	return Node{
+		RPCAddr:      fmt.Sprintf("127.0.0.1:%d", port),
+		TLSCertPath:  filepath.Join(dir, "tls.cert"),
+		MacaroonPath: filepath.Join(dir, "data", "chain", "bitcoin", "regtest", "admin.macaroon"),
+	}
+}
+
+// NodeFromEnv reads a node from the <PREFIX>_RPC_ADDR, <PREFIX>_TLS_CERT and <PREFIX>_MACAROON environment
+// variables. It returns false if any of them is missing.
+func NodeFromEnv(prefix string) (Node, bool) {
+	node := Node{
+		RPCAddr:      os.Getenv(prefix + "_RPC_ADDR"),
+		TLSCertPath:  os.Getenv(prefix + "_TLS_CERT"),
+		MacaroonPath: os.Getenv(prefix + "_MACAROON"),
+	}
+
+	return node, node.RPCAddr != "" && node.TLSCertPath != "" && node.MacaroonPath != ""
+}
+
+// RequireNode returns the node described by the environment, skipping the test if there is none or its
+// files can't be read.
+func RequireNode(t testing.TB, prefix string) Node {
+	t.Helper()
+
+	node, ok := NodeFromEnv(prefix)
+	if !ok {
+		t.Skipf("lightauthtest: %v_* environment variables are not set, skipping regtest test", prefix)
+	}
+
+	for _, f := range []string{node.TLSCertPath, node.MacaroonPath} {
+		if _, err := os.Stat(f); err != nil {
+			t.Skipf("lightauthtest: %v", err)
+		}
+	}
+
+	return node
+}
+
+// WriteConfig writes a regtest lightauth configuration for the node and routes in dir, points lightauth
+// at it and returns its path.
+func WriteConfig(dir string, node Node, routes ...server.RouteInfo) (string, error) {
+	conf := config{
+		ServerAddr:   node.RPCAddr,
+		CAFile:       node.TLSCertPath,
+		MacaroonPath: node.MacaroonPath,
+		Network:      "regtest",
+		Routes:       map[string]server.RouteInfo{},
+	}
+
+	for _, v := range routes {
+		conf.Routes[v.Name] = v
+	}
+
+	return writeConfig(dir, conf)
+}
+
+func writeConfig(dir string, conf config) (string, error) {
+	path := filepath.Join(dir, "lightauth.toml")
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := toml.NewEncoder(f).Encode(conf); err != nil {
+		return "", err
+	}
+
+	lightauth.SetConfigPath(path)
+
+	return path, nil
+}
@@ -0,0 +1,291 @@
+package lightauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/faurehu/lightauth/core"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+)
+
+// lNBITSPOLL is how often an outgoing LNbits payment is checked until it completes
+const lNBITSPOLL = time.Second
+
+// lnbitsBackend uses an LNbits wallet as node. LNbits doesn't sign its webhook calls, so every payment
+// they notify is checked with the API before being accepted.
+type lnbitsBackend struct {
+	endpoint   string
+	key        string
+	webhookURL string
+	payments   paymentFeed
+	httpClient *http.Client
+}
+
+// NewLNbitsBackend returns a LightningBackend for the LNbits wallet with the given admin key (or
+// invoice key, for servers that don't pay). Servers receive payments through
+// server.LNbitsWebhookHandler, which must be mounted at webhookURL. Preflight checks and signed
+// requests are not available.
+func NewLNbitsBackend(endpoint string, key string, webhookURL string) LightningBackend {
+	return &lnbitsBackend{
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		key:        key,
+		webhookURL: webhookURL,
+		payments:   make(paymentFeed, pAYMENTFEEDBUFFER),
+		httpClient: http.DefaultClient,
+	}
+}
+
+// parseLNbits reads the LNbits option of lightauth.toml, the URL of the LNbits instance with the key
+// of the wallet as password, e.g. https://:key@lnbits.example.com
+func parseLNbits(lnbitsURL string) (string, string, error) {
+	u, err := url.Parse(lnbitsURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", "", errors.New("Lightauth error: LNbits must be an https:// URL")
+	}
+
+	key, _ := u.User.Password()
+	if key == "" {
+		return "", "", errors.New("Lightauth error: LNbits URL has no wallet key")
+	}
+
+	u.User = nil
+	return u.String(), key, nil
+}
+
+func (b *lnbitsBackend) call(ctx context.Context, method string, path string, body interface{}, result interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	request, err := http.NewRequest(method, b.endpoint+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("X-Api-Key", b.key)
+	request.Header.Set("Content-Type", "application/json")
+
+	r, err := b.httpClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	response, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusCreated {
+		return fmt.Errorf("Lightauth error: LNbits answered with status %v: %s", r.StatusCode, response)
+	}
+
+	return json.Unmarshal(response, result)
+}
+
+// GetInfo only tells whether the wallet can be reached, LNbits doesn't say which network it is on
+func (b *lnbitsBackend) GetInfo(ctx context.Context) (*lnrpc.GetInfoResponse, error) {
+	wallet := struct {
+		Name string `json:"name"`
+	}{}
+	if err := b.call(ctx, "GET", "/api/v1/wallet", nil, &wallet); err != nil {
+		return nil, err
+	}
+
+	return &lnrpc.GetInfoResponse{Alias: wallet.Name, SyncedToChain: true}, nil
+}
+
+// AddInvoice can't make private invoices or add route hints, the funding source of LNbits does
+func (b *lnbitsBackend) AddInvoice(ctx context.Context, invoice *lnrpc.Invoice) (*lnrpc.AddInvoiceResponse, error) {
+	params := map[string]interface{}{
+		"out":    false,
+		"amount": invoice.Value,
+		"memo":   invoice.Memo,
+	}
+	if invoice.Expiry != 0 {
+		params["expiry"] = invoice.Expiry
+	}
+	if b.webhookURL != "" {
+		params["webhook"] = b.webhookURL
+	}
+
+	created := struct {
+		PaymentHash    string `json:"payment_hash"`
+		PaymentRequest string `json:"payment_request"`
+		Bolt11         string `json:"bolt11"`
+	}{}
+	if err := b.call(ctx, "POST", "/api/v1/payments", params, &created); err != nil {
+		return nil, err
+	}
+
+	rHash, err := hex.DecodeString(created.PaymentHash)
+	if err != nil {
+		return nil, err
+	}
+
+	paymentRequest := created.PaymentRequest
+	if paymentRequest == "" {
+		paymentRequest = created.Bolt11
+	}
+
+	return &lnrpc.AddInvoiceResponse{RHash: rHash, PaymentRequest: paymentRequest}, nil
+}
+
+func (b *lnbitsBackend) SubscribeInvoices(ctx context.Context) (InvoiceStream, error) {
+	return b.payments.stream(ctx), nil
+}
+
+func (b *lnbitsBackend) DecodePayReq(ctx context.Context, payReq string) (*lnrpc.PayReq, error) {
+	return core.DecodeBOLT11(payReq)
+}
+
+// lnbitsPayment is the state of a payment of the wallet
+type lnbitsPayment struct {
+	Paid     bool   `json:"paid"`
+	Preimage string `json:"preimage"`
+	Status   string `json:"status"`
+}
+
+func (b *lnbitsBackend) payment(ctx context.Context, paymentHash string) (*lnbitsPayment, error) {
+	payment := &lnbitsPayment{}
+	if err := b.call(ctx, "GET", "/api/v1/payments/"+paymentHash, nil, payment); err != nil {
+		return nil, err
+	}
+
+	return payment, nil
+}
+
+// SendPayment waits for the payment to complete, LNbits may answer while it is still in flight
+func (b *lnbitsBackend) SendPayment(ctx context.Context, request *routerrpc.SendPaymentRequest) (*lnrpc.Payment, error) {
+	sent := struct {
+		PaymentHash string `json:"payment_hash"`
+	}{}
+	params := map[string]interface{}{"out": true, "bolt11": request.PaymentRequest}
+	if err := b.call(ctx, "POST", "/api/v1/payments", params, &sent); err != nil {
+		return nil, err
+	}
+
+	result := &lnrpc.Payment{PaymentRequest: request.PaymentRequest, PaymentHash: sent.PaymentHash}
+	for {
+		payment, err := b.payment(ctx, sent.PaymentHash)
+		if err != nil {
+			return nil, err
+		}
+
+		if payment.Paid {
+			result.Status = lnrpc.Payment_SUCCEEDED
+			result.PaymentPreimage = payment.Preimage
+			return result, nil
+		}
+
+		if payment.Status == "failed" {
+			log.Printf("Lightauth error: LNbits failed to pay %v\n", sent.PaymentHash)
+			result.Status = lnrpc.Payment_FAILED
+			result.FailureReason = lnrpc.PaymentFailureReason_FAILURE_REASON_ERROR
+			return result, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lNBITSPOLL):
+		}
+	}
+}
+
+// ChannelBalance is the balance of the wallet, which LNbits keeps in millisatoshis
+func (b *lnbitsBackend) ChannelBalance(ctx context.Context) (int64, error) {
+	wallet := struct {
+		Balance int64 `json:"balance"`
+	}{}
+	if err := b.call(ctx, "GET", "/api/v1/wallet", nil, &wallet); err != nil {
+		return 0, err
+	}
+
+	return wallet.Balance / 1000, nil
+}
+
+func (b *lnbitsBackend) QueryRoutes(ctx context.Context, request *lnrpc.QueryRoutesRequest) (*lnrpc.QueryRoutesResponse, error) {
+	return nil, ErrNotSupported
+}
+
+func (b *lnbitsBackend) SignMessage(ctx context.Context, message []byte) (string, error) {
+	return "", ErrNotSupported
+}
+
+func (b *lnbitsBackend) VerifyMessage(ctx context.Context, message []byte, signature string) (string, error) {
+	return "", ErrNotSupported
+}
+
+// webhook notifies the payments LNbits calls about once the API confirms them. It tells whether the
+// payment is one of the wallet of the backend, and writes nothing when it isn't.
+func (b *lnbitsBackend) webhook(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	event := struct {
+		PaymentHash string `json:"payment_hash"`
+	}{}
+	if err := json.Unmarshal(body, &event); err != nil {
+		http.Error(w, "invalid event", http.StatusBadRequest)
+		return true
+	}
+
+	paymentHash, err := hex.DecodeString(event.PaymentHash)
+	if err != nil {
+		http.Error(w, "invalid payment hash", http.StatusBadRequest)
+		return true
+	}
+
+	ctx, cancel := RPCContext(r.Context())
+	defer cancel()
+
+	payment, err := b.payment(ctx, event.PaymentHash)
+	if err != nil {
+		return false
+	}
+
+	if payment.Paid {
+		if err := b.payments.notify(r.Context(), paymentHash, 0); err != nil {
+			http.Error(w, "payment not processed", http.StatusServiceUnavailable)
+			return true
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return true
+}
+
+// ServeLNbitsWebhook handles a webhook call of LNbits for backend, telling whether the call was for
+// it: backend runs on LNbits and the payment is one of its wallet. Otherwise nothing is written and
+// the body of r is left to be read again, so the call can be tried on other backends. The server
+// mounts it as its LNbitsWebhookHandler.
+func ServeLNbitsWebhook(backend LightningBackend, w http.ResponseWriter, r *http.Request) bool {
+	lnbits, ok := backend.(*lnbitsBackend)
+	if !ok {
+		return false
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+
+	return lnbits.webhook(w, r, body)
+}
@@ -0,0 +1,65 @@
+package lightauth
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strings"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// lndConnection is the node address, TLS credentials and macaroon decoded from an lndconnect URI
+type lndConnection struct {
+	address  string
+	creds    credentials.TransportCredentials
+	macaroon []byte
+}
+
+// parseLNDConnect decodes an lndconnect://host:port?cert=...&macaroon=... URI, as exported by node
+// managers and hosted nodes. Both the certificate (DER) and the macaroon are base64url encoded. When
+// there is no certificate, the node is expected to present one signed by a public authority.
+func parseLNDConnect(uri string) (*lndConnection, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "lndconnect" || u.Host == "" {
+		return nil, errors.New("Lightauth error: LNDConnect must be an lndconnect:// URI")
+	}
+
+	query := u.Query()
+	macaroon, err := decodeLNDConnectParam(query.Get("macaroon"))
+	if err != nil || len(macaroon) == 0 {
+		return nil, errors.New("Lightauth error: lndconnect URI has no valid macaroon")
+	}
+
+	conn := &lndConnection{address: u.Host, macaroon: macaroon}
+
+	if query.Get("cert") == "" {
+		conn.creds = credentials.NewClientTLSFromCert(nil, "")
+		return conn, nil
+	}
+
+	der, err := decodeLNDConnectParam(query.Get("cert"))
+	if err != nil {
+		return nil, errors.New("Lightauth error: lndconnect URI has an invalid certificate")
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	conn.creds = credentials.NewClientTLSFromCert(pool, "")
+
+	return conn, nil
+}
+
+func decodeLNDConnectParam(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
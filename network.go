@@ -0,0 +1,42 @@
+package lightauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// ErrWrongNetwork is returned when an invoice is meant for a different network than the one configured
+var ErrWrongNetwork = errors.New("Lightauth error: invoice is for a different network than the one configured")
+
+var networks = map[string]bool{
+	"mainnet": true,
+	"testnet": true,
+	"regtest": true,
+	"signet":  true,
+	"simnet":  true,
+}
+
+// CheckNetwork returns the network lightauth operates on. If one is configured, the node must be on it.
+func CheckNetwork(backend LightningBackend, configured string) (string, error) {
+	if configured != "" && !networks[configured] {
+		return "", fmt.Errorf("Lightauth error: unknown network %v", configured)
+	}
+
+	ctx, cancel := RPCContext(context.Background())
+	defer cancel()
+
+	info, err := backend.GetInfo(ctx)
+	if err != nil || len(info.Chains) == 0 {
+		log.Printf("Lightauth error: Could not fetch the network of the node: %v\n", err)
+		return configured, nil
+	}
+
+	network := info.Chains[0].Network
+	if configured != "" && configured != network {
+		return "", fmt.Errorf("Lightauth error: lightauth is configured for %v but the node is on %v", configured, network)
+	}
+
+	return network, nil
+}
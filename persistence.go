@@ -0,0 +1,123 @@
+package lightauth
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// dEFAULTFLUSHINTERVAL is how often pending edits are written in write-behind mode
+const dEFAULTFLUSHINTERVAL = time.Second
+
+// PersistenceConfig details how records are written to the DataProvider. In the default sync mode
+// every change is written before the request goes on. In write-behind mode edits are queued and
+// written every FlushInterval, so a crash loses the changes of the last interval at most. Settlements
+// and claims are always written straight away, as losing them would make clients pay twice or reuse
+// an invoice.
+//
+// Journal is a local file where the settlements that couldn't be written to the store are kept until
+// they are, so they survive a restart.
+type PersistenceConfig struct {
+	Mode          string
+	FlushInterval string
+	Journal       string
+}
+
+// Store is where the records of the client or the server are written, the part of their DataProvider
+// both have in common
+type Store interface {
+	Create(Record) (string, error)
+	Edit(Record)
+}
+
+// Record is an entity of the client or the server kept in their DataProvider: a Route, a Client, a
+// Path or an Invoice
+type Record interface{}
+
+// CheckedEditor can be implemented by a DataProvider to tell when an edit failed. Without it lightauth
+// can't know, and settlements that fail to be written are lost.
+type CheckedEditor interface {
+	EditChecked(r Record) error
+}
+
+// writeBehind holds the records edited since the last flush along with the store they belong to. A
+// record edited several times is written once.
+type writeBehind struct {
+	mux     sync.Mutex
+	enabled bool
+	pending map[Record]Store
+}
+
+var editQueue = &writeBehind{pending: make(map[Record]Store)}
+
+// StartPersistence applies the persistence configuration, starting the flush loop on write-behind mode
+func StartPersistence(conf PersistenceConfig) {
+	if conf.Mode != "write-behind" {
+		return
+	}
+
+	interval, err := ParseDuration(conf.FlushInterval)
+	if err != nil || interval <= 0 {
+		interval = dEFAULTFLUSHINTERVAL
+	}
+
+	editQueue.mux.Lock()
+	defer editQueue.mux.Unlock()
+
+	if editQueue.enabled {
+		// The other role has already started it
+		return
+	}
+	editQueue.enabled = true
+
+	go func() {
+		defer RecoverBackground("write-behind flush")
+		for range time.Tick(interval) {
+			editQueue.flush()
+		}
+	}()
+}
+
+// Edit writes a record to its store, or queues it in write-behind mode unless it must be durable
+func Edit(db Store, r Record, durable bool) error {
+	editQueue.mux.Lock()
+	if editQueue.enabled && !durable {
+		editQueue.pending[r] = db
+		editQueue.mux.Unlock()
+		return nil
+	}
+
+	delete(editQueue.pending, r)
+	editQueue.mux.Unlock()
+
+	return EditChecked(db, r)
+}
+
+// EditChecked writes a record to its store, telling whether it was written when the store is a
+// CheckedEditor
+func EditChecked(db Store, r Record) error {
+	if checked, ok := db.(CheckedEditor); ok {
+		return checked.EditChecked(r)
+	}
+
+	db.Edit(r)
+	return nil
+}
+
+func (w *writeBehind) flush() {
+	w.mux.Lock()
+	pending := w.pending
+	w.pending = make(map[Record]Store)
+	w.mux.Unlock()
+
+	for r, db := range pending {
+		if err := EditChecked(db, r); err != nil {
+			ReportError(fmt.Errorf("Lightauth error: could not write queued edit: %v", err))
+		}
+	}
+}
+
+// Flush writes the edits queued in write-behind mode. Applications should call it before exiting.
+func Flush() {
+	editQueue.flush()
+}
@@ -0,0 +1,306 @@
+package lightauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/faurehu/lightauth/core"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+)
+
+// pAYMENTFEEDBUFFER is the number of payments notified by webhooks kept until the server reads them
+const pAYMENTFEEDBUFFER = 64
+
+// paymentFeed turns the payments notified by a webhook into an InvoiceStream
+type paymentFeed chan *lnrpc.Invoice
+
+func (f paymentFeed) stream(ctx context.Context) InvoiceStream {
+	return &feedStream{ctx: ctx, feed: f}
+}
+
+type feedStream struct {
+	ctx  context.Context
+	feed paymentFeed
+}
+
+// notify waits for the server to take the payment, so the webhook is only answered once it has
+func (f paymentFeed) notify(ctx context.Context, paymentHash []byte, amountPaidMsat int64) error {
+	invoice := &lnrpc.Invoice{RHash: paymentHash, Settled: true, State: lnrpc.Invoice_SETTLED, AmtPaidMsat: amountPaidMsat}
+	select {
+	case f <- invoice:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *feedStream) Recv() (*lnrpc.Invoice, error) {
+	select {
+	case invoice := <-s.feed:
+		return invoice, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+// phoenixdBackend talks to the HTTP API of phoenixd and learns about payments through its webhook
+type phoenixdBackend struct {
+	endpoint      string
+	password      string
+	webhookSecret string
+	payments      paymentFeed
+	httpClient    *http.Client
+}
+
+// NewPhoenixdBackend returns a LightningBackend for the phoenixd listening at endpoint, e.g.
+// http://127.0.0.1:9740, with the http-password of its configuration. Payments are received through
+// server.PhoenixdWebhookHandler, which must be mounted at the webhook URL phoenixd is configured with.
+// Preflight checks are not available, phoenixd doesn't expose routes.
+func NewPhoenixdBackend(endpoint string, password string, webhookSecret string) LightningBackend {
+	return &phoenixdBackend{
+		endpoint:      strings.TrimSuffix(endpoint, "/"),
+		password:      password,
+		webhookSecret: webhookSecret,
+		payments:      make(paymentFeed, pAYMENTFEEDBUFFER),
+		httpClient:    http.DefaultClient,
+	}
+}
+
+// parsePhoenixd reads the Phoenixd option of lightauth.toml, the URL of phoenixd with its
+// http-password as the password of the URL, e.g. http://:password@127.0.0.1:9740
+func parsePhoenixd(phoenixdURL string) (string, string, error) {
+	u, err := url.Parse(phoenixdURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", "", errors.New("Lightauth error: Phoenixd must be an http:// URL")
+	}
+
+	password, _ := u.User.Password()
+	if password == "" {
+		return "", "", errors.New("Lightauth error: Phoenixd URL has no password")
+	}
+
+	u.User = nil
+	return u.String(), password, nil
+}
+
+func (b *phoenixdBackend) call(ctx context.Context, method string, path string, form url.Values, result interface{}) error {
+	request, err := http.NewRequest(method, b.endpoint+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	request.SetBasicAuth("", b.password)
+	if form != nil {
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	r, err := b.httpClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("Lightauth error: phoenixd answered with status %v: %s", r.StatusCode, body)
+	}
+
+	return json.Unmarshal(body, result)
+}
+
+func (b *phoenixdBackend) GetInfo(ctx context.Context) (*lnrpc.GetInfoResponse, error) {
+	info := struct {
+		NodeID      string `json:"nodeId"`
+		Chain       string `json:"chain"`
+		BlockHeight uint32 `json:"blockHeight"`
+		Version     string `json:"version"`
+	}{}
+	if err := b.call(ctx, "GET", "/getinfo", nil, &info); err != nil {
+		return nil, err
+	}
+
+	response := &lnrpc.GetInfoResponse{
+		IdentityPubkey: info.NodeID,
+		BlockHeight:    info.BlockHeight,
+		Version:        info.Version,
+		SyncedToChain:  true,
+	}
+	if info.Chain != "" {
+		response.Chains = []*lnrpc.Chain{{Chain: "bitcoin", Network: info.Chain}}
+	}
+
+	return response, nil
+}
+
+// AddInvoice can't make private invoices or add route hints, phoenixd decides on its own
+func (b *phoenixdBackend) AddInvoice(ctx context.Context, invoice *lnrpc.Invoice) (*lnrpc.AddInvoiceResponse, error) {
+	form := url.Values{}
+	form.Set("description", invoice.Memo)
+	form.Set("amountSat", strconv.FormatInt(invoice.Value, 10))
+	if invoice.Expiry != 0 {
+		form.Set("expirySeconds", strconv.FormatInt(invoice.Expiry, 10))
+	}
+
+	created := struct {
+		PaymentHash string `json:"paymentHash"`
+		Serialized  string `json:"serialized"`
+	}{}
+	if err := b.call(ctx, "POST", "/createinvoice", form, &created); err != nil {
+		return nil, err
+	}
+
+	rHash, err := hex.DecodeString(created.PaymentHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lnrpc.AddInvoiceResponse{RHash: rHash, PaymentRequest: created.Serialized}, nil
+}
+
+func (b *phoenixdBackend) SubscribeInvoices(ctx context.Context) (InvoiceStream, error) {
+	return b.payments.stream(ctx), nil
+}
+
+func (b *phoenixdBackend) DecodePayReq(ctx context.Context, payReq string) (*lnrpc.PayReq, error) {
+	return core.DecodeBOLT11(payReq)
+}
+
+// SendPayment leaves the fee limit to phoenixd, which pays through its LSP
+func (b *phoenixdBackend) SendPayment(ctx context.Context, request *routerrpc.SendPaymentRequest) (*lnrpc.Payment, error) {
+	form := url.Values{}
+	form.Set("invoice", request.PaymentRequest)
+
+	paid := struct {
+		RecipientAmountSat int64  `json:"recipientAmountSat"`
+		RoutingFeeSat      int64  `json:"routingFeeSat"`
+		PaymentHash        string `json:"paymentHash"`
+		PaymentPreimage    string `json:"paymentPreimage"`
+		Reason             string `json:"reason"`
+	}{}
+	if err := b.call(ctx, "POST", "/payinvoice", form, &paid); err != nil {
+		return nil, err
+	}
+
+	if paid.PaymentPreimage == "" {
+		log.Printf("Lightauth error: phoenixd failed to pay: %v\n", paid.Reason)
+		return &lnrpc.Payment{
+			PaymentRequest: request.PaymentRequest,
+			Status:         lnrpc.Payment_FAILED,
+			FailureReason:  lnrpc.PaymentFailureReason_FAILURE_REASON_ERROR,
+		}, nil
+	}
+
+	return &lnrpc.Payment{
+		PaymentRequest:  request.PaymentRequest,
+		PaymentHash:     paid.PaymentHash,
+		PaymentPreimage: paid.PaymentPreimage,
+		ValueSat:        paid.RecipientAmountSat,
+		FeeSat:          paid.RoutingFeeSat,
+		Status:          lnrpc.Payment_SUCCEEDED,
+	}, nil
+}
+
+func (b *phoenixdBackend) ChannelBalance(ctx context.Context) (int64, error) {
+	balance := struct {
+		BalanceSat int64 `json:"balanceSat"`
+	}{}
+	if err := b.call(ctx, "GET", "/getbalance", nil, &balance); err != nil {
+		return 0, err
+	}
+
+	return balance.BalanceSat, nil
+}
+
+func (b *phoenixdBackend) QueryRoutes(ctx context.Context, request *lnrpc.QueryRoutesRequest) (*lnrpc.QueryRoutesResponse, error) {
+	return nil, ErrNotSupported
+}
+
+func (b *phoenixdBackend) SignMessage(ctx context.Context, message []byte) (string, error) {
+	return "", ErrNotSupported
+}
+
+func (b *phoenixdBackend) VerifyMessage(ctx context.Context, message []byte, signature string) (string, error) {
+	return "", ErrNotSupported
+}
+
+// signed tells whether a webhook call was signed with the secret of the backend. Without a secret
+// anybody could sign the calls, so none is taken.
+func (b *phoenixdBackend) signed(r *http.Request, body []byte) bool {
+	if b.webhookSecret == "" {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(b.webhookSecret))
+	mac.Write(body)
+	signature, err := hex.DecodeString(r.Header.Get("X-Phoenix-Signature"))
+	return err == nil && hmac.Equal(signature, mac.Sum(nil))
+}
+
+// webhook notifies the payments received of a webhook call signed by phoenixd
+func (b *phoenixdBackend) webhook(w http.ResponseWriter, r *http.Request, body []byte) {
+
+	event := struct {
+		Type        string `json:"type"`
+		PaymentHash string `json:"paymentHash"`
+		AmountSat   int64  `json:"amountSat"`
+	}{}
+	if err := json.Unmarshal(body, &event); err != nil {
+		http.Error(w, "invalid event", http.StatusBadRequest)
+		return
+	}
+
+	if event.Type == "payment_received" {
+		paymentHash, err := hex.DecodeString(event.PaymentHash)
+		if err != nil {
+			http.Error(w, "invalid payment hash", http.StatusBadRequest)
+			return
+		}
+
+		if err := b.payments.notify(r.Context(), paymentHash, event.AmountSat*1000); err != nil {
+			http.Error(w, "payment not processed", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// ServePhoenixdWebhook handles a webhook call of phoenixd for backend, telling whether the call was
+// for it: backend runs on phoenixd and the call is signed with its webhook secret. Otherwise nothing
+// is written and the body of r is left to be read again, so the call can be tried on other backends.
+// The server mounts it as its PhoenixdWebhookHandler.
+func ServePhoenixdWebhook(backend LightningBackend, w http.ResponseWriter, r *http.Request) bool {
+	phoenixd, ok := backend.(*phoenixdBackend)
+	if !ok {
+		return false
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil || !phoenixd.signed(r, body) {
+		return false
+	}
+
+	phoenixd.webhook(w, r, body)
+	return true
+}
@@ -0,0 +1,117 @@
+package lightauth
+
+import "github.com/faurehu/lightauth/core"
+
+// ErrNotLightauth is returned when reading a response that doesn't come from a lightauth server
+var ErrNotLightauth = core.ErrNotLightauth
+
+// ProtocolVersion is the version of the protocol announced in the Light-Auth header
+const ProtocolVersion = core.ProtocolVersion
+
+// The headers of the protocol, as defined in core
+const (
+	Header                   = core.Header
+	HeaderToken              = core.HeaderToken
+	HeaderName               = core.HeaderName
+	HeaderMode               = core.HeaderMode
+	HeaderFee                = core.HeaderFee
+	HeaderMaxInvoices        = core.HeaderMaxInvoices
+	HeaderInvoicesPerRequest = core.HeaderInvoicesPerRequest
+	HeaderTimePeriod         = core.HeaderTimePeriod
+	HeaderExpirationTime     = core.HeaderExpirationTime
+	HeaderExpiresIn          = core.HeaderExpiresIn
+	HeaderExpiryWarning      = core.HeaderExpiryWarning
+	HeaderInvoices           = core.HeaderInvoices
+	HeaderInvoicesURL        = core.HeaderInvoicesURL
+	HeaderInvoicesTotal      = core.HeaderInvoicesTotal
+	HeaderDeferredInvoices   = core.HeaderDeferredInvoices
+	HeaderInvoice            = core.HeaderInvoice
+	HeaderInvoiceRemaining   = core.HeaderInvoiceRemaining
+	HeaderPreImage           = core.HeaderPreImage
+	HeaderNonce              = core.HeaderNonce
+	HeaderFingerprint        = core.HeaderFingerprint
+	HeaderBindRequest        = core.HeaderBindRequest
+	HeaderVaries             = core.HeaderVaries
+	HeaderLNURL              = core.HeaderLNURL
+	HeaderCredit             = core.HeaderCredit
+	HeaderBatchSize          = core.HeaderBatchSize
+	HeaderIdentitySignature  = core.HeaderIdentitySignature
+	HeaderIdentityTimestamp  = core.HeaderIdentityTimestamp
+	HeaderIdentityNonce      = core.HeaderIdentityNonce
+	HeaderPromo              = core.HeaderPromo
+	HeaderSync               = core.HeaderSync
+	HeaderClaimed            = core.HeaderClaimed
+	HeaderQuotaLimit         = core.HeaderQuotaLimit
+	HeaderQuotaRemaining     = core.HeaderQuotaRemaining
+	HeaderQuotaRate          = core.HeaderQuotaRate
+	HeaderAcceptInvoices     = core.HeaderAcceptInvoices
+	HeaderInvoicesEncoding   = core.HeaderInvoicesEncoding
+	HeaderStatus             = core.HeaderStatus
+)
+
+// Mode is the mode of a route
+type Mode = core.Mode
+
+const (
+	ModeTime     = core.ModeTime
+	ModeDiscrete = core.ModeDiscrete
+)
+
+// Period is what an invoice of a time route pays for
+type Period = core.Period
+
+const (
+	PeriodMillisecond = core.PeriodMillisecond
+	PeriodSecond      = core.PeriodSecond
+	PeriodMinute      = core.PeriodMinute
+)
+
+// Result is the result of the Light-Auth header
+type Result = core.Result
+
+const (
+	ResultOK    = core.ResultOK
+	ResultError = core.ResultError
+)
+
+// Warning is the warning of Light-Auth-Expiry-Warning
+type Warning = core.Warning
+
+const (
+	WarningSoft = core.WarningSoft
+	WarningHard = core.WarningHard
+)
+
+// Code is the code of an ErrorResponse
+type Code = core.Code
+
+const (
+	CodeInvalidToken       = core.CodeInvalidToken
+	CodeTimeExpired        = core.CodeTimeExpired
+	CodeInvalidCredentials = core.CodeInvalidCredentials
+	CodeMissingInvoice     = core.CodeMissingInvoice
+	CodeMissingPreImage    = core.CodeMissingPreImage
+	CodePaymentPending     = core.CodePaymentPending
+	CodeInvoiceClaimed     = core.CodeInvoiceClaimed
+	CodeInternalError      = core.CodeInternalError
+	CodeInvalidSignature   = core.CodeInvalidSignature
+	CodeIdentityRevoked    = core.CodeIdentityRevoked
+	CodeMissingCertificate = core.CodeMissingCertificate
+	CodeInvalidBinding     = core.CodeInvalidBinding
+	CodeReplayedNonce      = core.CodeReplayedNonce
+	CodeUnknownInvoice     = core.CodeUnknownInvoice
+	CodeNodeUnavailable    = core.CodeNodeUnavailable
+	CodeWrongBundle        = core.CodeWrongBundle
+	CodePaymentOutstanding = core.CodePaymentOutstanding
+	CodeWrongRequest       = core.CodeWrongRequest
+	CodeHeadersTooLarge    = core.CodeHeadersTooLarge
+	CodeRequestInProgress  = core.CodeRequestInProgress
+	CodeRateLimited        = core.CodeRateLimited
+	CodeRepeatedHeader     = core.CodeRepeatedHeader
+	CodeInvalidPromo       = core.CodeInvalidPromo
+	CodeMalformedHeader    = core.CodeMalformedHeader
+	CodeRiskDenied         = core.CodeRiskDenied
+	CodeRouteSunset        = core.CodeRouteSunset
+	CodeLegacyClient       = core.CodeLegacyClient
+	CodeInvalidAPIKey      = core.CodeInvalidAPIKey
+)
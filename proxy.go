@@ -0,0 +1,81 @@
+package lightauth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+	"google.golang.org/grpc"
+)
+
+// parseProxy reads the Proxy option of lightauth.toml, a SOCKS5 URL such as socks5://127.0.0.1:9050
+// for a local Tor daemon. Credentials in the URL are used for SOCKS5 authentication, which Tor uses
+// to isolate circuits.
+func parseProxy(proxyURL string) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "socks5h" {
+		// Hostnames are always resolved by the proxy, which is what .onion addresses need
+		u.Scheme = "socks5"
+	}
+
+	if u.Scheme != "socks5" || u.Host == "" {
+		return nil, errors.New("Lightauth error: Proxy must be a socks5:// URL")
+	}
+
+	return u, nil
+}
+
+// proxyDialOption routes the gRPC connection to lnd through the SOCKS5 proxy
+func proxyDialOption(u *url.URL) (grpc.DialOption, error) {
+	var auth *proxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &proxy.Auth{User: u.User.Username(), Password: password}
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", u.Host, auth, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+
+	return grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		// SOCKS5 dialers of recent x/net releases honour the context
+		if contextDialer, ok := dialer.(interface {
+			DialContext(ctx context.Context, network string, addr string) (net.Conn, error)
+		}); ok {
+			return contextDialer.DialContext(ctx, "tcp", addr)
+		}
+
+		return dialer.Dial("tcp", addr)
+	}), nil
+}
+
+// proxyHTTPClient returns a client that sends all the protocol traffic through the SOCKS5 proxy
+func proxyHTTPClient(u *url.URL) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyURL(u),
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// ProxyHTTPClient returns a client that sends all the protocol traffic through the SOCKS5 proxy of
+// lightauth.toml, given as a socks5:// URL
+func ProxyHTTPClient(proxyURL string) (*http.Client, error) {
+	u, err := parseProxy(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return proxyHTTPClient(u), nil
+}
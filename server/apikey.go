@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+const aPIKEYINVALID = "Lightauth error: the API key is not valid"
+
+var apiKeyValidator func(r *http.Request, key string) bool
+
+// SetAPIKeyValidator registers the function that checks the API keys sent to routes with an
+// APIKeyHeader. Requests with a key it accepts are served without payment, those with a key it rejects
+// are refused, and those without a key pay as usual. Keys are never accepted while it isn't set.
+func SetAPIKeyValidator(validator func(r *http.Request, key string) bool) {
+	apiKeyValidator = validator
+}
+
+// readAPIKey returns the API key of a request to a route with an APIKeyHeader, without the Bearer
+// scheme when it is sent in the Authorization header
+func readAPIKey(r *http.Request, rt *Route) string {
+	if rt.APIKeyHeader == "" {
+		return ""
+	}
+
+	key := strings.TrimSpace(r.Header.Get(rt.APIKeyHeader))
+	if http.CanonicalHeaderKey(rt.APIKeyHeader) == "Authorization" {
+		if !strings.HasPrefix(key, "Bearer ") {
+			return ""
+		}
+		key = strings.TrimSpace(strings.TrimPrefix(key, "Bearer "))
+	}
+
+	return key
+}
+
+// serveAPIKey serves a request to a route with an APIKeyHeader that bears an API key, returning false
+// when it doesn't and has to pay
+func serveAPIKey(w *deferredWriter, r *http.Request, rt *Route, handler func(http.ResponseWriter, *http.Request)) bool {
+	key := readAPIKey(r, rt)
+	if key == "" {
+		return false
+	}
+	// Keyed callers speak no version of the protocol, without being legacy clients
+	w.legacy = false
+
+	if apiKeyValidator == nil || !apiKeyValidator(r, key) {
+		deny(w, r, "", aPIKEYINVALID, http.StatusUnauthorized)
+		return true
+	}
+
+	dispatch(w, r, "", handler, validation{authorized: true, message: "paid with an API key"})
+	return true
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+)
+
+// AuditEntry is one authorization decision taken by the server middleware. Invoice is the payment
+// request the decision is about if any, or the comma separated payment requests of a bundle. Reason is
+// the error message sent to the client when the request was denied.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Route      string    `json:"route"`
+	Token      string    `json:"token,omitempty"`
+	Invoice    string    `json:"invoice,omitempty"`
+	Allowed    bool      `json:"allowed"`
+	StatusCode int       `json:"status_code"`
+	Reason     string    `json:"reason"`
+}
+
+// AuditSink receives every authorization decision. Record is called before the response is
+// written, so it should be quick; errors are reported on Errors().
+type AuditSink interface {
+	Record(entry AuditEntry) error
+}
+
+var auditSink AuditSink
+
+// SetAuditSink sets where authorization decisions are recorded. The AuditLog path in lightauth.toml
+// sets a NewAuditLog writing to that file.
+func SetAuditSink(s AuditSink) {
+	auditSink = s
+}
+
+type auditLog struct {
+	w   io.Writer
+	mux sync.Mutex
+}
+
+// NewAuditLog returns an AuditSink appending the entries to w as JSON lines
+func NewAuditLog(w io.Writer) AuditSink {
+	return &auditLog{w: w}
+}
+
+func (l *auditLog) Record(entry AuditEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	_, err = l.w.Write(append(b, '\n'))
+	return err
+}
+
+func audit(r *http.Request, token string, invoices []*Invoice, allowed bool, statusCode int, reason string) {
+	if auditSink == nil {
+		return
+	}
+
+	entry := AuditEntry{
+		Time:       time.Now(),
+		Route:      r.Method + r.URL.Path,
+		Token:      token,
+		Invoice:    core.ReadHeader(r.Header, core.HeaderInvoice),
+		Allowed:    allowed,
+		StatusCode: statusCode,
+		Reason:     reason,
+	}
+	if len(invoices) > 0 {
+		entry.Invoice = paymentRequests(invoices)
+	}
+
+	if err := auditSink.Record(entry); err != nil {
+		lightauth.ReportError(fmt.Errorf("Lightauth error: could not record audit entry: %v", err))
+	}
+}
+
+// deny records the denial of a request before answering it with the error
+func deny(w http.ResponseWriter, r *http.Request, token string, message string, statusCode int) {
+	audit(r, token, nil, false, statusCode, message)
+	writeError(w, message, statusCode)
+}
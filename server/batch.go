@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+// negotiateBatch records the number of invoices a client asked to be sent at once in the
+// Light-Auth-Batch-Size header of its request, between the invoices of one request and the MaxInvoices
+// of the route. It holds for the following requests of the client until it asks for another one.
+func (c *Client) negotiateBatch(r *http.Request) error {
+	requested, err := strconv.Atoi(core.ReadHeader(r.Header, core.HeaderBatchSize))
+	if err != nil {
+		return nil
+	}
+
+	if requested < c.Route.invoicesPerRequest() {
+		requested = c.Route.invoicesPerRequest()
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if requested >= c.Route.MaxInvoices {
+		requested = 0
+	}
+
+	if requested == c.Batch {
+		return nil
+	}
+
+	c.Batch = requested
+	return c.persist(false)
+}
+
+// batchSize is the number of unpaid invoices the client is sent at once: the MaxInvoices of the route,
+// unless it asked for fewer.
+func (c *Client) batchSize() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.Batch > 0 && c.Batch < c.Route.MaxInvoices {
+		return c.Batch
+	}
+
+	return c.Route.MaxInvoices
+}
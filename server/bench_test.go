@@ -0,0 +1,207 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/client"
+	"github.com/faurehu/lightauth/core"
+	"github.com/faurehu/lightauth/lightauthtest"
+	"github.com/faurehu/lightauth/server"
+	"github.com/faurehu/lightauth/simnet"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+)
+
+const benchRoute = "GET/bench"
+
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok")
+}
+
+// startBench starts the server again with a single route in the given mode and an empty store, so each
+// run of a benchmark is measured from the same state, and returns the URL of the route. The client of
+// TestMain pays for it on the same network. The tests get the configuration of TestMain back once the
+// benchmark is done.
+func startBench(b *testing.B, mode core.Mode) string {
+	b.Helper()
+
+	route := server.RouteInfo{Name: benchRoute, Fee: 1, MaxInvoices: 1, Mode: mode, Period: core.PeriodMinute}
+	if _, err := lightauthtest.WriteSimnetConfig(b.TempDir(), route); err != nil {
+		b.Fatal(err)
+	}
+
+	restart(b)
+	b.Cleanup(func() {
+		lightauth.SetConfigPath(configPath)
+		restart(b)
+	})
+
+	bench := httptest.NewServer(http.HandlerFunc(server.Middleware(okHandler)))
+	b.Cleanup(bench.Close)
+
+	return bench.URL + strings.TrimPrefix(benchRoute, http.MethodGet)
+}
+
+func restart(b *testing.B) {
+	server.ResetStart()
+	if err := server.StartWithBackend(simnet.NewMemoryProvider(), network); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func clearRequest(b *testing.B, url string) *http.Request {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	request, err = client.ClearRequest(request)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return request
+}
+
+func roundTrip(b *testing.B, url string) {
+	response, err := http.DefaultClient.Do(clearRequest(b, url))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if _, err := client.ReadResponse(response, url); err != nil {
+		b.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, response.Body)
+}
+
+// benchmarkMiddleware measures Middleware serving requests that have been paid for. Paying
+// is left out of the measure.
+func benchmarkMiddleware(b *testing.B, mode core.Mode) {
+	url := startBench(b, mode)
+	handler := server.Middleware(okHandler)
+	roundTrip(b, url)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		request := clearRequest(b, url)
+		w := httptest.NewRecorder()
+		b.StartTimer()
+
+		handler(w, request)
+
+		b.StopTimer()
+		for w.Code == http.StatusConflict {
+			// The settlement of the payment is still on its way, which only happens right after paying
+			runtime.Gosched()
+			w = httptest.NewRecorder()
+			b.StartTimer()
+			handler(w, request)
+			b.StopTimer()
+		}
+
+		if _, err := client.ReadResponse(w.Result(), url); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+	}
+}
+
+func BenchmarkMiddlewareTime(b *testing.B) {
+	benchmarkMiddleware(b, core.ModeTime)
+}
+
+func BenchmarkMiddlewareDiscrete(b *testing.B) {
+	benchmarkMiddleware(b, core.ModeDiscrete)
+}
+
+// BenchmarkClearRequest measures ClearRequest for a path that is already known and paid for
+func BenchmarkClearRequest(b *testing.B) {
+	url := startBench(b, core.ModeTime)
+	roundTrip(b, url)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		clearRequest(b, url)
+	}
+}
+
+// benchmarkInvoicesJSON measures the encoding of the Light-Auth-Invoices header with n invoices
+func benchmarkInvoicesJSON(b *testing.B, n int) {
+	invoices := make([]core.JSONInvoice, n)
+	for i := range invoices {
+		invoices[i].PaymentRequest = "lnbc10n1" + strings.Repeat("q", 300)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(invoices); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInvoicesJSON1(b *testing.B) {
+	benchmarkInvoicesJSON(b, 1)
+}
+
+func BenchmarkInvoicesJSON10(b *testing.B) {
+	benchmarkInvoicesJSON(b, 10)
+}
+
+// BenchmarkSettlement measures the time from the payment of an invoice until the server accepts it,
+// which covers the dispatch of the settlement from the node's invoice subscription.
+func BenchmarkSettlement(b *testing.B) {
+	url := startBench(b, core.ModeDiscrete)
+	handler := server.Middleware(okHandler)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, url, nil))
+		invoices := []core.JSONInvoice{}
+		if err := json.Unmarshal([]byte(w.Header().Get(core.HeaderInvoices)), &invoices); err != nil || len(invoices) == 0 {
+			b.Fatalf("no invoice issued: %v", err)
+		}
+		b.StartTimer()
+
+		payment, err := network.SendPayment(context.Background(), &routerrpc.SendPaymentRequest{PaymentRequest: invoices[0].PaymentRequest})
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for {
+			request := httptest.NewRequest(http.MethodGet, url, nil)
+			request.Header.Set(core.HeaderToken, w.Header().Get(core.HeaderToken))
+			request.Header.Set(core.HeaderInvoice, invoices[0].PaymentRequest)
+			request.Header.Set(core.HeaderPreImage, payment.PaymentPreimage)
+			claim := httptest.NewRecorder()
+			handler(claim, request)
+
+			if claim.Code == http.StatusOK {
+				break
+			}
+
+			if claim.Code != http.StatusConflict {
+				b.Fatalf("claim rejected with %v: %v", claim.Code, claim.Body.String())
+			}
+
+			// Let the settlement through when there are few processors
+			runtime.Gosched()
+		}
+	}
+}
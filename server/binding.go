@@ -0,0 +1,80 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+// certificateFingerprint returns the fingerprint of the TLS client certificate of a request, or an
+// empty string if none was presented.
+func certificateFingerprint(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+
+	fingerprint := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+	return hex.EncodeToString(fingerprint[:])
+}
+
+// checkTokenBinding makes sure the token is used from the TLS client certificate it was bound to. A
+// token is bound to the first certificate it is presented with.
+func checkTokenBinding(c *Client, r *http.Request) error {
+	if c.Route.TokenBinding != "certificate" {
+		return nil
+	}
+
+	fingerprint := certificateFingerprint(r)
+	if fingerprint == "" {
+		return errors.New(mISSINGCERTIFICATE)
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.Binding == "" {
+		c.Binding = fingerprint
+		return c.save()
+	}
+
+	if c.Binding != fingerprint {
+		return errors.New(iNVALIDBINDING)
+	}
+
+	return nil
+}
+
+// declaredFingerprint returns the fingerprint of the request a client wants invoices for, or an empty
+// string if it didn't send a valid one.
+func declaredFingerprint(r *http.Request) string {
+	fingerprint := core.ReadHeader(r.Header, core.HeaderFingerprint)
+	if b, err := hex.DecodeString(fingerprint); err != nil || len(b) != sha256.Size {
+		return ""
+	}
+
+	return fingerprint
+}
+
+// checkRequestBinding makes sure the invoices claimed by a request were issued for it, on routes that
+// bind invoices to requests.
+func checkRequestBinding(c *Client, r *http.Request, invoices []*Invoice) error {
+	if !c.Route.BindRequest {
+		return nil
+	}
+
+	fingerprint, err := core.RequestFingerprint(r)
+	if err != nil {
+		return errors.New(iNVALIDCREDENTIALS)
+	}
+
+	for _, i := range invoices {
+		if i.Fingerprint != fingerprint {
+			return errors.New(wRONGREQUEST)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"context"
+
+	"github.com/faurehu/lightauth"
+)
+
+// What a route does while the circuit breaker of its node is open
+const (
+	dEGRADEFAILCLOSED  = "fail-closed"
+	dEGRADEFAILOPEN    = "fail-open"
+	dEGRADEBALANCEONLY = "balance-only"
+)
+
+var serverBreaker = lightauth.NewBreaker(func(ctx context.Context) error {
+	_, err := serverBackend.GetInfo(ctx)
+	return err
+}, nil)
+
+// degradation is the policy of a route while the node is down, fail-closed by default
+func (r *Route) degradation() string {
+	if r.Degradation == "" {
+		return dEGRADEFAILCLOSED
+	}
+
+	return r.Degradation
+}
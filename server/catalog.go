@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+// oPENAPIEXTENSION is the OpenAPI extension the price of an operation is published under
+const oPENAPIEXTENSION = "x-lightning-price"
+
+// Price is what a route costs, as published in the pricing catalog. Fee is in satoshis and is paid per
+// request in discrete mode, or per Period in time mode. PerResult routes invoice the cost of their
+// results beyond the fee after each request, and BindRequest routes issue invoices for one request.
+// Match lists the query parameters and headers requests need for the price to apply. Time routes with a
+// Rate take that many requests per second, in bursts of up to Burst requests. Split is the percentage of the
+// fee shared with whoever referred the client.
+type Price struct {
+	Method             string      `json:"method"`
+	Path               string      `json:"path"`
+	Mode               core.Mode   `json:"mode"`
+	Fee                int         `json:"fee"`
+	Period             core.Period `json:"period,omitempty"`
+	MaxInvoices        int         `json:"max_invoices"`
+	InvoicesPerRequest int         `json:"invoices_per_request,omitempty"`
+	PerResult          bool        `json:"per_result,omitempty"`
+	BindRequest        bool        `json:"bind_request,omitempty"`
+	LNURL              string      `json:"lnurl,omitempty"`
+	Match              []string    `json:"match,omitempty"`
+	Rate               float64     `json:"rate,omitempty"`
+	Burst              int         `json:"burst,omitempty"`
+	Tenant             string      `json:"tenant,omitempty"`
+	Split              int         `json:"split,omitempty"`
+}
+
+// Catalog returns the prices of the routes of the server, sorted by path and method
+func Catalog() []Price {
+	catalog := []Price{}
+	for _, rt := range serverStore {
+		catalog = append(catalog, routePrice(rt.RouteInfo))
+	}
+
+	sort.Slice(catalog, func(a, b int) bool {
+		if catalog[a].Path != catalog[b].Path {
+			return catalog[a].Path < catalog[b].Path
+		}
+
+		return catalog[a].Method < catalog[b].Method
+	})
+
+	return catalog
+}
+
+func routePrice(rt RouteInfo) Price {
+	method, path := rt.Name, "/"
+	if k := strings.Index(rt.Name, "/"); k >= 0 {
+		method, path = rt.Name[:k], rt.Name[k:]
+	}
+
+	p := Price{
+		Method:      method,
+		Path:        path,
+		Mode:        rt.Mode,
+		Fee:         rt.Fee,
+		MaxInvoices: rt.MaxInvoices,
+		PerResult:   rt.PerResult,
+		BindRequest: rt.BindRequest,
+		LNURL:       rt.LNURL,
+		Match:       rt.Match,
+		Tenant:      rt.Tenant,
+		Split:       rt.Split,
+	}
+
+	if rt.Mode == core.ModeTime {
+		p.Period = rt.Period
+		if rt.Rate > 0 {
+			p.Rate = rt.Rate
+			p.Burst = int((&Route{RouteInfo: rt}).burst())
+		}
+	} else {
+		p.InvoicesPerRequest = (&Route{RouteInfo: rt}).invoicesPerRequest()
+	}
+
+	return p
+}
+
+// CatalogHandler serves the pricing catalog as JSON, so API consumers can see the costs of the routes
+// ahead of time.
+func CatalogHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Catalog())
+}
+
+// MergeOpenAPI adds the price of each route of the server to the matching operation of an OpenAPI
+// document in JSON, under the x-lightning-price extension. Routes the document doesn't describe are
+// added as operations answering 402 until paid for.
+func MergeOpenAPI(document []byte) ([]byte, error) {
+	doc := make(map[string]interface{})
+	if err := json.Unmarshal(document, &doc); err != nil {
+		return nil, err
+	}
+
+	paths, ok := doc["paths"].(map[string]interface{})
+	if !ok {
+		paths = make(map[string]interface{})
+		doc["paths"] = paths
+	}
+
+	for _, p := range Catalog() {
+		item, ok := paths[p.Path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[p.Path] = item
+		}
+
+		method := strings.ToLower(p.Method)
+		operation, ok := item[method].(map[string]interface{})
+		if !ok {
+			operation = map[string]interface{}{
+				"responses": map[string]interface{}{
+					"402": map[string]interface{}{"description": "Payment required"},
+				},
+			}
+			item[method] = operation
+		}
+
+		operation[oPENAPIEXTENSION] = p
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
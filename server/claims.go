@@ -0,0 +1,98 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// nONCETTL is how long the nonce of a claim is remembered. Replays are rejected for at least as long.
+const nONCETTL = 10 * time.Minute
+
+// Claimer can be implemented by a DataProvider to claim invoices with a compare-and-set in the store,
+// so an invoice is claimed once even when several servers share the store. ClaimInvoice returns
+// false if the invoice had already been claimed. Invoices paying for several requests are claimed once
+// per request, with ClaimCount going up by one each time.
+type Claimer interface {
+	ClaimInvoice(i *Invoice) (bool, error)
+}
+
+// nonceCache remembers the nonces of the claims received recently
+type nonceCache struct {
+	mux  sync.Mutex
+	seen map[string]time.Time
+}
+
+var claimNonces = &nonceCache{seen: make(map[string]time.Time)}
+
+// use records a nonce, returning false if it has been seen before
+func (n *nonceCache) use(nonce string) bool {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	t := time.Now()
+	if expiry, seen := n.seen[nonce]; seen && expiry.After(t) {
+		return false
+	}
+
+	if len(n.seen) > 0 && len(n.seen)%1024 == 0 {
+		for k, v := range n.seen {
+			if v.Before(t) {
+				delete(n.seen, k)
+			}
+		}
+	}
+
+	n.seen[nonce] = t.Add(nONCETTL)
+	return true
+}
+
+// releaseClaim makes a claimed invoice usable again, when the request that claimed it failed before
+// getting any response.
+func (i *Invoice) releaseClaim() error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	return i.release()
+}
+
+// release gives back the last claim of an invoice. The lock of the invoice must be held.
+func (i *Invoice) release() error {
+	if i.ClaimCount > 0 {
+		i.ClaimCount--
+	}
+	i.Claimed = false
+	i.ClaimNonce = ""
+	return i.persist(true)
+}
+
+// tryClaim claims an invoice for a request unless it has been claimed already, in which case it returns
+// false. The claim is written to the store before returning, and given back if it can't be.
+func (i *Invoice) tryClaim(nonce string) (bool, error) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	if i.Claimed {
+		return false, nil
+	}
+
+	if claimer, ok := serverDatabase.(Claimer); ok {
+		claimed, err := claimer.ClaimInvoice(i)
+		if err != nil || !claimed {
+			return false, err
+		}
+	}
+
+	i.ClaimCount++
+	i.Claimed = i.Claims <= i.ClaimCount
+	i.ClaimNonce = nonce
+	if err := i.persist(true); err != nil {
+		// Not to leave the invoice claimed in memory, or in the store of a Claimer
+		if err := i.release(); err != nil {
+			log.Printf("Lightauth error: could not release claim: %v\n", err)
+		}
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/faurehu/lightauth"
+)
+
+// failingStore is a DataProvider that can claim invoices but fails to write them
+type failingStore struct {
+	claims int
+	edits  int
+}
+
+func (s *failingStore) Create(r lightauth.Record) (string, error) {
+	return "", errors.New("store unavailable")
+}
+
+func (s *failingStore) Edit(r lightauth.Record) {}
+
+func (s *failingStore) EditChecked(r lightauth.Record) error {
+	s.edits++
+	return errors.New("store unavailable")
+}
+
+func (s *failingStore) GetServerData() (map[string]*Route, error) {
+	return nil, nil
+}
+
+func (s *failingStore) ClaimInvoice(i *Invoice) (bool, error) {
+	s.claims++
+	return true, nil
+}
+
+func TestClaimNotPersisted(t *testing.T) {
+	store := &failingStore{}
+	previous := serverDatabase
+	serverDatabase = store
+	defer func() { serverDatabase = previous }()
+
+	i := &Invoice{ID: "invoice", Claims: 1}
+	claimed, err := i.tryClaim("nonce")
+	if claimed || err == nil {
+		t.Fatalf("claimed %v with error %v, the claim couldn't be written", claimed, err)
+	}
+
+	if i.Claimed || i.ClaimCount != 0 || i.ClaimNonce != "" {
+		t.Errorf("the claim was kept: Claimed %v, ClaimCount %v, ClaimNonce %q", i.Claimed, i.ClaimCount, i.ClaimNonce)
+	}
+	if store.claims != 1 || store.edits != 2 {
+		t.Errorf("%v claims and %v edits written, the claim should have been released", store.claims, store.edits)
+	}
+
+	i.tryClaim("retry")
+	if store.claims != 2 {
+		t.Error("the released invoice wasn't claimed again")
+	}
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+type invoiceCodecKey struct{}
+
+// withInvoiceCodec keeps in the context of a request the encoding its invoices are sent in
+func withInvoiceCodec(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), invoiceCodecKey{}, core.AcceptedInvoiceCodec(r.Header)))
+}
+
+// invoiceCodec returns the encoding the invoices of a request are sent in, JSON unless negotiated
+func invoiceCodec(ctx context.Context) core.InvoiceCodec {
+	if c, negotiated := ctx.Value(invoiceCodecKey{}).(core.InvoiceCodec); negotiated {
+		return c
+	}
+
+	c, _ := core.LookupInvoiceCodec(core.EncodingJSON)
+	return c
+}
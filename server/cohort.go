@@ -0,0 +1,132 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+)
+
+// Cohort is a price a route tries out on part of its clients. New clients are assigned to the cohorts
+// of their route in proportion to their Weight, and pay Fee instead of the fee of the route.
+type Cohort struct {
+	Name   string
+	Fee    int
+	Weight int
+}
+
+// assignCohort picks the cohort of a new client of the route. The assignment only depends on the token
+// of the client, so it can be checked again afterwards.
+func (r *Route) assignCohort(token string) string {
+	total := 0
+	for _, cohort := range r.Cohorts {
+		total += cohort.Weight
+	}
+
+	if total <= 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(r.key() + "|" + token))
+	n := int(binary.BigEndian.Uint64(sum[:8]) % uint64(total))
+	for _, cohort := range r.Cohorts {
+		if n < cohort.Weight {
+			return cohort.Name
+		}
+		n -= cohort.Weight
+	}
+
+	return ""
+}
+
+// baseFee is the fee of the cohort of the client, or of its route when it is in none
+func (r *Route) baseFee(cohortName string) int {
+	for _, cohort := range r.Cohorts {
+		if cohort.Name == cohortName {
+			return cohort.Fee
+		}
+	}
+
+	return r.Fee
+}
+
+func (c *Client) cohort() string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.Cohort
+}
+
+// CohortResults is how a cohort of a route is doing: how many clients it has, how many of them paid,
+// and what they paid in millisatoshis.
+type CohortResults struct {
+	Cohort          string `json:"cohort"`
+	Fee             int    `json:"fee"`
+	Clients         int    `json:"clients"`
+	PayingClients   int    `json:"paying_clients"`
+	AmountMsat      int64  `json:"amount_msat"`
+	SettledInvoices int    `json:"settled_invoices"`
+}
+
+// Cohorts returns the results of each cohort of the route with the given name, sorted by cohort. The
+// clients that are in no cohort, those that came before the cohorts were set up, are left out.
+func Cohorts(routeName string) ([]CohortResults, error) {
+	rt, routeExists := serverStore[routeName]
+	if !routeExists {
+		return nil, ErrUnknownRoute
+	}
+
+	results := make(map[string]*CohortResults)
+	for _, cohort := range rt.Cohorts {
+		results[cohort.Name] = &CohortResults{Cohort: cohort.Name, Fee: cohort.Fee}
+	}
+
+	rt.rangeClients(func(c *Client) bool {
+		c.mux.Lock()
+		r, inCohort := results[c.Cohort]
+		invoices := make([]*Invoice, 0, len(c.Invoices))
+		for _, i := range c.Invoices {
+			invoices = append(invoices, i)
+		}
+		c.mux.Unlock()
+
+		if !inCohort {
+			return true
+		}
+
+		r.Clients++
+		paid := false
+		for _, i := range invoices {
+			i.mux.Lock()
+			settled, amountPaid := i.Settled, i.AmountPaid
+			i.mux.Unlock()
+
+			if !settled {
+				continue
+			}
+
+			if amountPaid == 0 {
+				amountPaid = int64(i.amount()) * 1000
+			}
+			r.AmountMsat += amountPaid
+			r.SettledInvoices++
+			paid = true
+		}
+
+		if paid {
+			r.PayingClients++
+		}
+
+		return true
+	})
+
+	cohorts := []CohortResults{}
+	for _, r := range results {
+		cohorts = append(cohorts, *r)
+	}
+
+	sort.Slice(cohorts, func(a, b int) bool {
+		return cohorts[a].Cohort < cohorts[b].Cohort
+	})
+
+	return cohorts, nil
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+)
+
+var (
+	routePeriods  = map[core.Period]bool{core.PeriodMillisecond: true, core.PeriodSecond: true, core.PeriodMinute: true}
+	tokenBindings = map[string]bool{"": true, "certificate": true}
+	overpayments  = map[string]bool{"": true, "tip": true, oVERPAYMENTCREDIT: true}
+	degradations  = map[string]bool{"": true, dEGRADEFAILCLOSED: true, dEGRADEFAILOPEN: true, dEGRADEBALANCEONLY: true}
+)
+
+// ValidateConfig reads lightauth.toml and reports all the problems of the server's configuration at
+// once, so they can be caught before starting it.
+func ValidateConfig() error {
+	var conf serverConfig
+	if err := lightauth.DecodeConfig(&conf); err != nil {
+		return err
+	}
+
+	problems := conf.Validate()
+	problems = append(problems, conf.validateRoutes()...)
+	if conf.Server != nil {
+		problems = append(problems, lightauth.ValidateNode("Server", *conf.Server)...)
+	}
+	if conf.ServerAddr != "" || conf.LNDConnect != "" {
+		problems = append(problems, lightauth.ValidateNode("", conf.Node(nil))...)
+	}
+
+	return lightauth.NewConfigError(problems)
+}
+
+// validateRoutes returns the problems of the routes and of the rest of the settings of the server
+func (conf serverConfig) validateRoutes() []string {
+	var problems []string
+	names := make(map[string]string)
+	for key, rt := range conf.Routes {
+		if rt.Name == "" || !strings.Contains(rt.Name, "/") {
+			problems = append(problems, fmt.Sprintf("Routes.%v: Name %q must be a method followed by a path, like GET/resource", key, rt.Name))
+		} else if other, exists := names[rt.key()]; exists {
+			problems = append(problems, fmt.Sprintf("Routes.%v: Name %v and Match conditions are also used by Routes.%v", key, rt.Name, other))
+		}
+		names[rt.key()] = key
+
+		for _, m := range rt.Match {
+			if _, err := core.ParseCondition(m); err != nil {
+				problems = append(problems, fmt.Sprintf("Routes.%v: Match %q must be query:name, query:name=value, header:name or header:name=value", key, m))
+			}
+		}
+
+		if _, known := lookupValidator(rt.Mode); !known {
+			problems = append(problems, fmt.Sprintf("Routes.%v: Mode %q must be time, discrete or registered with RegisterValidator", key, rt.Mode))
+		}
+
+		if rt.Mode == core.ModeTime && !routePeriods[rt.Period] {
+			problems = append(problems, fmt.Sprintf("Routes.%v: Period %q must be millisecond, second or minute in time mode", key, rt.Period))
+		}
+
+		if rt.Fee <= 0 {
+			problems = append(problems, fmt.Sprintf("Routes.%v: Fee must be a positive amount of satoshis", key))
+		}
+
+		if rt.MaxInvoices <= 0 {
+			problems = append(problems, fmt.Sprintf("Routes.%v: MaxInvoices must be at least 1", key))
+		}
+
+		if rt.InvoicesPerRequest < 0 || rt.InvoicesPerRequest > rt.MaxInvoices {
+			problems = append(problems, fmt.Sprintf("Routes.%v: InvoicesPerRequest must be between 1 and MaxInvoices", key))
+		}
+
+		if rt.BindRequest && (rt.Mode != core.ModeDiscrete || rt.LNURL != "") {
+			problems = append(problems, fmt.Sprintf("Routes.%v: BindRequest needs discrete mode and no LNURL", key))
+		}
+
+		if rt.Rate < 0 || rt.Burst < 0 || ((rt.Rate > 0 || rt.Burst > 0) && (rt.Mode != core.ModeTime || rt.Rate == 0)) {
+			problems = append(problems, fmt.Sprintf("Routes.%v: Rate and Burst need time mode and a positive Rate", key))
+		}
+
+		if rt.InvoicesURL != "" {
+			if u, err := url.Parse(rt.InvoicesURL); err != nil || !u.IsAbs() {
+				problems = append(problems, fmt.Sprintf("Routes.%v: InvoicesURL %q must be an absolute URL", key, rt.InvoicesURL))
+			}
+		}
+
+		if !overpayments[rt.Overpayment] {
+			problems = append(problems, fmt.Sprintf("Routes.%v: Overpayment %q must be tip or credit", key, rt.Overpayment))
+		}
+
+		if !degradations[rt.Degradation] {
+			problems = append(problems, fmt.Sprintf("Routes.%v: Degradation %q must be fail-closed, fail-open or balance-only", key, rt.Degradation))
+		}
+
+		if !tokenBindings[rt.TokenBinding] {
+			problems = append(problems, fmt.Sprintf("Routes.%v: TokenBinding %q must be empty or certificate", key, rt.TokenBinding))
+		}
+
+		for field, d := range map[string]string{"TokenTTL": rt.TokenTTL, "TokenOverlap": rt.TokenOverlap, "InvoiceExpiry": rt.InvoiceExpiry, "CacheTTL": rt.CacheTTL, "ExpiryWarning": rt.ExpiryWarning} {
+			if duration, err := lightauth.ParseDuration(d); err != nil || duration < 0 {
+				problems = append(problems, fmt.Sprintf("Routes.%v: %v %q is not a valid duration", key, field, d))
+			}
+		}
+
+		for _, hint := range rt.RouteHints {
+			if b, err := hex.DecodeString(hint.NodeID); err != nil || len(b) != 33 {
+				problems = append(problems, fmt.Sprintf("Routes.%v: RouteHints NodeID %q is not a node public key", key, hint.NodeID))
+			}
+		}
+
+		cohorts := make(map[string]bool)
+		for _, cohort := range rt.Cohorts {
+			if cohort.Name == "" || cohorts[cohort.Name] || cohort.Fee <= 0 || cohort.Weight <= 0 {
+				problems = append(problems, fmt.Sprintf("Routes.%v: Cohorts need distinct names, a positive Fee and a positive Weight", key))
+				break
+			}
+			cohorts[cohort.Name] = true
+		}
+
+		if strings.HasPrefix(http.CanonicalHeaderKey(rt.APIKeyHeader), core.Header) {
+			problems = append(problems, fmt.Sprintf("Routes.%v: APIKeyHeader can't be a Light-Auth header", key))
+		}
+
+		if rt.InvoiceCutoff != "" && rt.Sunset == "" {
+			problems = append(problems, fmt.Sprintf("Routes.%v: InvoiceCutoff needs a Sunset", key))
+		}
+
+		for field, date := range map[string]string{"Sunset": rt.Sunset, "InvoiceCutoff": rt.InvoiceCutoff} {
+			if _, err := time.Parse("2006-01-02T15:04:05Z07:00", date); date != "" && err != nil {
+				problems = append(problems, fmt.Sprintf("Routes.%v: %v %q is not an RFC 3339 date", key, field, date))
+			}
+		}
+
+		if rt.Split < 0 || rt.Split > 100 {
+			problems = append(problems, fmt.Sprintf("Routes.%v: Split must be a percentage between 0 and 100", key))
+		}
+
+		if _, exists := conf.Tenants[rt.Tenant]; rt.Tenant != "" && !exists {
+			problems = append(problems, fmt.Sprintf("Routes.%v: Tenant %q is not one of the Tenants", key, rt.Tenant))
+		}
+	}
+
+	for referrer, destination := range conf.Referrers {
+		if u, err := url.Parse(lnurlPayURL(destination)); err != nil || !u.IsAbs() {
+			problems = append(problems, fmt.Sprintf("Referrers.%v: %q must be a lightning address or an LNURL-pay URL", referrer, destination))
+		}
+	}
+
+	if d, err := lightauth.ParseDuration(conf.IdempotencyWindow); err != nil || d < 0 {
+		problems = append(problems, fmt.Sprintf("IdempotencyWindow %q is not a valid duration", conf.IdempotencyWindow))
+	}
+
+	if d, err := lightauth.ParseDuration(conf.PayoutInterval); err != nil || d < 0 {
+		problems = append(problems, fmt.Sprintf("PayoutInterval %q is not a valid duration", conf.PayoutInterval))
+	}
+
+	if _, err := time.Parse("2006-01-02T15:04:05Z07:00", conf.LegacyClientsUntil); conf.LegacyClientsUntil != "" && err != nil {
+		problems = append(problems, fmt.Sprintf("LegacyClientsUntil %q is not an RFC 3339 date", conf.LegacyClientsUntil))
+	}
+
+	if d, err := lightauth.ParseDuration(conf.Watchdog.Window); err != nil || d < 0 {
+		problems = append(problems, fmt.Sprintf("Watchdog.Window %q is not a valid duration", conf.Watchdog.Window))
+	}
+
+	if conf.Watchdog.MaxUnsettledRatio < 0 || conf.Watchdog.MinInvoices < 0 || conf.Watchdog.UnmatchedSettlements < 0 {
+		problems = append(problems, "Watchdog thresholds can't be negative")
+	}
+
+	for name, node := range conf.Tenants {
+		problems = append(problems, lightauth.ValidateNode("Tenants."+name, *node)...)
+	}
+
+	return problems
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+)
+
+// ErrUnknownToken is returned when crediting a token no route knows
+var ErrUnknownToken = errors.New("Lightauth error: no client has this token")
+
+// CreditGrant is goodwill credit given to a client by an operator, kept on the client apart from what
+// it paid for. Amount is in satoshis and Period the time given on time routes.
+type CreditGrant struct {
+	Time   time.Time     `json:"time"`
+	Amount int           `json:"amount"`
+	Period time.Duration `json:"period"`
+	Reason string        `json:"reason"`
+}
+
+// period is the time one fee of a time route buys
+func (r *Route) period() time.Duration {
+	switch r.Period {
+	case core.PeriodSecond:
+		return time.Second
+	case core.PeriodMinute:
+		return time.Minute
+	default:
+		return time.Millisecond
+	}
+}
+
+// Credit gives the client with the given token credit it hasn't paid for, after an outage for instance.
+// On time routes the client gets period, plus the time amount satoshis would have bought. On discrete
+// routes amount satoshis are added to the credit balance of the client, which pays for its requests
+// made without invoices. The grant is recorded on the client with its reason, and in the audit log.
+func Credit(token string, amount int, period time.Duration, reason string) error {
+	if !serverState.IsStarted() {
+		return &lightauth.NotStartedError{Side: "server"}
+	}
+
+	if amount < 0 || period < 0 || (amount == 0 && period == 0) {
+		return errors.New("Lightauth error: credit must be a positive amount or period")
+	}
+
+	c, tokenExists := lookupToken(token)
+	if !tokenExists {
+		return ErrUnknownToken
+	}
+
+	return c.grantCredit(CreditGrant{Time: time.Now(), Amount: amount, Period: period, Reason: reason})
+}
+
+// lookupToken returns the client with the given token, whatever its route
+func lookupToken(token string) (*Client, bool) {
+	for _, rt := range serverStore {
+		if c, tokenExists := rt.lookupClient(token); tokenExists {
+			return c, true
+		}
+	}
+
+	return nil, false
+}
+
+func (c *Client) grantCredit(grant CreditGrant) error {
+	if c.Route.Mode == core.ModeTime {
+		period := grant.Period + time.Duration(int64(c.Route.period())*int64(grant.Amount)/int64(c.Route.Fee))
+
+		// The credit starts when the time already paid for ends
+		from := time.Now()
+		if expirationTime := c.getExpirationTime(); expirationTime.After(from) {
+			from = expirationTime
+		}
+
+		if err := c.setExpirationTime(from.Add(period)); err != nil {
+			return err
+		}
+	}
+
+	c.mux.Lock()
+	if c.Route.Mode == core.ModeDiscrete {
+		c.CreditBalance += grant.Amount
+	}
+	c.Credits = append(c.Credits, grant)
+	err := c.persist(true)
+	c.mux.Unlock()
+
+	if auditSink != nil {
+		entry := AuditEntry{
+			Time:       grant.Time,
+			Route:      c.Route.Name,
+			Token:      c.getToken(),
+			Allowed:    true,
+			StatusCode: http.StatusOK,
+			Reason:     "credit: " + grant.Reason,
+		}
+		if err := auditSink.Record(entry); err != nil {
+			lightauth.ReportError(err)
+		}
+	}
+
+	return err
+}
+
+// useCredit pays for a discrete request with the credit balance of the client, if it covers it
+func (c *Client) useCredit() bool {
+	cost := c.fee() * c.Route.invoicesPerRequest()
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.CreditBalance < cost {
+		return false
+	}
+
+	c.CreditBalance -= cost
+	return c.persist(true) == nil
+}
+
+func (c *Client) creditBalance() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.CreditBalance
+}
+
+// creditRequest is the body taken by CreditHandler. Period is a duration like 1h.
+type creditRequest struct {
+	Token  string `json:"token"`
+	Amount int    `json:"amount"`
+	Period string `json:"period"`
+	Reason string `json:"reason"`
+}
+
+// CreditHandler lets operators give credit to clients over HTTP, with a POST of a JSON object with the
+// token of the client, the amount in satoshis and/or the period to give, and the reason. It must be
+// mounted behind the operators' own authentication.
+func CreditHandler(w http.ResponseWriter, r *http.Request) {
+	handleCredit(w, r, Credit)
+}
+
+// handleCredit serves a credit request with the given credit function
+func handleCredit(w http.ResponseWriter, r *http.Request, credit func(string, int, time.Duration, string) error) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	request := creditRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Lightauth error: could not decode credit request", http.StatusBadRequest)
+		return
+	}
+
+	period, err := lightauth.ParseDuration(request.Period)
+	if err != nil {
+		http.Error(w, "Lightauth error: period is not a valid duration", http.StatusBadRequest)
+		return
+	}
+
+	err = credit(request.Token, request.Amount, period, request.Reason)
+	if errors.Is(err, ErrUnknownToken) || errors.Is(err, ErrUnknownTenant) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setCreditHeader tells a client of a discrete route the credit balance it has, if any
+func setCreditHeader(h http.Header, c *Client) {
+	if balance := c.creditBalance(); balance > 0 {
+		h.Set(core.HeaderCredit, strconv.Itoa(balance))
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const rOUTESUNSET = "Lightauth error: the route has been retired"
+
+// sunset is when a deprecated route stops serving requests, zero when the route isn't deprecated
+func (r *Route) sunset() time.Time {
+	t, _ := time.Parse("2006-01-02T15:04:05Z07:00", r.Sunset)
+	return t
+}
+
+// invoiceCutoff is when a deprecated route stops issuing invoices, its sunset unless InvoiceCutoff is set
+func (r *Route) invoiceCutoff() time.Time {
+	if t, err := time.Parse("2006-01-02T15:04:05Z07:00", r.InvoiceCutoff); err == nil {
+		return t
+	}
+
+	return r.sunset()
+}
+
+// isSunset tells whether a deprecated route has reached its sunset
+func (r *Route) isSunset() bool {
+	sunset := r.sunset()
+	return !sunset.IsZero() && !time.Now().Before(sunset)
+}
+
+// issuesInvoices tells whether the route still issues invoices. After its cutoff a deprecated route
+// keeps serving what its clients have paid for until its sunset, but takes no more payments.
+func (r *Route) issuesInvoices() bool {
+	cutoff := r.invoiceCutoff()
+	return cutoff.IsZero() || time.Now().Before(cutoff)
+}
+
+// setDeprecationHeaders tells the clients of a deprecated route when it goes away, in the Sunset header
+// of RFC 8594, and in the Deprecation header of RFC 9745 when it stops taking payments
+func setDeprecationHeaders(h http.Header, r *Route) {
+	sunset := r.sunset()
+	if sunset.IsZero() {
+		return
+	}
+
+	h.Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+	h.Set("Deprecation", "@"+strconv.FormatInt(r.invoiceCutoff().Unix(), 10))
+}
@@ -0,0 +1,108 @@
+package server
+
+import "github.com/faurehu/lightauth"
+
+// sealingProvider seals the sensitive fields of the records on their way to the DataProvider and opens
+// them on their way back. The provider gets copies of the records, whose references to other records
+// (Invoice.Client, Client.Route, Client.Invoices) point to the records in memory and must be stored
+// by ID.
+type sealingProvider struct {
+	*lightauth.SealingStore
+	db DataProvider
+}
+
+// seal returns a copy of the record with its sensitive fields sealed
+func seal(s *lightauth.Sealer, r lightauth.Record) (lightauth.Record, error) {
+	var err error
+	switch v := lightauth.CopyRecord(r).(type) {
+	case *Invoice:
+		v.PreImage, err = s.SealPreImage(v.PreImage)
+		return v, err
+	case *Client:
+		previousTokens := make([]RotatedToken, len(v.PreviousTokens))
+		for i, t := range v.PreviousTokens {
+			previousTokens[i] = RotatedToken{ExpirationTime: t.ExpirationTime}
+			if previousTokens[i].Token, err = s.SealToken(t.Token); err != nil {
+				return nil, err
+			}
+		}
+
+		v.Token, err = s.SealToken(v.Token)
+		v.PreviousTokens = previousTokens
+		return v, err
+	default:
+		return r, nil
+	}
+}
+
+func (p *sealingProvider) GetServerData() (map[string]*Route, error) {
+	routes, err := p.db.GetServerData()
+	if err != nil {
+		return routes, err
+	}
+
+	for _, r := range routes {
+		clients := make(map[string]*Client, len(r.Clients))
+		for _, c := range r.Clients {
+			if c.Token, err = p.OpenToken(c.Token); err != nil {
+				return routes, err
+			}
+
+			for i := range c.PreviousTokens {
+				if c.PreviousTokens[i].Token, err = p.OpenToken(c.PreviousTokens[i].Token); err != nil {
+					return routes, err
+				}
+			}
+
+			for _, i := range c.Invoices {
+				if i.PreImage, err = p.OpenPreImage(i.PreImage); err != nil {
+					return routes, err
+				}
+			}
+
+			clients[c.Token] = c
+		}
+		r.Clients = clients
+	}
+
+	return routes, nil
+}
+
+// The optional interfaces of the provider are forwarded, doing what the server does without them when
+// the provider doesn't implement them.
+
+func (p *sealingProvider) TokenExists(token string) (bool, error) {
+	if checker, ok := p.db.(TokenChecker); ok {
+		sealed, err := p.SealToken(token)
+		if err != nil {
+			return false, err
+		}
+
+		return checker.TokenExists(sealed)
+	}
+
+	return false, nil
+}
+
+func (p *sealingProvider) ClaimInvoice(i *Invoice) (bool, error) {
+	if claimer, ok := p.db.(Claimer); ok {
+		sealed, err := p.Seal(i)
+		if err != nil {
+			return false, err
+		}
+
+		return claimer.ClaimInvoice(sealed.(*Invoice))
+	}
+
+	return true, nil
+}
+
+// sealRecords wraps the DataProvider when encryption at rest is enabled
+func sealRecords(db DataProvider, keyFile string) (DataProvider, error) {
+	s, err := lightauth.NewSealingStore(db, keyFile, seal)
+	if err != nil || s == nil {
+		return db, err
+	}
+
+	return &sealingProvider{SealingStore: s, db: db}, nil
+}
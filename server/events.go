@@ -0,0 +1,12 @@
+package server
+
+import "github.com/faurehu/lightauth"
+
+var settlements = lightauth.NewSettlementFeed()
+
+// Settlements returns the channel where the server reports the invoices its node has been paid, once
+// they are credited to their clients. Settlements are dropped when nobody reads them and the channel
+// is full.
+func Settlements() <-chan lightauth.SettlementEvent {
+	return settlements
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+)
+
+// dEFAULTEXPIRYWARNING is how long before the time of a client runs out it is warned, when its route
+// has no ExpiryWarning
+const dEFAULTEXPIRYWARNING = 30 * time.Second
+
+// Warnings sent in Light-Auth-Expiry-Warning. Soft means the client has little left, hard that it has
+// nothing left.
+const (
+	eXPIRYSOFT = core.WarningSoft
+	eXPIRYHARD = core.WarningHard
+)
+
+// expiryWarning is how long before the time of its clients runs out a time route warns them
+func (r *Route) expiryWarning() time.Duration {
+	if d, err := lightauth.ParseDuration(r.ExpiryWarning); err == nil && d > 0 {
+		return d
+	}
+
+	return dEFAULTEXPIRYWARNING
+}
+
+// paidRequests is the number of requests a client of a discrete route has paid for and not made yet
+func (c *Client) paidRequests() int {
+	c.mux.Lock()
+	invoices := make([]*Invoice, 0, len(c.Invoices))
+	for _, i := range c.Invoices {
+		invoices = append(invoices, i)
+	}
+	credit := c.CreditBalance
+	c.mux.Unlock()
+
+	claims := 0
+	for _, i := range invoices {
+		if i.isSettled() && !i.Deferred {
+			claims += i.remainingClaims()
+		}
+	}
+
+	return claims/c.Route.invoicesPerRequest() + credit/(c.fee()*c.Route.invoicesPerRequest())
+}
+
+// setExpiryHeaders tells a client how much it has left: the seconds until its time runs out in
+// Light-Auth-Expires-In on time routes, and a warning in Light-Auth-Expiry-Warning when it is nearly or
+// completely used up, so it can top up before its requests are refused.
+func setExpiryHeaders(h http.Header, c *Client) {
+	var warning core.Warning
+	if c.Route.Mode == core.ModeTime {
+		left := time.Until(c.getExpirationTime())
+		if left < 0 {
+			left = 0
+		}
+		// Rounded down, so a client never counts on time it hasn't got
+		h.Set(core.HeaderExpiresIn, strconv.FormatInt(int64(left/time.Second), 10))
+
+		if left == 0 {
+			warning = eXPIRYHARD
+		} else if left < c.Route.expiryWarning() {
+			warning = eXPIRYSOFT
+		}
+	} else {
+		switch paid := c.paidRequests(); {
+		case paid == 0:
+			warning = eXPIRYHARD
+		case paid <= 1:
+			warning = eXPIRYSOFT
+		}
+	}
+
+	if warning != "" {
+		h.Set(core.HeaderExpiryWarning, string(warning))
+	}
+}
@@ -0,0 +1,9 @@
+package server
+
+import "github.com/faurehu/lightauth"
+
+// ResetStart forgets that the server has been started, so the tests can start it again with another
+// configuration. What the previous start left running is not stopped.
+func ResetStart() {
+	serverState = &lightauth.StartState{}
+}
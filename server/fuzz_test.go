@@ -0,0 +1,66 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"net/http"
+	"net/textproto"
+	"testing"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+func FuzzRequestHeaders(f *testing.F) {
+	f.Add([]byte("Light-Auth-Token: abc\r\nLight-Auth-Fingerprint: 00ff\r\nLight-Auth-Batch-Size: 2"))
+	f.Add([]byte("Light-Auth: version=1\r\nLight-Auth-Invoice: lnsb1n1\r\nLight-Auth-Pre-Image: zz"))
+	f.Add([]byte("Light-Auth: ,=,\r\nLight-Auth-Invoices-Per-Request: -1"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		mimeHeader, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(append(data, '\r', '\n', '\r', '\n')))).ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		h := http.Header(mimeHeader)
+
+		core.ParseHeader(h)
+		paymentInstructions(h)
+		declaredFingerprint(&http.Request{Header: h})
+
+		strict := strictMode
+		defer func() { strictMode = strict }()
+		strictMode = true
+		checkRequestHeaders(&http.Request{Header: h})
+	})
+}
+
+// discreteFuzzClient is a client of a discrete route taking bundles of two invoices, with the invoices
+// lnsb1n1fuzz-a and lnsb1n1fuzz-b whose pre-images are fuzz-a and fuzz-b. They are never settled.
+func discreteFuzzClient() *Client {
+	rt := &Route{RouteInfo: RouteInfo{Name: "GET/fuzz", Fee: 1, MaxInvoices: 2, Mode: core.ModeDiscrete, InvoicesPerRequest: 2}}
+	c := &Client{Route: rt, Invoices: make(map[string]*Invoice)}
+	for _, preImage := range []string{"fuzz-a", "fuzz-b"} {
+		hash := sha256.Sum256([]byte(preImage))
+		c.keepInvoice(&Invoice{PaymentRequest: "lnsb1n1" + preImage, PaymentHash: hash[:], Fee: 1, Client: c})
+	}
+
+	return c
+}
+
+// FuzzDiscreteValidator presents invoices and pre-images to the discrete validator. The invoices are
+// never settled, so the validator never goes as far as claiming them, and right pre-images are answered
+// with a 409.
+func FuzzDiscreteValidator(f *testing.F) {
+	f.Add("lnsb1n1fuzz-a,lnsb1n1fuzz-b", "00,11")
+	f.Add(",", ",")
+	f.Add("lnsb1n1fuzz-a", "zz")
+	f.Fuzz(func(t *testing.T, invoices string, preImages string) {
+		c := discreteFuzzClient()
+		r := &http.Request{Header: http.Header{}}
+		r.Header.Set(core.HeaderInvoice, invoices)
+		r.Header.Set(core.HeaderPreImage, preImages)
+
+		if v := discreteTypeValidator(c, r); v.authorized {
+			t.Errorf("unsettled invoices %q authorized the request", invoices)
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+// mAXREQUESTHEADERBYTES caps the total size of the Light-Auth headers of a request
+const mAXREQUESTHEADERBYTES = 32 * 1024
+
+const (
+	hEADERSTOOLARGE = "Lightauth error: Light-Auth headers are too large"
+	rEPEATEDHEADER  = "Lightauth error: Light-Auth headers can't be repeated"
+)
+
+// requestHeaders are the Light-Auth headers clients send. The others are only ever sent by servers.
+var requestHeaders = map[string]bool{
+	core.Header:                  true,
+	core.HeaderToken:             true,
+	core.HeaderInvoice:           true,
+	core.HeaderPreImage:          true,
+	core.HeaderNonce:             true,
+	core.HeaderFingerprint:       true,
+	core.HeaderIdentitySignature: true,
+	core.HeaderIdentityTimestamp: true,
+	core.HeaderIdentityNonce:     true,
+	core.HeaderBatchSize:         true,
+	core.HeaderPromo:             true,
+	core.HeaderSync:              true,
+	core.HeaderAcceptInvoices:    true,
+}
+
+// guardHeaders strips the Light-Auth headers of a request that only servers send, so neither lightauth
+// nor the handler can be fooled by a client sending them, and checks the rest. It returns the message
+// and status code to reject the request with, or an empty message if it can go on.
+func guardHeaders(r *http.Request) (string, int) {
+	size := 0
+	for k, values := range r.Header {
+		if !strings.HasPrefix(k, core.Header) {
+			continue
+		}
+
+		if !requestHeaders[k] {
+			delete(r.Header, k)
+			continue
+		}
+
+		if len(values) > 1 {
+			// Lightauth and the handler could read different values
+			return rEPEATEDHEADER, http.StatusBadRequest
+		}
+
+		size += len(k) + len(values[0])
+	}
+
+	if size > mAXREQUESTHEADERBYTES {
+		return hEADERSTOOLARGE, http.StatusRequestHeaderFieldsTooLarge
+	}
+
+	return "", 0
+}
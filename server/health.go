@@ -0,0 +1,23 @@
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/faurehu/lightauth"
+)
+
+// serverStreamAlive is set while the server is receiving invoice updates from its node
+var serverStreamAlive int32
+
+// Health reports whether the server can take paid requests: its node is reachable and synced, the
+// invoice subscription is running and the store is reachable.
+func Health() lightauth.Health {
+	h := lightauth.CheckHealth(serverBackend, serverDatabase)
+	h.Subscribed = atomic.LoadInt32(&serverStreamAlive) == 1
+	if !h.Subscribed && serverBackend != nil {
+		h.Errors = append(h.Errors, "Lightauth error: invoice subscription is down")
+	}
+
+	h.Ready = h.Ready && h.Subscribed
+	return h
+}
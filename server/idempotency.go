@@ -0,0 +1,244 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+)
+
+// mAXIDEMPOTENTBODY is the size of the largest response body kept to answer the retries of a request
+const mAXIDEMPOTENTBODY = 1024 * 1024
+
+// The most recorded responses kept, and the most bytes of bodies they hold together. The least recently
+// used responses are forgotten first once either is reached.
+const (
+	mAXIDEMPOTENTRESPONSES = 10000
+	mAXIDEMPOTENTBYTES     = 64 * 1024 * 1024
+)
+
+// iDEMPOTENCYSWEEP is how often the recorded responses that expired are forgotten
+const iDEMPOTENCYSWEEP = time.Minute
+
+const rEQUESTINPROGRESS = "Lightauth error: a request with the same Idempotency-Key is in progress"
+
+// idempotencyWindow is how long the responses of requests with an Idempotency-Key are kept, set with
+// IdempotencyWindow in lightauth.toml. Idempotency keys are ignored when it is 0.
+var idempotencyWindow time.Duration
+
+// recordedResponse is the response of a paid request with an Idempotency-Key, or of a GET to a route
+// with a CacheTTL, kept to be sent again to the retries of the request without charging for them.
+type recordedResponse struct {
+	status      int
+	wroteHeader bool
+	header      http.Header
+	body        []byte
+	overflow    bool
+	done        bool
+	expiration  time.Time
+	finished    chan struct{}
+}
+
+type idempotencyKey struct {
+	client *Client
+	key    string
+}
+
+type idempotentEntry struct {
+	key    idempotencyKey
+	record *recordedResponse
+}
+
+// idempotentResponses are the recorded responses, in recent from the most to the least recently used.
+// bytes is the size of the bodies of those that are done.
+var idempotentResponses = struct {
+	mux       sync.Mutex
+	responses map[idempotencyKey]*list.Element
+	recent    *list.List
+	bytes     int
+}{responses: make(map[idempotencyKey]*list.Element), recent: list.New()}
+
+// cACHEKEY prefixes the replay keys of the GETs to routes with a CacheTTL
+const cACHEKEY = "get:"
+
+// replayKey tells what requests of a client get the same response as the request, and for how long:
+// those with the same Idempotency-Key, or else on routes with a CacheTTL, the GETs of the same URL. The
+// key is empty when the request is charged whatever the requests before it.
+func replayKey(c *Client, r *http.Request) (string, time.Duration) {
+	if key := r.Header.Get("Idempotency-Key"); key != "" && idempotencyWindow > 0 {
+		return "key:" + key, idempotencyWindow
+	}
+
+	if ttl := c.Route.cacheTTL(); ttl > 0 && r.Method == http.MethodGet {
+		return cACHEKEY + r.URL.RequestURI(), ttl
+	}
+
+	return "", 0
+}
+
+// beginIdempotent looks up the response to a request with a replay key. It returns the recorded
+// response if the request has already been served, or starts recording a new one if it is the first
+// attempt. Nothing is recorded for requests without a key. A GET whose response is being recorded waits
+// for it, and inProgress is set when an earlier attempt of any other request is still being served, or
+// when ctx is done before the response is recorded.
+func beginIdempotent(ctx context.Context, c *Client, key string) (recorded *recordedResponse, record *recordedResponse, inProgress bool) {
+	if key == "" {
+		return nil, nil, false
+	}
+
+	for {
+		recorded, record, pending := lookupIdempotent(c, key)
+		if pending == nil {
+			return recorded, record, false
+		}
+
+		if !strings.HasPrefix(key, cACHEKEY) {
+			return nil, nil, true
+		}
+
+		select {
+		case <-pending.finished:
+			// Replayed if it was served, attempted again otherwise
+		case <-ctx.Done():
+			return nil, nil, true
+		}
+	}
+}
+
+// lookupIdempotent returns the recorded response of a request, or starts recording a new one. pending
+// is set instead when an earlier attempt is still being served.
+func lookupIdempotent(c *Client, key string) (recorded *recordedResponse, record *recordedResponse, pending *recordedResponse) {
+	idempotentResponses.mux.Lock()
+	defer idempotentResponses.mux.Unlock()
+
+	k := idempotencyKey{client: c, key: key}
+	if e, exists := idempotentResponses.responses[k]; exists {
+		previous := e.Value.(*idempotentEntry).record
+		if !previous.done {
+			return nil, nil, previous
+		}
+
+		if previous.expiration.After(time.Now()) {
+			idempotentResponses.recent.MoveToFront(e)
+			return previous, nil, nil
+		}
+
+		forgetIdempotent(e)
+	}
+
+	record = &recordedResponse{status: http.StatusOK, finished: make(chan struct{})}
+	idempotentResponses.responses[k] = idempotentResponses.recent.PushFront(&idempotentEntry{key: k, record: record})
+	evictIdempotent()
+	return nil, record, nil
+}
+
+// endIdempotent keeps the recorded response of a request that has been charged and served for ttl, or
+// forgets it otherwise so the request can be attempted again. Either way, the requests waiting for it
+// are let through.
+func endIdempotent(c *Client, key string, ttl time.Duration, record *recordedResponse, header http.Header, served bool) {
+	k := idempotencyKey{client: c, key: key}
+
+	idempotentResponses.mux.Lock()
+	defer idempotentResponses.mux.Unlock()
+	defer close(record.finished)
+
+	e, exists := idempotentResponses.responses[k]
+	if !exists || e.Value.(*idempotentEntry).record != record {
+		// Evicted while the request was served
+		return
+	}
+
+	if !served || record.overflow {
+		forgetIdempotent(e)
+		return
+	}
+
+	record.header = make(http.Header)
+	for name, values := range header {
+		// The Light-Auth headers are those of each attempt
+		if !strings.HasPrefix(name, core.Header) {
+			record.header[name] = append([]string{}, values...)
+		}
+	}
+	record.done = true
+	record.expiration = time.Now().Add(ttl)
+	idempotentResponses.bytes += len(record.body)
+	evictIdempotent()
+}
+
+// forgetIdempotent forgets a recorded response. The lock of idempotentResponses must be held.
+func forgetIdempotent(e *list.Element) {
+	entry := idempotentResponses.recent.Remove(e).(*idempotentEntry)
+	delete(idempotentResponses.responses, entry.key)
+	if entry.record.done {
+		idempotentResponses.bytes -= len(entry.record.body)
+	}
+}
+
+// evictIdempotent forgets the least recently used responses that are done until the recorded responses
+// fit in their limits. The lock of idempotentResponses must be held.
+func evictIdempotent() {
+	e := idempotentResponses.recent.Back()
+	for e != nil && (idempotentResponses.recent.Len() > mAXIDEMPOTENTRESPONSES || idempotentResponses.bytes > mAXIDEMPOTENTBYTES) {
+		previous := e.Prev()
+		if e.Value.(*idempotentEntry).record.done {
+			forgetIdempotent(e)
+		}
+		e = previous
+	}
+}
+
+// sweepIdempotent forgets the recorded responses that expired, so they don't wait to be evicted
+func sweepIdempotent() {
+	defer lightauth.RecoverBackground("idempotency sweep")
+
+	for range time.Tick(iDEMPOTENCYSWEEP) {
+		t := time.Now()
+		idempotentResponses.mux.Lock()
+		for e := idempotentResponses.recent.Front(); e != nil; {
+			next := e.Next()
+			if record := e.Value.(*idempotentEntry).record; record.done && record.expiration.Before(t) {
+				forgetIdempotent(e)
+			}
+			e = next
+		}
+		idempotentResponses.mux.Unlock()
+	}
+}
+
+// replay sends the recorded response of a request again, without charging for it
+func (record *recordedResponse) replay(w http.ResponseWriter) {
+	for name, values := range record.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	core.SetHeader(w, core.ResultOK)
+
+	w.WriteHeader(record.status)
+	w.Write(record.body)
+}
+
+// writeHeader records the status code of the response
+func (record *recordedResponse) writeHeader(statusCode int) {
+	if !record.wroteHeader {
+		record.status = statusCode
+		record.wroteHeader = true
+	}
+}
+
+// write records a part of the body of the response, giving up on keeping it when it gets too large
+func (record *recordedResponse) write(b []byte) {
+	record.wroteHeader = true
+	if record.overflow || len(record.body)+len(b) > mAXIDEMPOTENTBODY {
+		record.overflow = true
+		record.body = nil
+		return
+	}
+
+	record.body = append(record.body, b...)
+}
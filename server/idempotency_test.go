@@ -0,0 +1,95 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// serveIdempotent records a served response for the key
+func serveIdempotent(c *Client, key string, body []byte, ttl time.Duration) {
+	_, record, _ := beginIdempotent(context.Background(), c, key)
+	record.write(body)
+	endIdempotent(c, key, ttl, record, http.Header{}, true)
+}
+
+// resetIdempotent forgets the responses recorded by earlier tests
+func resetIdempotent() {
+	idempotentResponses.mux.Lock()
+	defer idempotentResponses.mux.Unlock()
+
+	idempotentResponses.responses = make(map[idempotencyKey]*list.Element)
+	idempotentResponses.recent = list.New()
+	idempotentResponses.bytes = 0
+}
+
+func TestIdempotentEviction(t *testing.T) {
+	resetIdempotent()
+	c := &Client{}
+
+	serveIdempotent(c, "first", nil, time.Hour)
+	for i := 0; i < mAXIDEMPOTENTRESPONSES; i++ {
+		serveIdempotent(c, "key"+strconv.Itoa(i), nil, time.Hour)
+	}
+
+	if recorded, _, _ := beginIdempotent(context.Background(), c, "key0"); recorded == nil {
+		t.Error("a recent response was forgotten")
+	}
+	if _, record, _ := beginIdempotent(context.Background(), c, "first"); record == nil {
+		t.Error("the least recently used response was kept beyond the limit of responses")
+	}
+
+	body := make([]byte, mAXIDEMPOTENTBODY)
+	for i := 0; i <= mAXIDEMPOTENTBYTES/mAXIDEMPOTENTBODY; i++ {
+		serveIdempotent(c, "large"+strconv.Itoa(i), body, time.Hour)
+	}
+
+	if _, record, _ := beginIdempotent(context.Background(), c, "large0"); record == nil {
+		t.Error("the least recently used response was kept beyond the limit of bytes")
+	}
+	if idempotentResponses.bytes > mAXIDEMPOTENTBYTES {
+		t.Errorf("%v bytes of responses are kept", idempotentResponses.bytes)
+	}
+}
+
+func TestIdempotentExpiration(t *testing.T) {
+	resetIdempotent()
+	c := &Client{}
+
+	serveIdempotent(c, "expired", nil, -time.Second)
+	if recorded, _, _ := beginIdempotent(context.Background(), c, "expired"); recorded != nil {
+		t.Error("an expired response was replayed")
+	}
+}
+
+func TestIdempotentConcurrentGets(t *testing.T) {
+	resetIdempotent()
+	c := &Client{}
+	key := cACHEKEY + "/cached"
+
+	_, record, _ := beginIdempotent(context.Background(), c, key)
+
+	replayed := make(chan *recordedResponse)
+	go func() {
+		recorded, _, _ := beginIdempotent(context.Background(), c, key)
+		replayed <- recorded
+	}()
+
+	record.write([]byte("cached"))
+	endIdempotent(c, key, time.Hour, record, http.Header{}, true)
+
+	if recorded := <-replayed; recorded == nil || string(recorded.body) != "cached" {
+		t.Error("a concurrent GET wasn't answered with the response in progress")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, record, _ = beginIdempotent(context.Background(), c, cACHEKEY+"/pending")
+	cancel()
+	if _, _, inProgress := beginIdempotent(ctx, c, cACHEKEY+"/pending"); !inProgress {
+		t.Error("a GET waited for the response in progress after it was canceled")
+	}
+	endIdempotent(c, cACHEKEY+"/pending", time.Hour, record, http.Header{}, false)
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+)
+
+// identityWindow is how far a signed request's timestamp may drift from the server's clock
+var identityWindow = time.Minute
+
+// identityNonces are the nonces of the signed requests received recently
+var identityNonces = &nonceCache{seen: make(map[string]time.Time)}
+
+// verifyIdentity returns the public key that signed the request, or an empty string if the request is
+// not signed. The signature is checked by the node of the route.
+func verifyIdentity(r *http.Request, rt *Route) (string, error) {
+	signature := core.ReadHeader(r.Header, core.HeaderIdentitySignature)
+	if signature == "" {
+		return "", nil
+	}
+
+	timestamp, err := strconv.ParseInt(core.ReadHeader(r.Header, core.HeaderIdentityTimestamp), 10, 64)
+	if err != nil {
+		return "", errors.New(iNVALIDSIGNATURE)
+	}
+
+	drift := time.Since(time.Unix(timestamp, 0))
+	if drift > identityWindow || drift < -identityWindow {
+		return "", errors.New(iNVALIDSIGNATURE)
+	}
+
+	nonce := core.ReadHeader(r.Header, core.HeaderIdentityNonce)
+	if nonce == "" {
+		return "", errors.New(iNVALIDSIGNATURE)
+	}
+
+	message := core.IdentityMessage(r.Method, r.Host+r.URL.Path, timestamp, nonce)
+
+	var identity string
+	err = rt.breaker().Call(r.Context(), func(ctx context.Context) error {
+		var err error
+		identity, err = rt.backend().VerifyMessage(ctx, []byte(message), signature)
+		return err
+	})
+	if errors.Is(err, lightauth.ErrCircuitOpen) {
+		return "", err
+	}
+
+	if err != nil || identity == "" {
+		return "", errors.New(iNVALIDSIGNATURE)
+	}
+
+	if !identityNonces.use(identity + " " + nonce) {
+		// The signature has been presented before
+		return "", errors.New(rEPLAYEDNONCE)
+	}
+
+	return identity, nil
+}
+
+// bindIdentity returns the token of the client bound to the identity. An identity seen for the first
+// time is bound to the client presenting the token, or to a new client if there is none.
+func bindIdentity(rt *Route, identity string, token string) (string, error) {
+	if c, bound := rt.identityClient(identity); bound {
+		return c.getToken(), nil
+	}
+
+	c, tokenExists := rt.lookupClient(token)
+	if !tokenExists || c.getIdentity() != "" {
+		var err error
+		c, err = rt.newClient()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	c, err := rt.bindClient(identity, c)
+	if err != nil {
+		return "", err
+	}
+
+	return c.getToken(), nil
+}
+
+// RevokeIdentity stops all balances bound to an identity from being used on any route
+func RevokeIdentity(identity string) error {
+	for _, r := range serverStore {
+		c, bound := r.identityClient(identity)
+		if !bound {
+			continue
+		}
+
+		if err := c.revoke(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) getIdentity() string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.Identity
+}
+
+// setIdentity binds the client to an identity, unless it is bound to another one already
+func (c *Client) setIdentity(identity string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.Identity != "" && c.Identity != identity {
+		return errors.New("Lightauth error: the client is bound to another identity")
+	}
+
+	c.Identity = identity
+	return c.persist(false)
+}
+
+func (c *Client) isRevoked() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.Revoked
+}
+
+func (c *Client) revoke() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.Revoked {
+		return nil
+	}
+
+	c.Revoked = true
+	return c.persist(false)
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"encoding/hex"
+	"time"
+
+	"github.com/faurehu/lightauth"
+)
+
+// Info returns a copy of the state of the invoice
+func (i *Invoice) Info() lightauth.InvoiceInfo {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	return lightauth.InvoiceInfo{
+		PaymentRequest: i.PaymentRequest,
+		PaymentHash:    hex.EncodeToString(i.PaymentHash),
+		Fee:            i.Fee,
+		Settled:        i.Settled,
+		Claimed:        i.Claimed,
+		Expired:        time.Now().After(i.ExpirationTime),
+		Deferred:       i.Deferred,
+		ExpirationTime: i.ExpirationTime,
+		AmountPaidMsat: i.AmountPaid,
+		Claims:         i.Claims,
+		ClaimCount:     i.ClaimCount,
+	}
+}
+
+// ListInvoices returns the invoices of a client of the server that match the filter, sorted by
+// expiration time
+func (c *Client) ListInvoices(filter lightauth.InvoiceFilter) []lightauth.InvoiceInfo {
+	return lightauth.ListInvoices(c.invoices(), filter)
+}
+
+// LookupClient returns the client of the server with the given token, whatever its route
+func LookupClient(token string) (*Client, error) {
+	c, tokenExists := lookupToken(token)
+	if !tokenExists {
+		return nil, ErrUnknownToken
+	}
+
+	return c, nil
+}
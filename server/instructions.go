@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+// paymentInstructions gathers the Light-Auth headers written for a rejected request into the payment
+// object of its body, or returns nil if the request didn't get as far as its route.
+func paymentInstructions(h http.Header) *core.PaymentInstructions {
+	mode := core.Mode(core.ReadHeader(h, core.HeaderMode))
+	if mode == "" {
+		return nil
+	}
+
+	fee, _ := strconv.Atoi(core.ReadHeader(h, core.HeaderFee))
+	maxInvoices, _ := strconv.Atoi(core.ReadHeader(h, core.HeaderMaxInvoices))
+	invoicesPerRequest, _ := strconv.Atoi(core.ReadHeader(h, core.HeaderInvoicesPerRequest))
+	invoicesTotal, _ := strconv.Atoi(core.ReadHeader(h, core.HeaderInvoicesTotal))
+
+	p := &core.PaymentInstructions{
+		Token:              core.ReadHeader(h, core.HeaderToken),
+		Name:               core.ReadHeader(h, core.HeaderName),
+		Mode:               mode,
+		Fee:                fee,
+		MaxInvoices:        maxInvoices,
+		InvoicesPerRequest: invoicesPerRequest,
+		Period:             core.Period(core.ReadHeader(h, core.HeaderTimePeriod)),
+		ExpirationTime:     core.ReadHeader(h, core.HeaderExpirationTime),
+		LNURL:              core.ReadHeader(h, core.HeaderLNURL),
+		BindRequest:        core.ReadHeader(h, core.HeaderBindRequest) == "true",
+		Fingerprint:        core.ReadHeader(h, core.HeaderFingerprint),
+		Varies:             core.ReadHeader(h, core.HeaderVaries),
+		InvoicesTotal:      invoicesTotal,
+		InvoicesURL:        core.ReadHeader(h, core.HeaderInvoicesURL),
+		RetryWith:          []string{core.HeaderToken},
+	}
+
+	if mode == core.ModeDiscrete {
+		p.RetryWith = append(p.RetryWith, core.HeaderInvoice, core.HeaderPreImage)
+		if p.BindRequest {
+			p.RetryWith = append(p.RetryWith, core.HeaderFingerprint)
+		}
+	}
+
+	return p
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+)
+
+// Invoice is a hash that stores all the information of an invoice the server issued to a client
+type Invoice struct {
+	Client         *Client
+	PaymentRequest string
+	PaymentHash    []byte
+	Fee            int
+	Settled        bool
+	PreImage       []byte
+	Claimed        bool
+	ClaimNonce     string
+	mux            sync.Mutex
+	ID             string
+	ExpirationTime time.Time
+	Description    string
+	CreditedFrom   time.Time
+	CreditedUntil  time.Time
+	AmountPaid     int64
+	Claims         int
+	ClaimCount     int
+	Deferred       bool
+	Fingerprint    string
+	Referrer       string
+	ReferrerPaid   bool
+	ReferrerPayout string
+}
+
+// JSONInvoice is an invoice as sent in the Light-Auth headers
+type JSONInvoice = core.JSONInvoice
+
+// jsonInvoices lists invoices as sent in the Light-Auth headers
+func jsonInvoices(invoices []*Invoice) []JSONInvoice {
+	data := []JSONInvoice{}
+	for _, v := range invoices {
+		data = append(data, JSONInvoice{
+			PaymentRequest: v.PaymentRequest,
+			ExpirationTime: v.ExpirationTime,
+		})
+	}
+
+	return data
+}
+
+func getInvoicesJSON(invoices []*Invoice) (string, error) {
+	jsonData, err := json.Marshal(jsonInvoices(invoices))
+	if err != nil {
+		log.Printf("Lightauth error: could not encode invoices to JSON %v\n", err)
+		return "", err
+	}
+
+	return string(jsonData), nil
+}
+
+// paymentRequests lists the payment requests of invoices as sent in the Light-Auth-Invoice header
+func paymentRequests(invoices []*Invoice) string {
+	requests := make([]string, len(invoices))
+	for k, i := range invoices {
+		requests[k] = i.PaymentRequest
+	}
+
+	return strings.Join(requests, ",")
+}
+
+func (i *Invoice) settle(preImage []byte) error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	i.Settled = true
+	i.PreImage = preImage
+
+	return i.persist(true)
+}
+
+// settlePayment settles an invoice of the server with the amount received in millisatoshis and the
+// number of requests it pays for in discrete mode.
+func (i *Invoice) settlePayment(amountPaid int64, claims int) error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	i.Settled = true
+	i.AmountPaid = amountPaid
+	i.Claims = claims
+
+	return i.persist(true)
+}
+
+// remainingClaims is the number of requests an invoice can still pay for. Invoices stored before
+// overpayments were credited pay for one.
+func (i *Invoice) remainingClaims() int {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	claims := i.Claims
+	if claims == 0 {
+		claims = 1
+	}
+
+	return claims - i.ClaimCount
+}
+
+// credit records the period bought by an invoice of a time route
+func (i *Invoice) credit(from time.Time, until time.Time) error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	i.CreditedFrom = from
+	i.CreditedUntil = until
+
+	return i.persist(true)
+}
+
+func (i *Invoice) isSettled() bool {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	return i.Settled
+}
+
+func (i *Invoice) isClaimed() bool {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	return i.Claimed
+}
+
+func (i *Invoice) isExpired() bool {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	return i.ExpirationTime.Before(time.Now())
+}
+
+// resave writes the invoice again after a failed durable write
+func (i *Invoice) resave() error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	return i.persist(true)
+}
+
+func (i *Invoice) save() error {
+	return i.persist(false)
+}
+
+// persist writes the invoice to the store, straight away if durable even in write-behind mode
+func (i *Invoice) persist(durable bool) error {
+	if i.ID == "" {
+		var err error
+		i.ID, err = serverDatabase.Create(i)
+		return err
+	}
+
+	return lightauth.Edit(serverDatabase, i, durable)
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+const lEGACYCLIENT = "Lightauth error: the client is too old for this server, it must announce the protocol version it speaks"
+
+// legacyClientsUntil is when the server stops serving clients that don't announce their protocol
+// version, set with LegacyClientsUntil in lightauth.toml. They are served for as long as it is zero.
+var legacyClientsUntil time.Time
+
+// isLegacyRequest tells whether a request comes from a client older than the announcement of the
+// protocol version, which only sends its Light-Auth-Token and credentials. Such clients speak the
+// first version of the protocol, so the server selects it for them.
+func isLegacyRequest(r *http.Request) bool {
+	params, announced := core.ParseHeader(r.Header)
+	return !announced || params["version"] == ""
+}
+
+// servesLegacy tells whether a request comes from a legacy client still within the deprecation window.
+// Those get the responses of the first version of the protocol: a 200 whatever the outcome, with the
+// status code in Light-Auth-Status and the error message as plain text.
+func servesLegacy(r *http.Request) bool {
+	return isLegacyRequest(r) && (legacyClientsUntil.IsZero() || time.Now().Before(legacyClientsUntil))
+}
+
+// checkLegacyRequest returns the message to refuse a request of a legacy client with once the
+// deprecation window of legacy clients is over, or an empty message if it can go on
+func checkLegacyRequest(r *http.Request) string {
+	if !isLegacyRequest(r) || servesLegacy(r) {
+		return ""
+	}
+
+	return lEGACYCLIENT
+}
+
+// writeLegacyError answers a legacy client with the error of its request
+func writeLegacyError(w http.ResponseWriter, message string, statusCode int) {
+	w.Header().Set(core.HeaderStatus, strconv.Itoa(statusCode))
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, message)
+}
@@ -0,0 +1,95 @@
+package server_test
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/faurehu/lightauth/core"
+	"github.com/faurehu/lightauth/lightauthtest"
+	"github.com/faurehu/lightauth/server"
+)
+
+// legacyGet sends a request the way clients did before they announced their protocol version, and
+// returns the status code of the response as such clients read it, from Light-Auth-Status
+func legacyGet(t *testing.T, url string, headers map[string]string) (*http.Response, int, string) {
+	t.Helper()
+
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for header, value := range headers {
+		request.Header.Set(header, value)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("legacy client got a %v: %s", response.StatusCode, body)
+	}
+
+	status, err := strconv.Atoi(response.Header.Get(core.HeaderStatus))
+	if err != nil {
+		t.Fatalf("legacy client got no status in %v: %v", core.HeaderStatus, err)
+	}
+
+	return response, status, string(body)
+}
+
+func TestLegacyClient(t *testing.T) {
+	live := httptest.NewServer(http.HandlerFunc(server.Middleware(okHandler)))
+	defer live.Close()
+	url := live.URL + strings.TrimPrefix(lightauthtest.ConformanceDiscreteRoute, http.MethodGet)
+
+	response, status, body := legacyGet(t, url, nil)
+	if status != http.StatusBadRequest || strings.HasPrefix(body, "{") {
+		t.Fatalf("first request: got %v %q, want a 400 with a plain text message", status, body)
+	}
+
+	token := response.Header.Get(core.HeaderToken)
+	invoices := []core.JSONInvoice{}
+	if err := json.Unmarshal([]byte(response.Header.Get(core.HeaderInvoices)), &invoices); err != nil || len(invoices) == 0 {
+		t.Fatalf("no invoices for the legacy client: %v", err)
+	}
+
+	preImage, err := lightauthtest.SimnetPayer(network)(context.Background(), invoices[0].PaymentRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := map[string]string{
+		core.HeaderToken:    token,
+		core.HeaderInvoice:  invoices[0].PaymentRequest,
+		core.HeaderPreImage: hex.EncodeToString(preImage),
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		// The settlement reaches the server asynchronously
+		_, status, body = legacyGet(t, url, headers)
+		if status != http.StatusConflict || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if status != http.StatusOK || body != "ok" {
+		t.Fatalf("paid request: got %v %q, want 200 \"ok\"", status, body)
+	}
+}
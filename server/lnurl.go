@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+func lnurlMetadata(rt *Route) string {
+	metadata, _ := json.Marshal([][]string{{"text/plain", "Lightauth access to " + rt.Name}})
+	return string(metadata)
+}
+
+func writeLNURL(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Lightauth error: could not encode LNURL response: %v\n", err)
+	}
+}
+
+func writeLNURLError(w http.ResponseWriter, reason string) {
+	writeLNURL(w, core.LNURLStatus{Status: "ERROR", Reason: reason})
+}
+
+// LNURLPayHandler serves the LNURL-pay endpoint of a route. The URL it is mounted on must be the one
+// configured as the route's LNURL. Clients present their token in the token query parameter, or in
+// Light-Auth-Token, so the invoices it issues are credited to them, and the callback it returns
+// carries the token along. routeName is the Name of the route, followed by its Match conditions joined
+// with & after a ? if it has some, like GET/video?query:resolution=4k.
+func LNURLPayHandler(routeName string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rt, routeExists := serverStore[routeName]
+		if !routeExists || rt.LNURL == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			token = core.ReadHeader(r.Header, core.HeaderToken)
+		}
+
+		c, tokenExists := rt.lookupClient(token)
+		if !tokenExists {
+			writeLNURLError(w, iNVALIDTOKEN)
+			return
+		}
+
+		metadata := lnurlMetadata(rt)
+		amount := r.URL.Query().Get("amount")
+		if amount == "" {
+			callback, err := core.LNURLWithToken(rt.LNURL, c.Token)
+			if err != nil {
+				writeLNURLError(w, sOMETHINGWENTWRONG)
+				return
+			}
+
+			writeLNURL(w, core.LNURLPayParams{
+				Tag:         "payRequest",
+				Callback:    callback,
+				MinSendable: int64(rt.Fee) * 1000,
+				MaxSendable: int64(rt.Fee) * 1000,
+				Metadata:    metadata,
+			})
+			return
+		}
+
+		msat, err := strconv.ParseInt(amount, 10, 64)
+		if err != nil || msat != int64(rt.Fee)*1000 {
+			writeLNURLError(w, "Lightauth error: The amount does not match the route fee")
+			return
+		}
+
+		descriptionHash := sha256.Sum256([]byte(metadata))
+		invoice := c.lnInvoice("")
+		invoice.Memo = ""
+		invoice.DescriptionHash = descriptionHash[:]
+		i, err := c.addInvoice(r.Context(), invoice, &Invoice{})
+		if err != nil {
+			writeLNURLError(w, sOMETHINGWENTWRONG)
+			return
+		}
+
+		writeLNURL(w, core.LNURLPayInvoice{PR: i.PaymentRequest, Routes: []string{}})
+	}
+}
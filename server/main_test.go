@@ -0,0 +1,42 @@
+package server_test
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/faurehu/lightauth/client"
+	"github.com/faurehu/lightauth/lightauthtest"
+	"github.com/faurehu/lightauth/server"
+	"github.com/faurehu/lightauth/simnet"
+)
+
+// network is the simnet network the server and the client of the tests share
+var network *simnet.Network
+
+// configPath is the conformance configuration the tests run with
+var configPath string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "lightauth")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if configPath, err = lightauthtest.WriteConformanceConfig(dir); err != nil {
+		log.Fatal(err)
+	}
+
+	network = simnet.New(1 << 40)
+	if err := server.StartWithBackend(simnet.NewMemoryProvider(), network); err != nil {
+		log.Fatal(err)
+	}
+	if err := client.StartWithBackend(simnet.NewMemoryProvider(), network); err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
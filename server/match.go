@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+// conditions returns the parsed Match conditions of the route. They are checked when the configuration
+// is read.
+func (ri RouteInfo) conditions() []core.Condition {
+	conditions := []core.Condition{}
+	for _, m := range ri.Match {
+		if rc, err := core.ParseCondition(m); err == nil {
+			conditions = append(conditions, rc)
+		}
+	}
+
+	return conditions
+}
+
+// key is what the route is stored under in serverStore and what LNURLPayHandler takes: its Name,
+// followed by its Match conditions if it has some, like GET/video?query:resolution=4k.
+func (ri RouteInfo) key() string {
+	if len(ri.Match) == 0 {
+		return ri.Name
+	}
+
+	match := append([]string{}, ri.Match...)
+	sort.Strings(match)
+	return ri.Name + "?" + strings.Join(match, "&")
+}
+
+// routeIndex lists the routes sharing each Name, those with the most conditions first
+var routeIndex map[string][]*Route
+
+// indexRoutes builds routeIndex from serverStore and tells each route what the prices of its Name
+// depend on.
+func indexRoutes() {
+	routeIndex = make(map[string][]*Route)
+	for _, rt := range serverStore {
+		routeIndex[rt.Name] = append(routeIndex[rt.Name], rt)
+	}
+
+	for _, routes := range routeIndex {
+		for _, rt := range routes {
+			rt.match = rt.conditions()
+		}
+
+		sort.SliceStable(routes, func(a, b int) bool {
+			return len(routes[a].Match) > len(routes[b].Match)
+		})
+
+		seen := make(map[string]bool)
+		varies := []string{}
+		for _, rt := range routes {
+			for _, rc := range rt.match {
+				if !seen[rc.Varies()] {
+					seen[rc.Varies()] = true
+					varies = append(varies, rc.Varies())
+				}
+			}
+		}
+		sort.Strings(varies)
+
+		for _, rt := range routes {
+			rt.varies = varies
+		}
+	}
+}
+
+// matchRoute returns the route of a request: the most specific of the routes with its method and path
+// whose conditions it all meets.
+func matchRoute(r *http.Request) (*Route, bool) {
+	query := r.URL.Query()
+	for _, rt := range routeIndex[r.Method+r.URL.Path] {
+		matches := true
+		for _, rc := range rt.match {
+			matches = matches && rc.Matches(query, r.Header)
+		}
+
+		if matches {
+			return rt, true
+		}
+	}
+
+	return nil, false
+}
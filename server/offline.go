@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// rECONCILEINTERVAL is how often the invoices accepted while the node was down are checked against it
+const rECONCILEINTERVAL = 30 * time.Second
+
+// offlineVerification lets the server accept discrete claims on the preimage alone while it has lost
+// its invoice subscription.
+var offlineVerification bool
+
+// InvoiceLooker can be implemented by a LightningBackend to look up an invoice by payment hash, which
+// is how invoices accepted while the node was down are reconciled.
+type InvoiceLooker interface {
+	LookupInvoice(ctx context.Context, rHash []byte) (*lnrpc.Invoice, error)
+}
+
+// offlineQueue holds the invoices accepted offline until the node confirms their settlement
+type offlineQueue struct {
+	mux      sync.Mutex
+	invoices []*Invoice
+}
+
+var offlineClaims = &offlineQueue{}
+
+func (q *offlineQueue) add(i *Invoice) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	q.invoices = append(q.invoices, i)
+}
+
+func (q *offlineQueue) take() []*Invoice {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	invoices := q.invoices
+	q.invoices = nil
+	return invoices
+}
+
+// acceptOffline settles an invoice on the proof given by its preimage, which the client could only
+// have learned by paying it, and queues it to be checked once the node is back.
+func acceptOffline(i *Invoice, preImage []byte) error {
+	if err := i.settle(preImage); err != nil {
+		return err
+	}
+
+	offlineClaims.add(i)
+	return nil
+}
+
+// reconcileOffline checks the invoices accepted offline with the node of their route once it is
+// reachable again, and reports the ones the node doesn't know as settled.
+func reconcileOffline() {
+	defer lightauth.RecoverBackground("offline reconciliation")
+
+	for range time.Tick(rECONCILEINTERVAL) {
+		for _, i := range offlineClaims.take() {
+			tenantName := i.Client.Route.Tenant
+			if tenantOffline(tenantName) {
+				// Try again on the next round
+				offlineClaims.add(i)
+				continue
+			}
+
+			looker, ok := tenantBackend(tenantName).(InvoiceLooker)
+			if !ok {
+				continue
+			}
+
+			var invoice *lnrpc.Invoice
+			err := tenantBreaker(tenantName).Call(context.Background(), func(ctx context.Context) error {
+				var err error
+				invoice, err = looker.LookupInvoice(ctx, i.PaymentHash)
+				return err
+			})
+
+			if err != nil {
+				offlineClaims.add(i)
+				continue
+			}
+
+			if invoice.State != lnrpc.Invoice_SETTLED && !invoice.Settled {
+				lightauth.ReportError(fmt.Errorf("Lightauth error: invoice %v was accepted offline but the node has not settled it", i.PaymentRequest))
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+// paginate returns the page of invoices with the given number, the invoices that expire first coming
+// first, so the first page always holds the next invoices to pay.
+func paginate(invoices []*Invoice, page int) []*Invoice {
+	sorted := append([]*Invoice{}, invoices...)
+	sort.Slice(sorted, func(a, b int) bool {
+		if !sorted[a].ExpirationTime.Equal(sorted[b].ExpirationTime) {
+			return sorted[a].ExpirationTime.Before(sorted[b].ExpirationTime)
+		}
+
+		return sorted[a].PaymentRequest < sorted[b].PaymentRequest
+	})
+
+	start := page * core.InvoicesPageSize
+	if page < 0 || start >= len(sorted) {
+		return []*Invoice{}
+	}
+
+	end := start + core.InvoicesPageSize
+	if end > len(sorted) {
+		end = len(sorted)
+	}
+
+	return sorted[start:end]
+}
+
+// setInvoicesHeaders lists the unpaid invoices of a client in the response headers. Routes with an
+// InvoicesURL only send the first page, along with the number of invoices there are and where to get
+// the other pages.
+func setInvoicesHeaders(ctx context.Context, h http.Header, rt *Route, invoices []*Invoice) error {
+	if rt.InvoicesURL != "" && len(invoices) > core.InvoicesPageSize {
+		h.Set(core.HeaderInvoicesTotal, strconv.Itoa(len(invoices)))
+		invoices = paginate(invoices, 0)
+	}
+
+	if rt.InvoicesURL != "" {
+		h.Set(core.HeaderInvoicesURL, rt.InvoicesURL)
+	}
+
+	if err := core.SetInvoices(h, invoiceCodec(ctx), jsonInvoices(invoices)); err != nil {
+		log.Printf("Lightauth error: could not encode invoices: %v\n", err)
+		return err
+	}
+
+	return nil
+}
+
+// InvoicesHandler serves the pages of unpaid invoices of the clients of a route, so routes with a large
+// MaxInvoices don't have to send them all in a header. The URL it is mounted on must be the one
+// configured as the route's InvoicesURL. Clients present their Light-Auth-Token and ask for a page
+// with the page query parameter, the first one (0) by default. routeName is the key of the route, as
+// taken by LNURLPayHandler.
+func InvoicesHandler(routeName string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rt, routeExists := serverStore[routeName]
+		if !routeExists || rt.InvoicesURL == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		c, tokenExists := rt.lookupClient(core.ReadHeader(r.Header, core.HeaderToken))
+		if !tokenExists {
+			writeError(w, iNVALIDTOKEN, http.StatusBadRequest)
+			return
+		}
+
+		if err := c.negotiateBatch(r); err != nil {
+			writeError(w, sOMETHINGWENTWRONG, http.StatusInternalServerError)
+			return
+		}
+
+		page := 0
+		if p := r.URL.Query().Get("page"); p != "" {
+			var err error
+			page, err = strconv.Atoi(p)
+			if err != nil || page < 0 {
+				writeError(w, "Lightauth error: page must be a positive number", http.StatusBadRequest)
+				return
+			}
+		}
+
+		fingerprint := ""
+		if rt.BindRequest {
+			fingerprint = declaredFingerprint(r)
+		}
+
+		invoices, err := c.getUnpayedInvoices(r.Context(), fingerprint)
+		if err != nil {
+			writeError(w, sOMETHINGWENTWRONG, http.StatusInternalServerError)
+			return
+		}
+
+		response := core.InvoicesPage{Page: page, Total: len(invoices), Invoices: []JSONInvoice{}}
+		for _, i := range paginate(invoices, page) {
+			response.Invoices = append(response.Invoices, JSONInvoice{PaymentRequest: i.PaymentRequest, ExpirationTime: i.ExpirationTime})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
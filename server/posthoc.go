@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+)
+
+const pAYMENTOUTSTANDING = "Lightauth error: Pay the invoice for your previous results before making another request"
+
+type costKey struct{}
+
+// costMeter adds up the cost a handler reports for the results of a request to a PerResult route.
+// Prepaid is what the invoices claimed by the request paid for, the rest is invoiced after the fact.
+type costMeter struct {
+	mux      sync.Mutex
+	client   *Client
+	prepaid  int
+	cost     int
+	invoiced int
+	invoices []*Invoice
+}
+
+// ReportCost adds amount satoshis to the cost of the request ctx belongs to. Handlers of routes with
+// PerResult set call it with what their results actually cost (per row returned for instance), and
+// whatever goes beyond the fee paid upfront is invoiced to the client, who has to pay it before its
+// next request. Handlers reporting their cost before writing the response get the invoice sent along
+// with it. On other routes it does nothing.
+func ReportCost(ctx context.Context, amount int) {
+	m, ok := ctx.Value(costKey{}).(*costMeter)
+	if !ok || amount <= 0 {
+		return
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.cost += amount
+}
+
+// meterCost starts metering the cost of a request, returning the request the handler should be given
+func (d *deferredWriter) meterCost(r *http.Request, c *Client, prepaid int) *http.Request {
+	d.meter = &costMeter{client: c, prepaid: prepaid}
+	return r.WithContext(context.WithValue(r.Context(), costKey{}, d.meter))
+}
+
+// invoiceCost invoices the cost reported so far and lists the deferred invoices of the request in the
+// response headers, which only reach the client if the response hasn't been written yet.
+func (d *deferredWriter) invoiceCost(ctx context.Context) {
+	invoices, err := d.meter.invoice(ctx)
+	if err != nil {
+		lightauth.ReportError(err)
+	}
+
+	if len(invoices) == 0 {
+		return
+	}
+
+	invoicesJSON, err := getInvoicesJSON(invoices)
+	if err != nil {
+		return
+	}
+
+	d.Header().Set(core.HeaderDeferredInvoices, invoicesJSON)
+}
+
+// invoice creates an invoice for the cost beyond the prepaid amount that hasn't been invoiced yet, and
+// returns all the invoices created for the request.
+func (m *costMeter) invoice(ctx context.Context) ([]*Invoice, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	due := m.cost - m.prepaid
+	if due <= m.invoiced {
+		return m.invoices, nil
+	}
+
+	i, err := m.client.addDeferredInvoice(ctx, due-m.invoiced)
+	if err != nil {
+		return m.invoices, err
+	}
+	m.invoiced = due
+	m.invoices = append(m.invoices, i)
+
+	return m.invoices, nil
+}
+
+// addDeferredInvoice invoices the client for amount satoshis of results it has already received
+func (c *Client) addDeferredInvoice(ctx context.Context, amount int) (*Invoice, error) {
+	invoice := c.lnInvoice("")
+	invoice.Value = int64(amount)
+
+	i, err := c.addInvoice(ctx, invoice, &Invoice{Deferred: true})
+	if i == nil || err != nil {
+		if err == nil {
+			err = errors.New("Lightauth error: could not create deferred invoice")
+		}
+		return nil, err
+	}
+
+	return i, nil
+}
+
+// deferredInvoices returns the invoices for past results the client hasn't paid yet. Those that
+// expired are replaced with new invoices for the same amount.
+func (c *Client) deferredInvoices(ctx context.Context) ([]*Invoice, error) {
+	outstanding := []*Invoice{}
+	expired := []*Invoice{}
+	for _, i := range c.invoices() {
+		if !i.Deferred || i.isSettled() {
+			continue
+		}
+
+		if i.isExpired() {
+			expired = append(expired, i)
+			continue
+		}
+
+		outstanding = append(outstanding, i)
+	}
+
+	for _, i := range expired {
+		renewed, err := c.addDeferredInvoice(ctx, i.Fee)
+		if err != nil {
+			return outstanding, err
+		}
+
+		c.forgetInvoice(i)
+		outstanding = append(outstanding, renewed)
+	}
+
+	return outstanding, nil
+}
+
+// amount is what an invoice of the server was issued for in satoshis. Invoices stored before it was
+// recorded were issued for the route fee.
+func (i *Invoice) amount() int {
+	if i.Fee == 0 {
+		return i.Client.Route.Fee
+	}
+
+	return i.Fee
+}
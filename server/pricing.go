@@ -0,0 +1,134 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Pricing adjusts the fee of a client from what its requests look like. It returns the percentage
+// added to the fee of the client, or taken from it when negative, for the invoices issued from then on.
+// It is called on every request to a paid route, so it should be quick.
+type Pricing func(r *http.Request, c *Client) int
+
+var pricing Pricing
+
+// SetPricing sets the Pricing the server asks about each request to a paid route
+func SetPricing(p Pricing) {
+	pricing = p
+}
+
+// priceClient sets the adjustment of the fee of a client for the request it makes
+func priceClient(r *http.Request, c *Client) error {
+	if pricing == nil {
+		return c.setAdjustment(0)
+	}
+
+	adjustment := pricing(r, c)
+	if adjustment < -99 {
+		adjustment = -99
+	}
+
+	return c.setAdjustment(adjustment)
+}
+
+// setAdjustment sets the percentage added to the fee of the client. The invoices it hasn't paid yet are
+// replaced on its next request, as their amount no longer matches its fee.
+func (c *Client) setAdjustment(adjustment int) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.Adjustment == adjustment {
+		return nil
+	}
+
+	c.Adjustment = adjustment
+	return c.persist(true)
+}
+
+// Locator tells where a request comes from: the ISO 3166 code of its country and the number of the
+// autonomous system of its address, empty or 0 when they aren't known. It can be backed by a GeoIP
+// database, or by the headers a CDN in front of the server adds.
+type Locator interface {
+	Locate(r *http.Request) (country string, asn int)
+}
+
+// HeaderLocator is a Locator reading the country and the AS number of a request from headers set by a
+// proxy or a CDN in front of the server, like CF-IPCountry. The headers must not be passed through from
+// the callers, who could otherwise pick their own price.
+type HeaderLocator struct {
+	CountryHeader string
+	ASNHeader     string
+}
+
+// Locate reads the location of the request from its headers
+func (l HeaderLocator) Locate(r *http.Request) (string, int) {
+	country := ""
+	if l.CountryHeader != "" {
+		country = strings.ToUpper(strings.TrimSpace(r.Header.Get(l.CountryHeader)))
+	}
+
+	asn := 0
+	if l.ASNHeader != "" {
+		value := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(r.Header.Get(l.ASNHeader))), "AS")
+		asn, _ = strconv.Atoi(value)
+	}
+
+	return country, asn
+}
+
+// GeoDatabase looks an address up in a GeoIP database, like one opened with a MaxMind reader
+type GeoDatabase interface {
+	Lookup(ip net.IP) (country string, asn int, err error)
+}
+
+// DatabaseLocator is a Locator looking the remote address of requests up in a GeoIP database
+type DatabaseLocator struct {
+	Database GeoDatabase
+}
+
+// Locate looks the remote address of the request up, or returns nothing if it can't be found
+func (l DatabaseLocator) Locate(r *http.Request) (string, int) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", 0
+	}
+
+	country, asn, err := l.Database.Lookup(ip)
+	if err != nil {
+		return "", 0
+	}
+
+	return strings.ToUpper(country), asn
+}
+
+// RegionalPricing returns a Pricing adjusting fees by where requests come from. The adjustments are
+// percentages of the fee, by AS number and by country code; the AS number is looked at first, as it is
+// the more specific, and requests found in neither pay the usual fee. For instance, to halve the fee
+// for callers in Brazil and double it for those in the network of a cloud provider:
+//
+//	server.SetPricing(server.RegionalPricing(
+//		server.HeaderLocator{CountryHeader: "CF-IPCountry"},
+//		map[string]int{"BR": -50},
+//		map[int]int{16509: 100},
+//	))
+func RegionalPricing(locator Locator, countries map[string]int, asns map[int]int) Pricing {
+	return func(r *http.Request, c *Client) int {
+		country, asn := locator.Locate(r)
+		if adjustment, exists := asns[asn]; exists && asn != 0 {
+			return adjustment
+		}
+
+		if adjustment, exists := countries[country]; exists && country != "" {
+			return adjustment
+		}
+
+		return 0
+	}
+}
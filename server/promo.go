@@ -0,0 +1,244 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+)
+
+const iNVALIDPROMO = "Lightauth error: the promo code is unknown, expired or used up"
+
+// ErrUnknownRoute is returned when managing the promo codes of a route the server doesn't have
+var ErrUnknownRoute = errors.New("Lightauth error: no route has this name")
+
+// PromoCode is a code clients redeem with the Light-Auth-Promo header. Discount is the percentage taken
+// off the fee of the route for the client that redeems it, and Period the free time it gives on time
+// routes. It can be redeemed MaxRedemptions times, without limit when it is 0, until ExpirationTime
+// when it is set. Each client redeems one promo code.
+type PromoCode struct {
+	Code           string        `json:"code"`
+	Discount       int           `json:"discount"`
+	Period         time.Duration `json:"period"`
+	MaxRedemptions int           `json:"max_redemptions"`
+	Redemptions    int           `json:"redemptions"`
+	ExpirationTime time.Time     `json:"expiration_time"`
+}
+
+// promosMux guards the Promos of the routes, which are persisted with them
+var promosMux sync.Mutex
+
+// CreatePromo adds a promo code to the route with the given name, replacing any with the same code
+func CreatePromo(routeName string, promo PromoCode) error {
+	if !serverState.IsStarted() {
+		return &lightauth.NotStartedError{Side: "server"}
+	}
+
+	rt, routeExists := serverStore[routeName]
+	if !routeExists {
+		return ErrUnknownRoute
+	}
+
+	if promo.Code == "" || promo.Discount < 0 || promo.Discount > 100 || promo.Period < 0 || promo.MaxRedemptions < 0 {
+		return errors.New("Lightauth error: promo codes need a code, a discount between 0 and 100 and no negative period or limit")
+	}
+
+	if promo.Discount == 0 && promo.Period == 0 {
+		return errors.New("Lightauth error: promo codes must give a discount or a period")
+	}
+
+	if promo.Period > 0 && rt.Mode != core.ModeTime {
+		return errors.New("Lightauth error: only promo codes of time routes can give a period")
+	}
+
+	promosMux.Lock()
+	defer promosMux.Unlock()
+
+	if rt.Promos == nil {
+		rt.Promos = make(map[string]*PromoCode)
+	}
+	rt.Promos[promo.Code] = &promo
+
+	return lightauth.Edit(serverDatabase, rt, true)
+}
+
+// DeletePromo removes a promo code from the route with the given name. Clients that redeemed it keep
+// their discount.
+func DeletePromo(routeName string, code string) error {
+	if !serverState.IsStarted() {
+		return &lightauth.NotStartedError{Side: "server"}
+	}
+
+	rt, routeExists := serverStore[routeName]
+	if !routeExists {
+		return ErrUnknownRoute
+	}
+
+	promosMux.Lock()
+	defer promosMux.Unlock()
+
+	delete(rt.Promos, code)
+	return lightauth.Edit(serverDatabase, rt, true)
+}
+
+// Promos returns the promo codes of the route with the given name, sorted by code
+func Promos(routeName string) ([]PromoCode, error) {
+	rt, routeExists := serverStore[routeName]
+	if !routeExists {
+		return nil, ErrUnknownRoute
+	}
+
+	promosMux.Lock()
+	defer promosMux.Unlock()
+
+	promos := []PromoCode{}
+	for _, promo := range rt.Promos {
+		promos = append(promos, *promo)
+	}
+
+	sort.Slice(promos, func(a, b int) bool {
+		return promos[a].Code < promos[b].Code
+	})
+
+	return promos, nil
+}
+
+// PromoHandler lets operators manage the promo codes of a route over HTTP: GET lists them, POST
+// creates one from a JSON object and DELETE removes the one given in the code query parameter. It must
+// be mounted behind the operators' own authentication.
+func PromoHandler(routeName string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			var promos []PromoCode
+			if promos, err = Promos(routeName); err == nil {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(promos)
+				return
+			}
+		case http.MethodPost:
+			promo := PromoCode{}
+			if err := json.NewDecoder(r.Body).Decode(&promo); err != nil {
+				http.Error(w, "Lightauth error: could not decode promo code", http.StatusBadRequest)
+				return
+			}
+			err = CreatePromo(routeName, promo)
+		case http.MethodDelete:
+			err = DeletePromo(routeName, r.URL.Query().Get("code"))
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if errors.Is(err, ErrUnknownRoute) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// takePromo counts a redemption of a promo code of the route, if it can still be redeemed
+func (r *Route) takePromo(code string) (PromoCode, bool) {
+	promosMux.Lock()
+	defer promosMux.Unlock()
+
+	promo, exists := r.Promos[code]
+	if !exists || (!promo.ExpirationTime.IsZero() && time.Now().After(promo.ExpirationTime)) {
+		return PromoCode{}, false
+	}
+
+	if promo.MaxRedemptions > 0 && promo.Redemptions >= promo.MaxRedemptions {
+		return PromoCode{}, false
+	}
+
+	promo.Redemptions++
+	if err := lightauth.Edit(serverDatabase, r, true); err != nil {
+		promo.Redemptions--
+		lightauth.ReportError(err)
+		return PromoCode{}, false
+	}
+
+	return *promo, true
+}
+
+// redeemPromo gives the client what the promo code in the Light-Auth-Promo header of the request is
+// for. Once a client has redeemed a code, the header is ignored if it is the same and rejected if not.
+func (c *Client) redeemPromo(r *http.Request) (string, int) {
+	code := r.Header.Get(core.HeaderPromo)
+	if code == "" {
+		return "", 0
+	}
+
+	c.mux.Lock()
+	redeemed := c.Promo
+	c.mux.Unlock()
+
+	if redeemed == code {
+		return "", 0
+	}
+
+	if redeemed != "" {
+		return iNVALIDPROMO, http.StatusBadRequest
+	}
+
+	promo, valid := c.Route.takePromo(code)
+	if !valid {
+		return iNVALIDPROMO, http.StatusBadRequest
+	}
+
+	c.mux.Lock()
+	c.Promo = code
+	c.Discount = promo.Discount
+	err := c.persist(true)
+	c.mux.Unlock()
+
+	if err == nil && promo.Period > 0 {
+		err = c.grantCredit(CreditGrant{Time: time.Now(), Period: promo.Period, Reason: "promo " + code})
+	}
+
+	if err != nil {
+		lightauth.ReportError(err)
+		return sOMETHINGWENTWRONG, http.StatusInternalServerError
+	}
+
+	return "", 0
+}
+
+// fee is what the client pays for one invoice of its route in satoshis: the fee of its cohort, adjusted
+// by the Pricing, with the surcharge of its risk decision and after the discount of its promo code. It
+// is never less than a satoshi.
+func (c *Client) fee() int {
+	c.mux.Lock()
+	cohort, adjustment, surcharge, discount := c.Cohort, c.Adjustment, c.Surcharge, c.Discount
+	c.mux.Unlock()
+
+	fee := c.Route.baseFee(cohort) * (100 + adjustment) / 100
+	fee = fee * (100 + surcharge) / 100 * (100 - discount) / 100
+	if fee < 1 {
+		return 1
+	}
+
+	return fee
+}
+
+// setFeeHeader tells a client whose fee differs from the fee of its route the fee it pays
+func setFeeHeader(h http.Header, c *Client) {
+	if fee := c.fee(); fee != c.Route.Fee {
+		h.Set(core.HeaderFee, strconv.Itoa(fee))
+	}
+}
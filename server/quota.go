@@ -0,0 +1,66 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+const rATELIMITED = "Lightauth error: the request quota is used up, slow down"
+
+// burst is the number of requests a client of a time route with a Rate can make at once. It is Burst,
+// or the requests of one second at the sustained rate when it isn't set.
+func (r *Route) burst() float64 {
+	if r.Burst > 0 {
+		return float64(r.Burst)
+	}
+
+	return math.Max(1, math.Ceil(r.Rate))
+}
+
+// takeQuota takes a request from the quota of a client of a time route with a Rate. The quota fills up
+// at Rate requests per second, up to the burst of the route. It returns the requests left, and when the
+// quota is used up, how long to wait for the next one.
+func (c *Client) takeQuota() (int, time.Duration, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	t := time.Now()
+	burst := c.Route.burst()
+	if c.quotaUpdated.IsZero() {
+		c.quota = burst
+	} else {
+		c.quota = math.Min(burst, c.quota+t.Sub(c.quotaUpdated).Seconds()*c.Route.Rate)
+	}
+	c.quotaUpdated = t
+
+	if c.quota < 1 {
+		wait := time.Duration((1 - c.quota) / c.Route.Rate * float64(time.Second))
+		return 0, wait, false
+	}
+
+	c.quota--
+	return int(c.quota), 0, true
+}
+
+// checkQuota rejects the requests of a paid up client of a time route with a Rate that go beyond its
+// quota, and tells the client what is left of it.
+func checkQuota(w http.ResponseWriter, c *Client, v validation) validation {
+	if !v.authorized || c.Route.Mode != core.ModeTime || c.Route.Rate <= 0 {
+		return v
+	}
+
+	remaining, wait, ok := c.takeQuota()
+	w.Header().Set(core.HeaderQuotaLimit, strconv.Itoa(int(c.Route.burst())))
+	w.Header().Set(core.HeaderQuotaRate, strconv.FormatFloat(c.Route.Rate, 'f', -1, 64))
+	w.Header().Set(core.HeaderQuotaRemaining, strconv.Itoa(remaining))
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return reject(http.StatusTooManyRequests, rATELIMITED)
+	}
+
+	return v
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+)
+
+// ReceiptHandler answers a payment_hash and the preimage proving its payment with a SignedReceipt. It
+// lets clients settle disputes and reconcile their books out of band, and can be mounted anywhere,
+// e.g. http.HandleFunc("/lightauth/receipt", server.ReceiptHandler).
+func ReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	paymentHash := r.FormValue("payment_hash")
+	preImageString := r.FormValue("preimage")
+	if paymentHash == "" || preImageString == "" {
+		writeError(w, iNVALIDCREDENTIALS, http.StatusBadRequest)
+		return
+	}
+
+	preImage, err := hex.DecodeString(preImageString)
+	hash := sha256.Sum256(preImage)
+	if err != nil || hex.EncodeToString(hash[:]) != paymentHash {
+		writeError(w, iNVALIDCREDENTIALS, http.StatusBadRequest)
+		return
+	}
+
+	i, invoiceExists := serverInvoices.Get(paymentHash)
+	if !invoiceExists || i.Client == nil {
+		writeError(w, uNKNOWNINVOICE, http.StatusNotFound)
+		return
+	}
+
+	if !i.isSettled() {
+		writeError(w, tRYAGAIN, http.StatusConflict)
+		return
+	}
+
+	i.mux.Lock()
+	receipt := core.Receipt{
+		PaymentHash:    paymentHash,
+		PaymentRequest: i.PaymentRequest,
+		Route:          i.Client.Route.Name,
+		Mode:           i.Client.Route.Mode,
+		Fee:            i.amount(),
+		AmountPaidMsat: i.AmountPaid,
+		Claimed:        i.Claimed,
+		CreditedFrom:   i.CreditedFrom,
+		CreditedUntil:  i.CreditedUntil,
+		IssuedAt:       time.Now(),
+	}
+	if receipt.Mode == core.ModeDiscrete {
+		receipt.Requests = i.Claims
+		if receipt.Requests == 0 {
+			receipt.Requests = 1
+		}
+	}
+	i.mux.Unlock()
+
+	message, err := core.ReceiptMessage(receipt)
+	if err != nil {
+		writeError(w, sOMETHINGWENTWRONG, http.StatusInternalServerError)
+		return
+	}
+
+	var signature string
+	rt := i.Client.Route
+	err = rt.breaker().Call(r.Context(), func(ctx context.Context) error {
+		var err error
+		signature, err = rt.backend().SignMessage(ctx, message)
+		return err
+	})
+	if err != nil {
+		lightauth.ReportError(fmt.Errorf("Lightauth error: could not sign receipt: %v", err))
+		writeError(w, sOMETHINGWENTWRONG, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(core.SignedReceipt{Receipt: receipt, Signature: signature})
+}
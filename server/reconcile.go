@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"log"
+
+	"github.com/faurehu/lightauth"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// reconcileInvoices checks the open invoices of the routes of a tenant with the node they were issued
+// by, as it may have been paid while the server was down. Invoices the node settled are credited to
+// their clients, and those it canceled or that expired unpaid are dropped, so clients get new ones.
+// Deferred invoices are kept, they are reissued when they expire.
+func reconcileInvoices(tenantName string) {
+	looker, ok := tenantBackend(tenantName).(InvoiceLooker)
+	if !ok {
+		log.Printf("Lightauth error: the invoices of tenant %q can't be checked with its node, payments made while the server was down are lost\n", tenantName)
+		return
+	}
+
+	for _, rt := range serverStore {
+		if rt.Tenant != tenantName {
+			continue
+		}
+
+		rt.rangeClients(func(c *Client) bool {
+			for _, i := range c.invoices() {
+				if i.isSettled() {
+					continue
+				}
+
+				var invoice *lnrpc.Invoice
+				err := tenantBreaker(tenantName).Call(context.Background(), func(ctx context.Context) error {
+					var err error
+					invoice, err = looker.LookupInvoice(ctx, i.PaymentHash)
+					return err
+				})
+				if err != nil {
+					lightauth.ReportError(err)
+					continue
+				}
+
+				if invoice.State == lnrpc.Invoice_SETTLED || invoice.Settled {
+					if err := updateInvoice(i.PaymentHash, invoice.AmtPaidMsat); err != nil {
+						unsavedSettlements.add(i.PaymentHash, err)
+					}
+					continue
+				}
+
+				if !i.Deferred && (invoice.State == lnrpc.Invoice_CANCELED || i.isExpired()) {
+					c.forgetInvoice(i)
+				}
+			}
+
+			return true
+		})
+	}
+}
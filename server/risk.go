@@ -0,0 +1,95 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const rISKDENIED = "Lightauth error: the request was refused"
+
+// What a RiskAssessor can decide for a request
+const (
+	RiskAllow = iota
+	RiskDeny
+	RiskThrottle
+	RiskSurcharge
+)
+
+// Decision is what a RiskAssessor makes of a request. Throttled requests are rejected with 429 and told
+// to come back after RetryAfter. Surcharge is the percentage added to the fee of the client when
+// Action is RiskSurcharge, for the invoices issued from then on. Reason is recorded in the audit log
+// when the request is refused.
+type Decision struct {
+	Action     int
+	RetryAfter time.Duration
+	Surcharge  int
+	Reason     string
+}
+
+// RiskAssessor scores the requests to paid routes before the server issues a token or invoices for
+// them, with IP reputation or custom heuristics for instance. The client is nil when the request has no
+// token yet. Assess is called on every request, so it should be quick.
+type RiskAssessor interface {
+	Assess(r *http.Request, client *Client) Decision
+}
+
+var riskAssessor RiskAssessor
+
+// SetRiskAssessor sets the RiskAssessor the server asks about each request to a paid route
+func SetRiskAssessor(a RiskAssessor) {
+	riskAssessor = a
+}
+
+// assessRisk asks the RiskAssessor about a request and refuses it if it decides so, returning false
+func assessRisk(w http.ResponseWriter, r *http.Request, token string, c *Client) (Decision, bool) {
+	if riskAssessor == nil {
+		return Decision{}, true
+	}
+
+	decision := riskAssessor.Assess(r, c)
+	reason := decision.Reason
+	switch decision.Action {
+	case RiskDeny:
+		if reason == "" {
+			reason = rISKDENIED
+		}
+		audit(r, token, nil, false, http.StatusForbidden, reason)
+		writeError(w, rISKDENIED, http.StatusForbidden)
+		return decision, false
+	case RiskThrottle:
+		if reason == "" {
+			reason = rATELIMITED
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(decision.RetryAfter.Seconds()))))
+		audit(r, token, nil, false, http.StatusTooManyRequests, reason)
+		writeError(w, rATELIMITED, http.StatusTooManyRequests)
+		return decision, false
+	}
+
+	return decision, true
+}
+
+// surcharge is the percentage the decision adds to the fee, none unless the caller was found risky
+func (d Decision) surcharge() int {
+	if d.Action != RiskSurcharge || d.Surcharge < 0 {
+		return 0
+	}
+
+	return d.Surcharge
+}
+
+// setSurcharge sets the percentage added to the fee of the client. The invoices it hasn't paid yet are
+// replaced on its next request, as their amount no longer matches its fee.
+func (c *Client) setSurcharge(surcharge int) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.Surcharge == surcharge {
+		return nil
+	}
+
+	c.Surcharge = surcharge
+	return c.persist(true)
+}
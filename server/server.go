@@ -0,0 +1,1033 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+const (
+	iNVALIDTOKEN          = "Lightauth error: Invalid token"
+	tIMEEXPIRED           = "Lightauth error: Your authorized time has expired, pay up some balances to buy more time"
+	iNVALIDCREDENTIALS    = "Lightauth error: Invalid credentials"
+	mISSINGINVOICE        = "Lightauth error: Missing invoice ID"
+	mISSINGPREIMAGE       = "Lightauth error: Missing pre_image"
+	tRYAGAIN              = "Lightauth error: We can't validate your payment yet, please try again"
+	iNVOICEALREADYCLAIMED = "Lightauth error: Invoice has already been claimed"
+	sOMETHINGWENTWRONG    = "Lightauth error: Something went wrong"
+	iNVALIDSIGNATURE      = "Lightauth error: Invalid identity signature"
+	iDENTITYREVOKED       = "Lightauth error: Identity has been revoked"
+	mISSINGCERTIFICATE    = "Lightauth error: Missing TLS client certificate"
+	iNVALIDBINDING        = "Lightauth error: Token is bound to another client certificate"
+	rEPLAYEDNONCE         = "Lightauth error: Request nonce has already been used"
+	uNKNOWNINVOICE        = "Lightauth error: Unknown invoice"
+	nODEUNAVAILABLE       = "Lightauth error: Payments are unavailable at the moment, please try again later"
+	wRONGBUNDLE           = "Lightauth error: Wrong number of invoices for this route"
+	wRONGREQUEST          = "Lightauth error: Invoice was issued for another request"
+)
+
+const dEFAULTINVOICEEXPIRY = time.Minute * 59
+
+// oVERPAYMENTCREDIT is the Overpayment policy of routes that credit what is paid beyond the fee, in
+// proportional time or in whole requests. By default it is kept as a tip.
+const oVERPAYMENTCREDIT = "credit"
+
+// rETRYAFTER is the number of seconds clients are told to wait before retrying a pending payment
+const rETRYAFTER = 1
+
+// Route is a hash that stores all the information of a specific endpoint. Clients are the clients the
+// route had in the store when the server started; from then on clients are looked up by token, or by
+// the identity they are bound to, in indexes of their own.
+type Route struct {
+	RouteInfo
+	Clients    map[string]*Client
+	Promos     map[string]*PromoCode
+	ID         string
+	tokens     *clientShards
+	identities *clientShards
+	match      []core.Condition
+	varies     []string
+}
+
+func (r *Route) save() error {
+	var err error
+	r.ID, err = serverDatabase.Create(r)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *Route) newClient() (*Client, error) {
+	token, err := r.newToken()
+	if err != nil {
+		log.Printf("Lightauth error: Could not generate token: %v\n", err)
+		return nil, err
+	}
+
+	c := &Client{Token: token, IssuedAt: time.Now(), Invoices: map[string]*Invoice{}, ExpirationTime: time.Now(), Route: r, Cohort: r.assignCohort(token)}
+	err = c.save()
+	if err != nil {
+		log.Printf("Lightauth error: Could not save client: %v\n", err)
+		return nil, err
+	}
+	r.setClient(token, c)
+
+	return c, nil
+}
+
+// Client is a hash that stores all the information of a server's client
+type Client struct {
+	Token          string
+	IssuedAt       time.Time
+	PreviousTokens []RotatedToken
+	ExpirationTime time.Time
+	Invoices       map[string]*Invoice
+	Route          *Route
+	Identity       string
+	Revoked        bool
+	Binding        string
+	Batch          int
+	CreditBalance  int
+	Credits        []CreditGrant
+	Referrer       string
+	Promo          string
+	Discount       int
+	Cohort         string
+	Surcharge      int
+	Adjustment     int
+	ID             string
+	mux            sync.Mutex
+	quota          float64
+	quotaUpdated   time.Time
+}
+
+func (c *Client) setExpirationTime(t time.Time) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.ExpirationTime = t
+	// The expiration time is what the client has paid for
+	return c.persist(true)
+}
+
+// resave writes the client again after a failed durable write
+func (c *Client) resave() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.persist(true)
+}
+
+func (c *Client) getToken() string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.Token
+}
+
+func (c *Client) getExpirationTime() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.ExpirationTime
+}
+
+// invoices returns the invoices of the client, copied so they can be gone through without its lock
+func (c *Client) invoices() []*Invoice {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	invoices := make([]*Invoice, 0, len(c.Invoices))
+	for _, i := range c.Invoices {
+		invoices = append(invoices, i)
+	}
+
+	return invoices
+}
+
+func (c *Client) getInvoice(invoiceID string) (*Invoice, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	i, exists := c.Invoices[invoiceID]
+	return i, exists
+}
+
+func (c *Client) keepInvoice(i *Invoice) {
+	c.mux.Lock()
+	c.Invoices[i.PaymentRequest] = i
+	c.mux.Unlock()
+
+	serverInvoices.Add(i.PaymentHash, i)
+}
+
+// forgetInvoice drops an invoice the client can't pay anymore
+func (c *Client) forgetInvoice(i *Invoice) {
+	c.mux.Lock()
+	delete(c.Invoices, i.PaymentRequest)
+	c.mux.Unlock()
+
+	serverInvoices.Remove(i.PaymentHash)
+}
+
+func (c *Client) save() error {
+	return c.persist(false)
+}
+
+// persist writes the client to the store, straight away if durable even in write-behind mode
+func (c *Client) persist(durable bool) error {
+	if c.ID == "" {
+		var err error
+		c.ID, err = serverDatabase.Create(c)
+		return err
+	}
+
+	return lightauth.Edit(serverDatabase, c, durable)
+}
+
+func writeConstantHeaders(w http.ResponseWriter, rt *Route) {
+	core.SetHeader(w, "")
+	w.Header().Set(core.HeaderName, rt.Name)
+	w.Header().Set(core.HeaderMode, string(rt.Mode))
+	w.Header().Set(core.HeaderFee, strconv.Itoa(rt.Fee))
+	w.Header().Set(core.HeaderMaxInvoices, strconv.Itoa(rt.MaxInvoices))
+	if rt.InvoicesPerRequest > 1 {
+		w.Header().Set(core.HeaderInvoicesPerRequest, strconv.Itoa(rt.InvoicesPerRequest))
+	}
+
+	if rt.Mode == core.ModeTime {
+		w.Header().Set(core.HeaderTimePeriod, string(rt.Period))
+	}
+
+	if rt.LNURL != "" {
+		w.Header().Set(core.HeaderLNURL, rt.LNURL)
+	}
+
+	if rt.BindRequest {
+		w.Header().Set(core.HeaderBindRequest, "true")
+	}
+
+	if len(rt.varies) > 0 {
+		// Requests to the path are priced by these query parameters and headers
+		w.Header().Set(core.HeaderVaries, strings.Join(rt.varies, ", "))
+	}
+
+	setDeprecationHeaders(w.Header(), rt)
+}
+
+// writeClientHeaders sends the client its token and unpaid invoices, those bound to the request with
+// the given fingerprint on routes binding invoices to requests. When it fails, the caller rejects the
+// request.
+func writeClientHeaders(ctx context.Context, w http.ResponseWriter, c *Client, fingerprint string) error {
+	unpayedInvoices, err := c.getUnpayedInvoices(ctx, fingerprint)
+	if err != nil {
+		return err
+	}
+
+	if err := setInvoicesHeaders(ctx, w.Header(), c.Route, unpayedInvoices); err != nil {
+		return err
+	}
+	setCreditHeader(w.Header(), c)
+	setFeeHeader(w.Header(), c)
+	setExpiryHeaders(w.Header(), c)
+
+	w.Header().Set(core.HeaderToken, c.Token)
+	if fingerprint != "" {
+		w.Header().Set(core.HeaderFingerprint, fingerprint)
+	}
+
+	if c.Route.Mode == core.ModeTime {
+		// RFC3339
+		w.Header().Set(core.HeaderExpirationTime, c.ExpirationTime.Format("2006-01-02T15:04:05Z07:00"))
+	}
+
+	return err
+}
+
+// ErrorResponse is the JSON object the server writes when it rejects a request
+type ErrorResponse = core.ErrorResponse
+
+var errorCodes = map[string]core.Code{
+	iNVALIDTOKEN:          core.CodeInvalidToken,
+	tIMEEXPIRED:           core.CodeTimeExpired,
+	iNVALIDCREDENTIALS:    core.CodeInvalidCredentials,
+	mISSINGINVOICE:        core.CodeMissingInvoice,
+	mISSINGPREIMAGE:       core.CodeMissingPreImage,
+	tRYAGAIN:              core.CodePaymentPending,
+	iNVOICEALREADYCLAIMED: core.CodeInvoiceClaimed,
+	sOMETHINGWENTWRONG:    core.CodeInternalError,
+	iNVALIDSIGNATURE:      core.CodeInvalidSignature,
+	iDENTITYREVOKED:       core.CodeIdentityRevoked,
+	mISSINGCERTIFICATE:    core.CodeMissingCertificate,
+	iNVALIDBINDING:        core.CodeInvalidBinding,
+	rEPLAYEDNONCE:         core.CodeReplayedNonce,
+	uNKNOWNINVOICE:        core.CodeUnknownInvoice,
+	nODEUNAVAILABLE:       core.CodeNodeUnavailable,
+	wRONGBUNDLE:           core.CodeWrongBundle,
+	pAYMENTOUTSTANDING:    core.CodePaymentOutstanding,
+	wRONGREQUEST:          core.CodeWrongRequest,
+	hEADERSTOOLARGE:       core.CodeHeadersTooLarge,
+	rEQUESTINPROGRESS:     core.CodeRequestInProgress,
+	rATELIMITED:           core.CodeRateLimited,
+	rEPEATEDHEADER:        core.CodeRepeatedHeader,
+	iNVALIDPROMO:          core.CodeInvalidPromo,
+	mALFORMEDHEADER:       core.CodeMalformedHeader,
+	rISKDENIED:            core.CodeRiskDenied,
+	rOUTESUNSET:           core.CodeRouteSunset,
+	lEGACYCLIENT:          core.CodeLegacyClient,
+	aPIKEYINVALID:         core.CodeInvalidAPIKey,
+}
+
+var statusCodes = map[int]core.Code{
+	http.StatusBadRequest:                  "bad_request",
+	http.StatusUnauthorized:                "unauthorized",
+	http.StatusPaymentRequired:             "payment_required",
+	http.StatusForbidden:                   "forbidden",
+	http.StatusNotFound:                    "not_found",
+	http.StatusGone:                        "gone",
+	http.StatusConflict:                    "conflict",
+	http.StatusInternalServerError:         "internal_error",
+	http.StatusServiceUnavailable:          "service_unavailable",
+	http.StatusRequestHeaderFieldsTooLarge: "headers_too_large",
+	http.StatusTooManyRequests:             "too_many_requests",
+}
+
+func writeError(w http.ResponseWriter, message string, statusCode int) {
+	core.SetHeader(w, core.ResultError)
+	if dw, ok := w.(*deferredWriter); ok {
+		dw.commit(statusCode)
+		if dw.legacy {
+			writeLegacyError(w, message, statusCode)
+			return
+		}
+	}
+
+	if textErrors {
+		w.WriteHeader(statusCode)
+		fmt.Fprint(w, message)
+		return
+	}
+
+	response := ErrorResponse{Code: errorCodes[message], Message: message}
+	if response.Code == "" {
+		response.Code = statusCodes[statusCode]
+	}
+
+	if statusCode == http.StatusConflict {
+		response.RetryAfter = rETRYAFTER
+		w.Header().Set("Retry-After", strconv.Itoa(rETRYAFTER))
+	}
+
+	if message == nODEUNAVAILABLE {
+		// The breaker probes the node that often
+		response.RetryAfter = int(lightauth.BreakerCooldown.Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(response.RetryAfter))
+	}
+
+	if statusCode == http.StatusTooManyRequests {
+		response.RetryAfter, _ = strconv.Atoi(w.Header().Get("Retry-After"))
+	}
+
+	if statusCode == http.StatusBadRequest || statusCode == http.StatusPaymentRequired || statusCode == http.StatusConflict {
+		if w.Header().Get(core.HeaderInvoices) != "" {
+			var err error
+			if response.Invoices, err = core.ReadInvoices(w.Header()); err != nil {
+				log.Printf("Lightauth error: could not decode invoices for error response: %v\n", err)
+			}
+		}
+
+		deferred := w.Header().Get(core.HeaderDeferredInvoices)
+		if deferred != "" {
+			if err := json.Unmarshal([]byte(deferred), &response.DeferredInvoices); err != nil {
+				log.Printf("Lightauth error: could not decode deferred invoices for error response: %v\n", err)
+			}
+		}
+
+		response.Payment = paymentInstructions(w.Header())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Lightauth error: could not encode error response: %v\n", err)
+	}
+}
+
+// updateInvoice settles the invoice of a payment received by the node. amountPaidMsat is 0 when the
+// backend doesn't tell, in which case the invoice is taken as paid in full.
+func updateInvoice(paymentHash []byte, amountPaidMsat int64) error {
+	i, invoiceExists := serverInvoices.Get(hex.EncodeToString(paymentHash))
+	if !invoiceExists {
+		noteUnmatched()
+		return nil
+	}
+
+	if i.isSettled() {
+		// Webhooks can notify the same payment more than once
+		return nil
+	}
+
+	fee := int64(i.amount()) * 1000
+	if amountPaidMsat != 0 && amountPaidMsat < fee {
+		// Nothing is credited for less than the fee, the invoice stays unpaid
+		lightauth.ReportError(fmt.Errorf("Lightauth error: invoice %v was underpaid, %d msat received out of %d", i.PaymentRequest, amountPaidMsat, fee))
+		return nil
+	}
+
+	claims := 1
+	if i.Client.Route.Overpayment == oVERPAYMENTCREDIT && amountPaidMsat > fee && !i.Deferred {
+		claims = int(amountPaidMsat / fee)
+	}
+
+	err := i.settlePayment(amountPaidMsat, claims)
+	if err != nil {
+		return err
+	}
+	noteSettlement()
+
+	if err := creditInvoice(i); err != nil {
+		return err
+	}
+
+	if referrer := i.Client.referrer(); referrer != "" {
+		if err := i.refer(referrer); err != nil {
+			return err
+		}
+	}
+
+	if amountPaidMsat == 0 {
+		amountPaidMsat = fee
+	}
+	event := lightauth.NewSettlementEvent(i.Info(), i.Client.Route.key(), amountPaidMsat)
+	event.Cohort = i.Client.cohort()
+	settlements.Notify(event)
+	return nil
+}
+
+// creditInvoice gives the client of a time route the period bought by a settled invoice. Deferred
+// invoices pay for results already served and buy nothing.
+func creditInvoice(i *Invoice) error {
+	c := i.Client
+	if c.Route.Mode == core.ModeTime && !i.Deferred {
+		timePeriod := c.Route.period()
+
+		i.mux.Lock()
+		amountPaid := i.AmountPaid
+		i.mux.Unlock()
+
+		fee := int64(i.amount()) * 1000
+		if c.Route.Overpayment == oVERPAYMENTCREDIT && amountPaid > fee {
+			timePeriod = time.Duration(int64(timePeriod) * amountPaid / fee)
+		}
+
+		// The period bought by the invoice starts when the time already paid for ends
+		from := time.Now()
+		expirationTime := c.getExpirationTime()
+		if expirationTime.After(from) {
+			from = expirationTime
+		}
+
+		err := i.credit(from, from.Add(timePeriod))
+		if err != nil {
+			return err
+		}
+
+		return c.setExpirationTime(from.Add(timePeriod))
+	}
+
+	return nil
+}
+
+// invoicesPerRequest is the number of invoices a request of a discrete route costs
+func (r *Route) invoicesPerRequest() int {
+	if r.InvoicesPerRequest == 0 {
+		return 1
+	}
+
+	return r.InvoicesPerRequest
+}
+
+// cacheTTL is how long the responses to the GETs of a client are served again for free
+func (r *Route) cacheTTL() time.Duration {
+	ttl, err := lightauth.ParseDuration(r.CacheTTL)
+	if err != nil {
+		return 0
+	}
+
+	return ttl
+}
+
+func (r *Route) invoiceExpiry() time.Duration {
+	expiry, err := lightauth.ParseDuration(r.InvoiceExpiry)
+	if err != nil || expiry == 0 {
+		return dEFAULTINVOICEEXPIRY
+	}
+
+	return expiry
+}
+
+// lnInvoice returns the invoice to be created in the lightning node for one payment of the client.
+// The fingerprint of the request an invoice is bound to is echoed in the memo. Memos are seen by payers
+// and routing nodes, so {{token}} stands for a hash of the token rather than the token itself.
+func (c *Client) lnInvoice(fingerprint string) *lnrpc.Invoice {
+	r := c.Route
+
+	routeHints := []*lnrpc.RouteHint{}
+	for _, v := range r.RouteHints {
+		routeHints = append(routeHints, &lnrpc.RouteHint{
+			HopHints: []*lnrpc.HopHint{{
+				NodeId:                    v.NodeID,
+				ChanId:                    v.ChanID,
+				FeeBaseMsat:               v.FeeBaseMsat,
+				FeeProportionalMillionths: v.FeeProportionalMillionths,
+				CltvExpiryDelta:           v.CltvExpiryDelta,
+			}},
+		})
+	}
+
+	memo := strings.NewReplacer("{{route}}", r.Name, "{{token}}", tokenTag(c.Token), "{{request}}", fingerprint).Replace(r.Memo)
+	if fingerprint != "" && !strings.Contains(r.Memo, "{{request}}") {
+		memo = strings.TrimSpace(memo + " request " + fingerprint)
+	}
+
+	return &lnrpc.Invoice{
+		Memo:       memo,
+		Value:      int64(c.fee()),
+		Expiry:     int64(r.invoiceExpiry().Seconds()),
+		Private:    r.Private,
+		RouteHints: routeHints,
+	}
+}
+
+// tokenTag identifies a token in memos without revealing it
+func tokenTag(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:6])
+}
+
+// getUnpayedInvoices returns the invoices the client can pay, topped up to MaxInvoices. On routes
+// binding invoices to requests, those are the invoices for the request with the given fingerprint, and
+// none are issued to clients that don't tell what request they are for.
+func (c *Client) getUnpayedInvoices(ctx context.Context, fingerprint string) ([]*Invoice, error) {
+	unpayedInvoices := []*Invoice{}
+	for _, i := range c.invoices() {
+		if i.isSettled() || i.Deferred {
+			continue
+		}
+
+		if i.isExpired() || i.amount() != c.fee() {
+			// Expired invoices can't be paid anymore, and those issued before a discount aren't paid by
+			// the client, they get replaced with new ones
+			c.forgetInvoice(i)
+			continue
+		}
+
+		if i.Fingerprint != fingerprint {
+			continue
+		}
+
+		unpayedInvoices = append(unpayedInvoices, i)
+	}
+
+	numUnpayed := len(unpayedInvoices)
+	if c.Route.BindRequest && fingerprint == "" {
+		return unpayedInvoices, nil
+	}
+
+	if batch := c.batchSize(); numUnpayed < batch && !c.Route.breaker().IsOpen() && c.Route.issuesInvoices() {
+		newInvoices, err := c.generateInvoices(ctx, batch-numUnpayed, fingerprint)
+		if err != nil {
+			return []*Invoice{}, err
+		}
+
+		unpayedInvoices = append(unpayedInvoices, newInvoices...)
+	}
+
+	return unpayedInvoices, nil
+}
+
+func (c *Client) generateInvoices(ctx context.Context, numberOfInvoices int, fingerprint string) ([]*Invoice, error) {
+	invoices := []*Invoice{}
+
+	for i := 0; i < numberOfInvoices; i++ {
+		invoice, err := c.addInvoice(ctx, c.lnInvoice(fingerprint), &Invoice{Fingerprint: fingerprint})
+		if invoice == nil {
+			return invoices, err
+		}
+		invoices = append(invoices, invoice)
+	}
+
+	return invoices, nil
+}
+
+// addInvoice creates an invoice in the lightning node and keeps it in the client's store. i holds what
+// is known of it beforehand: whether it is Deferred, for results the client has already received (see
+// ReportCost), and the Fingerprint of the request it is bound to.
+func (c *Client) addInvoice(ctx context.Context, invoice *lnrpc.Invoice, i *Invoice) (*Invoice, error) {
+	var addInvoiceResponse *lnrpc.AddInvoiceResponse
+	err := c.Route.breaker().Call(ctx, func(ctx context.Context) error {
+		var err error
+		addInvoiceResponse, err = c.Route.backend().AddInvoice(ctx, invoice)
+		return err
+	})
+	if err != nil {
+		log.Printf("Lightauth error: Failed to generate an invoice in the lighting node: %v\n", err)
+		return nil, err
+	}
+
+	invoiceID := addInvoiceResponse.PaymentRequest
+	hash := addInvoiceResponse.RHash
+	expirationTime := time.Now().Add(time.Duration(invoice.Expiry) * time.Second)
+	i.PaymentRequest = invoiceID
+	i.PaymentHash = hash
+	i.Client = c
+	i.ExpirationTime = expirationTime
+	i.Fee = int(invoice.Value)
+	err = i.save()
+	if err != nil {
+		// Couldn't save the invoice, so we will not keep it in store
+		return i, err
+	}
+	c.keepInvoice(i)
+	noteInvoice()
+
+	return i, nil
+}
+
+// validation is the outcome of a validator: the request is either authorized, or rejected with the
+// status code and message to answer with. Invoice is the invoice claimed by an authorized request in
+// discrete mode.
+type validation struct {
+	authorized bool
+	statusCode int
+	message    string
+	invoices   []*Invoice
+}
+
+func reject(statusCode int, message string) validation {
+	return validation{statusCode: statusCode, message: message}
+}
+
+// discreteTypeValidator checks the invoices attached to a request, as many as the route charges per
+// request, and claims them all or none.
+func discreteTypeValidator(c *Client, r *http.Request) validation {
+	invoiceIDs := core.ReadHeader(r.Header, core.HeaderInvoice)
+	if invoiceIDs == "" {
+		if c.useCredit() {
+			return validation{authorized: true, message: "paid with credit"}
+		}
+
+		return reject(http.StatusBadRequest, mISSINGINVOICE)
+	}
+
+	preImageStrings := core.ReadHeader(r.Header, core.HeaderPreImage)
+	if preImageStrings == "" {
+		return reject(http.StatusBadRequest, mISSINGPREIMAGE)
+	}
+
+	ids := strings.Split(invoiceIDs, ",")
+	preImages := strings.Split(preImageStrings, ",")
+	if len(ids) != len(preImages) {
+		return reject(http.StatusBadRequest, iNVALIDCREDENTIALS)
+	}
+
+	if len(ids) != c.Route.invoicesPerRequest() {
+		return reject(http.StatusBadRequest, wRONGBUNDLE)
+	}
+
+	invoices := []*Invoice{}
+	seen := make(map[string]bool)
+	for k, invoiceID := range ids {
+		invoiceID = strings.TrimSpace(invoiceID)
+		i, v := checkPreImage(c, invoiceID, strings.TrimSpace(preImages[k]))
+		if i == nil {
+			return v
+		}
+
+		if seen[invoiceID] {
+			return reject(http.StatusBadRequest, iNVOICEALREADYCLAIMED)
+		}
+		seen[invoiceID] = true
+		invoices = append(invoices, i)
+	}
+
+	if err := checkRequestBinding(c, r, invoices); err != nil {
+		return reject(http.StatusBadRequest, err.Error())
+	}
+
+	nonce := core.ReadHeader(r.Header, core.HeaderNonce)
+	if nonce != "" && !claimNonces.use(nonce) {
+		return reject(http.StatusBadRequest, rEPLAYEDNONCE)
+	}
+
+	for k, i := range invoices {
+		claimed, err := i.tryClaim(nonce)
+		if err != nil || !claimed {
+			// Give back the invoices of the bundle claimed so far
+			for _, previous := range invoices[:k] {
+				if err := previous.releaseClaim(); err != nil {
+					log.Printf("Lightauth error: could not release claim: %v\n", err)
+				}
+			}
+
+			if err != nil {
+				return reject(http.StatusInternalServerError, sOMETHINGWENTWRONG)
+			}
+
+			// Another request claimed it in the meantime
+			return reject(http.StatusBadRequest, iNVOICEALREADYCLAIMED)
+		}
+	}
+
+	return validation{authorized: true, message: "invoice claimed", invoices: invoices}
+}
+
+// checkPreImage returns the client's invoice if the preimage proves it has been paid, or the rejection
+// of the request otherwise.
+func checkPreImage(c *Client, invoiceID string, preImageString string) (*Invoice, validation) {
+	i, invoiceExists := c.getInvoice(invoiceID)
+	if !invoiceExists || i.Deferred {
+		return nil, reject(http.StatusBadRequest, iNVALIDCREDENTIALS)
+	}
+
+	preImage, err := hex.DecodeString(preImageString)
+	if err != nil {
+		return nil, reject(http.StatusBadRequest, iNVALIDCREDENTIALS)
+	}
+	hasher := sha256.New()
+	hasher.Write(preImage)
+	hexPreImage := hex.EncodeToString(hasher.Sum(nil))
+	hexPaymentHash := hex.EncodeToString(i.PaymentHash)
+
+	if hexPreImage != hexPaymentHash {
+		return nil, reject(http.StatusBadRequest, iNVALIDCREDENTIALS)
+	}
+
+	if i.isClaimed() {
+		return nil, reject(http.StatusBadRequest, iNVOICEALREADYCLAIMED)
+	}
+
+	if !i.isSettled() {
+		if !offlineVerification || !tenantOffline(c.Route.Tenant) {
+			return nil, reject(http.StatusConflict, tRYAGAIN)
+		}
+
+		// The node may have been paid while we couldn't hear about it
+		if err := acceptOffline(i, preImage); err != nil {
+			return nil, reject(http.StatusInternalServerError, sOMETHINGWENTWRONG)
+		}
+	}
+
+	return i, validation{}
+}
+
+func timeTypeValidator(c *Client, r *http.Request) validation {
+	if c.getExpirationTime().Before(time.Now()) {
+		return reject(http.StatusPaymentRequired, tIMEEXPIRED)
+	}
+
+	return validation{authorized: true, message: "paid until " + c.getExpirationTime().Format(time.RFC3339)}
+}
+
+// dispatch answers a request according to the outcome of its validation, passing it to the handler
+// when it has been authorized.
+func dispatch(w *deferredWriter, r *http.Request, token string, handler func(http.ResponseWriter, *http.Request), v validation) {
+	if !v.authorized {
+		audit(r, token, v.invoices, false, v.statusCode, v.message)
+		writeError(w, v.message, v.statusCode)
+		return
+	}
+
+	audit(r, token, v.invoices, true, http.StatusOK, v.message)
+
+	if len(v.invoices) > 0 {
+		w.Header().Set(core.HeaderInvoice, paymentRequests(v.invoices))
+		if len(v.invoices) == 1 {
+			if remaining := v.invoices[0].remainingClaims(); remaining > 0 {
+				// The invoice was overpaid, the client can use it again
+				w.Header().Set(core.HeaderInvoiceRemaining, strconv.Itoa(remaining))
+			}
+		}
+	}
+	core.SetHeader(w, core.ResultOK)
+
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+
+		lightauth.ReportError(fmt.Errorf("Lightauth error: handler of %v panicked: %v", r.URL.Path, p))
+		if w.committed {
+			// Part of the response is gone, let net/http abort it
+			if w.record != nil {
+				w.record.overflow = true
+			}
+			panic(p)
+		}
+
+		// The client got nothing for its invoices, so it can use them again, and owes nothing for results
+		w.meter = nil
+		w.Header().Del(core.HeaderInvoice)
+		w.Header().Del(core.HeaderInvoiceRemaining)
+		for _, i := range v.invoices {
+			if err := i.releaseClaim(); err != nil {
+				log.Printf("Lightauth error: could not release claim: %v\n", err)
+			}
+		}
+
+		audit(r, token, v.invoices, false, http.StatusInternalServerError, sOMETHINGWENTWRONG)
+		writeError(w, sOMETHINGWENTWRONG, http.StatusInternalServerError)
+	}()
+
+	handler(w, r)
+}
+
+// Middleware is a middleware that checks if the request is valid according to the fees declared for the
+// route.
+func Middleware(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !serverState.IsStarted() {
+			// Paid routes aren't known yet, nothing is served for free meanwhile
+			writeError(w, (&lightauth.NotStartedError{Side: "server"}).Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		if message, statusCode := guardHeaders(r); message != "" {
+			deny(w, r, core.ReadHeader(r.Header, core.HeaderToken), message, statusCode)
+			return
+		}
+
+		if message := checkRequestHeaders(r); message != "" {
+			deny(w, r, core.ReadHeader(r.Header, core.HeaderToken), message, http.StatusBadRequest)
+			return
+		}
+
+		r = withInvoiceCodec(r)
+		if isSyncRequest(r) {
+			serveSync(w, r)
+			return
+		}
+
+		rt, routeExists := matchRoute(r)
+		if !routeExists {
+			handler(w, r)
+			return
+		}
+
+		dw := &deferredWriter{ResponseWriter: w, ctx: r.Context(), legacy: servesLegacy(r)}
+		w = dw
+
+		token := core.ReadHeader(r.Header, core.HeaderToken)
+		if rt.isSunset() {
+			writeConstantHeaders(w, rt)
+			deny(w, r, token, rOUTESUNSET, http.StatusGone)
+			return
+		}
+
+		if serveAPIKey(dw, r, rt, handler) {
+			// Keyed callers speak no version of the protocol
+			return
+		}
+
+		if message := checkLegacyRequest(r); message != "" {
+			writeConstantHeaders(w, rt)
+			deny(w, r, token, message, http.StatusBadRequest)
+			return
+		}
+		fingerprint := ""
+		if rt.BindRequest {
+			fingerprint = declaredFingerprint(r)
+		}
+
+		if rt.breaker().IsOpen() {
+			// Balance-only routes go on with what clients have already paid for
+			switch rt.degradation() {
+			case dEGRADEFAILCLOSED:
+				deny(w, r, token, nODEUNAVAILABLE, http.StatusServiceUnavailable)
+				return
+			case dEGRADEFAILOPEN:
+				dispatch(dw, r, token, handler, validation{authorized: true, message: "node unavailable, served for free"})
+				return
+			}
+		}
+		if rt.Identity {
+			identity, err := verifyIdentity(r, rt)
+			if errors.Is(err, lightauth.ErrCircuitOpen) {
+				deny(w, r, token, nODEUNAVAILABLE, http.StatusServiceUnavailable)
+				return
+			}
+
+			if err != nil {
+				deny(w, r, token, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if identity != "" {
+				token, err = bindIdentity(rt, identity, token)
+				if err != nil {
+					deny(w, r, token, "Something went wrong", http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+
+		assessed := false
+		if token == "" {
+			decision, ok := assessRisk(w, r, token, nil)
+			if !ok {
+				return
+			}
+
+			// Token not found, create new one
+			c, err := rt.newClient()
+			if err != nil {
+				deny(w, r, token, "Something went wrong", http.StatusInternalServerError)
+				return
+			}
+			token = c.Token
+
+			if err := c.setSurcharge(decision.surcharge()); err != nil {
+				deny(w, r, token, "Something went wrong", http.StatusInternalServerError)
+				return
+			}
+			assessed = true
+		}
+
+		writeConstantHeaders(w, rt)
+
+		c, tokenExists := rt.lookupClient(token)
+		if !tokenExists {
+			// Token doesn't exist
+			deny(w, r, token, iNVALIDTOKEN, http.StatusBadRequest)
+			return
+		}
+
+		if c.isRevoked() {
+			deny(w, r, token, iDENTITYREVOKED, http.StatusForbidden)
+			return
+		}
+
+		if !assessed {
+			decision, ok := assessRisk(w, r, token, c)
+			if !ok {
+				return
+			}
+
+			if err := c.setSurcharge(decision.surcharge()); err != nil {
+				deny(w, r, token, "Something went wrong", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := priceClient(r, c); err != nil {
+			deny(w, r, token, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		err := c.rotateToken()
+		if err != nil {
+			deny(w, r, token, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		if err := c.negotiateBatch(r); err != nil {
+			deny(w, r, token, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		if err := c.noticeReferrer(r); err != nil {
+			deny(w, r, token, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		if message, statusCode := c.redeemPromo(r); message != "" {
+			deny(w, r, token, message, statusCode)
+			return
+		}
+
+		if deferHeaders {
+			dw.client = c
+			dw.fingerprint = fingerprint
+		} else {
+			err = writeClientHeaders(r.Context(), w, c, fingerprint)
+			if err != nil {
+				deny(w, r, token, sOMETHINGWENTWRONG, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		err = checkTokenBinding(c, r)
+		if err != nil {
+			deny(w, r, token, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		if rt.PerResult {
+			outstanding, err := c.deferredInvoices(r.Context())
+			if err != nil {
+				deny(w, r, token, "Something went wrong", http.StatusInternalServerError)
+				return
+			}
+
+			if len(outstanding) > 0 {
+				if invoicesJSON, err := getInvoicesJSON(outstanding); err == nil {
+					w.Header().Set(core.HeaderDeferredInvoices, invoicesJSON)
+				}
+				deny(w, r, token, pAYMENTOUTSTANDING, http.StatusPaymentRequired)
+				return
+			}
+		}
+
+		replay, ttl := replayKey(c, r)
+		recorded, record, inProgress := beginIdempotent(r.Context(), c, replay)
+		if inProgress {
+			deny(w, r, token, rEQUESTINPROGRESS, http.StatusConflict)
+			return
+		}
+
+		if recorded != nil {
+			// The request has been paid for and served already
+			audit(r, token, nil, true, recorded.status, "replayed")
+			recorded.replay(w)
+			return
+		}
+		dw.record = record
+
+		v := validate(w, r, c)
+
+		if rt.PerResult && v.authorized {
+			// The invoices claimed pay for the first part of the cost
+			r = dw.meterCost(r, c, c.fee()*len(v.invoices))
+		}
+
+		if record != nil {
+			// Even when the handler panics, so that the request can be attempted again
+			defer func() {
+				endIdempotent(c, replay, ttl, record, dw.Header(), v.authorized && core.ReadResult(dw.Header()) == core.ResultOK)
+			}()
+		}
+
+		dispatch(dw, r, token, handler, v)
+
+		if dw.meter != nil {
+			// The request may be over for the client, the cost it reported is invoiced all the same
+			dw.invoiceCost(context.Background())
+		}
+	}
+}
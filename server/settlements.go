@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+)
+
+// A settlement that can't be written is retried with a backoff between sETTLEMENTRETRY and
+// mAXSETTLEMENTRETRY, and reported again on Errors() every sETTLEMENTALERT while it stays unsaved.
+const (
+	sETTLEMENTRETRY    = time.Second
+	mAXSETTLEMENTRETRY = time.Minute
+	sETTLEMENTALERT    = 5 * time.Minute
+)
+
+// settlementQueue holds the payment hashes of the settlements not written to the store yet, in memory
+// and in the journal file when there is one.
+type settlementQueue struct {
+	mux     sync.Mutex
+	pending map[string]time.Time
+	journal string
+	wake    chan struct{}
+}
+
+var unsavedSettlements = &settlementQueue{pending: make(map[string]time.Time), wake: make(chan struct{}, 1)}
+
+// PendingSettlements returns the number of payments received that are not in the store yet
+func PendingSettlements() int {
+	unsavedSettlements.mux.Lock()
+	defer unsavedSettlements.mux.Unlock()
+
+	return len(unsavedSettlements.pending)
+}
+
+// startSettlements replays the journal left by a previous run and starts retrying. It must be called
+// once the server's invoices are indexed.
+func startSettlements(journal string) error {
+	q := unsavedSettlements
+	q.mux.Lock()
+	q.journal = journal
+	q.mux.Unlock()
+
+	if journal != "" {
+		f, err := os.Open(journal)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if err == nil {
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				if paymentHash := strings.TrimSpace(scanner.Text()); paymentHash != "" {
+					q.pending[paymentHash] = time.Now()
+				}
+			}
+			f.Close()
+
+			if err := scanner.Err(); err != nil {
+				return err
+			}
+		}
+	}
+
+	go q.retry()
+	q.signal()
+	return nil
+}
+
+func (q *settlementQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// add queues a settlement that failed to be written
+func (q *settlementQueue) add(paymentHash []byte, cause error) {
+	key := hex.EncodeToString(paymentHash)
+	lightauth.ReportError(fmt.Errorf("Lightauth error: could not save settlement of %v, will retry: %v", key, cause))
+
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if _, queued := q.pending[key]; queued {
+		return
+	}
+	q.pending[key] = time.Now()
+
+	if q.journal != "" {
+		f, err := os.OpenFile(q.journal, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = fmt.Fprintln(f, key)
+			if err == nil {
+				err = f.Sync()
+			}
+			f.Close()
+		}
+
+		if err != nil {
+			lightauth.ReportError(fmt.Errorf("Lightauth error: could not journal settlement of %v: %v", key, err))
+		}
+	}
+
+	q.signal()
+}
+
+// retry writes the queued settlements until the store takes them, rewriting the journal after every
+// round so it only lists the ones still pending.
+func (q *settlementQueue) retry() {
+	defer lightauth.RecoverBackground("settlement retries")
+
+	backoff := sETTLEMENTRETRY
+	for {
+		select {
+		case <-q.wake:
+		case <-time.After(backoff):
+		}
+
+		q.mux.Lock()
+		pending := make(map[string]time.Time, len(q.pending))
+		for k, v := range q.pending {
+			pending[k] = v
+		}
+		q.mux.Unlock()
+
+		if len(pending) == 0 {
+			backoff = sETTLEMENTRETRY
+			continue
+		}
+
+		failed := false
+		for key, since := range pending {
+			err := resaveSettlement(key)
+			if err == nil {
+				q.mux.Lock()
+				delete(q.pending, key)
+				q.mux.Unlock()
+				continue
+			}
+
+			failed = true
+			if time.Since(since) > sETTLEMENTALERT {
+				lightauth.ReportError(fmt.Errorf("Lightauth error: settlement of %v has been unsaved since %v: %v", key, since.Format(time.RFC3339), err))
+				q.mux.Lock()
+				q.pending[key] = time.Now()
+				q.mux.Unlock()
+			}
+		}
+
+		q.rewriteJournal()
+
+		if failed && backoff < mAXSETTLEMENTRETRY {
+			backoff *= 2
+		} else if !failed {
+			backoff = sETTLEMENTRETRY
+		}
+	}
+}
+
+func (q *settlementQueue) rewriteJournal() {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if q.journal == "" {
+		return
+	}
+
+	var b strings.Builder
+	for key := range q.pending {
+		b.WriteString(key + "\n")
+	}
+
+	// Written aside and renamed, so a crash leaves either journal
+	tmp := q.journal + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(b.String()), 0600)
+	if err == nil {
+		err = os.Rename(tmp, q.journal)
+	}
+
+	if err != nil {
+		lightauth.ReportError(fmt.Errorf("Lightauth error: could not rewrite settlement journal: %v", err))
+	}
+}
+
+// resaveSettlement writes a settlement again, finishing what updateInvoice couldn't. After a restart the
+// invoice comes unsettled from the store and is settled from scratch.
+func resaveSettlement(key string) error {
+	i, invoiceExists := serverInvoices.Get(key)
+	if !invoiceExists {
+		// Nothing to save it to, e.g. the route is gone
+		return nil
+	}
+
+	if !i.isSettled() {
+		paymentHash, err := hex.DecodeString(key)
+		if err != nil {
+			return nil
+		}
+
+		return updateInvoice(paymentHash, 0)
+	}
+
+	if err := i.resave(); err != nil {
+		return err
+	}
+
+	c := i.Client
+	if c.Route.Mode != core.ModeTime {
+		return nil
+	}
+
+	i.mux.Lock()
+	creditedUntil := i.CreditedUntil
+	i.mux.Unlock()
+
+	if creditedUntil.IsZero() {
+		return creditInvoice(i)
+	}
+
+	if c.getExpirationTime().Before(creditedUntil) {
+		return c.setExpirationTime(creditedUntil)
+	}
+
+	return c.resave()
+}
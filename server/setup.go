@@ -0,0 +1,308 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+	"google.golang.org/grpc"
+)
+
+var (
+	serverStore    map[string]*Route
+	serverInvoices = lightauth.NewInvoiceIndex[*Invoice]()
+	serverBackend  lightauth.LightningBackend
+	serverDatabase DataProvider
+	serverState    = &lightauth.StartState{}
+	textErrors     bool
+	deferHeaders   bool
+)
+
+const mAXRESUBSCRIBEBACKOFF = time.Minute
+
+// DataProvider is an interface that specifies the methods required to store the data of the server
+type DataProvider interface {
+	lightauth.Store
+	GetServerData() (map[string]*Route, error)
+}
+
+// RouteInfo is the bare fields that details a route
+type RouteInfo struct {
+	Name               string
+	Fee                int
+	MaxInvoices        int
+	Mode               core.Mode
+	Period             core.Period
+	LNURL              string
+	Identity           bool
+	TokenBinding       string
+	TokenTTL           string
+	TokenOverlap       string
+	Private            bool
+	RouteHints         []HopHint
+	Memo               string
+	InvoiceExpiry      string
+	Degradation        string
+	Overpayment        string
+	InvoicesPerRequest int
+	PerResult          bool
+	BindRequest        bool
+	Match              []string
+	InvoicesURL        string
+	CacheTTL           string
+	Rate               float64
+	Burst              int
+	Tenant             string
+	Split              int
+	ReferrerHeader     string
+	Cohorts            []Cohort
+	ExpiryWarning      string
+	Sunset             string
+	InvoiceCutoff      string
+	APIKeyHeader       string
+}
+
+// HopHint describes the last hop to reach the node through a private channel. Each one is included in
+// the route's invoices as its own route hint.
+type HopHint struct {
+	NodeID                    string
+	ChanID                    uint64
+	FeeBaseMsat               uint32
+	FeeProportionalMillionths uint32
+	CltvExpiryDelta           uint32
+}
+
+// serverConfig holds the settings of the server on top of the shared ones. Each of the Tenants
+// sections is the node the routes of that tenant are paid to.
+type serverConfig struct {
+	lightauth.Config
+	AuditLog            string
+	TextErrors          bool
+	DeferHeaders        bool
+	OfflineVerification bool
+	IdempotencyWindow   string
+	PayoutInterval      string
+	Watchdog            WatchdogConfig
+	LegacyClientsUntil  string
+	Routes              map[string]*RouteInfo
+	Tenants             map[string]*lightauth.NodeConfig
+	Referrers           map[string]string
+}
+
+func readConfig() (serverConfig, error) {
+	var conf serverConfig
+	if err := lightauth.DecodeConfig(&conf); err != nil {
+		return conf, err
+	}
+
+	if err := lightauth.NewConfigError(conf.Validate()); err != nil {
+		return conf, err
+	}
+
+	return conf, nil
+}
+
+// StartConnection is used to initiate the connection with the LDN node on a server's behalf.
+// It requires lightauth.toml to be populated with the connection params and
+// the routes. The node is the one of the Server section if there is one. When the node is not lnd there
+// is no connection to return and the result is nil. Only the first successful call starts the server,
+// later ones return the same connection. When lightauth.toml can't be used, the error lists all of its
+// problems as a ConfigError.
+func StartConnection(db DataProvider) (*grpc.ClientConn, error) {
+	return serverState.Start(func() (*grpc.ClientConn, error) {
+		conf, err := readConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := lightauth.NewConfigError(conf.ValidateRole("Server", conf.Server)); err != nil {
+			return nil, err
+		}
+
+		backend, conn, err := lightauth.StartBackend(conf.Node(conf.Server), conf.Config)
+		if err != nil {
+			return nil, fmt.Errorf("Lightauth error: Failed to start server: %v", err)
+		}
+
+		serverBackend = backend
+		if err := startServer(db, conf); err != nil {
+			return nil, err
+		}
+
+		return conn, nil
+	})
+}
+
+// StartWithBackend starts the server on top of the given Lightning backend instead of connecting to
+// lnd. The routes are still read from lightauth.toml. Only the first start of the server does
+// anything.
+func StartWithBackend(db DataProvider, backend lightauth.LightningBackend) error {
+	_, err := serverState.Start(func() (*grpc.ClientConn, error) {
+		conf, err := readConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		serverBackend = backend
+		return nil, startServer(db, conf)
+	})
+
+	return err
+}
+
+func startServer(db DataProvider, conf serverConfig) error {
+	if err := lightauth.NewConfigError(conf.validateRoutes()); err != nil {
+		return err
+	}
+
+	db, err := sealRecords(db, conf.EncryptionKeyFile)
+	if err != nil {
+		return fmt.Errorf("Lightauth error: Failed to start server: %v", err)
+	}
+
+	serverDatabase = db
+	lightauth.StartPersistence(conf.Persistence)
+	textErrors = conf.TextErrors
+	deferHeaders = conf.DeferHeaders
+	offlineVerification = conf.OfflineVerification
+	idempotencyWindow, _ = lightauth.ParseDuration(conf.IdempotencyWindow)
+	strictMode = conf.Strict
+	legacyClientsUntil, _ = time.Parse("2006-01-02T15:04:05Z07:00", conf.LegacyClientsUntil)
+
+	if conf.AuditLog != "" && auditSink == nil {
+		f, err := os.OpenFile(conf.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("Lightauth error: could not open audit log: %v", err)
+		}
+		auditSink = NewAuditLog(f)
+	}
+
+	_, err = lightauth.CheckNetwork(serverBackend, conf.Network)
+	if err != nil {
+		return fmt.Errorf("Lightauth error: Failed to start server: %v", err)
+	}
+
+	serverStore, err = db.GetServerData()
+	if err != nil {
+		return fmt.Errorf("Lightauth error: could not fetch data from store: %v", err)
+	}
+	// Whatever the store keys them by, routes are looked up by Name and Match conditions
+	routes := make(map[string]*Route)
+	for _, r := range serverStore {
+		routes[r.key()] = r
+	}
+	serverStore = routes
+
+	for _, r := range serverStore {
+		r.indexClients()
+		for _, c := range r.Clients {
+			for _, i := range c.Invoices {
+				i.Client = c
+				serverInvoices.Add(i.PaymentHash, i)
+			}
+		}
+	}
+
+	for _, v := range conf.Routes {
+		if _, exists := serverStore[v.key()]; !exists {
+			// TODO: Delete from store those routes not in toml
+			r := &Route{
+				Clients:    make(map[string]*Client),
+				RouteInfo:  *v,
+				tokens:     newClientShards(),
+				identities: newClientShards(),
+			}
+
+			err := r.save()
+			if err != nil {
+				return fmt.Errorf("Lightauth error: could not save route %v: %v", v.Name, err)
+			}
+
+			serverStore[v.key()] = r
+		}
+	}
+	indexRoutes()
+
+	if err := startSettlements(conf.Persistence.Journal); err != nil {
+		return fmt.Errorf("Lightauth error: could not read settlement journal: %v", err)
+	}
+
+	ctxb := context.Background()
+	stream, err := serverBackend.SubscribeInvoices(ctxb)
+	if err != nil {
+		return fmt.Errorf("Lightauth error: Failed to start lightning client stream: %v", err)
+	}
+
+	// Settlements wait on the stream until the invoices paid while the server was down are credited
+	reconcileInvoices("")
+	go receiveInvoices(serverBackend, serverBreaker, stream, &serverStreamAlive)
+	if err := startTenants(conf); err != nil {
+		return err
+	}
+	referrers = conf.Referrers
+	if interval, _ := lightauth.ParseDuration(conf.PayoutInterval); interval > 0 {
+		go payoutSplits(interval)
+	}
+	startWatchdog(conf.Watchdog)
+	go sweepIdempotent()
+	if offlineVerification {
+		go reconcileOffline()
+	}
+
+	return nil
+}
+
+// receiveInvoices settles the invoices a node reports as paid on its stream, setting alive while the
+// stream is up. When the stream breaks it subscribes again, waiting longer after each failed attempt,
+// and the attempts are recorded on the breaker of the node.
+func receiveInvoices(backend lightauth.LightningBackend, breaker *lightauth.Breaker, stream lightauth.InvoiceStream, alive *int32) {
+	defer lightauth.RecoverBackground("invoice subscription")
+
+	backoff := time.Second
+	for {
+		atomic.StoreInt32(alive, 1)
+		for {
+			invoiceUpdate, err := stream.Recv()
+			if err == io.EOF {
+				atomic.StoreInt32(alive, 0)
+				return
+			}
+
+			if err != nil {
+				lightauth.ReportError(fmt.Errorf("Lightauth error: There was an error receiving data from the lightning client stream: %v", err))
+				break
+			}
+
+			backoff = time.Second
+			if invoiceUpdate != nil && invoiceUpdate.Settled {
+				err := updateInvoice(invoiceUpdate.RHash, invoiceUpdate.AmtPaidMsat)
+				if err != nil {
+					// We have been notified of a payment but we can't save it
+					unsavedSettlements.add(invoiceUpdate.RHash, err)
+				}
+			}
+		}
+		atomic.StoreInt32(alive, 0)
+
+		for {
+			time.Sleep(backoff)
+			if backoff < mAXRESUBSCRIBEBACKOFF {
+				backoff *= 2
+			}
+
+			var err error
+			stream, err = backend.SubscribeInvoices(context.Background())
+			breaker.Record(context.Background(), err)
+			if err == nil {
+				break
+			}
+
+			lightauth.ReportError(fmt.Errorf("Lightauth error: Failed to restart lightning client stream: %v", err))
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// nUMSHARDS is the number of locks the clients of a route are spread over
+const nUMSHARDS = 64
+
+type clientShard struct {
+	mux     sync.RWMutex
+	clients map[string]*Client
+}
+
+// clientShards maps the tokens of a route to their clients. Each token is kept in one of several maps
+// with their own lock, so requests presenting different tokens rarely wait on each other.
+type clientShards [nUMSHARDS]clientShard
+
+func newClientShards() *clientShards {
+	s := &clientShards{}
+	for i := range s {
+		s[i].clients = make(map[string]*Client)
+	}
+
+	return s
+}
+
+func (s *clientShards) shard(token string) *clientShard {
+	h := fnv.New32a()
+	h.Write([]byte(token))
+	return &s[h.Sum32()%nUMSHARDS]
+}
+
+// indexClients builds the token index of a route from the clients loaded from the store, including the
+// rotated tokens that are still accepted, and the index of the identities they are bound to.
+func (r *Route) indexClients() {
+	r.tokens = newClientShards()
+	r.identities = newClientShards()
+	for _, c := range r.Clients {
+		c.Route = r
+		r.setClient(c.Token, c)
+		for _, v := range c.PreviousTokens {
+			r.setClient(v.Token, c)
+		}
+
+		if c.Identity != "" {
+			r.identities.shard(c.Identity).clients[c.Identity] = c
+		}
+	}
+}
+
+func (r *Route) setClient(token string, c *Client) {
+	shard := r.tokens.shard(token)
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+
+	shard.clients[token] = c
+}
+
+func (r *Route) getClient(token string) (*Client, bool) {
+	shard := r.tokens.shard(token)
+	shard.mux.RLock()
+	defer shard.mux.RUnlock()
+
+	c, exists := shard.clients[token]
+	return c, exists
+}
+
+func (r *Route) deleteClient(token string) {
+	shard := r.tokens.shard(token)
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+
+	delete(shard.clients, token)
+}
+
+// identityClient returns the client bound to an identity
+func (r *Route) identityClient(identity string) (*Client, bool) {
+	shard := r.identities.shard(identity)
+	shard.mux.RLock()
+	defer shard.mux.RUnlock()
+
+	c, exists := shard.clients[identity]
+	return c, exists
+}
+
+// bindClient binds an identity to a client that has none, unless another client got it first, and
+// returns the client the identity ends up bound to. The shard of the identity stays locked meanwhile,
+// so two requests presenting a new identity can't bind it twice.
+func (r *Route) bindClient(identity string, c *Client) (*Client, error) {
+	shard := r.identities.shard(identity)
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+
+	if bound, exists := shard.clients[identity]; exists {
+		return bound, nil
+	}
+
+	if err := c.setIdentity(identity); err != nil {
+		return nil, err
+	}
+	shard.clients[identity] = c
+
+	return c, nil
+}
+
+// rangeClients calls f for every client of the route until it returns false
+func (r *Route) rangeClients(f func(c *Client) bool) {
+	for i := range r.tokens {
+		shard := &r.tokens[i]
+		shard.mux.RLock()
+		tokens := make(map[string]*Client, len(shard.clients))
+		for token, c := range shard.clients {
+			tokens[token] = c
+		}
+		shard.mux.RUnlock()
+
+		for token, c := range tokens {
+			// Clients are listed under their current token only. The client's lock is taken once the
+			// shard's is released, as rotateToken takes them the other way around.
+			if token == c.getToken() && !f(c) {
+				return
+			}
+		}
+	}
+}
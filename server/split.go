@@ -0,0 +1,417 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/core"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+)
+
+// dEFAULTREFERRERHEADER is the header clients are referred by on routes with a Split and no
+// ReferrerHeader
+const dEFAULTREFERRERHEADER = "X-Referrer"
+
+// Referrers are paid with the fee limit in satoshis, the timeout in seconds and the parts the client
+// pays invoices with by default
+const (
+	pAYOUTFEELIMIT = 10
+	pAYOUTTIMEOUT  = 60
+	pAYOUTMAXPARTS = 16
+)
+
+// payoutMux runs the payouts one at a time, so a share is never sent twice by payouts overlapping
+var payoutMux sync.Mutex
+
+// referrers maps the referrers the server shares its revenue with to where their share is paid: a
+// lightning address or an LNURL-pay URL, as set in the Referrers section of lightauth.toml.
+var referrers map[string]string
+
+// referrerHeader is the header that tells who referred the clients of a route
+func (r *Route) referrerHeader() string {
+	if r.ReferrerHeader != "" {
+		return http.CanonicalHeaderKey(r.ReferrerHeader)
+	}
+
+	return dEFAULTREFERRERHEADER
+}
+
+// noticeReferrer records who referred a client of a route with a Split, the first time one of its
+// requests names a known referrer. Its payments are shared with that referrer from then on.
+func (c *Client) noticeReferrer(r *http.Request) error {
+	if c.Route.Split <= 0 {
+		return nil
+	}
+
+	referrer := r.Header.Get(c.Route.referrerHeader())
+	if _, known := referrers[referrer]; !known {
+		return nil
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.Referrer != "" {
+		return nil
+	}
+
+	c.Referrer = referrer
+	return c.persist(false)
+}
+
+// referrer is who the payments of the client are shared with, if anyone
+func (c *Client) referrer() string {
+	if c.Route.Split <= 0 {
+		return ""
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.Referrer
+}
+
+// refer records the referrer a settled invoice is shared with
+func (i *Invoice) refer(referrer string) error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	i.Referrer = referrer
+	return i.persist(true)
+}
+
+// startPayout records the payout of the share of the invoice about to be sent, before it is, so a
+// payout the server doesn't see the end of is looked up before the share is paid again.
+func (i *Invoice) startPayout(paymentHash string) error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	i.ReferrerPayout = paymentHash
+	return i.persist(true)
+}
+
+// endPayout forgets the payout of the share of the invoice once it is known to have ended, and marks
+// the share paid out if it succeeded.
+func (i *Invoice) endPayout(paid bool) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	i.ReferrerPayout = ""
+	i.ReferrerPaid = paid
+	if err := i.persist(true); err != nil {
+		lightauth.ReportError(err)
+	}
+}
+
+// payout is the payment hash of the payout of the share of the invoice that was sent without the
+// server seeing how it ended, if any
+func (i *Invoice) payout() string {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	return i.ReferrerPayout
+}
+
+// share is the part of a settled invoice owed to its referrer in millisatoshis, or 0 once it has been
+// paid out
+func (i *Invoice) share() int64 {
+	i.mux.Lock()
+	settled, referrer, paidOut, amountPaid := i.Settled, i.Referrer, i.ReferrerPaid, i.AmountPaid
+	i.mux.Unlock()
+
+	if !settled || referrer == "" || paidOut {
+		return 0
+	}
+
+	if amountPaid == 0 {
+		amountPaid = int64(i.amount()) * 1000
+	}
+
+	return amountPaid * int64(i.Client.Route.Split) / 100
+}
+
+// owedShares lists the invoices whose share is owed to each referrer, by the tenant whose node got
+// paid them
+func owedShares() map[string]map[string][]*Invoice {
+	owed := make(map[string]map[string][]*Invoice)
+	for _, rt := range serverStore {
+		if rt.Split <= 0 {
+			continue
+		}
+
+		rt.rangeClients(func(c *Client) bool {
+			for _, i := range c.invoices() {
+				if i.share() == 0 {
+					continue
+				}
+
+				i.mux.Lock()
+				referrer := i.Referrer
+				i.mux.Unlock()
+
+				if owed[referrer] == nil {
+					owed[referrer] = make(map[string][]*Invoice)
+				}
+				owed[referrer][rt.Tenant] = append(owed[referrer][rt.Tenant], i)
+			}
+
+			return true
+		})
+	}
+
+	return owed
+}
+
+// OwedSplits returns what is owed to each referrer in millisatoshis and hasn't been paid out yet
+func OwedSplits() map[string]int64 {
+	splits := make(map[string]int64)
+	for referrer, byTenant := range owedShares() {
+		for _, invoices := range byTenant {
+			for _, i := range invoices {
+				splits[referrer] += i.share()
+			}
+		}
+	}
+
+	return splits
+}
+
+// PayoutSplits pays each referrer what it is owed over Lightning, from the node the shared payments
+// were made to. Amounts are paid in whole satoshis, the millisatoshis left over are dropped. The
+// errors of the payouts that failed are joined in the result, the others go through all the same.
+// Payouts run one at a time, and the shares of a payout whose outcome is unknown, the server having
+// stopped or lost the node while it was in flight, are only paid again once the node tells it failed.
+func PayoutSplits(ctx context.Context) error {
+	if !serverState.IsStarted() {
+		return &lightauth.NotStartedError{Side: "server"}
+	}
+
+	payoutMux.Lock()
+	defer payoutMux.Unlock()
+
+	var failures []string
+	for referrer, byTenant := range owedShares() {
+		for tenantName, invoices := range byTenant {
+			if err := payoutReferrer(ctx, tenantName, referrer, invoices); err != nil {
+				failures = append(failures, fmt.Sprintf("%v: %v", referrer, err))
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("Lightauth error: payouts failed: %v", strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+// lnurlPayURL returns the LNURL-pay endpoint of a lightning address, or the destination itself if it
+// is already a URL
+func lnurlPayURL(destination string) string {
+	if parts := strings.SplitN(destination, "@", 2); len(parts) == 2 && !strings.Contains(destination, "://") {
+		return "https://" + parts[1] + "/.well-known/lnurlp/" + parts[0]
+	}
+
+	return destination
+}
+
+// getLNURL calls the LNURL service of a referrer
+func getLNURL(ctx context.Context, u string, v interface{}) error {
+	request, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	return core.DecodeLNURL(body, v)
+}
+
+// resolvePayouts looks up the payouts sent for the shares of invoices without the server seeing how they
+// ended, forgetting those that failed and marking the shares of those that succeeded paid out. It
+// returns the invoices whose shares can be paid out, leaving out the ones whose payout is in flight or
+// can't be looked up.
+func resolvePayouts(ctx context.Context, tenantName string, invoices []*Invoice) []*Invoice {
+	owed := []*Invoice{}
+	pending := []*Invoice{}
+	for _, i := range invoices {
+		if i.payout() == "" {
+			owed = append(owed, i)
+		} else {
+			pending = append(pending, i)
+		}
+	}
+
+	if len(pending) == 0 {
+		return owed
+	}
+
+	lister, ok := tenantBackend(tenantName).(lightauth.PaymentLister)
+	if !ok {
+		lightauth.ReportError(fmt.Errorf("Lightauth error: %d shares may have been paid out without being recorded, the node can't list its payments", len(pending)))
+		return owed
+	}
+
+	var payments []*lnrpc.Payment
+	err := tenantBreaker(tenantName).Call(ctx, func(ctx context.Context) error {
+		var err error
+		payments, err = lister.ListPayments(ctx)
+		return err
+	})
+	if err != nil {
+		lightauth.ReportError(err)
+		return owed
+	}
+
+	byHash := make(map[string]*lnrpc.Payment)
+	for _, payment := range payments {
+		byHash[payment.PaymentHash] = payment
+	}
+
+	for _, i := range pending {
+		payment, sent := byHash[i.payout()]
+		switch {
+		case sent && payment.Status == lnrpc.Payment_SUCCEEDED:
+			i.endPayout(true)
+		case sent && payment.Status == lnrpc.Payment_IN_FLIGHT:
+			continue
+		default:
+			i.endPayout(false)
+			owed = append(owed, i)
+		}
+	}
+
+	return owed
+}
+
+func payoutReferrer(ctx context.Context, tenantName string, referrer string, invoices []*Invoice) error {
+	invoices = resolvePayouts(ctx, tenantName, invoices)
+
+	var msat int64
+	for _, i := range invoices {
+		msat += i.share()
+	}
+	// Only whole satoshis can be paid to an LNURL
+	msat = msat / 1000 * 1000
+	if msat == 0 {
+		return nil
+	}
+
+	params := core.LNURLPayParams{}
+	if err := getLNURL(ctx, lnurlPayURL(referrers[referrer]), &params); err != nil {
+		return err
+	}
+
+	if params.Tag != "payRequest" || msat < params.MinSendable {
+		// Not enough is owed yet
+		return nil
+	}
+
+	if msat > params.MaxSendable {
+		return errors.New("Lightauth error: the share owed is more than the referrer takes at once")
+	}
+
+	callback, err := url.Parse(params.Callback)
+	if err != nil {
+		return err
+	}
+
+	query := callback.Query()
+	query.Set("amount", strconv.FormatInt(msat, 10))
+	callback.RawQuery = query.Encode()
+
+	payInvoice := core.LNURLPayInvoice{}
+	if err := getLNURL(ctx, callback.String(), &payInvoice); err != nil {
+		return err
+	}
+
+	payReq, err := core.DecodeBOLT11(payInvoice.PR)
+	if err != nil {
+		return err
+	}
+
+	descriptionHash := sha256.Sum256([]byte(params.Metadata))
+	if payReq.NumSatoshis*1000 != msat || payReq.DescriptionHash != hex.EncodeToString(descriptionHash[:]) {
+		return errors.New("Lightauth error: the referrer's invoice does not match the payout")
+	}
+
+	// The payment outlasts the RPCTimeout of breaker.Call, so its outcome is recorded by hand
+	breaker := tenantBreaker(tenantName)
+	if !breaker.Allow() {
+		return lightauth.ErrCircuitOpen
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(pAYOUTTIMEOUT)*time.Second+lightauth.RPCTimeout)
+	defer cancel()
+
+	for k, i := range invoices {
+		if err := i.startPayout(payReq.PaymentHash); err != nil {
+			// Nothing has been sent yet
+			for _, started := range invoices[:k] {
+				started.endPayout(false)
+			}
+			return err
+		}
+	}
+
+	payment, err := tenantBackend(tenantName).SendPayment(ctx, &routerrpc.SendPaymentRequest{
+		PaymentRequest: payInvoice.PR,
+		FeeLimitSat:    pAYOUTFEELIMIT,
+		TimeoutSeconds: pAYOUTTIMEOUT,
+		MaxParts:       pAYOUTMAXPARTS,
+	})
+	breaker.Record(ctx, err)
+	if _, failed := err.(*lightauth.PaymentError); failed || (err == nil && payment.Status == lnrpc.Payment_FAILED) {
+		for _, i := range invoices {
+			i.endPayout(false)
+		}
+	}
+
+	if err != nil {
+		// Unless the payment failed, its outcome is looked up before the shares are paid again
+		return err
+	}
+
+	switch payment.Status {
+	case lnrpc.Payment_FAILED:
+		return &lightauth.PaymentError{PaymentRequest: payInvoice.PR, Reason: payment.FailureReason}
+	case lnrpc.Payment_SUCCEEDED:
+		for _, i := range invoices {
+			i.endPayout(true)
+		}
+	}
+
+	return nil
+}
+
+// payoutSplits pays the referrers their shares every interval
+func payoutSplits(interval time.Duration) {
+	defer lightauth.RecoverBackground("split payouts")
+
+	for range time.Tick(interval) {
+		if err := PayoutSplits(context.Background()); err != nil {
+			lightauth.ReportError(err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+const mALFORMEDHEADER = "Lightauth error: a Light-Auth header of the request is malformed"
+
+// strictMode turns the values lightauth would otherwise ignore or replace with a default into errors,
+// set with Strict in lightauth.toml
+var strictMode bool
+
+// checkRequestHeaders checks the Light-Auth headers of a request in strict mode, returning the message
+// to reject it with, or an empty message if it can go on
+func checkRequestHeaders(r *http.Request) string {
+	if !strictMode {
+		return ""
+	}
+
+	if params, announced := core.ParseHeader(r.Header); announced && params["version"] != core.ProtocolVersion {
+		return mALFORMEDHEADER
+	}
+
+	if !core.IsCount(r.Header, core.HeaderBatchSize, 1) || !core.IsCount(r.Header, core.HeaderIdentityTimestamp, 0) {
+		return mALFORMEDHEADER
+	}
+
+	if preImages := core.ReadHeader(r.Header, core.HeaderPreImage); preImages != "" {
+		for _, preImage := range strings.Split(preImages, ",") {
+			if b, err := hex.DecodeString(preImage); err != nil || len(b) != 32 {
+				return mALFORMEDHEADER
+			}
+		}
+	}
+
+	if fingerprint := core.ReadHeader(r.Header, core.HeaderFingerprint); fingerprint != "" {
+		if _, err := hex.DecodeString(fingerprint); err != nil {
+			return mALFORMEDHEADER
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+// isSyncRequest tells whether a request is the sync check a client makes on the first request to a
+// path after starting: a HEAD request to the path with the Light-Auth-Sync header. It is a HEAD request
+// so servers that don't know about it pass it to their handler harmlessly.
+func isSyncRequest(r *http.Request) bool {
+	return r.Method == http.MethodHead && core.ReadHeader(r.Header, core.HeaderSync) != ""
+}
+
+// serveSync tells a client what the server has for it on a path: its token, expiration time, credit
+// and invoices like on any request, and in Light-Auth-Claimed which of the invoices it lists in
+// Light-Auth-Invoice as paid and not used yet the server has already taken.
+func serveSync(w http.ResponseWriter, r *http.Request) {
+	token := core.ReadHeader(r.Header, core.HeaderToken)
+	c, tokenExists := lookupToken(token)
+	if !tokenExists || c.isRevoked() || c.Route.Name[strings.Index(c.Route.Name, "/"):] != r.URL.Path {
+		writeError(w, iNVALIDTOKEN, http.StatusBadRequest)
+		return
+	}
+
+	writeConstantHeaders(w, c.Route)
+	if err := writeClientHeaders(r.Context(), w, c, ""); err != nil {
+		writeError(w, sOMETHINGWENTWRONG, http.StatusInternalServerError)
+		return
+	}
+
+	listed := make(map[string]bool)
+	for _, paymentRequest := range strings.Split(core.ReadHeader(r.Header, core.HeaderInvoice), ",") {
+		listed[paymentRequest] = true
+	}
+
+	claimed := []*Invoice{}
+	for _, i := range c.invoices() {
+		if listed[i.PaymentRequest] && i.isClaimed() {
+			claimed = append(claimed, i)
+		}
+	}
+
+	if len(claimed) > 0 {
+		w.Header().Set(core.HeaderClaimed, paymentRequests(claimed))
+	}
+
+	core.SetHeader(w, core.ResultOK)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/faurehu/lightauth"
+)
+
+// ErrUnknownTenant is returned by the tenant scoped functions for tenants lightauth.toml doesn't have
+var ErrUnknownTenant = errors.New("Lightauth error: unknown tenant")
+
+// tenant is a customer hosting paid routes on the server, paid through its own node or wallet
+type tenant struct {
+	backend lightauth.LightningBackend
+	breaker *lightauth.Breaker
+	alive   int32
+}
+
+var tenants = make(map[string]*tenant)
+
+// startTenants connects to the node of each tenant of the configuration and starts settling the
+// invoices it is paid.
+func startTenants(conf serverConfig) error {
+	for name, node := range conf.Tenants {
+		backend, _, err := lightauth.StartBackend(*node, conf.Config)
+		if err != nil {
+			return fmt.Errorf("Lightauth error: Failed to start tenant %v: %v", name, err)
+		}
+
+		if _, err := lightauth.CheckNetwork(backend, conf.Network); err != nil {
+			return fmt.Errorf("Lightauth error: Failed to start tenant %v: %v", name, err)
+		}
+
+		stream, err := backend.SubscribeInvoices(context.Background())
+		if err != nil {
+			return fmt.Errorf("Lightauth error: Failed to start the invoice stream of tenant %v: %v", name, err)
+		}
+
+		t := &tenant{backend: backend}
+		t.breaker = lightauth.NewBreaker(func(ctx context.Context) error {
+			_, err := backend.GetInfo(ctx)
+			return err
+		}, nil)
+		tenants[name] = t
+		reconcileInvoices(name)
+		go receiveInvoices(backend, t.breaker, stream, &t.alive)
+	}
+
+	return nil
+}
+
+// tenantBackend is the node the invoices of a tenant are issued by, the node of the server for the
+// empty tenant.
+func tenantBackend(name string) lightauth.LightningBackend {
+	if t, exists := tenants[name]; exists {
+		return t.backend
+	}
+
+	return serverBackend
+}
+
+// tenantBreaker is the circuit breaker of the node of a tenant
+func tenantBreaker(name string) *lightauth.Breaker {
+	if t, exists := tenants[name]; exists {
+		return t.breaker
+	}
+
+	return serverBreaker
+}
+
+// tenantOffline tells whether the server can't learn about settlements from the node of a tenant at
+// the moment
+func tenantOffline(name string) bool {
+	if t, exists := tenants[name]; exists {
+		return atomic.LoadInt32(&t.alive) == 0
+	}
+
+	return atomic.LoadInt32(&serverStreamAlive) == 0
+}
+
+// backends lists the node of the server and those of its tenants
+func backends() []lightauth.LightningBackend {
+	nodes := []lightauth.LightningBackend{serverBackend}
+	for _, t := range tenants {
+		nodes = append(nodes, t.backend)
+	}
+
+	return nodes
+}
+
+// backend is the node the invoices of the route are issued by: the node of its tenant if it has one,
+// or the node of the server.
+func (r *Route) backend() lightauth.LightningBackend {
+	return tenantBackend(r.Tenant)
+}
+
+// breaker is the circuit breaker of the node of the route
+func (r *Route) breaker() *lightauth.Breaker {
+	return tenantBreaker(r.Tenant)
+}
+
+func tenantExists(name string) bool {
+	_, exists := tenants[name]
+	return exists || name == ""
+}
+
+// RouteRevenue is what the clients of a route have paid so far, in millisatoshis, over Invoices invoices
+type RouteRevenue struct {
+	Route      string `json:"route"`
+	AmountMsat int64  `json:"amount_msat"`
+	Invoices   int    `json:"invoices"`
+}
+
+// Revenue returns what the clients of the routes of a tenant have paid, route by route. The routes
+// without a tenant are those of the empty tenant.
+func Revenue(tenantName string) ([]RouteRevenue, error) {
+	if !tenantExists(tenantName) {
+		return nil, ErrUnknownTenant
+	}
+
+	revenue := []RouteRevenue{}
+	for key, rt := range serverStore {
+		if rt.Tenant != tenantName {
+			continue
+		}
+
+		r := RouteRevenue{Route: key}
+		rt.rangeClients(func(c *Client) bool {
+			for _, i := range c.invoices() {
+				i.mux.Lock()
+				settled, amountPaid := i.Settled, i.AmountPaid
+				i.mux.Unlock()
+
+				if !settled {
+					continue
+				}
+
+				if amountPaid == 0 {
+					amountPaid = int64(i.amount()) * 1000
+				}
+				r.AmountMsat += amountPaid
+				r.Invoices++
+			}
+
+			return true
+		})
+		revenue = append(revenue, r)
+	}
+
+	sort.Slice(revenue, func(a, b int) bool {
+		return revenue[a].Route < revenue[b].Route
+	})
+
+	return revenue, nil
+}
+
+// TenantCatalog returns the prices of the routes of a tenant, like Catalog does for all the routes
+func TenantCatalog(tenantName string) ([]Price, error) {
+	if !tenantExists(tenantName) {
+		return nil, ErrUnknownTenant
+	}
+
+	catalog := []Price{}
+	for _, p := range Catalog() {
+		if p.Tenant == tenantName {
+			catalog = append(catalog, p)
+		}
+	}
+
+	return catalog, nil
+}
+
+// TenantCredit gives credit like Credit, to a client of one of the routes of a tenant only
+func TenantCredit(tenantName string, token string, amount int, period time.Duration, reason string) error {
+	if !tenantExists(tenantName) {
+		return ErrUnknownTenant
+	}
+
+	c, exists := lookupToken(token)
+	if !exists || c.Route.Tenant != tenantName {
+		return ErrUnknownToken
+	}
+
+	return Credit(token, amount, period, reason)
+}
+
+// TenantCreditHandler is CreditHandler for the clients of a tenant, to be mounted behind the
+// authentication of the tenant's administrators.
+func TenantCreditHandler(tenantName string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handleCredit(w, r, func(token string, amount int, period time.Duration, reason string) error {
+			return TenantCredit(tenantName, token, amount, period, reason)
+		})
+	}
+}
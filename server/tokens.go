@@ -0,0 +1,231 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/faurehu/lightauth"
+)
+
+// tOKENATTEMPTS is the number of tokens generated before giving up on finding one that isn't taken
+const tOKENATTEMPTS = 8
+
+// dEFAULTTOKENOVERLAP is how long rotated tokens are accepted when a route doesn't set TokenOverlap
+const dEFAULTTOKENOVERLAP = time.Minute
+
+// TokenGenerator issues the tokens of the clients of a route
+type TokenGenerator interface {
+	NewToken(route string) (string, error)
+}
+
+// TokenVerifier can be implemented by a TokenGenerator whose tokens can be recognised without looking
+// them up, so forged tokens are rejected straight away.
+type TokenVerifier interface {
+	VerifyToken(route string, token string) bool
+}
+
+// TokenChecker can be implemented by a DataProvider to tell whether a token is already taken by a
+// client in the store, including the clients that haven't been loaded by this process.
+type TokenChecker interface {
+	TokenExists(token string) (bool, error)
+}
+
+var tokenGenerator TokenGenerator = RandomTokens("")
+
+// SetTokenGenerator changes how client tokens are generated, RandomTokens("") by default
+func SetTokenGenerator(g TokenGenerator) {
+	tokenGenerator = g
+}
+
+type randomTokens struct {
+	prefix string
+}
+
+// RandomTokens returns a generator of tokens made of the prefix followed by 128 random bits in hex
+func RandomTokens(prefix string) TokenGenerator {
+	return randomTokens{prefix: prefix}
+}
+
+func (g randomTokens) NewToken(route string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return g.prefix + hex.EncodeToString(b), nil
+}
+
+type signedTokens struct {
+	key []byte
+}
+
+// SignedTokens returns a generator of tokens that embed the route and the time they were issued at,
+// signed with HMAC-SHA256 and the given key. Tokens that are not signed with the key, or were issued
+// for another route, are rejected without looking them up.
+func SignedTokens(key []byte) TokenGenerator {
+	return signedTokens{key: key}
+}
+
+func (g signedTokens) sign(payload string) string {
+	mac := hmac.New(sha256.New, g.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (g signedTokens) NewToken(route string) (string, error) {
+	b := make([]byte, 24)
+	binary.BigEndian.PutUint64(b, uint64(time.Now().Unix()))
+	if _, err := rand.Read(b[8:]); err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString([]byte(route)) + "." + base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + g.sign(payload), nil
+}
+
+func (g signedTokens) VerifyToken(route string, token string) bool {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return false
+	}
+
+	payload := token[:i]
+	if !hmac.Equal([]byte(token[i+1:]), []byte(g.sign(payload))) {
+		return false
+	}
+
+	return strings.HasPrefix(payload, base64.RawURLEncoding.EncodeToString([]byte(route))+".")
+}
+
+// RotatedToken is a token that has been replaced by a successor but is still accepted until it expires,
+// so invoices issued to it can still be claimed.
+type RotatedToken struct {
+	Token          string
+	ExpirationTime time.Time
+}
+
+// newToken generates a token that no client of the route has, neither in memory nor in the store
+func (r *Route) newToken() (string, error) {
+	checker, canCheck := serverDatabase.(TokenChecker)
+	for attempt := 0; attempt < tOKENATTEMPTS; attempt++ {
+		token, err := tokenGenerator.NewToken(r.Name)
+		if err != nil {
+			return "", err
+		}
+
+		if _, tokenExists := r.getClient(token); tokenExists {
+			continue
+		}
+
+		if canCheck {
+			tokenExists, err := checker.TokenExists(token)
+			if err != nil {
+				return "", err
+			}
+
+			if tokenExists {
+				continue
+			}
+		}
+
+		return token, nil
+	}
+
+	return "", errors.New("Lightauth error: could not generate a token that isn't taken")
+}
+
+// lookupClient returns the client a token belongs to, forgetting rotated tokens that have expired
+func (r *Route) lookupClient(token string) (*Client, bool) {
+	if v, ok := tokenGenerator.(TokenVerifier); ok && !v.VerifyToken(r.Name, token) {
+		return nil, false
+	}
+
+	c, tokenExists := r.getClient(token)
+	if !tokenExists {
+		return nil, false
+	}
+
+	if !c.acceptsToken(token) {
+		r.deleteClient(token)
+		return nil, false
+	}
+
+	return c, true
+}
+
+func (c *Client) acceptsToken(token string) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if token == c.Token {
+		return true
+	}
+
+	for _, v := range c.PreviousTokens {
+		if v.Token == token {
+			return v.ExpirationTime.After(time.Now())
+		}
+	}
+
+	return false
+}
+
+// rotateToken issues a successor token once the current one has outlived the route's TTL. The response
+// carries the new token in the Light-Auth-Token header and clients adopt it transparently.
+func (c *Client) rotateToken() error {
+	ttl, err := lightauth.ParseDuration(c.Route.TokenTTL)
+	if err != nil || ttl == 0 {
+		return err
+	}
+
+	overlap, err := c.Route.tokenOverlap()
+	if err != nil {
+		return err
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	t := time.Now()
+	if c.IssuedAt.Add(ttl).After(t) {
+		return nil
+	}
+
+	previousTokens := []RotatedToken{{Token: c.Token, ExpirationTime: t.Add(overlap)}}
+	for _, v := range c.PreviousTokens {
+		if v.ExpirationTime.After(t) {
+			previousTokens = append(previousTokens, v)
+		} else {
+			c.Route.deleteClient(v.Token)
+		}
+	}
+
+	token, err := c.Route.newToken()
+	if err != nil {
+		return err
+	}
+
+	c.Token = token
+	c.IssuedAt = t
+	c.PreviousTokens = previousTokens
+	c.Route.setClient(c.Token, c)
+
+	return c.save()
+}
+
+// tokenOverlap is how long the token of a client is still accepted after its rotation, so requests
+// in flight with it don't fail. It is dEFAULTTOKENOVERLAP unless TokenOverlap is set, even to 0s.
+func (r *Route) tokenOverlap() (time.Duration, error) {
+	if r.TokenOverlap == "" {
+		return dEFAULTTOKENOVERLAP, nil
+	}
+
+	return lightauth.ParseDuration(r.TokenOverlap)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+// Validator decides whether a request to a route of the mode it was registered for has been paid for.
+// c is the client the request comes from, with its invoices, and w the response it is answered with,
+// to set headers on. It is only called for requests with a known token.
+type Validator interface {
+	Validate(w http.ResponseWriter, r *http.Request, c *Client) Verdict
+}
+
+// ValidatorFunc lets a function be used as a Validator
+type ValidatorFunc func(w http.ResponseWriter, r *http.Request, c *Client) Verdict
+
+// Validate calls f
+func (f ValidatorFunc) Validate(w http.ResponseWriter, r *http.Request, c *Client) Verdict {
+	return f(w, r, c)
+}
+
+// Verdict is the outcome of a Validator: the request is either authorized and passed to the handler,
+// or rejected with StatusCode and Message. Message is also what is audited for authorized requests.
+type Verdict struct {
+	Authorized bool
+	StatusCode int
+	Message    string
+}
+
+// modeValidator validates the requests to the routes of a mode
+type modeValidator func(w http.ResponseWriter, r *http.Request, c *Client) validation
+
+// validators are the validators of each mode of route
+var validators = struct {
+	mux    sync.RWMutex
+	byMode map[core.Mode]modeValidator
+}{byMode: map[core.Mode]modeValidator{
+	core.ModeTime: func(w http.ResponseWriter, r *http.Request, c *Client) validation {
+		return checkQuota(w, c, timeTypeValidator(c, r))
+	},
+	core.ModeDiscrete: func(w http.ResponseWriter, r *http.Request, c *Client) validation {
+		return discreteTypeValidator(c, r)
+	},
+}}
+
+// RegisterValidator adds a mode of route, like bytes or account, whose requests are validated by v. It
+// must be called before the server is set up, so the routes of lightauth.toml can use the mode. It
+// returns an error for an empty mode and for the time and discrete modes, which can't be replaced.
+func RegisterValidator(mode core.Mode, v Validator) error {
+	if mode == "" || mode == core.ModeTime || mode == core.ModeDiscrete {
+		return fmt.Errorf("Lightauth error: the validator of mode %q can't be registered", mode)
+	}
+
+	validators.mux.Lock()
+	defer validators.mux.Unlock()
+
+	validators.byMode[mode] = func(w http.ResponseWriter, r *http.Request, c *Client) validation {
+		verdict := v.Validate(w, r, c)
+		if !verdict.Authorized && verdict.StatusCode == 0 {
+			return reject(http.StatusInternalServerError, sOMETHINGWENTWRONG)
+		}
+
+		return validation{authorized: verdict.Authorized, statusCode: verdict.StatusCode, message: verdict.Message}
+	}
+	return nil
+}
+
+// lookupValidator returns the validator of a mode of route, if it is known
+func lookupValidator(mode core.Mode) (modeValidator, bool) {
+	validators.mux.RLock()
+	defer validators.mux.RUnlock()
+
+	validator, known := validators.byMode[mode]
+	return validator, known
+}
+
+// validate checks a request of a client with the validator of the mode of its route
+func validate(w http.ResponseWriter, r *http.Request, c *Client) validation {
+	validator, known := lookupValidator(c.Route.Mode)
+	if !known {
+		return reject(http.StatusInternalServerError, sOMETHINGWENTWRONG)
+	}
+
+	return validator(w, r, c)
+}
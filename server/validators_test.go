@@ -0,0 +1,25 @@
+package server_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/faurehu/lightauth/core"
+	"github.com/faurehu/lightauth/server"
+)
+
+func TestRegisterValidator(t *testing.T) {
+	v := server.ValidatorFunc(func(w http.ResponseWriter, r *http.Request, c *server.Client) server.Verdict {
+		return server.Verdict{Authorized: true}
+	})
+
+	for _, mode := range []core.Mode{"", core.ModeTime, core.ModeDiscrete} {
+		if err := server.RegisterValidator(mode, v); err == nil {
+			t.Errorf("the validator of mode %q was replaced", mode)
+		}
+	}
+
+	if err := server.RegisterValidator("bytes", v); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/faurehu/lightauth"
+)
+
+const (
+	// dEFAULTWATCHDOGWINDOW is the period the watchdog counts invoices and settlements over
+	dEFAULTWATCHDOGWINDOW = time.Minute
+	// dEFAULTMININVOICES is the number of invoices issued in a window below which they aren't compared
+	// with the settlements, as a few unpaid invoices are the norm
+	dEFAULTMININVOICES = 100
+	// aLERTSBUFFER is the number of alerts kept for the application before new ones are dropped
+	aLERTSBUFFER = 64
+)
+
+// The kinds of alerts raised by the watchdog
+const (
+	AlertInvoiceFlood        = "invoice_flood"
+	AlertUnmatchedSettlement = "unmatched_settlement"
+)
+
+// WatchdogConfig sets the thresholds the server watches its invoices and settlements against, over
+// each Window. An alert is raised when more than MaxUnsettledRatio invoices are issued for each one
+// settled, once at least MinInvoices were issued, which can be a client making the server issue
+// invoices it never pays. Another one is raised when UnmatchedSettlements payments the node received
+// match no invoice of lightauth, which can be payments routed to the wrong node or invoices lost by
+// the store; nodes shared with other applications should leave it at 0. The checks left at 0 are off.
+type WatchdogConfig struct {
+	Window               string
+	MaxUnsettledRatio    float64
+	MinInvoices          int
+	UnmatchedSettlements int
+}
+
+// Alert is an anomaly noticed by the watchdog over the window ending at Time
+type Alert struct {
+	Kind        string        `json:"kind"`
+	Message     string        `json:"message"`
+	Window      time.Duration `json:"window"`
+	Invoices    int           `json:"invoices"`
+	Settlements int           `json:"settlements"`
+	Unmatched   int           `json:"unmatched"`
+	Time        time.Time     `json:"time"`
+}
+
+var alerts = make(chan Alert, aLERTSBUFFER)
+
+// Alerts returns the channel where the server reports the anomalies noticed by its watchdog. Alerts
+// are dropped when nobody reads them and the channel is full.
+func Alerts() <-chan Alert {
+	return alerts
+}
+
+// watchdog counts what happened in the current window
+var watchdog struct {
+	mux         sync.Mutex
+	config      WatchdogConfig
+	window      time.Duration
+	invoices    int
+	settlements int
+	unmatched   int
+}
+
+func noteInvoice() {
+	watchdog.mux.Lock()
+	watchdog.invoices++
+	watchdog.mux.Unlock()
+}
+
+func noteSettlement() {
+	watchdog.mux.Lock()
+	watchdog.settlements++
+	watchdog.mux.Unlock()
+}
+
+func noteUnmatched() {
+	watchdog.mux.Lock()
+	watchdog.unmatched++
+	watchdog.mux.Unlock()
+}
+
+// startWatchdog checks the counts of the server at the end of every window, when any check is on
+func startWatchdog(conf WatchdogConfig) {
+	if conf.MaxUnsettledRatio <= 0 && conf.UnmatchedSettlements <= 0 {
+		return
+	}
+
+	window, _ := lightauth.ParseDuration(conf.Window)
+	if window <= 0 {
+		window = dEFAULTWATCHDOGWINDOW
+	}
+
+	if conf.MinInvoices <= 0 {
+		conf.MinInvoices = dEFAULTMININVOICES
+	}
+
+	watchdog.mux.Lock()
+	watchdog.config = conf
+	watchdog.window = window
+	watchdog.mux.Unlock()
+
+	go func() {
+		defer lightauth.RecoverBackground("watchdog")
+
+		for range time.Tick(window) {
+			checkWatchdog()
+		}
+	}()
+}
+
+// checkWatchdog raises the alerts for the window that just ended and starts a new one
+func checkWatchdog() {
+	watchdog.mux.Lock()
+	conf, window := watchdog.config, watchdog.window
+	invoices, settlements, unmatched := watchdog.invoices, watchdog.settlements, watchdog.unmatched
+	watchdog.invoices, watchdog.settlements, watchdog.unmatched = 0, 0, 0
+	watchdog.mux.Unlock()
+
+	alert := Alert{
+		Window:      window,
+		Invoices:    invoices,
+		Settlements: settlements,
+		Unmatched:   unmatched,
+		Time:        time.Now(),
+	}
+
+	if conf.MaxUnsettledRatio > 0 && invoices >= conf.MinInvoices {
+		if settlements == 0 || float64(invoices)/float64(settlements) > conf.MaxUnsettledRatio {
+			alert.Kind = AlertInvoiceFlood
+			alert.Message = fmt.Sprintf("Lightauth alert: %d invoices were issued in the last %v but only %d were settled", invoices, window, settlements)
+			raiseAlert(alert)
+		}
+	}
+
+	if conf.UnmatchedSettlements > 0 && unmatched >= conf.UnmatchedSettlements {
+		alert.Kind = AlertUnmatchedSettlement
+		alert.Message = fmt.Sprintf("Lightauth alert: %d payments received in the last %v matched no invoice", unmatched, window)
+		raiseAlert(alert)
+	}
+}
+
+func raiseAlert(alert Alert) {
+	log.Printf("%v\n", alert.Message)
+	select {
+	case alerts <- alert:
+	default:
+	}
+}
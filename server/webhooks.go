@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/faurehu/lightauth"
+)
+
+// PhoenixdWebhookHandler receives the webhook calls of phoenixd when the server or one of its tenants
+// runs on a phoenixd backend. A call goes to the backend whose webhook secret it is signed with, e.g.
+// http.HandleFunc("/lightauth/phoenixd", server.PhoenixdWebhookHandler).
+func PhoenixdWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	for _, backend := range backends() {
+		if lightauth.ServePhoenixdWebhook(backend, w, r) {
+			return
+		}
+	}
+
+	http.Error(w, "invalid signature", http.StatusUnauthorized)
+}
+
+// LNbitsWebhookHandler receives the webhook calls of LNbits when the server or one of its tenants runs
+// on an LNbits backend. It must be mounted at the LNbitsWebhook URL of lightauth.toml, e.g.
+// http.HandleFunc("/lightauth/lnbits", server.LNbitsWebhookHandler). A call goes to the backend whose
+// wallet has the payment.
+func LNbitsWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	for _, backend := range backends() {
+		if lightauth.ServeLNbitsWebhook(backend, w, r) {
+			return
+		}
+	}
+
+	http.Error(w, "payment not found", http.StatusBadGateway)
+}
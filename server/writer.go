@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/faurehu/lightauth/core"
+)
+
+// deferredWriter wraps the responses of paid routes and tells whether they have started to be written.
+// When DeferHeaders is set in lightauth.toml, it also holds back the client headers until the status
+// code is known, so that invoices are only generated and sent when the outcome calls for them. It
+// implements http.Flusher, http.Hijacker, http.Pusher and io.ReaderFrom by forwarding to the wrapped
+// writer, so streaming handlers (server-sent events, websocket upgrades) keep working behind the
+// middleware.
+type deferredWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	client      *Client
+	fingerprint string
+	meter       *costMeter
+	record      *recordedResponse
+	committed   bool
+	legacy      bool
+}
+
+// commit writes the client headers appropriate to the status code. The token is always sent, the
+// unpaid invoices only when the request succeeded or the client is expected to pay, and the
+// expiration time only when it succeeded or ran out of time.
+func (d *deferredWriter) commit(statusCode int) {
+	if d.committed {
+		return
+	}
+	d.committed = true
+
+	if d.meter != nil {
+		d.invoiceCost(d.ctx)
+	}
+
+	success := core.ReadResult(d.Header()) == core.ResultOK
+	if d.legacy && success {
+		// Whatever the handler answers, the request went through
+		d.Header().Set(core.HeaderStatus, strconv.Itoa(http.StatusOK))
+	}
+
+	c := d.client
+	if c == nil {
+		return
+	}
+
+	d.Header().Set(core.HeaderToken, c.Token)
+	setCreditHeader(d.Header(), c)
+	setFeeHeader(d.Header(), c)
+	setExpiryHeaders(d.Header(), c)
+
+	if success || statusCode == http.StatusBadRequest || statusCode == http.StatusPaymentRequired || statusCode == http.StatusConflict {
+		unpayedInvoices, err := c.getUnpayedInvoices(d.ctx, d.fingerprint)
+		if err != nil {
+			log.Printf("Lightauth error: could not generate invoices: %v\n", err)
+			return
+		}
+
+		if err := setInvoicesHeaders(d.ctx, d.Header(), c.Route, unpayedInvoices); err != nil {
+			return
+		}
+
+		if d.fingerprint != "" {
+			d.Header().Set(core.HeaderFingerprint, d.fingerprint)
+		}
+	}
+
+	if c.Route.Mode == core.ModeTime && (success || statusCode == http.StatusPaymentRequired) {
+		// RFC3339
+		d.Header().Set(core.HeaderExpirationTime, c.ExpirationTime.Format("2006-01-02T15:04:05Z07:00"))
+	}
+}
+
+func (d *deferredWriter) WriteHeader(statusCode int) {
+	d.commit(statusCode)
+	if d.record != nil {
+		d.record.writeHeader(statusCode)
+	}
+	d.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (d *deferredWriter) Write(b []byte) (int, error) {
+	d.commit(http.StatusOK)
+	if d.record != nil {
+		d.record.write(b)
+	}
+	return d.ResponseWriter.Write(b)
+}
+
+// Flush sends the headers and any buffered data to the client, if the wrapped writer supports it
+func (d *deferredWriter) Flush() {
+	d.commit(http.StatusOK)
+	if f, ok := d.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the handler take over the connection, if the wrapped writer supports it
+func (d *deferredWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := d.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Lightauth error: the response writer does not support hijacking")
+	}
+
+	d.committed = true
+	if d.record != nil {
+		// What goes through the connection can't be replayed
+		d.record.overflow = true
+	}
+	return h.Hijack()
+}
+
+// Push initiates an HTTP/2 server push, if the wrapped writer supports it
+func (d *deferredWriter) Push(target string, opts *http.PushOptions) error {
+	p, ok := d.ResponseWriter.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+
+	return p.Push(target, opts)
+}
+
+// ReadFrom lets the wrapped writer use its own copy (sendfile on plain connections) when it has one
+func (d *deferredWriter) ReadFrom(src io.Reader) (int64, error) {
+	d.commit(http.StatusOK)
+	if d.record != nil {
+		// The body has to go through Write to be recorded
+		return io.Copy(struct{ io.Writer }{d}, src)
+	}
+
+	if rf, ok := d.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+
+	return io.Copy(struct{ io.Writer }{d.ResponseWriter}, src)
+}
+
+// Unwrap returns the wrapped writer, as expected by http.ResponseController
+func (d *deferredWriter) Unwrap() http.ResponseWriter {
+	return d.ResponseWriter
+}
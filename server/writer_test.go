@@ -0,0 +1,162 @@
+package server_test
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/faurehu/lightauth/client"
+	"github.com/faurehu/lightauth/core"
+	"github.com/faurehu/lightauth/server"
+)
+
+// paidServer serves handler behind the middleware on the time route of the conformance config
+func paidServer(handler func(http.ResponseWriter, *http.Request)) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/conformance/time", server.Middleware(handler))
+	return httptest.NewServer(mux)
+}
+
+// paidRequest returns a request to the time route of server, paid for by the client
+func paidRequest(t *testing.T, server *httptest.Server) *http.Request {
+	t.Helper()
+
+	request, err := http.NewRequest(http.MethodGet, server.URL+"/conformance/time", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err = client.ClearRequest(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return request
+}
+
+func TestServerSentEventsThroughMiddleware(t *testing.T) {
+	flushed := make(chan struct{})
+	server := paidServer(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			t.Error("the middleware's writer is not an http.Flusher")
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: first\n\n"))
+		flusher.Flush()
+
+		// The second event is only written once the client has read the first one
+		select {
+		case <-flushed:
+		case <-time.After(5 * time.Second):
+			t.Error("the first event was not flushed to the client")
+		}
+		w.Write([]byte("data: second\n\n"))
+	})
+	defer server.Close()
+
+	response, err := http.DefaultClient.Do(paidRequest(t, server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if core.ReadResult(response.Header) != core.ResultOK {
+		t.Fatalf("expected the stream to be authorized, got %v %q", response.StatusCode, response.Header.Get(core.Header))
+	}
+
+	if response.Header.Get(core.HeaderToken) == "" {
+		t.Error("the client headers were not sent with the stream")
+	}
+
+	events := bufio.NewReader(response.Body)
+	for _, expected := range []string{"data: first", "data: second"} {
+		event, err := events.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.TrimSpace(event) != expected {
+			t.Fatalf("expected %q, got %q", expected, event)
+		}
+		events.ReadString('\n')
+
+		if expected == "data: first" {
+			close(flushed)
+		}
+	}
+}
+
+func TestWebsocketUpgradeThroughMiddleware(t *testing.T) {
+	server := paidServer(func(w http.ResponseWriter, r *http.Request) {
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			t.Error("the middleware's writer is not an http.Hijacker")
+			return
+		}
+
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+
+		// Echo a message back, as a websocket handler would
+		message, err := rw.ReadString('\n')
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		rw.WriteString(message)
+		rw.Flush()
+	})
+	defer server.Close()
+
+	request := paidRequest(t, server)
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err := request.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the connection to be upgraded, got %v", response.StatusCode)
+	}
+
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	echo, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if echo != "ping\n" {
+		t.Fatalf("expected the message to be echoed, got %q", echo)
+	}
+}
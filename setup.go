@@ -1,204 +1,198 @@
 package lightauth
 
 import (
-	"context"
-	"github.com/lightningnetwork/lnd/macaroons"
-	"gopkg.in/macaroon.v2"
-	"io"
+	"fmt"
 	"io/ioutil"
-	"log"
-	"os"
 
 	"github.com/BurntSushi/toml"
-	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/macaroons"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"gopkg.in/macaroon.v2"
 )
 
-var (
-	clientStore           map[string]*Path
-	serverStore           map[string]*Route
-	conn                  *grpc.ClientConn
-	lightningClient       lnrpc.LightningClient
-	lightningClientStream lnrpc.Lightning_SendPaymentClient
-	lightningServerStream lnrpc.Lightning_SubscribeInvoicesClient
-	database              DataProvider
-)
-
-// Record is an interface that superclasses all entities stored in a permanent store
-type Record interface {
-	save() error
+var configPath = "lightauth.toml"
+
+// NodeConfig details how to connect to an lnd node. LNDConnect is an lndconnect:// URI that replaces
+// the other fields when set.
+type NodeConfig struct {
+	ServerAddr            string
+	CAFile                string
+	ServerHostOverride    string
+	MacaroonPath          string
+	LNDConnect            string
+	NWC                   string
+	LNDHub                string
+	CLNSocket             string
+	Phoenixd              string
+	PhoenixdWebhookSecret string
+	LNbits                string
+	LNbitsWebhook         string
 }
 
-// DataProvider is an interface that specifies the methods required to store data
-type DataProvider interface {
-	Create(Record) (string, error)
-	Edit(Record)
-	GetServerData() (map[string]*Route, error)
-	GetClientData() (map[string]*Path, error)
+// Config holds the settings the client and the server have in common. The node used by both is at its
+// top level, the Client and Server sections, when present, give each its own node instead. Each side
+// reads its own settings from lightauth.toml on top of these.
+type Config struct {
+	ServerAddr            string
+	CAFile                string
+	ServerHostOverride    string
+	MacaroonPath          string
+	LNDConnect            string
+	NWC                   string
+	LNDHub                string
+	CLNSocket             string
+	Phoenixd              string
+	PhoenixdWebhookSecret string
+	LNbits                string
+	LNbitsWebhook         string
+	Client                *NodeConfig
+	Server                *NodeConfig
+	Proxy                 string
+	Network               string
+	EncryptionKeyFile     string
+	Persistence           PersistenceConfig
+	Strict                bool
 }
 
-// RouteInfo is the bare fields that details a route
-type RouteInfo struct {
-	Name        string
-	Fee         int
-	MaxInvoices int
-	Mode        string
-	Period      string
+// SetConfigPath changes the file the configuration is read from, lightauth.toml by default
+func SetConfigPath(path string) {
+	configPath = path
 }
 
-type tomlConfig struct {
-	ServerAddr         string
-	CAFile             string
-	ServerHostOverride string
-	MacaroonPath       string
-	Routes             map[string]*RouteInfo
+// DecodeConfig reads lightauth.toml into conf, the configuration of a side embedding Config
+func DecodeConfig(conf interface{}) error {
+	if _, err := toml.DecodeFile(configPath, conf); err != nil {
+		return fmt.Errorf("Lightauth error: Could not parse %v: %v", configPath, err)
+	}
+
+	return nil
 }
 
-func startRPCClient() (tomlConfig, error) {
-	var conf tomlConfig
-	if _, err := toml.DecodeFile("lightauth.toml", &conf); err != nil {
-		log.Fatalf("Lightauth error: Could not parse lightauth.toml: %v\n", err)
+// Node returns the connection details of the node for the given role section, if any
+func (conf Config) Node(role *NodeConfig) NodeConfig {
+	if role != nil {
+		return *role
+	}
+
+	return NodeConfig{
+		ServerAddr:            conf.ServerAddr,
+		CAFile:                conf.CAFile,
+		ServerHostOverride:    conf.ServerHostOverride,
+		MacaroonPath:          conf.MacaroonPath,
+		LNDConnect:            conf.LNDConnect,
+		NWC:                   conf.NWC,
+		LNDHub:                conf.LNDHub,
+		CLNSocket:             conf.CLNSocket,
+		Phoenixd:              conf.Phoenixd,
+		PhoenixdWebhookSecret: conf.PhoenixdWebhookSecret,
+		LNbits:                conf.LNbits,
+		LNbitsWebhook:         conf.LNbitsWebhook,
 	}
+}
 
+func startRPCClient(node NodeConfig, proxyURL string) (*grpc.ClientConn, error) {
 	var opts []grpc.DialOption
+	var creds credentials.TransportCredentials
+	var b []byte
+	var err error
+
+	if node.LNDConnect != "" {
+		lndConn, err := parseLNDConnect(node.LNDConnect)
+		if err != nil {
+			return nil, err
+		}
 
-	creds, err := credentials.NewClientTLSFromFile(conf.CAFile, conf.ServerHostOverride)
-	if err != nil {
-		log.Fatalf("Lightauth error: Failed to create TLS credentials: %v\n", err)
+		node.ServerAddr = lndConn.address
+		creds = lndConn.creds
+		b = lndConn.macaroon
+	} else {
+		creds, err = credentials.NewClientTLSFromFile(node.CAFile, node.ServerHostOverride)
+		if err != nil {
+			return nil, fmt.Errorf("Lightauth error: Failed to create TLS credentials: %v", err)
+		}
+
+		b, err = ioutil.ReadFile(node.MacaroonPath)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	opts = append(opts, grpc.WithTransportCredentials(creds))
 
-	b, err := ioutil.ReadFile(conf.MacaroonPath)
-	if err != nil {
-		return conf, err
-	}
-
 	mac := &macaroon.Macaroon{}
 	if err = mac.UnmarshalBinary(b); err != nil {
-		return conf, err
+		return nil, err
 	}
 
 	cred := macaroons.NewMacaroonCredential(mac)
 	opts = append(opts, grpc.WithPerRPCCredentials(cred))
 
-	conn, err = grpc.Dial(conf.ServerAddr, opts...)
-	if err != nil {
-		log.Fatalf("Lightauth error: Failed to start grpc connection: %v\n", err)
-	}
-
-	lightningClient = lnrpc.NewLightningClient(conn)
+	if proxyURL != "" {
+		u, err := parseProxy(proxyURL)
+		if err != nil {
+			return nil, err
+		}
 
-	return conf, nil
-}
+		dialOption, err := proxyDialOption(u)
+		if err != nil {
+			return nil, err
+		}
 
-// StartClientConnection is used to initiate the connection with the LDN node on a client's behalf.
-func StartClientConnection(db DataProvider) *grpc.ClientConn {
-	database = db
-	_, err := startRPCClient()
-	if err != nil {
-		log.Fatalf("Lightauth error: Failed to start client: %v\n", err)
+		opts = append(opts, dialOption)
 	}
 
-	clientStore, err = db.GetClientData()
+	conn, err := grpc.Dial(node.ServerAddr, opts...)
 	if err != nil {
-		log.Fatalf("Lightauth error: could not fetch data from store: %v\n", err)
+		return nil, fmt.Errorf("Lightauth error: Failed to start grpc connection: %v", err)
 	}
 
-	ctxb := context.Background()
-	lightningClientStream, err = lightningClient.SendPayment(ctxb)
-	if err != nil {
-		log.Fatalf("Lightauth error: Failed to start lightning client stream: %v\n", err)
-	}
+	return conn, nil
+}
 
-	go func() {
-		for {
-			paymentResponse, err := lightningClientStream.Recv()
-			if err == io.EOF {
-				return
-			}
+// StartBackend connects to the node of a side, which can be lnd, Core Lightning, phoenixd or LNbits.
+// The gRPC connection is only returned for lnd.
+func StartBackend(node NodeConfig, conf Config) (LightningBackend, *grpc.ClientConn, error) {
+	if node.CLNSocket != "" {
+		return NewCLNBackend(node.CLNSocket), nil, nil
+	}
 
-			if err != nil {
-				log.Fatalf("Lightauth error: There was an error receiving data from the lightning client stream: %v\n", err)
-			}
+	if node.Phoenixd != "" {
+		endpoint, password, err := parsePhoenixd(node.Phoenixd)
+		if err != nil {
+			return nil, nil, err
+		}
 
-			if paymentResponse != nil {
-				if paymentResponse.PaymentError != "" {
-					log.Printf("Lightauth error: Lightning payment contains an error: %v\n", paymentResponse.PaymentError)
-				} else {
-					confirmInvoiceSettled(paymentResponse.PaymentPreimage)
-				}
+		backend := NewPhoenixdBackend(endpoint, password, node.PhoenixdWebhookSecret).(*phoenixdBackend)
+		if conf.Proxy != "" {
+			if backend.httpClient, err = ProxyHTTPClient(conf.Proxy); err != nil {
+				return nil, nil, err
 			}
 		}
-	}()
-
-	return conn
-}
 
-// StartServerConnection is used to initiate the connection with the LDN node on a server's behalf.
-// It requires lightauth.toml to be populated with the connection params and
-// the routes.
-func StartServerConnection(db DataProvider) *grpc.ClientConn {
-	database = db
-	conf, err := startRPCClient()
-	if err != nil {
-		log.Fatalf("Lightauth error: Failed to start client: %v\n", err)
+		return backend, nil, nil
 	}
 
-	serverStore, err = db.GetServerData()
-	if err != nil {
-		log.Fatalf("Lightauth error: could not fetch data from store: %v\n", err)
-	}
-
-	for _, v := range conf.Routes {
-		if _, exists := serverStore[v.Name]; !exists {
-			// TODO: Delete from store those routes not in toml
-			r := &Route{
-				Clients: make(map[string]*Client),
-				RouteInfo: RouteInfo{
-					Name:        v.Name,
-					Fee:         v.Fee,
-					MaxInvoices: v.MaxInvoices,
-					Mode:        v.Mode,
-					Period:      v.Period,
-				},
-			}
+	if node.LNbits != "" {
+		endpoint, key, err := parseLNbits(node.LNbits)
+		if err != nil {
+			return nil, nil, err
+		}
 
-			err := r.save()
-			if err != nil {
-				os.Exit(1)
+		backend := NewLNbitsBackend(endpoint, key, node.LNbitsWebhook).(*lnbitsBackend)
+		if conf.Proxy != "" {
+			if backend.httpClient, err = ProxyHTTPClient(conf.Proxy); err != nil {
+				return nil, nil, err
 			}
-
-			serverStore[v.Name] = r
 		}
+
+		return backend, nil, nil
 	}
 
-	ctxb := context.Background()
-	lightningServerStream, err = lightningClient.SubscribeInvoices(ctxb, &lnrpc.InvoiceSubscription{})
+	conn, err := startRPCClient(node, conf.Proxy)
 	if err != nil {
-		log.Fatalf("Lightauth error: Failed to start lightning client stream: %v\n%v\n", conf, err)
+		return nil, nil, err
 	}
 
-	go func() {
-		for {
-			invoiceUpdate, err := lightningServerStream.Recv()
-			if err == io.EOF {
-				return
-			}
-
-			if err != nil {
-				log.Printf("Lightauth error: There was an error receiving data from the lightning client stream: %v\n", err)
-			}
-
-			if invoiceUpdate != nil && invoiceUpdate.Settled {
-				err := updateInvoice(invoiceUpdate.PaymentRequest)
-				if err != nil {
-					// TODO: Serious error: we have been notified of a payment but we can't save it in database. EXCEPTIONAL
-				}
-			}
-		}
-	}()
-
-	return conn
+	return NewLndBackend(conn), conn, nil
 }
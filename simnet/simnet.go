@@ -0,0 +1,336 @@
+// Package simnet is a fake, in-process Lightning network for testing lightauth. A Network is a
+// LightningBackend on which payments settle instantly, so a client and a server sharing it can run the
+// whole protocol without any Lightning infrastructure.
+package simnet
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faurehu/lightauth"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+)
+
+// NodeKey is the identity of the node every Network pretends to be
+const NodeKey = "02simnet"
+
+const defaultExpiry = 3600
+
+// ErrDisconnected is returned by every call of a Network while the Disconnected fault is set
+var ErrDisconnected = errors.New("simnet: node is unreachable")
+
+// Faults are misbehaviours a Network can inject, so integrators can check how their applications cope
+// with payment edge cases.
+type Faults struct {
+	// SettlementDelay delays the notification of settled invoices to subscribers
+	SettlementDelay time.Duration
+	// DropSettlements is the probability, between 0 and 1, of a settlement never being notified
+	DropSettlements float64
+	// DuplicateSettlements is the probability of a settlement being notified twice
+	DuplicateSettlements float64
+	// Disconnected makes every call fail as if the node was unreachable, and ends the subscriptions
+	Disconnected bool
+}
+
+type invoice struct {
+	lnrpc.Invoice
+}
+
+// Network is a fake Lightning node that pays its own invoices
+type Network struct {
+	mux         sync.Mutex
+	invoices    map[string]*invoice
+	subscribers []*invoiceStream
+	balance     int64
+	addIndex    uint64
+	settleIndex uint64
+	faults      Faults
+}
+
+// New returns a network whose payments can spend up to balance satoshis
+func New(balance int64) *Network {
+	return &Network{
+		invoices: make(map[string]*invoice),
+		balance:  balance,
+	}
+}
+
+// Balance returns the satoshis that are left to spend
+func (n *Network) Balance() int64 {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	return n.balance
+}
+
+// SetFaults changes the faults the network injects from now on
+func (n *Network) SetFaults(faults Faults) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	n.faults = faults
+	if faults.Disconnected {
+		for _, s := range n.subscribers {
+			close(s.disconnected)
+		}
+		n.subscribers = nil
+	}
+}
+
+func (n *Network) reachable() error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	if n.faults.Disconnected {
+		return ErrDisconnected
+	}
+
+	return nil
+}
+
+// GetInfo implements lightauth.LightningBackend
+func (n *Network) GetInfo(ctx context.Context) (*lnrpc.GetInfoResponse, error) {
+	if err := n.reachable(); err != nil {
+		return nil, err
+	}
+
+	return &lnrpc.GetInfoResponse{
+		IdentityPubkey: NodeKey,
+		Alias:          "simnet",
+		SyncedToChain:  true,
+		SyncedToGraph:  true,
+		Chains:         []*lnrpc.Chain{{Chain: "bitcoin", Network: "simnet"}},
+	}, nil
+}
+
+// AddInvoice implements lightauth.LightningBackend
+func (n *Network) AddInvoice(ctx context.Context, in *lnrpc.Invoice) (*lnrpc.AddInvoiceResponse, error) {
+	preImage := make([]byte, 32)
+	if _, err := rand.Read(preImage); err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(preImage)
+
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	if n.faults.Disconnected {
+		return nil, ErrDisconnected
+	}
+
+	n.addIndex++
+	i := &invoice{Invoice: *in}
+	i.RPreimage = preImage
+	i.RHash = hash[:]
+	i.PaymentRequest = fmt.Sprintf("lnsb%dn1%x", in.Value, hash)
+	i.CreationDate = time.Now().Unix()
+	i.AddIndex = n.addIndex
+	i.State = lnrpc.Invoice_OPEN
+	if i.Expiry == 0 {
+		i.Expiry = defaultExpiry
+	}
+	n.invoices[i.PaymentRequest] = i
+
+	return &lnrpc.AddInvoiceResponse{RHash: i.RHash, PaymentRequest: i.PaymentRequest, AddIndex: i.AddIndex}, nil
+}
+
+type invoiceStream struct {
+	ctx          context.Context
+	updates      chan *lnrpc.Invoice
+	disconnected chan struct{}
+}
+
+func (s *invoiceStream) Recv() (*lnrpc.Invoice, error) {
+	select {
+	case update := <-s.updates:
+		return update, nil
+	case <-s.disconnected:
+		return nil, ErrDisconnected
+	case <-s.ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+func (s *invoiceStream) send(update *lnrpc.Invoice) {
+	select {
+	case s.updates <- update:
+	case <-s.disconnected:
+	case <-s.ctx.Done():
+	}
+}
+
+// SubscribeInvoices implements lightauth.LightningBackend
+func (n *Network) SubscribeInvoices(ctx context.Context) (lightauth.InvoiceStream, error) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	if n.faults.Disconnected {
+		return nil, ErrDisconnected
+	}
+
+	stream := &invoiceStream{ctx: ctx, updates: make(chan *lnrpc.Invoice), disconnected: make(chan struct{})}
+	n.subscribers = append(n.subscribers, stream)
+
+	return stream, nil
+}
+
+// DecodePayReq implements lightauth.LightningBackend
+func (n *Network) DecodePayReq(ctx context.Context, payReq string) (*lnrpc.PayReq, error) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	if n.faults.Disconnected {
+		return nil, ErrDisconnected
+	}
+
+	i, invoiceExists := n.invoices[strings.ToLower(payReq)]
+	if !invoiceExists {
+		return nil, errors.New("simnet: unknown payment request")
+	}
+
+	return &lnrpc.PayReq{
+		Destination:     NodeKey,
+		PaymentHash:     hex.EncodeToString(i.RHash),
+		NumSatoshis:     i.Value,
+		Timestamp:       i.CreationDate,
+		Expiry:          i.Expiry,
+		Description:     i.Memo,
+		DescriptionHash: hex.EncodeToString(i.DescriptionHash),
+		RouteHints:      i.RouteHints,
+	}, nil
+}
+
+// SendPayment implements lightauth.LightningBackend. Unless a settlement delay is set, the invoice is
+// settled and its subscribers notified before it returns.
+func (n *Network) SendPayment(ctx context.Context, request *routerrpc.SendPaymentRequest) (*lnrpc.Payment, error) {
+	n.mux.Lock()
+
+	if n.faults.Disconnected {
+		n.mux.Unlock()
+		return nil, ErrDisconnected
+	}
+
+	i, invoiceExists := n.invoices[strings.ToLower(request.PaymentRequest)]
+	payment := &lnrpc.Payment{PaymentRequest: request.PaymentRequest, Status: lnrpc.Payment_FAILED}
+	switch {
+	case !invoiceExists || time.Unix(i.CreationDate+i.Expiry, 0).Before(time.Now()):
+		payment.FailureReason = lnrpc.PaymentFailureReason_FAILURE_REASON_INCORRECT_PAYMENT_DETAILS
+	case i.State == lnrpc.Invoice_SETTLED:
+		payment.FailureReason = lnrpc.PaymentFailureReason_FAILURE_REASON_ERROR
+	case n.balance < i.Value:
+		payment.FailureReason = lnrpc.PaymentFailureReason_FAILURE_REASON_INSUFFICIENT_BALANCE
+	}
+
+	if payment.FailureReason != lnrpc.PaymentFailureReason_FAILURE_REASON_NONE {
+		n.mux.Unlock()
+		return payment, nil
+	}
+
+	n.balance -= i.Value
+	n.settleIndex++
+	i.Settled = true
+	i.State = lnrpc.Invoice_SETTLED
+	i.SettleDate = time.Now().Unix()
+	i.SettleIndex = n.settleIndex
+	i.AmtPaid = i.Value * 1000
+	i.AmtPaidSat = i.Value
+	i.AmtPaidMsat = i.Value * 1000
+
+	update := i.Invoice
+	subscribers := n.subscribers
+	faults := n.faults
+	n.mux.Unlock()
+
+	notify := func() {
+		time.Sleep(faults.SettlementDelay)
+		for _, s := range subscribers {
+			if mathrand.Float64() < faults.DropSettlements {
+				continue
+			}
+
+			s.send(&update)
+			if mathrand.Float64() < faults.DuplicateSettlements {
+				duplicate := update
+				s.send(&duplicate)
+			}
+		}
+	}
+
+	if faults.SettlementDelay > 0 {
+		go notify()
+	} else {
+		notify()
+	}
+
+	payment.Status = lnrpc.Payment_SUCCEEDED
+	payment.PaymentHash = hex.EncodeToString(i.RHash)
+	payment.PaymentPreimage = hex.EncodeToString(i.RPreimage)
+	payment.ValueSat = i.Value
+	payment.ValueMsat = i.Value * 1000
+	payment.Value = i.Value
+
+	return payment, nil
+}
+
+// ChannelBalance implements lightauth.LightningBackend
+func (n *Network) ChannelBalance(ctx context.Context) (int64, error) {
+	if err := n.reachable(); err != nil {
+		return 0, err
+	}
+
+	return n.Balance(), nil
+}
+
+// QueryRoutes implements lightauth.LightningBackend. Every destination is a direct, free hop away.
+func (n *Network) QueryRoutes(ctx context.Context, request *lnrpc.QueryRoutesRequest) (*lnrpc.QueryRoutesResponse, error) {
+	if err := n.reachable(); err != nil {
+		return nil, err
+	}
+
+	route := &lnrpc.Route{
+		TotalAmt: request.Amt,
+		Hops:     []*lnrpc.Hop{{AmtToForward: request.Amt, PubKey: request.PubKey}},
+	}
+
+	return &lnrpc.QueryRoutesResponse{Routes: []*lnrpc.Route{route}, SuccessProb: 1}, nil
+}
+
+// SignMessage implements lightauth.LightningBackend
+func (n *Network) SignMessage(ctx context.Context, message []byte) (string, error) {
+	if err := n.reachable(); err != nil {
+		return "", err
+	}
+
+	return sign(NodeKey, message), nil
+}
+
+// VerifyMessage implements lightauth.LightningBackend
+func (n *Network) VerifyMessage(ctx context.Context, message []byte, signature string) (string, error) {
+	if err := n.reachable(); err != nil {
+		return "", err
+	}
+
+	parts := strings.SplitN(signature, ":", 2)
+	if len(parts) != 2 || sign(parts[0], message) != signature {
+		return "", errors.New("simnet: invalid signature")
+	}
+
+	return parts[0], nil
+}
+
+// sign is not a real signature: anyone can produce it for any key. It only lets identities flow through
+// the protocol in tests.
+func sign(key string, message []byte) string {
+	digest := sha256.Sum256(append([]byte(key), message...))
+	return key + ":" + hex.EncodeToString(digest[:])
+}
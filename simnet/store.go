@@ -0,0 +1,51 @@
+package simnet
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/faurehu/lightauth"
+	"github.com/faurehu/lightauth/client"
+	"github.com/faurehu/lightauth/server"
+)
+
+// MemoryProvider is a client.DataProvider and a server.DataProvider that keeps nothing beyond the process' memory
+type MemoryProvider struct {
+	mux     sync.Mutex
+	records map[string]lightauth.Record
+}
+
+// NewMemoryProvider returns an empty MemoryProvider
+func NewMemoryProvider() *MemoryProvider {
+	return &MemoryProvider{records: make(map[string]lightauth.Record)}
+}
+
+// Create implements lightauth.Store
+func (p *MemoryProvider) Create(r lightauth.Record) (string, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	id := strconv.Itoa(len(p.records) + 1)
+	p.records[id] = r
+
+	return id, nil
+}
+
+// Edit implements lightauth.Store. Records are kept by reference, so there is nothing to update.
+func (p *MemoryProvider) Edit(r lightauth.Record) {}
+
+// GetServerData implements server.DataProvider
+func (p *MemoryProvider) GetServerData() (map[string]*server.Route, error) {
+	return make(map[string]*server.Route), nil
+}
+
+// GetClientData implements client.DataProvider
+func (p *MemoryProvider) GetClientData() (map[string]*client.Path, error) {
+	return make(map[string]*client.Path), nil
+}
+
+// Ping implements lightauth.Pinger. The memory store is always reachable.
+func (p *MemoryProvider) Ping(ctx context.Context) error {
+	return nil
+}
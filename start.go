@@ -0,0 +1,62 @@
+package lightauth
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+)
+
+// ErrNotStarted is matched with errors.Is by the errors returned when lightauth is used before being
+// started, see NotStartedError.
+var ErrNotStarted = errors.New("Lightauth error: not started")
+
+// NotStartedError is returned by the functions of the client or the server called before it has been
+// started. Side is either "client" or "server".
+type NotStartedError struct {
+	Side string
+}
+
+func (e *NotStartedError) Error() string {
+	return "Lightauth error: the " + e.Side + " has not been started"
+}
+
+// Is makes NotStartedError match ErrNotStarted
+func (e *NotStartedError) Is(target error) bool {
+	return target == ErrNotStarted
+}
+
+// StartState records whether a side of lightauth has been started. Only the first start does anything,
+// the later ones return the connection the first one made.
+type StartState struct {
+	mux     sync.Mutex
+	started int32
+	conn    *grpc.ClientConn
+}
+
+// Start runs f, which starts the side, unless it has been started already. A side that failed to
+// start is not marked as started, so it can be started again once the problem is fixed.
+func (s *StartState) Start(f func() (*grpc.ClientConn, error)) (*grpc.ClientConn, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.IsStarted() {
+		return s.conn, nil
+	}
+
+	conn, err := f()
+	if err != nil {
+		return nil, err
+	}
+
+	s.conn = conn
+	atomic.StoreInt32(&s.started, 1)
+
+	return s.conn, nil
+}
+
+// IsStarted tells whether the side has been started
+func (s *StartState) IsStarted() bool {
+	return atomic.LoadInt32(&s.started) == 1
+}
@@ -1,17 +1,27 @@
 package lightauth
 
 import (
-	"net/http"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
 )
 
-func readHeader(h http.Header, header string) string {
-	_value, headerExists := h[header]
-	var value string
-	if !headerExists {
-		value = ""
-	} else {
-		value = _value[0]
+// NewNonce returns 128 random bits in hex, to tell requests apart
+func NewNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("Lightauth error: could not generate a nonce: %v", err)
 	}
 
-	return value
+	return hex.EncodeToString(b), nil
+}
+
+// ParseDuration parses the durations of lightauth.toml, where an empty one is 0
+func ParseDuration(d string) (time.Duration, error) {
+	if d == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(d)
 }